@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Charana123/torrent/go-torrent/torrent"
+)
+
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+const editUsage = `usage: edit [flags] <torrent file or directory>...
+
+Edits .torrent files in place. Directories are edited file by file, e.g. the
+client's torrent directory whose files are named by info-hash. Editing the
+private flag or source changes the info-hash, files named by their info-hash
+aren't edited that way as the client keeps their resume state and data under
+the old info-hash. Edit a copy and add it to the client instead.
+
+`
+
+// edit batch edits torrent files, returning the exit code
+func edit(args []string) int {
+	flags := flag.NewFlagSet("edit", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), editUsage)
+		flags.PrintDefaults()
+	}
+	var replaceHosts, addTrackers, removeTrackers, webSeeds stringsFlag
+	flags.Var(&replaceHosts, "replace-host", "`old=new` tracker and web seed hostname (repeatable)")
+	flags.Var(&addTrackers, "add-tracker", "tracker `URL` to add in a new tier (repeatable)")
+	flags.Var(&removeTrackers, "remove-tracker", "tracker `URL` to remove (repeatable)")
+	flags.Var(&webSeeds, "web-seed", "web seed `URL`, replaces the url-list (repeatable)")
+	comment := flags.String("comment", "", "comment")
+	createdBy := flags.String("created-by", "", "created by")
+	creationDate := flags.Int("creation-date", 0, "creation date in `seconds` since the epoch")
+	private := flags.Bool("private", false, "private flag, changes the info-hash")
+	source := flags.String("source", "", "source, changes the info-hash")
+	dryRun := flags.Bool("n", false, "print the changes without writing them")
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	set := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	editTorrent := func(tor *torrent.Torrent) error {
+		for _, replaceHost := range replaceHosts {
+			hosts := strings.SplitN(replaceHost, "=", 2)
+			if len(hosts) != 2 {
+				return fmt.Errorf("Invalid -replace-host %q", replaceHost)
+			}
+			tor.ReplaceTrackerHost(hosts[0], hosts[1])
+		}
+		for _, tracker := range removeTrackers {
+			tor.RemoveTracker(tracker)
+		}
+		for _, tracker := range addTrackers {
+			tor.AddTracker(tracker, -1)
+		}
+		if set["web-seed"] {
+			tor.MetaInfo.URLList = webSeeds
+		}
+		if set["comment"] {
+			tor.MetaInfo.Comment = *comment
+		}
+		if set["created-by"] {
+			tor.MetaInfo.CreatedBy = *createdBy
+		}
+		if set["creation-date"] {
+			tor.MetaInfo.CreationDate = *creationDate
+		}
+		if set["private"] {
+			err := tor.SetPrivate(*private)
+			if err != nil {
+				return err
+			}
+		}
+		if set["source"] {
+			err := tor.SetSource(*source)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	exitCode := 0
+	for _, arg := range flags.Args() {
+		paths := []string{arg}
+		if fi, err := os.Stat(arg); err == nil && fi.IsDir() {
+			paths, err = torrentFiles(arg)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				exitCode = 1
+				continue
+			}
+		}
+		for _, path := range paths {
+			err := editFile(path, editTorrent, *dryRun)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+				exitCode = 1
+			}
+		}
+	}
+	return exitCode
+}
+
+func torrentFiles(directory string) ([]string, error) {
+	files, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{}
+	for _, f := range files {
+		if f.Mode().IsRegular() && !strings.HasPrefix(f.Name(), ".") {
+			paths = append(paths, filepath.Join(directory, f.Name()))
+		}
+	}
+	return paths, nil
+}
+
+func editFile(path string, editTorrent func(tor *torrent.Torrent) error, dryRun bool) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	tor, err := torrent.NewTorrent(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	oldInfoHashHex := hex.EncodeToString(tor.InfoHash)
+	err = editTorrent(tor)
+	if err != nil {
+		return err
+	}
+	edited := tor.Bencode()
+	if bytes.Equal(edited, data) {
+		return nil
+	}
+
+	infoHashHex := hex.EncodeToString(tor.InfoHash)
+	if infoHashHex != oldInfoHashHex && filepath.Base(path) == oldInfoHashHex {
+		// Torrents saved by the client are named by their info-hash, their
+		// resume state and data would be left behind
+		return fmt.Errorf("Edit changes the info-hash of a torrent named by its info-hash")
+	}
+	fmt.Printf("%s: %d -> %d bytes, info-hash %s\n", path, len(data), len(edited), infoHashHex)
+	if dryRun {
+		return nil
+	}
+
+	// Replace the file atomically
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(edited)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Stat(path); err == nil {
+		os.Chmod(tmp.Name(), fi.Mode())
+	}
+	return os.Rename(tmp.Name(), path)
+}
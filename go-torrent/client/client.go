@@ -1,23 +1,35 @@
 package client
 
 import (
+	"bytes"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
-	"regexp"
+	"strings"
 
+	"github.com/Charana123/torrent/go-torrent/ipfilter"
+	"github.com/Charana123/torrent/go-torrent/piece"
+	"github.com/Charana123/torrent/go-torrent/storage"
 	"github.com/Charana123/torrent/go-torrent/torrent"
 )
 
 type Client interface {
-	AddTorrent(torrentReader io.ReadSeeker) TorrentDownload
+	AddTorrent(torrentReader io.ReadSeeker) (TorrentDownload, error)
 	AddMagnet(magnetURI string) (TorrentDownload, error)
-	RemoveTorrent(infoHashHex string)
-	RemoveTorrentAndData(infoHashHex string)
+	SeedTorrent(tor *torrent.Torrent, savePath string) (TorrentDownload, error)
+	RemoveTorrent(infoHashHex string) error
+	RemoveTorrentAndData(infoHashHex string) error
 	GetTorrents() []TorrentDownload
+	GetTorrent(infoHashHex string) TorrentDownload
+	GetNumBlocked() int
+	SetMaxOpenFiles(maxOpenFiles int)
+	SetMaxBlockMemory(maxMemory int)
+	SetStorageFactory(factory StorageFactory)
+	SetSavePath(savePath string)
+	SetLayout(layout int)
 
 	// StopTorrent(torrentID string)
 	// StopFile(torrentID string, fileIndex int)
@@ -29,14 +41,35 @@ type client struct {
 	torrents     []TorrentDownload
 	torrentsPath string
 	dataPath     string
+	resumePath   string
+	ipFilterPath string
+	ipFilter     ipfilter.IPFilter
+	// Creates the storage of torrents added afterwards, nil is on disk
+	storageFactory StorageFactory
+	quit           chan int
+	// Where torrents added afterwards are saved, the data directory if it's
+	// empty, and how they're laid out
+	savePath string
+	layout   int
 }
 
 func NewClient(storagePath string) Client {
+	c := newClient(storagePath)
+	go c.init()
+	return c
+}
+
+// The client's directories are created and its torrents loaded by init
+func newClient(storagePath string) *client {
 	c := &client{
 		torrentsPath: storagePath + "/torrent",
 		dataPath:     storagePath + "/data",
+		resumePath:   storagePath + "/resume",
+		ipFilterPath: storagePath + "/ipfilter",
+		layout:       storage.LAYOUT_INFO_HASH,
+		quit:         make(chan int),
 	}
-	go c.init()
+	c.ipFilter = ipfilter.NewIPFilter(c.ipFilterPath)
 	return c
 }
 
@@ -57,13 +90,68 @@ func (c *client) init() {
 		err := os.Mkdir(c.dataPath, 0755)
 		fail(err)
 	}
+	// Create resume state directory
+	if _, err := os.Stat(c.resumePath); os.IsNotExist(err) {
+		err := os.Mkdir(c.resumePath, 0755)
+		fail(err)
+	}
+	// Create blocklist directory and load blocklists
+	if _, err := os.Stat(c.ipFilterPath); os.IsNotExist(err) {
+		err := os.Mkdir(c.ipFilterPath, 0755)
+		fail(err)
+	}
+	err := c.ipFilter.Reload()
+	fail(err)
+	go c.ipFilter.Start(c.quit)
 	// Read all torrent files and load them as stopped torrents
 	torrentFiles, err := ioutil.ReadDir(c.torrentsPath)
 	fail(err)
 	for _, f := range torrentFiles {
 		torrentReader, err := os.Open(c.torrentsPath + "/" + f.Name())
 		fail(err)
-		c.addTorrent(torrentReader)
+		td, infoHashHex, err := c.addTorrent(torrentReader)
+		torrentReader.Close()
+		if err != nil {
+			fmt.Println(f.Name(), err)
+			continue
+		}
+		// Torrents added before their resume state was saved are laid out
+		// under the data directory by info-hash
+		d := td.(*torrentDownload)
+		state, err := loadResumeState(c.resumePath + "/" + infoHashHex)
+		if err == nil {
+			d.resume(state)
+		} else if !os.IsNotExist(err) {
+			fmt.Println(f.Name(), err)
+		}
+		d.resumePath = c.resumePath + "/" + infoHashHex
+		c.torrents = append(c.torrents, td)
+	}
+	// Magnet links whose metadata wasn't downloaded are only in the resume
+	// state
+	resumeFiles, err := ioutil.ReadDir(c.resumePath)
+	fail(err)
+	for _, f := range resumeFiles {
+		infoHashHex := f.Name()
+		if strings.HasSuffix(infoHashHex, ".tmp") || c.GetTorrent(infoHashHex) != nil {
+			continue
+		}
+		state, err := loadResumeState(c.resumePath + "/" + infoHashHex)
+		if err != nil {
+			fmt.Println(infoHashHex, err)
+			continue
+		}
+		if state.Magnet == "" {
+			continue
+		}
+		muri, err := torrent.ParseMagnetURI(state.Magnet)
+		if err != nil {
+			fmt.Println(infoHashHex, err)
+			continue
+		}
+		td, _ := c.newMagnet(muri)
+		td.(*torrentDownload).resume(state)
+		c.torrents = append(c.torrents, td)
 	}
 }
 
@@ -71,81 +159,177 @@ func (c *client) GetTorrents() []TorrentDownload {
 	return c.torrents
 }
 
-func parseMagnetURI(magnetURI string) (*torrent.MagnetURI, error) {
-	r1, _ := regexp.Compile(`magnet:\?xt=urn:(\S{4}):(\S{40})`)
-	g1 := r1.FindStringSubmatch(magnetURI)
-	if len(g1) == 0 {
-		return nil, fmt.Errorf("Malformed magnet URI")
-	}
-	if g1[1] == "btmh" {
-		return nil, fmt.Errorf("Client doesn't support multihash format")
-	}
-	muri := &torrent.MagnetURI{}
-	muri.InfoHashHex = g1[2]
-	r2, _ := regexp.Compile(`&(\S*?)=(\S*?)(?=(?:&|$))`)
-	if r2 == nil {
-		fmt.Printf("r2 is nil")
-	}
-	g2 := r2.FindAllStringSubmatch(magnetURI, -1)
-	for i := 0; i < len(g2); i++ {
-		if g2[i][1] == "name" {
-			muri.Name = g2[i][2]
-		}
-		if g2[i][1] == "tr" {
-			muri.Trackers = append(muri.Trackers, g2[i][2])
-		}
-		if g2[i][1] == "x.pe" {
-			muri.Peers = append(muri.Peers, g2[i][2])
+// The torrent with the info-hash, nil if there isn't one. Magnet links are
+// found by their info-hash before their metadata is downloaded.
+func (c *client) GetTorrent(infoHashHex string) TorrentDownload {
+	for _, td := range c.torrents {
+		if hex.EncodeToString(td.GetInfoHash()) == infoHashHex {
+			return td
 		}
 	}
-	return muri, nil
+	return nil
+}
+
+// Number of peer connections refused by the blocklists
+func (c *client) GetNumBlocked() int {
+	return c.ipFilter.GetNumBlocked()
 }
 
+// Maximum number of files kept open across every torrent, the least recently
+// used files are closed beyond it
+func (c *client) SetMaxOpenFiles(maxOpenFiles int) {
+	storage.GetFilePool().SetMaxOpenFiles(maxOpenFiles)
+}
+
+// Memory of the blocks of partial pieces across every torrent, beyond it
+// partial pieces are flushed to storage
+func (c *client) SetMaxBlockMemory(maxMemory int) {
+	piece.GetBufferPool().SetMaxMemory(maxMemory)
+}
+
+// Storage of the torrents added afterwards, torrents loaded when the client
+// starts are stored on disk
+func (c *client) SetStorageFactory(factory StorageFactory) {
+	c.storageFactory = factory
+}
+
+// Save path of the torrents added afterwards, the data directory if it's
+// empty
+func (c *client) SetSavePath(savePath string) {
+	c.savePath = savePath
+}
+
+// Layout of the torrents added afterwards, one of the storage.LAYOUT_
+// constants. Torrents sharing a name are given another name.
+func (c *client) SetLayout(layout int) {
+	c.layout = layout
+}
+
+// Magnet links are saved in their resume state until their metadata is
+// downloaded, their torrent file is saved then
 func (c *client) AddMagnet(magnetURI string) (TorrentDownload, error) {
-	muri, err := parseMagnetURI(magnetURI)
+	muri, err := torrent.ParseMagnetURI(magnetURI)
 	if err != nil {
 		return nil, err
 	}
-	return NewTorrentFromMagnet(muri), nil
+	td, _ := c.newMagnet(muri)
+	td.SetStorageFactory(c.storageFactory)
+	td.SetSavePath(c.savePath)
+	td.SetLayout(c.layout)
+	c.torrents = append(c.torrents, td)
+	return td, nil
 }
 
-func (c *client) AddTorrent(torrentReader io.ReadSeeker) TorrentDownload {
-	td, infoHashHex := c.addTorrent(torrentReader)
-	c.saveTorrent(torrentReader, infoHashHex)
+func (c *client) newMagnet(muri *torrent.MagnetURI) (TorrentDownload, string) {
+	td := NewTorrentFromMagnet(muri, c.dataPath, c.ipFilter)
+	infoHashHex := hex.EncodeToString(td.GetInfoHash())
+	d := td.(*torrentDownload)
+	d.resumePath = c.resumePath + "/" + infoHashHex
+	d.torrentPath = c.torrentsPath + "/" + infoHashHex
+	return td, infoHashHex
+}
+
+func (c *client) AddTorrent(torrentReader io.ReadSeeker) (TorrentDownload, error) {
+	td, infoHashHex, err := c.addTorrent(torrentReader)
+	if err != nil {
+		return nil, err
+	}
+	td.SetStorageFactory(c.storageFactory)
+	td.(*torrentDownload).resumePath = c.resumePath + "/" + infoHashHex
+	td.SetSavePath(c.savePath)
+	td.SetLayout(c.layout)
+	// e.g. the disk is full
+	err = c.saveTorrent(torrentReader, infoHashHex)
+	if err != nil {
+		return nil, err
+	}
 	c.torrents = append(c.torrents, td)
-	return td
+	return td, nil
 }
 
-func (c *client) addTorrent(torrentReader io.ReadSeeker) (TorrentDownload, string) {
-	// Parse Torrent
+// SeedTorrent seeds a torrent created with torrent.Create from the data
+// under savePath (the parent directory of the path the torrent was created from)
+func (c *client) SeedTorrent(tor *torrent.Torrent, savePath string) (TorrentDownload, error) {
+	infoHashHex := hex.EncodeToString(tor.InfoHash)
+	err := c.saveTorrent(bytes.NewReader(tor.Bencode()), infoHashHex)
+	if err != nil {
+		return nil, err
+	}
+	td := &torrentDownload{
+		tor:            tor,
+		savePath:       savePath,
+		ipFilter:       c.ipFilter,
+		storageFactory: c.storageFactory,
+		existingData:   true,
+		resumePath:     c.resumePath + "/" + infoHashHex,
+	}
+	td.saveResumeState()
+	c.torrents = append(c.torrents, td)
+	return td, nil
+}
+
+func (c *client) addTorrent(torrentReader io.ReadSeeker) (TorrentDownload, string, error) {
+	// Parse Torrent, malformed torrents and unsafe file paths are rejected
 	tor, err := torrent.NewTorrent(torrentReader)
-	fail(err)
+	if err != nil {
+		return nil, "", err
+	}
 
 	// Save Torrent
-	td := NewTorrentDownload(tor, c.dataPath)
+	td := NewTorrentDownload(tor, c.dataPath, c.ipFilter)
 	infoHashHex := hex.EncodeToString(td.GetInfoHash())
-	return td, infoHashHex
+	return td, infoHashHex, nil
 }
 
-func (c *client) saveTorrent(torrentReader io.ReadSeeker, infoHashHex string) {
-	torrentReader.Seek(0, 0)
+func (c *client) saveTorrent(torrentReader io.ReadSeeker, infoHashHex string) error {
+	_, err := torrentReader.Seek(0, 0)
+	if err != nil {
+		return err
+	}
 	validTorrentData, err := ioutil.ReadAll(torrentReader)
-	fail(err)
-	file, err := os.OpenFile(c.torrentsPath+"/"+infoHashHex, os.O_CREATE|os.O_RDWR, 0755)
-	fail(err)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(c.torrentsPath+"/"+infoHashHex, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0755)
+	if err != nil {
+		return err
+	}
 	_, err = file.Write(validTorrentData)
-	fail(err)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
 }
 
-func (c *client) RemoveTorrent(infoHashHex string) {
-	err := os.Remove(c.torrentsPath + "/" + infoHashHex)
-	fail(err)
+// Magnet links don't have a torrent file until their metadata is downloaded
+func (c *client) RemoveTorrent(infoHashHex string) error {
+	for _, path := range []string{c.torrentsPath + "/" + infoHashHex, c.resumePath + "/" + infoHashHex} {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for i, td := range c.torrents {
+		if hex.EncodeToString(td.GetInfoHash()) == infoHashHex {
+			c.torrents = append(c.torrents[:i], c.torrents[i+1:]...)
+			break
+		}
+	}
+	return nil
 }
 
-func (c *client) RemoveTorrentAndData(infoHashHex string) {
-	c.RemoveTorrent(infoHashHex)
-	err := os.RemoveAll(c.dataPath + "/" + infoHashHex)
-	fail(err)
+// The torrent's files are removed where they're laid out
+func (c *client) RemoveTorrentAndData(infoHashHex string) error {
+	td := c.GetTorrent(infoHashHex)
+	err := c.RemoveTorrent(infoHashHex)
+	if err != nil {
+		return err
+	}
+	if td != nil {
+		return td.(*torrentDownload).removeData()
+	}
+	return os.RemoveAll(c.dataPath + "/" + infoHashHex)
 }
 
 // func (c *client) StopTorrent(torrentID string) {
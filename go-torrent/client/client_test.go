@@ -0,0 +1,128 @@
+package client
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Charana123/torrent/go-torrent/torrent"
+	"github.com/stretchr/testify/assert"
+)
+
+// The client's directories are created and its torrents loaded before it's
+// returned
+func newTestClient(t *testing.T, storagePath string) *client {
+	c := newClient(storagePath)
+	c.init()
+	t.Cleanup(func() {
+		close(c.quit)
+	})
+	return c
+}
+
+// Torrent of a directory of two files, 2 pieces and 10 bytes of a third
+func createTestTorrent(t *testing.T, directory string) (*torrent.Torrent, []byte) {
+	root := filepath.Join(directory, "seed")
+	assert.Nil(t, os.MkdirAll(root, 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(root, "a"), bytes.Repeat([]byte{1}, 32768), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(root, "b"), bytes.Repeat([]byte{2}, 10), 0644))
+	metaInfo := &bytes.Buffer{}
+	tor, err := torrent.Create(root, metaInfo, torrent.CreateOptions{PieceLength: 16384})
+	assert.Nil(t, err)
+	return tor, metaInfo.Bytes()
+}
+
+func TestAddTorrent(t *testing.T) {
+	storagePath := t.TempDir()
+	c := newTestClient(t, storagePath)
+	c.SetStorageFactory(NewMemoryStorageFactory(0))
+	_, metaInfo := createTestTorrent(t, t.TempDir())
+
+	td, err := c.AddTorrent(bytes.NewReader(metaInfo))
+	assert.Nil(t, err)
+	infoHashHex := hex.EncodeToString(td.GetInfoHash())
+	assert.Equal(t, td, c.GetTorrent(infoHashHex))
+	assert.Equal(t, "seed", td.Name())
+	assert.NotNil(t, td.(*torrentDownload).storageFactory)
+	saved, err := ioutil.ReadFile(filepath.Join(storagePath, "torrent", infoHashHex))
+	assert.Nil(t, err)
+	assert.Equal(t, metaInfo, saved)
+
+	// Loaded as a stopped torrent once the client is restarted
+	restarted := newTestClient(t, storagePath)
+	assert.Len(t, restarted.GetTorrents(), 1)
+	td = restarted.GetTorrent(infoHashHex)
+	assert.NotNil(t, td)
+	assert.Equal(t, STATE_QUEUED, td.GetState())
+
+	// Malformed torrents aren't added
+	_, err = c.AddTorrent(bytes.NewReader([]byte("not a torrent")))
+	assert.NotNil(t, err)
+	assert.Len(t, c.GetTorrents(), 1)
+}
+
+func TestAddMagnet(t *testing.T) {
+	storagePath := t.TempDir()
+	c := newTestClient(t, storagePath)
+	infoHashHex := "6161616161616161616161616161616161616161"
+
+	// Found by the magnet link's info-hash before its metadata is downloaded
+	td, err := c.AddMagnet(testMagnet)
+	assert.Nil(t, err)
+	assert.Equal(t, td, c.GetTorrent(infoHashHex))
+	assert.Nil(t, c.GetTorrent("6262626262626262626262626262626262626262"))
+	_, err = c.AddMagnet("magnet:?dn=no-info-hash")
+	assert.NotNil(t, err)
+
+	// Added again from the resume state once the client is restarted
+	restarted := newTestClient(t, storagePath)
+	td = restarted.GetTorrent(infoHashHex)
+	assert.NotNil(t, td)
+	assert.Equal(t, "magnet", td.Name())
+	assert.Equal(t, 100, td.Size())
+
+	assert.Nil(t, restarted.RemoveTorrent(infoHashHex))
+	assert.Nil(t, restarted.GetTorrent(infoHashHex))
+	_, err = os.Stat(filepath.Join(storagePath, "resume", infoHashHex))
+	assert.True(t, os.IsNotExist(err))
+	assert.Len(t, newTestClient(t, storagePath).GetTorrents(), 0)
+}
+
+func TestRemoveTorrent(t *testing.T) {
+	storagePath := t.TempDir()
+	c := newTestClient(t, storagePath)
+	tor, _ := createTestTorrent(t, t.TempDir())
+	infoHashHex := hex.EncodeToString(tor.InfoHash)
+	_, err := c.SeedTorrent(tor, t.TempDir())
+	assert.Nil(t, err)
+
+	assert.Nil(t, c.RemoveTorrent(infoHashHex))
+	assert.Nil(t, c.GetTorrent(infoHashHex))
+	for _, directory := range []string{"torrent", "resume"} {
+		_, err := os.Stat(filepath.Join(storagePath, directory, infoHashHex))
+		assert.True(t, os.IsNotExist(err), directory)
+	}
+	// Removing it again isn't an error
+	assert.Nil(t, c.RemoveTorrent(infoHashHex))
+}
+
+func TestRemoveTorrentAndData(t *testing.T) {
+	storagePath := t.TempDir()
+	c := newTestClient(t, storagePath)
+	_, metaInfo := createTestTorrent(t, t.TempDir())
+	td, err := c.AddTorrent(bytes.NewReader(metaInfo))
+	assert.Nil(t, err)
+	infoHashHex := hex.EncodeToString(td.GetInfoHash())
+	// Laid out under the data directory by info-hash before it's started
+	data := filepath.Join(storagePath, "data", infoHashHex)
+	assert.Nil(t, os.MkdirAll(filepath.Join(data, "seed"), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(data, "seed", "a"), []byte{1}, 0644))
+
+	assert.Nil(t, c.RemoveTorrentAndData(infoHashHex))
+	assert.Nil(t, c.GetTorrent(infoHashHex))
+	_, err = os.Stat(data)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -1,15 +1,70 @@
 package client
 
-import "io"
+import (
+	"io"
+	"strings"
+
+	bitmap "github.com/boljen/go-bitmap"
+)
 
 type FileDownload interface {
 	Length() int
 	NewReader() io.ReadSeeker
+	// Path of the file within the torrent, starting with the torrent's name
 	Path() string
 	Name() string
 	PercentageComplete() float32
 }
 
 type fileDownload struct {
-	stopped bool
+	download *torrentDownload
+	path     []string
+	// Offset of the file within the torrent's data
+	offset int
+	length int
+}
+
+func (f *fileDownload) Length() int {
+	return f.length
+}
+
+// Reads the file from the storage of the running torrent
+func (f *fileDownload) NewReader() io.ReadSeeker {
+	return newTorrentReadSeeker(f)
+}
+
+func (f *fileDownload) Path() string {
+	return strings.Join(f.path, "/")
+}
+
+func (f *fileDownload) Name() string {
+	return f.path[len(f.path)-1]
+}
+
+// Percentage of the file's bytes in downloaded pieces
+func (f *fileDownload) PercentageComplete() float32 {
+	if f.length == 0 {
+		return 100
+	}
+	bitfield := f.download.bitfield()
+	if bitfield == nil {
+		return 0
+	}
+	pieceLength := f.download.PieceLength()
+	downloaded := 0
+	for pieceIndex := f.offset / pieceLength; pieceIndex*pieceLength < f.offset+f.length; pieceIndex++ {
+		if !bitmap.Get(bitfield, pieceIndex) {
+			continue
+		}
+		start := pieceIndex * pieceLength
+		if start < f.offset {
+			start = f.offset
+		}
+		end := (pieceIndex + 1) * pieceLength
+		if end > f.offset+f.length {
+			end = f.offset + f.length
+		}
+		downloaded += end - start
+	}
+	return 100 * float32(downloaded) / float32(f.length)
 }
@@ -0,0 +1,31 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPercentageComplete(t *testing.T) {
+	d := NewTorrentDownload(newTestTorrent(), t.TempDir(), nil).(*torrentDownload)
+	files := d.GetFiles()
+
+	// Nothing is downloaded before the data on disk is checked
+	assert.Equal(t, float32(0), files[0].PercentageComplete())
+
+	// a is the first piece and 4 bytes of the second, b the last 2 pieces
+	pieceMgr := &mockPieceManager{}
+	pieceMgr.On("GetBitField").Return(newBitfield(4, 1, 2))
+	d.pieceMgr = pieceMgr
+	d.checked = true
+	assert.Equal(t, float32(20), files[0].PercentageComplete())
+	assert.Equal(t, float32(80), files[1].PercentageComplete())
+}
+
+func TestPercentageCompleteEmptyFile(t *testing.T) {
+	tor := newTestTorrent()
+	tor.MetaInfo.Info.Files[0].Length = 0
+	d := NewTorrentDownload(tor, t.TempDir(), nil)
+
+	assert.Equal(t, float32(100), d.GetFiles()[0].PercentageComplete())
+}
@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+
+	"github.com/Charana123/torrent/go-torrent/storage"
 )
 
 type HTTPServeMux struct {
@@ -12,12 +14,40 @@ type HTTPServeMux struct {
 	client Client
 }
 
+// Layouts by the name given to /upload
+var layouts = map[string]int{
+	"original": storage.LAYOUT_ORIGINAL,
+	"infohash": storage.LAYOUT_INFO_HASH,
+	"flat":     storage.LAYOUT_FLAT,
+	"strip":    storage.LAYOUT_STRIP_ROOT,
+}
+
+// The torrent is saved to the savePath and laid out in the layout given in
+// the query, if they're given
 func (sm *HTTPServeMux) uploadTorrent(rw http.ResponseWriter, r *http.Request) {
 	if r.Method == "POST" {
+		layoutName := r.URL.Query().Get("layout")
+		layout, ok := layouts[layoutName]
+		if layoutName != "" && !ok {
+			rw.WriteHeader(http.StatusBadRequest)
+			rw.Write([]byte("Unknown layout " + layoutName))
+			return
+		}
 		torrentBuff := &bytes.Buffer{}
 		torrentBuff.ReadFrom(r.Body)
 		torrentReader := bytes.NewReader(torrentBuff.Bytes())
-		td := sm.client.AddTorrent(torrentReader)
+		td, err := sm.client.AddTorrent(torrentReader)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			rw.Write([]byte(err.Error()))
+			return
+		}
+		if savePath := r.URL.Query().Get("savePath"); savePath != "" {
+			td.SetSavePath(savePath)
+		}
+		if ok {
+			td.SetLayout(layout)
+		}
 		td.Start()
 
 		rw.WriteHeader(http.StatusOK)
@@ -76,11 +106,14 @@ func (sm *HTTPServeMux) commandTorrent(rw http.ResponseWriter, r *http.Request)
 }
 
 type clientData struct {
+	BlockedConnections int
 }
 
 func (sm *HTTPServeMux) getStats(rw http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
-		clientData := &clientData{}
+		clientData := &clientData{
+			BlockedConnections: sm.client.GetNumBlocked(),
+		}
 		data, _ := json.Marshal(clientData)
 		rw.Write(data)
 		rw.WriteHeader(http.StatusFound)
@@ -102,6 +135,39 @@ func (sm *HTTPServeMux) streamTorrent(rw http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// GET returns the report of the torrent's last verification, POST verifies
+// the torrent's files and returns the report
+func (sm *HTTPServeMux) verifyTorrent(rw http.ResponseWriter, r *http.Request) {
+	td := sm.client.GetTorrent(r.URL.Query().Get("torrentID"))
+	if td == nil {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var report *storage.VerificationReport
+	switch r.Method {
+	case "GET":
+		report = td.GetVerificationReport()
+		if report == nil {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+	case "POST":
+		var err error
+		report, err = td.VerifyFiles()
+		if err != nil {
+			rw.WriteHeader(http.StatusConflict)
+			rw.Write([]byte(err.Error()))
+			return
+		}
+	default:
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	data, _ := json.Marshal(report)
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(data)
+}
+
 func NewHTTPServeMux(storagePath string) *HTTPServeMux {
 	sm := http.NewServeMux()
 	client := NewClient(storagePath)
@@ -113,5 +179,6 @@ func NewHTTPServeMux(storagePath string) *HTTPServeMux {
 	httpSM.HandleFunc("/magnet", httpSM.magnetTorrent)
 	httpSM.HandleFunc("/command", httpSM.commandTorrent)
 	httpSM.HandleFunc("/stream", httpSM.streamTorrent)
+	httpSM.HandleFunc("/verify", httpSM.verifyTorrent)
 	return httpSM
 }
@@ -0,0 +1,75 @@
+package client
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Charana123/torrent/go-torrent/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func verifyRequest(sm *HTTPServeMux, method, infoHashHex string) (int, *storage.VerificationReport) {
+	rw := httptest.NewRecorder()
+	sm.verifyTorrent(rw, httptest.NewRequest(method, "/verify?torrentID="+infoHashHex, nil))
+	if rw.Code != http.StatusOK {
+		return rw.Code, nil
+	}
+	report := &storage.VerificationReport{}
+	json.Unmarshal(rw.Body.Bytes(), report)
+	return rw.Code, report
+}
+
+func TestVerifyTorrent(t *testing.T) {
+	c := newTestClient(t, t.TempDir())
+	sm := &HTTPServeMux{client: c}
+	savePath := t.TempDir()
+	tor, _ := createTestTorrent(t, savePath)
+	_, err := c.SeedTorrent(tor, savePath)
+	assert.Nil(t, err)
+	infoHashHex := hex.EncodeToString(tor.InfoHash)
+
+	// Not verified yet
+	code, _ := verifyRequest(sm, "GET", infoHashHex)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	// The stopped torrent's files are read where they're seeded from
+	code, report := verifyRequest(sm, "POST", infoHashHex)
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, report.OK())
+	code, report = verifyRequest(sm, "GET", infoHashHex)
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, report.OK())
+
+	// Missing files are corrupt, they aren't created
+	b := filepath.Join(savePath, "seed", "b")
+	assert.Nil(t, os.Remove(b))
+	code, report = verifyRequest(sm, "POST", infoHashHex)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []int{2}, report.CorruptPieces)
+	assert.Equal(t, []storage.FileReport{
+		{FileIndex: 1, Path: []string{"b"}, Corrupt: []storage.FileRange{{PieceIndex: 2, Offset: 0, Length: 10}}},
+	}, report.Files)
+	_, err = os.Stat(b)
+	assert.True(t, os.IsNotExist(err))
+
+	code, _ = verifyRequest(sm, "POST", "6262626262626262626262626262626262626262")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = verifyRequest(sm, "PUT", infoHashHex)
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestVerifyMagnet(t *testing.T) {
+	c := newTestClient(t, t.TempDir())
+	sm := &HTTPServeMux{client: c}
+	_, err := c.AddMagnet(testMagnet)
+	assert.Nil(t, err)
+
+	// The files can't be verified before the metadata is downloaded
+	code, _ := verifyRequest(sm, "POST", "6161616161616161616161616161616161616161")
+	assert.Equal(t, http.StatusConflict, code)
+}
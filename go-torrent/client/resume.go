@@ -0,0 +1,46 @@
+package client
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+)
+
+// Resume state of a torrent, s.t. the files are found where they were laid
+// out when the client is restarted
+type resumeState struct {
+	SavePath string   `json:"savePath"`
+	Layout   int      `json:"layout"`
+	Paths    []string `json:"paths"`
+	// The data was already under the save path e.g. of a seeded torrent
+	ExistingData bool `json:"existingData,omitempty"`
+	// Magnet links are added again from their URI until their metadata is
+	// downloaded
+	Magnet string `json:"magnet,omitempty"`
+}
+
+func loadResumeState(path string) (*resumeState, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	state := &resumeState{}
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// The state is replaced atomically, a crash leaves the previous state
+func saveResumeState(path string, state *resumeState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path+".tmp", data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,63 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Charana123/torrent/go-torrent/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResumeState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state")
+	state := &resumeState{
+		SavePath:     "save",
+		Layout:       storage.LAYOUT_FLAT,
+		Paths:        []string{"a", "", "b (1)"},
+		ExistingData: true,
+		Magnet:       testMagnet,
+	}
+	assert.Nil(t, saveResumeState(path, state))
+	loaded, err := loadResumeState(path)
+	assert.Nil(t, err)
+	assert.Equal(t, state, loaded)
+	// Written to a temporary file first
+	_, err = os.Stat(path + ".tmp")
+	assert.True(t, os.IsNotExist(err))
+
+	// Replaced as a whole
+	state = &resumeState{SavePath: "moved"}
+	assert.Nil(t, saveResumeState(path, state))
+	loaded, err = loadResumeState(path)
+	assert.Nil(t, err)
+	assert.Equal(t, state, loaded)
+
+	_, err = loadResumeState(path + "-missing")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestTorrentResumeState(t *testing.T) {
+	d := NewTorrentDownload(newTestTorrent(), t.TempDir(), nil).(*torrentDownload)
+	d.resumePath = filepath.Join(t.TempDir(), "state")
+	d.SetSavePath("save")
+	d.layoutPaths = []string{"root/a", "", "root/sub/b"}
+	d.existingData = true
+	d.saveResumeState()
+
+	// Restored into a torrent loaded when the client restarts
+	state, err := loadResumeState(d.resumePath)
+	assert.Nil(t, err)
+	resumed := NewTorrentDownload(newTestTorrent(), t.TempDir(), nil).(*torrentDownload)
+	resumed.resume(state)
+	assert.Equal(t, "save", resumed.savePath)
+	assert.Equal(t, storage.LAYOUT_INFO_HASH, resumed.layout)
+	assert.Equal(t, d.layoutPaths, resumed.layoutPaths)
+	assert.True(t, resumed.existingData)
+
+	// Laid out anew in another layout
+	d.SetLayout(storage.LAYOUT_ORIGINAL)
+	state, err = loadResumeState(d.resumePath)
+	assert.Nil(t, err)
+	assert.Equal(t, &resumeState{SavePath: "save", Layout: storage.LAYOUT_ORIGINAL}, state)
+}
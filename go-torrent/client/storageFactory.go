@@ -0,0 +1,41 @@
+package client
+
+import "github.com/Charana123/torrent/go-torrent/storage"
+
+// StorageFactory creates the storage of a torrent download. Torrents added
+// from a .torrent file are stored under dataDirectory, seeded torrents
+// under savePath.
+type StorageFactory func(dataDirectory, savePath string) storage.Storage
+
+// NewStorageFactory creates the storage of the files on disk, with either
+// storage.RANDOM_ACCESS_STORAGE or storage.MMAP_STORAGE. The msync policy
+// applies to memory mapped storage.
+func NewStorageFactory(backend, msyncPolicy int) StorageFactory {
+	return func(dataDirectory, savePath string) storage.Storage {
+		switch {
+		case backend == storage.MMAP_STORAGE && savePath != "":
+			return storage.NewMmapStorageAt(savePath, msyncPolicy)
+		case backend == storage.MMAP_STORAGE:
+			return storage.NewMmapStorage(dataDirectory, msyncPolicy)
+		case savePath != "":
+			return storage.NewRandomAccessStorageAt(savePath)
+		default:
+			return storage.NewRandomAccessStorage(dataDirectory)
+		}
+	}
+}
+
+// NewMemoryStorageFactory keeps each torrent's pieces in memory, up to
+// maxBytes per torrent (0 is unlimited)
+func NewMemoryStorageFactory(maxBytes int) StorageFactory {
+	return func(dataDirectory, savePath string) storage.Storage {
+		return storage.NewMemoryStorage(maxBytes)
+	}
+}
+
+// NewBlobStorageFactory stores each torrent's pieces as objects in the store
+func NewBlobStorageFactory(store storage.BlobStore, prefix string) StorageFactory {
+	return func(dataDirectory, savePath string) storage.Storage {
+		return storage.NewBlobStorage(store, prefix)
+	}
+}
@@ -6,7 +6,12 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"sync"
+	"time"
 
+	"github.com/Charana123/torrent/go-torrent/ipfilter"
+	"github.com/Charana123/torrent/go-torrent/lsd"
 	"github.com/Charana123/torrent/go-torrent/piece"
 	"github.com/Charana123/torrent/go-torrent/server"
 	"github.com/Charana123/torrent/go-torrent/stats"
@@ -15,36 +20,120 @@ import (
 
 	"github.com/Charana123/torrent/go-torrent/peer"
 	"github.com/Charana123/torrent/go-torrent/torrent"
+	bitmap "github.com/boljen/go-bitmap"
+)
+
+// States of a torrent, see GetState
+const (
+	// Added but not started
+	STATE_QUEUED = 0
+	// Downloading the metadata of a magnet link from peers
+	STATE_FETCHING_METADATA = 1
+	// Checking the pieces already on disk
+	STATE_CHECKING    = 2
+	STATE_DOWNLOADING = 3
+	STATE_SEEDING     = 4
+	STATE_PAUSED      = 5
+	// Stopped by an error, see GetError
+	STATE_ERROR = 6
 )
 
 type TorrentStats struct {
 	Peers   int
 	Seeders int
+	// Bytes per second
+	UploadRate   int
+	DownloadRate int
+	// Bytes uploaded and downloaded since the torrent was started
+	Uploaded   int
+	Downloaded int
+	// Bytes left to download
+	Left int
+	// Time left to download at the download rate, negative if it's unknown
+	ETA time.Duration
+	// Distributed copies of the torrent among the peers
+	Availability float64
+	// Bytes uploaded per byte downloaded, or per byte of the torrent if
+	// nothing was downloaded e.g. when seeding
+	Ratio float64
 }
 
 type TorrentDownload interface {
 	Start() error
 	Stop()
 	VerifyData()
-	// GetFiles() []*FileDownload
+	// Files of the torrent without the padding files, none before a magnet
+	// link's metadata is downloaded
+	GetFiles() []FileDownload
 	GetInfoHash() []byte
-	// Size() int
-	// Name() string
-	// NumPieces() int
-	// GetStats() TorrentStats
+	SetSuperSeeding(superSeeding bool)
+	SetUploadSlots(slots int)
+	SetUploadCapacity(bytesPerSecond int)
+	SetSeedingAlgorithm(algorithm int)
+	SetStorageBackend(backend, msyncPolicy int)
+	SetStorageFactory(factory StorageFactory)
+	SetAllocationMode(allocation int)
+	SetIncomplete(suffix, incompleteDirectory string)
+	SetCompletedDirectory(completedDirectory string)
+	MoveStorage(newPath string, adopt bool, progress func(moved, total int64)) error
+	SetVerifyOnCompletion(verify bool)
+	// Checks the files against their md5sum or sha1, and maps corrupt pieces
+	// to the files they overlap
+	VerifyFiles() (*storage.VerificationReport, error)
+	// The report of the last verification, nil if the files weren't verified
+	GetVerificationReport() *storage.VerificationReport
+	SetSavePath(savePath string)
+	SetLayout(layout int)
+	// The error that stopped the torrent e.g. a full disk, nil otherwise
+	GetError() error
+	// One of the STATE_ constants
+	GetState() int
+	Size() int
+	Name() string
+	NumPieces() int
+	PieceLength() int
+	GetStats() TorrentStats
 }
 
 type torrentDownload struct {
-	stopping      bool
-	stopped       bool
-	quit          chan int
-	peerMgr       peer.PeerManager
-	storage       storage.Storage
-	pieceMgr      piece.PieceManager
-	stats         stats.Stats
-	dataDirectory string
-	tor           *torrent.Torrent
-	muri          *torrent.MagnetURI
+	sync.Mutex
+	stopping         bool
+	stopped          bool
+	superSeeding     bool
+	uploadSlots      int
+	uploadCapacity   int
+	seedingAlgorithm int
+	storageFactory   StorageFactory
+	allocationMode   int
+	storageReady     bool
+	checked          bool
+	partSuffix       string
+	incompleteDir    string
+	completedDir     string
+	err              error
+	quit             chan int
+	peerMgr          peer.PeerManager
+	storage          storage.Storage
+	pieceMgr         piece.PieceManager
+	stats            stats.Stats
+	ipFilter         ipfilter.IPFilter
+	dataDirectory    string
+	savePath         string
+	tor              *torrent.Torrent
+	muri             *torrent.MagnetURI
+	// One of the storage.LAYOUT_ constants, the paths of the files once
+	// they're laid out
+	layout      int
+	layoutPaths []string
+	// The data is already under the save path e.g. of a seeded torrent
+	existingData bool
+	// Where the resume state is saved, empty if it isn't
+	resumePath string
+	// The files are verified once they're downloaded, the last report is kept
+	verifyOnCompletion bool
+	report             *storage.VerificationReport
+	// Where a magnet link's torrent file is saved, empty if it isn't
+	torrentPath string
 }
 
 func getExternalIP() (string, error) {
@@ -62,16 +151,21 @@ func getExternalIP() (string, error) {
 	return string(bytes.TrimSpace(buf)), nil
 }
 
-func NewTorrentFromMagnet(muri *torrent.MagnetURI) TorrentDownload {
+func NewTorrentFromMagnet(muri *torrent.MagnetURI, dataDirectory string, ipFilter ipfilter.IPFilter) TorrentDownload {
 	return &torrentDownload{
-		muri: muri,
+		muri:          muri,
+		dataDirectory: dataDirectory,
+		ipFilter:      ipFilter,
+		layout:        storage.LAYOUT_INFO_HASH,
 	}
 }
 
-func NewTorrentDownload(tor *torrent.Torrent, dataDirectory string) TorrentDownload {
+func NewTorrentDownload(tor *torrent.Torrent, dataDirectory string, ipFilter ipfilter.IPFilter) TorrentDownload {
 	return &torrentDownload{
 		tor:           tor,
 		dataDirectory: dataDirectory,
+		ipFilter:      ipFilter,
+		layout:        storage.LAYOUT_INFO_HASH,
 	}
 }
 
@@ -79,22 +173,73 @@ func NewTorrentDownload(tor *torrent.Torrent, dataDirectory string) TorrentDownl
 func (d *torrentDownload) Start() error {
 
 	quit := make(chan int)
+	d.Lock()
 	d.quit = quit
+	d.stopped = false
+	d.storageReady = false
+	d.checked = false
+	d.err = nil
+	d.Unlock()
 
-	d.storage = storage.NewRandomAccessStorage(d.dataDirectory)
-	d.stats = stats.NewStats(0, 0, 0)
-	d.pieceMgr = piece.NewRarestFirstPieceManager(d.storage)
+	// Reads and writes are scheduled on the disk's own threads
+	s := d.newStorage()
+	diskIO := storage.NewDiskIO(s, quit)
+	go diskIO.Start()
+	go func() {
+		// A failed write e.g. to a full disk stops the torrent, rather than
+		// every torrent
+		select {
+		case err := <-diskIO.Errors():
+			d.setError(err)
+		case <-quit:
+		}
+	}()
+	st := stats.NewStats(0, 0, 0)
+	// The files are verified once the download completes
+	pieceMgr := piece.NewRarestFirstPieceManager(&completionStorage{
+		DiskIO:    diskIO,
+		completed: d.downloadCompleted,
+	})
+	// Pieces evicted from memory are no longer advertised. Once the torrent
+	// is stopped, pieces are evicted while the piece manager writes them.
+	diskIO.SetEvicted(func(pieceIndex int) {
+		go pieceMgr.PieceLost(pieceIndex)
+	})
+	var superSeed peer.SuperSeed
+	if d.superSeeding {
+		superSeed = peer.NewSuperSeed()
+	}
+	// Hybrid torrents are part of both swarms
+	var infoHashes [][]byte
+	var err error
+	if d.tor != nil {
+		infoHashes = d.tor.InfoHashes()
+	} else {
+		infoHashes, err = d.muri.InfoHashes()
+		if err != nil {
+			return err
+		}
+	}
 	mdMgr, downloadedChan := piece.NewMetadataManager(d.muri)
-	d.peerMgr = peer.NewPeerManager(d.tor, d.pieceMgr, mdMgr, d.storage, d.stats)
-	choke := peer.NewChoke(d.peerMgr, d.pieceMgr, d.stats, quit)
-	sv, err := server.NewServer(d.peerMgr, quit)
+	peerMgr := peer.NewPeerManager(d.tor, pieceMgr, superSeed, mdMgr, diskIO, st, d.ipFilter, infoHashes)
+	// Read by the getters while the torrent starts
+	d.Lock()
+	d.storage = diskIO
+	d.stats = st
+	d.pieceMgr = pieceMgr
+	d.peerMgr = peerMgr
+	d.Unlock()
+	choke := peer.NewChoke(peerMgr, pieceMgr, st, quit)
+	choke.SetUploadSlots(d.uploadSlots)
+	choke.SetUploadCapacity(d.uploadCapacity)
+	choke.SetSeedingAlgorithm(d.seedingAlgorithm)
+	sv, err := server.NewServer(peerMgr, quit)
 	if err != nil {
 		return err
 	}
 
 	// tracker
 	var announceList [][]string
-	var infoHash []byte
 	if d.tor != nil {
 		if len(d.tor.MetaInfo.AnnounceList) > 0 {
 			announceList = d.tor.MetaInfo.AnnounceList
@@ -104,23 +249,73 @@ func (d *torrentDownload) Start() error {
 	} else {
 		announceList = [][]string{d.muri.Trackers}
 	}
-	if d.tor != nil {
-		infoHash = d.tor.InfoHash
-	} else {
-		infoHash, err = hex.DecodeString(d.muri.InfoHashHex)
+	// Hybrid torrents are announced to both swarms
+	trackers := []tracker.Tracker{}
+	for _, infoHash := range infoHashes {
+		tracker := tracker.NewTracker(announceList, infoHash, st, peerMgr, quit, sv.GetServerPort())
+		if d.tor != nil {
+			tracker.SetPrivate(d.tor.IsPrivate())
+		}
+		trackers = append(trackers, tracker)
+		go tracker.Start()
+	}
+	if d.tor == nil {
+		// Peer addresses given in the magnet link
+		for _, addr := range d.muri.Peers {
+			peerMgr.AddPeer(addr, nil, peer.PEER_SOURCE_MAGNET, nil)
+		}
 	}
-	tracker := tracker.NewTracker(announceList, infoHash, d.stats, d.peerMgr, quit, sv.GetServerPort())
-	go tracker.Start()
 
 	go func() {
 		if d.tor == nil {
-			d.tor = <-downloadedChan
+			tor := <-downloadedChan
+			d.Lock()
+			d.tor = tor
+			d.Unlock()
 			fmt.Println("Metadata Downloaded")
+			d.saveTorrentFile(tor)
+			for _, tracker := range trackers {
+				tracker.SetPrivate(d.tor.IsPrivate())
+			}
+		}
+		err := diskIO.Init(d.tor)
+		if err != nil {
+			// e.g. the disk doesn't have room for the torrent
+			d.setError(err)
+			return
+		}
+		d.Lock()
+		d.storageReady = true
+		d.Unlock()
+		d.laidOut(s)
+		clientBitfield, completed, _ := diskIO.GetCurrentDownloadState()
+		if completed {
+			err := diskIO.Completed()
+			if err != nil {
+				fmt.Println(err)
+			}
+		}
+		pieceMgr.Init(d.tor, clientBitfield)
+		d.Lock()
+		d.checked = true
+		d.Unlock()
+		if superSeed != nil {
+			if completed {
+				superSeed.Init(d.tor)
+			} else {
+				fmt.Println("Torrent incomplete, not superseeding")
+			}
+		}
+		peerMgr.Init(d.tor)
+		for _, url := range d.tor.MetaInfo.URLList {
+			go peer.NewWebSeed(url, peer.URL_LIST, d.tor, pieceMgr, peerMgr, diskIO, st, quit).Start()
+		}
+		for _, url := range d.tor.MetaInfo.HTTPSeeds {
+			go peer.NewWebSeed(url, peer.HTTP_SEEDS, d.tor, pieceMgr, peerMgr, diskIO, st, quit).Start()
+		}
+		if !d.tor.IsPrivate() {
+			go lsd.NewLSD(d.tor.InfoHashes(), sv.GetServerPort(), peerMgr, quit).Start()
 		}
-		d.storage.Init(d.tor)
-		clientBitfield, _, _ := d.storage.GetCurrentDownloadState()
-		d.pieceMgr.Init(d.tor, clientBitfield)
-		d.peerMgr.Init(d.tor)
 		go choke.Start(d.tor)
 		go sv.Serve()
 	}()
@@ -128,34 +323,469 @@ func (d *torrentDownload) Start() error {
 	return nil
 }
 
+// Creates the torrent's storage with the factory, in the allocation mode and
+// with the incomplete and completed directories set
+func (d *torrentDownload) newStorage() storage.Storage {
+	if d.storageFactory == nil {
+		d.storageFactory = NewStorageFactory(storage.RANDOM_ACCESS_STORAGE, storage.MSYNC_NONE)
+	}
+	s := d.storageFactory(d.dataDirectory, d.savePath)
+	if allocator, ok := s.(storage.Allocator); ok {
+		allocator.SetAllocationMode(d.allocationMode)
+	}
+	if incomplete, ok := s.(storage.IncompleteStorage); ok {
+		incomplete.SetIncomplete(d.partSuffix, d.incompleteDir)
+		incomplete.SetCompletedDirectory(d.completedDir)
+	}
+	if layout, ok := s.(storage.LayoutStorage); ok {
+		layout.SetLayout(d.layout, d.layoutPaths, !d.existingData)
+	}
+	return s
+}
+
+// Keeps the paths the storage laid the files out at, the resume state is
+// saved s.t. they're found there once the client is restarted
+func (d *torrentDownload) laidOut(s storage.Storage) {
+	if layout, ok := s.(storage.LayoutStorage); ok {
+		d.layoutPaths = layout.GetLayoutPaths()
+	}
+	d.saveResumeState()
+}
+
+func (d *torrentDownload) saveResumeState() {
+	if d.resumePath == "" {
+		return
+	}
+	state := &resumeState{
+		SavePath:     d.savePath,
+		Layout:       d.layout,
+		Paths:        d.layoutPaths,
+		ExistingData: d.existingData,
+	}
+	if d.muri != nil {
+		state.Magnet = d.muri.String()
+	}
+	err := saveResumeState(d.resumePath, state)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// Restores the state the torrent was saved with
+func (d *torrentDownload) resume(state *resumeState) {
+	d.savePath = state.SavePath
+	d.layout = state.Layout
+	d.layoutPaths = state.Paths
+	d.existingData = state.ExistingData
+}
+
+// Saves the torrent file of a magnet link once its metadata is downloaded,
+// s.t. it's added as a torrent when the client is restarted
+func (d *torrentDownload) saveTorrentFile(tor *torrent.Torrent) {
+	if d.torrentPath == "" {
+		return
+	}
+	err := ioutil.WriteFile(d.torrentPath, tor.Bencode(), 0644)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// Removes the torrent's files where they're laid out, or the directory
+// named after the info-hash under the data directory
+func (d *torrentDownload) removeData() error {
+	if d.layoutPaths == nil {
+		if d.tor == nil || d.savePath != "" || d.layout != storage.LAYOUT_INFO_HASH {
+			// Not laid out yet
+			return nil
+		}
+		return os.RemoveAll(d.dataDirectory + "/" + hex.EncodeToString(d.GetInfoHash()))
+	}
+	directories := []string{d.dataDirectory}
+	if d.savePath != "" {
+		directories[0] = d.savePath
+	}
+	for _, directory := range []string{d.incompleteDir, d.completedDir} {
+		if directory != "" {
+			directories = append(directories, directory)
+		}
+	}
+	for _, directory := range directories {
+		err := storage.RemoveLayout(directory, d.layoutPaths, d.partSuffix)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The storage of a running torrent, or of a stopped torrent its files are
+// found with without starting it
+func (d *torrentDownload) initialisedStorage() (storage.Storage, error) {
+	d.Lock()
+	running := d.quit != nil && !d.stopped
+	ready := d.storageReady
+	started := d.storage
+	tor := d.tor
+	d.Unlock()
+
+	switch {
+	case running && ready:
+		return started, nil
+	case running:
+		return nil, fmt.Errorf("Torrent's storage isn't initialised yet")
+	case tor == nil:
+		return nil, fmt.Errorf("Torrent's metadata isn't downloaded")
+	}
+	s := d.newStorage()
+	err := s.Init(tor)
+	if err != nil {
+		return nil, err
+	}
+	d.laidOut(s)
+	return s, nil
+}
+
+// Moves the torrent's files under newPath e.g. to another volume, progress
+// is called with the bytes moved (it may be nil). A running torrent's reads
+// and writes wait until the files are moved, then carry on without checking
+// the data again. With adopt, files already under newPath are verified and
+// kept rather than overwritten. The torrent is saved under newPath from then
+// on.
+func (d *torrentDownload) MoveStorage(newPath string, adopt bool, progress func(moved, total int64)) error {
+	s, err := d.initialisedStorage()
+	if err != nil {
+		return err
+	}
+	mover, ok := s.(storage.Mover)
+	if !ok {
+		return fmt.Errorf("Torrent's storage can't be moved")
+	}
+	err = mover.Move(newPath, adopt, progress)
+	if err != nil {
+		return err
+	}
+	d.savePath = newPath
+	d.saveResumeState()
+	return nil
+}
+
 // Stop downloading/uploading torrent
 func (d *torrentDownload) Stop() {
-	close(d.quit)
-	go d.peerMgr.StopPeers()
+	d.Lock()
+	if d.stopped || d.quit == nil {
+		// Stopped, or never started
+		d.Unlock()
+		return
+	}
+	d.stopped = true
+	quit := d.quit
+	peerMgr := d.peerMgr
+	d.Unlock()
+
+	close(quit)
+	if peerMgr != nil {
+		go peerMgr.StopPeers()
+	}
+}
+
+// Stops the torrent in an error state, the other torrents carry on
+func (d *torrentDownload) setError(err error) {
+	d.Lock()
+	if d.stopped {
+		d.Unlock()
+		return
+	}
+	d.err = err
+	d.Unlock()
+
+	if storage.IsDiskFull(err) {
+		fmt.Println("Disk full, torrent stopped:", err)
+	} else {
+		fmt.Println("Torrent stopped:", err)
+	}
+	d.Stop()
+}
+
+func (d *torrentDownload) GetError() error {
+	d.Lock()
+	defer d.Unlock()
+
+	return d.err
 }
 
 // Used to remove corrupted pieces while a torrent is downloading/seeding
 func (d *torrentDownload) VerifyData() {
-	bitfield, _, _ := d.storage.GetCurrentDownloadState()
-	d.pieceMgr.VerifyBitField(bitfield)
+	d.Lock()
+	checked := d.checked
+	s := d.storage
+	pieceMgr := d.pieceMgr
+	d.Unlock()
+
+	if !checked {
+		return
+	}
+	bitfield, _, _ := s.GetCurrentDownloadState()
+	pieceMgr.VerifyBitField(bitfield)
 }
 
-func (d *torrentDownload) GetFiles() []*FileDownload {
-	return nil
+// Superseeding (BEP 0016) takes effect when the torrent is next started
+func (d *torrentDownload) SetSuperSeeding(superSeeding bool) {
+	d.superSeeding = superSeeding
+}
+
+// Number of upload slots, 0 scales the slots with the upload capacity
+func (d *torrentDownload) SetUploadSlots(slots int) {
+	d.uploadSlots = slots
+}
+
+func (d *torrentDownload) SetUploadCapacity(bytesPerSecond int) {
+	d.uploadCapacity = bytesPerSecond
+}
+
+// Either peer.ROUND_ROBIN or peer.FASTEST_UPLOAD
+func (d *torrentDownload) SetSeedingAlgorithm(algorithm int) {
+	d.seedingAlgorithm = algorithm
+}
+
+// Either storage.RANDOM_ACCESS_STORAGE or storage.MMAP_STORAGE, the msync
+// policy applies to memory mapped storage. Takes effect when the torrent is
+// next started.
+func (d *torrentDownload) SetStorageBackend(backend, msyncPolicy int) {
+	d.storageFactory = NewStorageFactory(backend, msyncPolicy)
+}
+
+// One of storage.ALLOCATE_SPARSE, storage.ALLOCATE_FULL or
+// storage.ALLOCATE_ON_WRITE, takes effect when the torrent is next started.
+// Memory mapped storage always allocates its files fully.
+func (d *torrentDownload) SetAllocationMode(allocation int) {
+	d.allocationMode = allocation
+}
+
+// Files are downloaded with the suffix e.g. ".part" and/or under the
+// incomplete directory, and renamed once they're complete. Takes effect when
+// the torrent is next started.
+func (d *torrentDownload) SetIncomplete(suffix, incompleteDirectory string) {
+	d.partSuffix = suffix
+	d.incompleteDir = incompleteDirectory
+}
+
+// The torrent is moved under the directory once it's complete, takes effect
+// when the torrent is next started
+func (d *torrentDownload) SetCompletedDirectory(completedDirectory string) {
+	d.completedDir = completedDirectory
+}
+
+// The directory the torrent is saved to, rather than the client's data
+// directory. Takes effect when the torrent is next started, files already
+// downloaded aren't moved (see MoveStorage).
+func (d *torrentDownload) SetSavePath(savePath string) {
+	d.savePath = savePath
+	d.saveResumeState()
+}
+
+// One of the storage.LAYOUT_ constants, takes effect when the torrent is
+// next started. The files are laid out anew, files already downloaded
+// aren't moved.
+func (d *torrentDownload) SetLayout(layout int) {
+	d.layout = layout
+	d.layoutPaths = nil
+	d.existingData = false
+	d.saveResumeState()
+}
+
+// Creates the torrent's storage e.g. in memory, takes effect when the torrent
+// is next started
+func (d *torrentDownload) SetStorageFactory(factory StorageFactory) {
+	d.storageFactory = factory
+}
+
+// The torrent, nil until a magnet link's metadata is downloaded
+func (d *torrentDownload) torrent() *torrent.Torrent {
+	d.Lock()
+	defer d.Unlock()
+
+	return d.tor
+}
+
+// The client's bitfield once the data on disk is checked, nil before
+func (d *torrentDownload) bitfield() []byte {
+	d.Lock()
+	checked := d.checked
+	pieceMgr := d.pieceMgr
+	d.Unlock()
+
+	if !checked {
+		return nil
+	}
+	return pieceMgr.GetBitField()
+}
+
+// The storage of the torrent since it was last started, nil before
+func (d *torrentDownload) startedStorage() storage.Storage {
+	d.Lock()
+	defer d.Unlock()
+
+	return d.storage
 }
 
+func (d *torrentDownload) GetFiles() []FileDownload {
+	tor := d.torrent()
+	if tor == nil {
+		return nil
+	}
+	files := tor.MetaInfo.Info.Files
+	if len(files) == 0 {
+		// Single File Mode, the storage adds the file once it's initialised
+		files = []torrent.File{{Length: tor.MetaInfo.Info.Length, Path: []string{tor.MetaInfo.Info.Name}}}
+	}
+	offsets := storage.FileOffsets(tor)
+	fileDownloads := []FileDownload{}
+	for fileIndex, file := range files {
+		if file.IsPadding() {
+			continue
+		}
+		path := file.Path
+		if tor.MetaInfo.Info.Length == 0 {
+			// Multi File Mode, the files are under the torrent's directory
+			path = append([]string{tor.MetaInfo.Info.Name}, file.Path...)
+		}
+		fileDownloads = append(fileDownloads, &fileDownload{
+			download: d,
+			path:     path,
+			offset:   offsets[fileIndex],
+			length:   file.Length,
+		})
+	}
+	return fileDownloads
+}
+
+// The info-hash of the torrent, or of the magnet link before its metadata is
+// downloaded
 func (d *torrentDownload) GetInfoHash() []byte {
-	return d.tor.InfoHash
+	if tor := d.torrent(); tor != nil {
+		return tor.InfoHash
+	}
+	infoHashes, err := d.muri.InfoHashes()
+	if err != nil {
+		return nil
+	}
+	return infoHashes[0]
 }
 
+func (d *torrentDownload) GetState() int {
+	d.Lock()
+	err := d.err
+	started := d.quit != nil
+	stopped := d.stopped
+	tor := d.tor
+	checked := d.checked
+	pieceMgr := d.pieceMgr
+	d.Unlock()
+
+	switch {
+	case err != nil:
+		return STATE_ERROR
+	case !started:
+		return STATE_QUEUED
+	case stopped:
+		return STATE_PAUSED
+	case tor == nil:
+		return STATE_FETCHING_METADATA
+	case !checked:
+		return STATE_CHECKING
+	case pieceMgr.GetPiecesDownloaded() == tor.NumPieces:
+		return STATE_SEEDING
+	}
+	return STATE_DOWNLOADING
+}
+
+// Length of the torrent's data, or the exact length given in a magnet link
+// before its metadata is downloaded
 func (d *torrentDownload) Size() int {
-	return 0
+	if tor := d.torrent(); tor != nil {
+		return tor.Length
+	}
+	return d.muri.Length
 }
 
+// Name of the torrent, or the display name of a magnet link before its
+// metadata is downloaded
 func (d *torrentDownload) Name() string {
-	return ""
+	if tor := d.torrent(); tor != nil {
+		return tor.MetaInfo.Info.Name
+	}
+	return d.muri.Name
 }
 
 func (d *torrentDownload) NumPieces() int {
+	if tor := d.torrent(); tor != nil {
+		return tor.NumPieces
+	}
+	return 0
+}
+
+func (d *torrentDownload) PieceLength() int {
+	if tor := d.torrent(); tor != nil {
+		return tor.MetaInfo.Info.PieceLength
+	}
 	return 0
 }
+
+// Bytes of the pieces in the bitfield
+func downloadedBytes(tor *torrent.Torrent, bitfield []byte) int {
+	downloaded := 0
+	for pieceIndex := 0; pieceIndex < tor.NumPieces; pieceIndex++ {
+		if bitmap.Get(bitfield, pieceIndex) {
+			downloaded += tor.PieceSize(pieceIndex)
+		}
+	}
+	return downloaded
+}
+
+func (d *torrentDownload) GetStats() TorrentStats {
+	d.Lock()
+	running := d.quit != nil && !d.stopped
+	peerMgr := d.peerMgr
+	pieceMgr := d.pieceMgr
+	st := d.stats
+	d.Unlock()
+
+	torrentStats := TorrentStats{
+		Left: d.Size(),
+	}
+	if peerMgr != nil {
+		torrentStats.Peers = len(peerMgr.GetPeerList())
+	}
+	if pieceMgr != nil {
+		torrentStats.Seeders = pieceMgr.GetSeeders()
+		torrentStats.Availability = pieceMgr.GetAvailability()
+	}
+	if st != nil {
+		torrentStats.Uploaded, torrentStats.Downloaded, _ = st.GetTrackerStats()
+		if running {
+			// The rates are averaged over choke intervals
+			uploadRate, downloadRate := st.GetRates()
+			torrentStats.UploadRate = uploadRate / peer.CHOKE_INTERVAL
+			torrentStats.DownloadRate = downloadRate / peer.CHOKE_INTERVAL
+		}
+	}
+	if bitfield := d.bitfield(); bitfield != nil {
+		torrentStats.Left -= downloadedBytes(d.torrent(), bitfield)
+	}
+
+	switch {
+	case torrentStats.Left == 0 && d.torrent() != nil:
+		torrentStats.ETA = 0
+	case torrentStats.DownloadRate > 0:
+		torrentStats.ETA = time.Duration(torrentStats.Left/torrentStats.DownloadRate) * time.Second
+	default:
+		torrentStats.ETA = -1
+	}
+	if torrentStats.Downloaded > 0 {
+		torrentStats.Ratio = float64(torrentStats.Uploaded) / float64(torrentStats.Downloaded)
+	} else if size := d.Size(); size > 0 {
+		torrentStats.Ratio = float64(torrentStats.Uploaded) / float64(size)
+	}
+	return torrentStats
+}
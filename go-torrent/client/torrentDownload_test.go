@@ -0,0 +1,241 @@
+package client
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/Charana123/torrent/go-torrent/peer"
+	"github.com/Charana123/torrent/go-torrent/piece"
+	"github.com/Charana123/torrent/go-torrent/stats"
+	"github.com/Charana123/torrent/go-torrent/storage"
+	"github.com/Charana123/torrent/go-torrent/torrent"
+	bitmap "github.com/boljen/go-bitmap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type mockPieceManager struct {
+	piece.PieceManager
+	mock.Mock
+}
+
+func (m *mockPieceManager) GetPiecesDownloaded() int {
+	return m.Called().Int(0)
+}
+
+func (m *mockPieceManager) GetBitField() []byte {
+	return m.Called().Get(0).([]byte)
+}
+
+func (m *mockPieceManager) GetAvailability() float64 {
+	return m.Called().Get(0).(float64)
+}
+
+func (m *mockPieceManager) GetSeeders() int {
+	return m.Called().Int(0)
+}
+
+type mockStats struct {
+	stats.Stats
+	mock.Mock
+}
+
+func (m *mockStats) GetTrackerStats() (int, int, int) {
+	args := m.Called()
+	return args.Int(0), args.Int(1), args.Int(2)
+}
+
+func (m *mockStats) GetRates() (int, int) {
+	args := m.Called()
+	return args.Int(0), args.Int(1)
+}
+
+// 4 pieces of 16 bytes, b is aligned to the third piece by a padding file
+func newTestTorrent() *torrent.Torrent {
+	return &torrent.Torrent{
+		InfoHash:  []byte("aaaaaaaaaaaaaaaaaaaa"),
+		NumPieces: 4,
+		Length:    52,
+		MetaInfo: torrent.MetaInfo{
+			Info: torrent.Info{
+				PieceLength: 16,
+				Name:        "root",
+				Files: []torrent.File{
+					{Length: 20, Path: []string{"a"}},
+					{Length: 12, Path: []string{".pad", "12"}, Attr: "p"},
+					{Length: 20, Path: []string{"sub", "b"}},
+				},
+			},
+		},
+	}
+}
+
+func newBitfield(numPieces int, pieceIndexes ...int) []byte {
+	bitfield := bitmap.New(numPieces)
+	for _, pieceIndex := range pieceIndexes {
+		bitfield.Set(pieceIndex, true)
+	}
+	return bitfield.Data(false)
+}
+
+const testMagnet = "magnet:?xt=urn:btih:6161616161616161616161616161616161616161&dn=magnet&xl=100"
+
+func TestGetState(t *testing.T) {
+	d := NewTorrentDownload(newTestTorrent(), t.TempDir(), nil).(*torrentDownload)
+	assert.Equal(t, STATE_QUEUED, d.GetState())
+
+	// Started, the data on disk is checked
+	d.quit = make(chan int)
+	assert.Equal(t, STATE_CHECKING, d.GetState())
+	pieceMgr := &mockPieceManager{}
+	pieceMgr.On("GetPiecesDownloaded").Return(3).Once()
+	d.pieceMgr = pieceMgr
+	d.checked = true
+	assert.Equal(t, STATE_DOWNLOADING, d.GetState())
+	pieceMgr.On("GetPiecesDownloaded").Return(4)
+	assert.Equal(t, STATE_SEEDING, d.GetState())
+
+	d.Stop()
+	assert.Equal(t, STATE_PAUSED, d.GetState())
+	// Stopping again doesn't close quit twice
+	d.Stop()
+}
+
+func TestGetStateMagnet(t *testing.T) {
+	muri, err := torrent.ParseMagnetURI(testMagnet)
+	assert.Nil(t, err)
+	d := NewTorrentFromMagnet(muri, t.TempDir(), nil).(*torrentDownload)
+	assert.Equal(t, STATE_QUEUED, d.GetState())
+	d.quit = make(chan int)
+	assert.Equal(t, STATE_FETCHING_METADATA, d.GetState())
+	d.tor = newTestTorrent()
+	assert.Equal(t, STATE_CHECKING, d.GetState())
+}
+
+func TestSetError(t *testing.T) {
+	d := NewTorrentDownload(newTestTorrent(), t.TempDir(), nil).(*torrentDownload)
+	quit := make(chan int)
+	d.quit = quit
+
+	// The torrent is stopped in the error state
+	d.setError(storage.ErrDiskFull)
+	assert.Equal(t, STATE_ERROR, d.GetState())
+	assert.Equal(t, storage.ErrDiskFull, d.GetError())
+	select {
+	case <-quit:
+	default:
+		t.Fatal("torrent wasn't stopped")
+	}
+
+	// Errors once the torrent is stopped are ignored
+	d.err = nil
+	d.setError(storage.ErrDiskFull)
+	assert.Nil(t, d.GetError())
+	assert.Equal(t, STATE_PAUSED, d.GetState())
+}
+
+func TestGetStats(t *testing.T) {
+	d := NewTorrentDownload(newTestTorrent(), t.TempDir(), nil).(*torrentDownload)
+	st := &mockStats{}
+	st.On("GetTrackerStats").Return(30, 20, 0)
+	st.On("GetRates").Return(0, 2*peer.CHOKE_INTERVAL)
+	pieceMgr := &mockPieceManager{}
+	pieceMgr.On("GetSeeders").Return(1)
+	pieceMgr.On("GetAvailability").Return(1.5)
+	pieceMgr.On("GetBitField").Return(newBitfield(4, 0)).Once()
+	d.quit = make(chan int)
+	d.stats = st
+	d.pieceMgr = pieceMgr
+	d.checked = true
+
+	// 36 bytes left at 2 bytes per second
+	torrentStats := d.GetStats()
+	assert.Equal(t, 1, torrentStats.Seeders)
+	assert.Equal(t, 1.5, torrentStats.Availability)
+	assert.Equal(t, 30, torrentStats.Uploaded)
+	assert.Equal(t, 20, torrentStats.Downloaded)
+	assert.Equal(t, 2, torrentStats.DownloadRate)
+	assert.Equal(t, 36, torrentStats.Left)
+	assert.Equal(t, 18*time.Second, torrentStats.ETA)
+	assert.Equal(t, 1.5, torrentStats.Ratio)
+
+	// Complete
+	pieceMgr.On("GetBitField").Return(newBitfield(4, 0, 1, 2, 3))
+	torrentStats = d.GetStats()
+	assert.Equal(t, 0, torrentStats.Left)
+	assert.Equal(t, time.Duration(0), torrentStats.ETA)
+
+	// Stopped, without a rate
+	d.Stop()
+	d.checked = false
+	torrentStats = d.GetStats()
+	assert.Equal(t, 0, torrentStats.DownloadRate)
+	assert.Equal(t, 52, torrentStats.Left)
+	assert.Equal(t, time.Duration(-1), torrentStats.ETA)
+}
+
+func TestGetStatsSeeding(t *testing.T) {
+	d := NewTorrentDownload(newTestTorrent(), t.TempDir(), nil).(*torrentDownload)
+	st := &mockStats{}
+	st.On("GetTrackerStats").Return(104, 0, 0)
+	d.stats = st
+
+	// Nothing downloaded, the ratio is per byte of the torrent
+	torrentStats := d.GetStats()
+	assert.Equal(t, 2.0, torrentStats.Ratio)
+
+	// Before anything is uploaded or the torrent is started
+	d = NewTorrentDownload(newTestTorrent(), t.TempDir(), nil).(*torrentDownload)
+	torrentStats = d.GetStats()
+	assert.Equal(t, 0.0, torrentStats.Ratio)
+	assert.Equal(t, 52, torrentStats.Left)
+}
+
+func TestGetFiles(t *testing.T) {
+	d := NewTorrentDownload(newTestTorrent(), t.TempDir(), nil)
+
+	// Padding files are skipped, the files are under the torrent's name
+	files := d.GetFiles()
+	assert.Len(t, files, 2)
+	assert.Equal(t, "root/a", files[0].Path())
+	assert.Equal(t, "a", files[0].Name())
+	assert.Equal(t, 20, files[0].Length())
+	assert.Equal(t, "root/sub/b", files[1].Path())
+	assert.Equal(t, "b", files[1].Name())
+	assert.Equal(t, 32, files[1].(*fileDownload).offset)
+}
+
+func TestGetFilesSingleFile(t *testing.T) {
+	tor := &torrent.Torrent{
+		NumPieces: 2,
+		Length:    20,
+		MetaInfo: torrent.MetaInfo{
+			Info: torrent.Info{PieceLength: 16, Name: "single", Length: 20},
+		},
+	}
+	d := NewTorrentDownload(tor, t.TempDir(), nil)
+
+	files := d.GetFiles()
+	assert.Len(t, files, 1)
+	assert.Equal(t, "single", files[0].Path())
+	assert.Equal(t, 20, files[0].Length())
+}
+
+func TestMagnetBeforeMetadata(t *testing.T) {
+	muri, err := torrent.ParseMagnetURI(testMagnet)
+	assert.Nil(t, err)
+	d := NewTorrentFromMagnet(muri, t.TempDir(), nil)
+
+	// Described by the magnet link
+	assert.Equal(t, "6161616161616161616161616161616161616161", hex.EncodeToString(d.GetInfoHash()))
+	assert.Equal(t, "magnet", d.Name())
+	assert.Equal(t, 100, d.Size())
+	assert.Equal(t, 0, d.NumPieces())
+	assert.Nil(t, d.GetFiles())
+	_, err = d.VerifyFiles()
+	assert.NotNil(t, err)
+	torrentStats := d.GetStats()
+	assert.Equal(t, 100, torrentStats.Left)
+	assert.Equal(t, time.Duration(-1), torrentStats.ETA)
+}
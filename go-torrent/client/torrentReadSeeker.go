@@ -1,18 +1,67 @@
 package client
 
 import (
+	"fmt"
 	"io"
 
-	"github.com/Charana123/torrent/go-torrent/storage"
+	bitmap "github.com/boljen/go-bitmap"
 )
 
+// Reads a file of a running torrent from its storage, pieces that aren't
+// downloaded can't be read
 type torrentReadSeeker struct {
-	io.ReadSeeker
-	s *storage.Storage
+	file   *fileDownload
+	offset int64
 }
 
-// a file
-func NewTorrentReadSeeker() {
-	// get the file index and the file offset, read the block
-	// if piece
+func newTorrentReadSeeker(file *fileDownload) io.ReadSeeker {
+	return &torrentReadSeeker{
+		file: file,
+	}
+}
+
+// Reads up to the end of the piece at the offset
+func (r *torrentReadSeeker) Read(p []byte) (int, error) {
+	if r.offset >= int64(r.file.length) {
+		return 0, io.EOF
+	}
+	d := r.file.download
+	if state := d.GetState(); state != STATE_DOWNLOADING && state != STATE_SEEDING {
+		return 0, fmt.Errorf("Torrent isn't running")
+	}
+	tor := d.torrent()
+	globalOffset := r.file.offset + int(r.offset)
+	pieceIndex := globalOffset / tor.MetaInfo.Info.PieceLength
+	blockByteOffset := globalOffset % tor.MetaInfo.Info.PieceLength
+	if !bitmap.Get(d.bitfield(), pieceIndex) {
+		return 0, fmt.Errorf("Piece %d isn't downloaded", pieceIndex)
+	}
+	length := len(p)
+	if left := tor.PieceSize(pieceIndex) - blockByteOffset; length > left {
+		length = left
+	}
+	if left := r.file.length - int(r.offset); length > left {
+		length = left
+	}
+	data, err := d.startedStorage().BlockReadRequest(pieceIndex, blockByteOffset, length)
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, data)
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *torrentReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += int64(r.file.length)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("Negative offset")
+	}
+	r.offset = offset
+	return offset, nil
 }
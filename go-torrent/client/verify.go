@@ -0,0 +1,94 @@
+package client
+
+import (
+	"fmt"
+
+	"github.com/Charana123/torrent/go-torrent/storage"
+	"github.com/Charana123/torrent/go-torrent/torrent"
+)
+
+// Storage that calls completed once the piece manager has downloaded every
+// piece and the pieces are written, with the storage the disk writes to
+type completionStorage struct {
+	storage.DiskIO
+	completed func(s storage.Storage)
+}
+
+func (s *completionStorage) Completed() error {
+	return s.DiskIO.CompletedThen(s.completed)
+}
+
+// The files are checked against their md5sum or sha1 once the torrent is
+// downloaded, the report is kept until the next verification
+func (d *torrentDownload) SetVerifyOnCompletion(verify bool) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.verifyOnCompletion = verify
+}
+
+// The files are read back from disk, rather than from the pieces cached
+func (d *torrentDownload) downloadCompleted(s storage.Storage) {
+	d.Lock()
+	verify := d.verifyOnCompletion
+	tor := d.tor
+	d.Unlock()
+	if !verify {
+		return
+	}
+	report := d.verify(tor, s)
+	for _, file := range report.Files {
+		if !file.OK {
+			fmt.Println("Corrupt file:", file.Path)
+		}
+	}
+}
+
+// Reads every piece, a stopped torrent's files are verified without
+// starting it
+func (d *torrentDownload) VerifyFiles() (*storage.VerificationReport, error) {
+	d.Lock()
+	running := d.quit != nil && !d.stopped
+	ready := d.storageReady
+	started := d.storage
+	tor := d.tor
+	d.Unlock()
+
+	switch {
+	case running && ready:
+		return d.verify(tor, started), nil
+	case running:
+		return nil, fmt.Errorf("Torrent's storage isn't initialised yet")
+	case tor == nil:
+		return nil, fmt.Errorf("Torrent's metadata isn't downloaded")
+	}
+	// The stopped torrent's files are only read, missing files aren't
+	// created and the resume state is kept as it is
+	s := d.newStorage()
+	var err error
+	if readOnly, ok := s.(storage.ReadOnlyStorage); ok {
+		err = readOnly.InitReadOnly(tor)
+	} else {
+		// Storage without files of its own e.g. in memory
+		err = s.Init(tor)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d.verify(tor, s), nil
+}
+
+func (d *torrentDownload) verify(tor *torrent.Torrent, s storage.Storage) *storage.VerificationReport {
+	report := storage.VerifyFiles(tor, s)
+	d.Lock()
+	d.report = report
+	d.Unlock()
+	return report
+}
+
+func (d *torrentDownload) GetVerificationReport() *storage.VerificationReport {
+	d.Lock()
+	defer d.Unlock()
+
+	return d.report
+}
@@ -0,0 +1,347 @@
+package ipfilter
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	RELOAD_INTERVAL = 60
+	// eMule ipfilter.dat ranges with an access level below this are blocked
+	EMULE_ACCESS_THRESHOLD = 128
+)
+
+// IPFilter blocks peers whose addresses fall within the ranges of the
+// blocklists in a directory. Supported formats (detected per line) are
+// eMule ipfilter.dat, PeerGuardian P2P text and plain CIDR lists.
+type IPFilter interface {
+	Blocked(ip net.IP) (blocked bool)
+	Reload() (err error)
+	Start(quit chan int)
+	GetNumRanges() (numRanges int)
+	GetNumBlocked() (numBlocked int)
+}
+
+type ipFilter struct {
+	sync.RWMutex
+	directory  string
+	tree       *node
+	numRanges  int
+	numBlocked int64
+	modTimes   map[string]time.Time
+}
+
+type ipRange struct {
+	start [16]byte
+	end   [16]byte
+}
+
+// Node of an (augmented) interval tree, max is the largest range end
+// within the subtree rooted at the node
+type node struct {
+	r     ipRange
+	max   [16]byte
+	left  *node
+	right *node
+}
+
+func NewIPFilter(directory string) IPFilter {
+	return &ipFilter{
+		directory: directory,
+		modTimes:  make(map[string]time.Time),
+	}
+}
+
+func (f *ipFilter) Blocked(ip net.IP) bool {
+	key, ok := toKey(ip)
+	if !ok {
+		return false
+	}
+
+	f.RLock()
+	blocked := f.tree.contains(key)
+	f.RUnlock()
+
+	if blocked {
+		atomic.AddInt64(&f.numBlocked, 1)
+	}
+	return blocked
+}
+
+func (f *ipFilter) GetNumRanges() int {
+	f.RLock()
+	defer f.RUnlock()
+	return f.numRanges
+}
+
+func (f *ipFilter) GetNumBlocked() int {
+	return int(atomic.LoadInt64(&f.numBlocked))
+}
+
+// Reload re-reads every blocklist in the filter's directory
+func (f *ipFilter) Reload() error {
+	fileInfos, err := ioutil.ReadDir(f.directory)
+	if err != nil {
+		return err
+	}
+
+	ranges := []ipRange{}
+	modTimes := make(map[string]time.Time)
+	for _, fileInfo := range fileInfos {
+		if fileInfo.IsDir() {
+			continue
+		}
+		path := filepath.Join(f.directory, fileInfo.Name())
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		fileRanges, malformed, err := parseRanges(file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+		if malformed > 0 {
+			log.Printf("ipfilter: skipped %d malformed lines in %s\n", malformed, path)
+		}
+		ranges = append(ranges, fileRanges...)
+		modTimes[path] = fileInfo.ModTime()
+	}
+	tree := newIntervalTree(ranges)
+
+	f.Lock()
+	defer f.Unlock()
+	f.tree = tree
+	f.numRanges = len(ranges)
+	f.modTimes = modTimes
+	return nil
+}
+
+func (f *ipFilter) changed() bool {
+	fileInfos, err := ioutil.ReadDir(f.directory)
+	if err != nil {
+		return false
+	}
+
+	f.RLock()
+	defer f.RUnlock()
+	files := 0
+	for _, fileInfo := range fileInfos {
+		if fileInfo.IsDir() {
+			continue
+		}
+		files++
+		modTime, ok := f.modTimes[filepath.Join(f.directory, fileInfo.Name())]
+		if !ok || !modTime.Equal(fileInfo.ModTime()) {
+			return true
+		}
+	}
+	return files != len(f.modTimes)
+}
+
+// Start reloads the blocklists whenever a file in the directory is added,
+// removed or modified
+func (f *ipFilter) Start(quit chan int) {
+	for {
+		select {
+		case <-quit:
+			return
+		case <-time.After(time.Duration(RELOAD_INTERVAL * time.Second)):
+			if f.changed() {
+				err := f.Reload()
+				if err != nil {
+					log.Println("ipfilter: reload failed: ", err)
+				}
+			}
+		}
+	}
+}
+
+func parseRanges(r io.Reader) ([]ipRange, int, error) {
+	ranges := []ipRange{}
+	malformed := 0
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+		r, blocked, err := parseLine(line)
+		if err != nil {
+			malformed++
+			continue
+		}
+		if blocked {
+			ranges = append(ranges, r)
+		}
+	}
+	return ranges, malformed, scanner.Err()
+}
+
+func parseLine(line string) (ipRange, bool, error) {
+	// CIDR e.g. 10.0.0.0/8
+	if _, ipNet, err := net.ParseCIDR(line); err == nil {
+		r, err := cidrRange(ipNet)
+		return r, true, err
+	}
+	// Single address
+	if ip := parseIP(line); ip != nil {
+		r, err := parseRange(line + "-" + line)
+		return r, true, err
+	}
+	// PeerGuardian P2P e.g. Some Organization:1.2.4.0-1.2.4.255, before
+	// eMule as names may contain commas
+	if r, ok := parseP2P(line); ok {
+		return r, true, nil
+	}
+	// eMule e.g. 001.002.004.000 - 001.002.004.255 , 000 , Some Organization
+	if fields := strings.Split(line, ","); len(fields) >= 2 {
+		accessLevel, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+		if err != nil {
+			return ipRange{}, false, err
+		}
+		r, err := parseRange(fields[0])
+		return r, accessLevel < EMULE_ACCESS_THRESHOLD, err
+	}
+	return ipRange{}, false, fmt.Errorf("Unknown blocklist format")
+}
+
+// The range follows the first colon that's followed by a valid range, names
+// may contain colons and IPv6 ranges do
+func parseP2P(line string) (ipRange, bool) {
+	for i := 0; i < len(line); i++ {
+		if line[i] != ':' {
+			continue
+		}
+		if r, err := parseRange(line[i+1:]); err == nil {
+			return r, true
+		}
+	}
+	return ipRange{}, false
+}
+
+func parseRange(s string) (ipRange, error) {
+	bounds := strings.Split(s, "-")
+	if len(bounds) != 2 {
+		return ipRange{}, fmt.Errorf("Malformed IP range")
+	}
+	start, ok1 := toKey(parseIP(bounds[0]))
+	end, ok2 := toKey(parseIP(bounds[1]))
+	if !ok1 || !ok2 || bytes.Compare(start[:], end[:]) > 0 {
+		return ipRange{}, fmt.Errorf("Malformed IP range")
+	}
+	return ipRange{start: start, end: end}, nil
+}
+
+// parseIP additionally accepts IPv4 addresses with zero-padded octets,
+// as used by eMule ipfilter.dat
+func parseIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, ":") {
+		return net.ParseIP(s)
+	}
+	octets := strings.Split(s, ".")
+	if len(octets) != 4 {
+		return nil
+	}
+	ip := make(net.IP, 4)
+	for i, octet := range octets {
+		n, err := strconv.Atoi(octet)
+		if err != nil || n < 0 || n > 255 {
+			return nil
+		}
+		ip[i] = byte(n)
+	}
+	return ip.To16()
+}
+
+func cidrRange(ipNet *net.IPNet) (ipRange, error) {
+	start := ipNet.IP
+	end := make(net.IP, len(start))
+	for i := range start {
+		end[i] = start[i] | ^ipNet.Mask[i]
+	}
+	startKey, ok1 := toKey(start)
+	endKey, ok2 := toKey(end)
+	if !ok1 || !ok2 {
+		return ipRange{}, fmt.Errorf("Malformed CIDR")
+	}
+	return ipRange{start: startKey, end: endKey}, nil
+}
+
+// IPv4 addresses are keyed by their IPv4-mapped IPv6 address
+func toKey(ip net.IP) ([16]byte, bool) {
+	var key [16]byte
+	ip = ip.To16()
+	if ip == nil {
+		return key, false
+	}
+	copy(key[:], ip)
+	return key, true
+}
+
+func less(a, b [16]byte) bool {
+	return bytes.Compare(a[:], b[:]) < 0
+}
+
+func newIntervalTree(ranges []ipRange) *node {
+	sort.Slice(ranges, func(i, j int) bool {
+		return less(ranges[i].start, ranges[j].start)
+	})
+	return buildIntervalTree(ranges)
+}
+
+// Builds a balanced tree from ranges sorted by their start
+func buildIntervalTree(ranges []ipRange) *node {
+	if len(ranges) == 0 {
+		return nil
+	}
+	mid := len(ranges) / 2
+	n := &node{
+		r:     ranges[mid],
+		max:   ranges[mid].end,
+		left:  buildIntervalTree(ranges[:mid]),
+		right: buildIntervalTree(ranges[mid+1:]),
+	}
+	if n.left != nil && less(n.max, n.left.max) {
+		n.max = n.left.max
+	}
+	if n.right != nil && less(n.max, n.right.max) {
+		n.max = n.right.max
+	}
+	return n
+}
+
+func (n *node) contains(ip [16]byte) bool {
+	for n != nil {
+		if less(n.max, ip) {
+			// ip lies beyond every range in the subtree
+			return false
+		}
+		if !less(ip, n.r.start) && !less(n.r.end, ip) {
+			return true
+		}
+		// If a range in the left subtree ends at or after ip but doesn't
+		// contain it, it starts after ip, and so do all ranges to the right
+		if n.left != nil && !less(n.left.max, ip) {
+			n = n.left
+		} else {
+			n = n.right
+		}
+	}
+	return false
+}
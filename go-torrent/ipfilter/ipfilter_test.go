@@ -0,0 +1,71 @@
+package ipfilter
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeBlocklist(t *testing.T, directory, name, contents string) {
+	err := ioutil.WriteFile(filepath.Join(directory, name), []byte(contents), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBlocked(t *testing.T) {
+	directory, err := ioutil.TempDir("", "ipfilter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	writeBlocklist(t, directory, "ipfilter.dat", `# eMule
+001.002.004.000 - 001.002.004.255 , 000 , Blocked Organization
+005.006.007.000 - 005.006.007.255 , 200 , Allowed Organization
+`)
+	writeBlocklist(t, directory, "level1.p2p", `Some Organization:8.8.0.0-8.8.255.255
+Acme, Inc:9.9.9.0-9.9.9.255
+Colon: Networks:2001:db8:1::-2001:db8:1::ffff
+malformed line
+`)
+	writeBlocklist(t, directory, "cidr.txt", `10.0.0.0/8
+2001:db8::/32
+192.168.1.1
+`)
+
+	f := NewIPFilter(directory)
+	assert.Nil(t, f.Reload())
+	assert.Equal(t, 7, f.GetNumRanges())
+
+	blocked := []string{"1.2.4.0", "1.2.4.128", "1.2.4.255", "8.8.8.8", "9.9.9.9", "10.1.2.3", "2001:db8::1", "192.168.1.1"}
+	for _, ip := range blocked {
+		assert.True(t, f.Blocked(net.ParseIP(ip)), ip)
+	}
+	allowed := []string{"1.2.3.255", "1.2.5.0", "5.6.7.8", "8.9.0.0", "11.0.0.0", "2001:db9::1", "192.168.1.2"}
+	for _, ip := range allowed {
+		assert.False(t, f.Blocked(net.ParseIP(ip)), ip)
+	}
+	assert.Equal(t, len(blocked), f.GetNumBlocked())
+}
+
+func TestOverlappingRanges(t *testing.T) {
+	ranges := []ipRange{}
+	for _, s := range []string{"1.0.0.0-1.255.255.255", "1.1.0.0-1.1.0.10", "1.2.0.0-1.2.0.10", "3.0.0.0-3.0.0.0"} {
+		r, err := parseRange(s)
+		assert.Nil(t, err)
+		ranges = append(ranges, r)
+	}
+	tree := newIntervalTree(ranges)
+
+	key, _ := toKey(net.ParseIP("1.3.0.0"))
+	assert.True(t, tree.contains(key))
+	key, _ = toKey(net.ParseIP("2.0.0.0"))
+	assert.False(t, tree.contains(key))
+	key, _ = toKey(net.ParseIP("3.0.0.0"))
+	assert.True(t, tree.contains(key))
+}
@@ -0,0 +1,230 @@
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Charana123/torrent/go-torrent/peer"
+)
+
+// BEP 0014 - Local Service Discovery
+// Torrents are announced to the peers on the local network with BT-SEARCH
+// messages sent to a multicast group. Peers announcing the same torrent are
+// connected to directly, without a tracker.
+
+const (
+	LSD_IPV4_ADDRESS = "239.192.152.143:6771"
+	LSD_IPV6_ADDRESS = "[ff15::efc0:988f]:6771"
+	// Seconds between announcements
+	ANNOUNCE_INTERVAL = 300
+	// Announcements are sent at most once a minute
+	MIN_ANNOUNCE_INTERVAL = 60
+	// Seconds before a peer is added again after it was announced
+	PEER_DEDUP_INTERVAL = 60
+	MAX_MESSAGE_SIZE    = 1400
+)
+
+type LSD interface {
+	Start()
+}
+
+type lsd struct {
+	sync.Mutex
+	infoHashes   [][]byte
+	port         int
+	cookie       string
+	peerMgr      peer.PeerManager
+	quit         chan int
+	conns        []net.PacketConn
+	groups       []net.Addr
+	lastAnnounce time.Time
+	seenPeers    map[string]time.Time
+}
+
+var (
+	timeNow         = time.Now
+	listenMulticast = func(group string) (net.PacketConn, net.Addr, error) {
+		groupAddr, err := net.ResolveUDPAddr("udp", group)
+		if err != nil {
+			return nil, nil, err
+		}
+		network := "udp4"
+		if groupAddr.IP.To4() == nil {
+			network = "udp6"
+		}
+		conn, err := net.ListenMulticastUDP(network, nil, groupAddr)
+		if err != nil {
+			return nil, nil, err
+		}
+		return conn, groupAddr, nil
+	}
+)
+
+// NewLSD announces the info-hashes with the port peers accept connections
+// on. Private torrents (BEP 0027) must not be announced.
+func NewLSD(
+	infoHashes [][]byte,
+	port int,
+	peerMgr peer.PeerManager,
+	quit chan int) LSD {
+
+	return &lsd{
+		infoHashes: infoHashes,
+		port:       port,
+		// Identifies our own announcements, which the multicast group loops back
+		cookie:    strconv.FormatInt(rand.Int63(), 36),
+		peerMgr:   peerMgr,
+		quit:      quit,
+		seenPeers: make(map[string]time.Time),
+	}
+}
+
+func (l *lsd) Start() {
+	for _, group := range []string{LSD_IPV4_ADDRESS, LSD_IPV6_ADDRESS} {
+		conn, groupAddr, err := listenMulticast(group)
+		if err != nil {
+			// e.g. no IPv6 multicast route
+			fmt.Println("lsd:", err)
+			continue
+		}
+		l.conns = append(l.conns, conn)
+		l.groups = append(l.groups, groupAddr)
+		go l.receive(conn)
+	}
+	if len(l.conns) == 0 {
+		return
+	}
+
+	l.announce()
+	for {
+		select {
+		case <-l.quit:
+			for _, conn := range l.conns {
+				conn.Close()
+			}
+			return
+		case <-time.After(time.Second * ANNOUNCE_INTERVAL):
+			l.announce()
+		}
+	}
+}
+
+func (l *lsd) message(host string) []byte {
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "BT-SEARCH * HTTP/1.1\r\n")
+	fmt.Fprintf(b, "Host: %s\r\n", host)
+	fmt.Fprintf(b, "Port: %d\r\n", l.port)
+	for _, infoHash := range l.infoHashes {
+		fmt.Fprintf(b, "Infohash: %s\r\n", hex.EncodeToString(infoHash))
+	}
+	fmt.Fprintf(b, "cookie: %s\r\n", l.cookie)
+	fmt.Fprintf(b, "\r\n\r\n")
+	return b.Bytes()
+}
+
+func (l *lsd) announce() {
+	l.Lock()
+	now := timeNow()
+	if !l.lastAnnounce.IsZero() && now.Sub(l.lastAnnounce) < time.Second*MIN_ANNOUNCE_INTERVAL {
+		l.Unlock()
+		return
+	}
+	l.lastAnnounce = now
+	l.Unlock()
+
+	for i, conn := range l.conns {
+		_, err := conn.WriteTo(l.message(l.groups[i].String()), l.groups[i])
+		if err != nil {
+			fmt.Println("lsd:", err)
+		}
+	}
+}
+
+func (l *lsd) receive(conn net.PacketConn) {
+	buf := make([]byte, MAX_MESSAGE_SIZE)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			// Connection closed
+			return
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		port, infoHashes, cookie, err := parseMessage(buf[:n])
+		if err != nil || cookie == l.cookie {
+			continue
+		}
+		if infoHash := l.announced(infoHashes); infoHash != nil {
+			host := udpAddr.IP.String()
+			if udpAddr.Zone != "" {
+				host += "%" + udpAddr.Zone
+			}
+			l.addPeer(net.JoinHostPort(host, strconv.Itoa(port)), infoHash)
+		}
+	}
+}
+
+// The info-hash of the torrent's swarm the peer announced, nil if it
+// announced none of them
+func (l *lsd) announced(infoHashes []string) []byte {
+	for _, infoHashHex := range infoHashes {
+		for _, infoHash := range l.infoHashes {
+			if strings.EqualFold(infoHashHex, hex.EncodeToString(infoHash)) {
+				return infoHash
+			}
+		}
+	}
+	return nil
+}
+
+// Peers announce every torrent they share, each peer is added once a minute
+func (l *lsd) addPeer(id string, infoHash []byte) {
+	l.Lock()
+	now := timeNow()
+	if seen, ok := l.seenPeers[id]; ok && now.Sub(seen) < time.Second*PEER_DEDUP_INTERVAL {
+		l.Unlock()
+		return
+	}
+	// Peers announced before the interval would be added again anyway
+	for seenID, seen := range l.seenPeers {
+		if now.Sub(seen) >= time.Second*PEER_DEDUP_INTERVAL {
+			delete(l.seenPeers, seenID)
+		}
+	}
+	l.seenPeers[id] = now
+	l.Unlock()
+
+	l.peerMgr.AddPeer(id, nil, peer.PEER_SOURCE_LSD, infoHash)
+}
+
+func parseMessage(message []byte) (int, []string, string, error) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(message)))
+	if err != nil {
+		return 0, nil, "", err
+	}
+	if req.Method != "BT-SEARCH" {
+		return 0, nil, "", fmt.Errorf("Not a BT-SEARCH message")
+	}
+	port, err := strconv.Atoi(req.Header.Get("Port"))
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, nil, "", fmt.Errorf("Invalid port")
+	}
+	infoHashes := []string{}
+	for _, infoHash := range req.Header["Infohash"] {
+		if len(infoHash) == 40 {
+			infoHashes = append(infoHashes, infoHash)
+		}
+	}
+	return port, infoHashes, req.Header.Get("Cookie"), nil
+}
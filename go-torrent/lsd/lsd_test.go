@@ -0,0 +1,154 @@
+package lsd
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Charana123/torrent/go-torrent/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type mockPeerManager struct {
+	peer.PeerManager
+	mock.Mock
+}
+
+func (m *mockPeerManager) AddPeer(id string, conn net.Conn, source int, infoHash []byte) {
+	m.Called(id, conn, source, infoHash)
+}
+
+var infoHash = []byte("aaaaaaaaaaaaaaaaaaaa")
+
+func message(port int, infoHash, cookie string) []byte {
+	return []byte(fmt.Sprintf("BT-SEARCH * HTTP/1.1\r\nHost: %s\r\nPort: %d\r\nInfohash: %s\r\ncookie: %s\r\n\r\n\r\n",
+		LSD_IPV4_ADDRESS, port, infoHash, cookie))
+}
+
+func TestParseMessage(t *testing.T) {
+	l := NewLSD([][]byte{infoHash, []byte("bbbbbbbbbbbbbbbbbbbb")}, 6881, nil, nil).(*lsd)
+	port, infoHashes, cookie, err := parseMessage(l.message(LSD_IPV4_ADDRESS))
+	assert.Nil(t, err)
+	assert.Equal(t, 6881, port)
+	assert.Equal(t, []string{"6161616161616161616161616161616161616161", "6262626262626262626262626262626262626262"}, infoHashes)
+	assert.Equal(t, l.cookie, cookie)
+
+	_, _, _, err = parseMessage([]byte("GET / HTTP/1.1\r\nPort: 6881\r\n\r\n"))
+	assert.NotNil(t, err)
+	_, _, _, err = parseMessage(message(0, "6161616161616161616161616161616161616161", ""))
+	assert.NotNil(t, err)
+}
+
+func TestLSD(t *testing.T) {
+	// The multicast group is a loopback socket, announcements are looped back
+	conns := []net.PacketConn{}
+	listen := listenMulticast
+	defer func() { listenMulticast = listen }()
+	listenMulticast = func(group string) (net.PacketConn, net.Addr, error) {
+		if group == LSD_IPV6_ADDRESS {
+			return nil, nil, fmt.Errorf("no IPv6")
+		}
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		conns = append(conns, conn)
+		return conn, conn.LocalAddr(), err
+	}
+
+	peerMgr := &mockPeerManager{}
+	added := make(chan string, 10)
+	peerMgr.On("AddPeer", mock.Anything, nil, peer.PEER_SOURCE_LSD, infoHash).Run(func(args mock.Arguments) {
+		added <- args.String(0)
+	})
+	quit := make(chan int)
+	stopped := make(chan int)
+	l := NewLSD([][]byte{infoHash}, 6881, peerMgr, quit).(*lsd)
+	go func() {
+		l.Start()
+		close(stopped)
+	}()
+	defer func() {
+		close(quit)
+		<-stopped
+	}()
+	announced := func() bool {
+		l.Lock()
+		defer l.Unlock()
+		return !l.lastAnnounce.IsZero()
+	}
+	for !announced() {
+		time.Sleep(time.Millisecond)
+	}
+	group := conns[0].LocalAddr()
+
+	other, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer other.Close()
+	// Another torrent, then the same announcement twice
+	other.WriteTo(message(7000, "6262626262626262626262626262626262626262", "other"), group)
+	other.WriteTo(message(7000, "6161616161616161616161616161616161616161", "other"), group)
+	other.WriteTo(message(7000, "6161616161616161616161616161616161616161", "other"), group)
+
+	select {
+	case id := <-added:
+		assert.Equal(t, "127.0.0.1:7000", id)
+	case <-time.After(time.Second):
+		t.Fatal("peer not added")
+	}
+	select {
+	case id := <-added:
+		t.Fatal("peer added twice", id)
+	case <-time.After(100 * time.Millisecond):
+	}
+	// Our own announcement was ignored
+	peerMgr.AssertNumberOfCalls(t, "AddPeer", 1)
+}
+
+func TestAnnounceRateLimit(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer conn.Close()
+	l := NewLSD([][]byte{infoHash}, 6881, nil, nil).(*lsd)
+	l.conns = []net.PacketConn{conn}
+	l.groups = []net.Addr{conn.LocalAddr()}
+
+	now := time.Now()
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return now }
+	l.announce()
+	l.announce()
+	now = now.Add(time.Second * MIN_ANNOUNCE_INTERVAL)
+	l.announce()
+
+	received := 0
+	buf := make([]byte, MAX_MESSAGE_SIZE)
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	for {
+		_, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		received++
+	}
+	assert.Equal(t, 2, received)
+}
+
+func TestSeenPeersExpire(t *testing.T) {
+	peerMgr := &mockPeerManager{}
+	peerMgr.On("AddPeer", mock.Anything, nil, peer.PEER_SOURCE_LSD, infoHash)
+	l := NewLSD([][]byte{infoHash}, 6881, peerMgr, nil).(*lsd)
+
+	now := time.Now()
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return now }
+	l.addPeer("10.0.0.1:6881", infoHash)
+	l.addPeer("10.0.0.1:6881", infoHash)
+	peerMgr.AssertNumberOfCalls(t, "AddPeer", 1)
+
+	// Peers announced before the interval are forgotten
+	now = now.Add(time.Second * PEER_DEDUP_INTERVAL)
+	l.addPeer("10.0.0.2:6881", infoHash)
+	assert.Len(t, l.seenPeers, 1)
+	l.addPeer("10.0.0.1:6881", infoHash)
+	peerMgr.AssertNumberOfCalls(t, "AddPeer", 3)
+}
@@ -14,9 +14,29 @@ import (
 )
 
 const (
-	SNUBBED_PERIOD = 60
-	CHOKE_INTERVAL = 10
-	DOWNLOADERS    = 5
+	SNUBBED_PERIOD              = 60
+	CHOKE_INTERVAL              = 10
+	OPTIMISTIC_UNCHOKE_INTERVAL = 30
+	// Peers connected within this period are NEW_PEER_WEIGHT times as likely
+	// to be optimistically unchoked
+	NEW_PEER_PERIOD = 60
+	NEW_PEER_WEIGHT = 3
+	// Period a peer keeps its upload slot for when round-robin seeding
+	ROUND_ROBIN_PERIOD = 30
+	// Default number of upload slots, including the optimistic unchoke
+	DOWNLOADERS          = 5
+	MIN_UPLOAD_SLOTS     = 2
+	MAX_UPLOAD_SLOTS     = 50
+	UPLOAD_RATE_PER_SLOT = 5 * 1024 // bytes per second
+
+	// Seeding chokers
+	ROUND_ROBIN    = 0
+	FASTEST_UPLOAD = 1
+)
+
+var (
+	timeNow  = time.Now
+	randIntn = rand.Intn
 )
 
 type PeerInfo struct {
@@ -35,15 +55,25 @@ type PeerInfo struct {
 
 type Choke interface {
 	Start(tor *torrent.Torrent)
+	SetUploadSlots(slots int)
+	SetUploadCapacity(bytesPerSecond int)
+	SetSeedingAlgorithm(algorithm int)
 }
 
 type choke struct {
-	torrent  *torrent.Torrent
-	peerMgr  PeerManager
-	pieceMgr piece.PieceManager
-	stats    stats.Stats
-	seeding  bool
-	quit     chan int
+	torrent          *torrent.Torrent
+	peerMgr          PeerManager
+	pieceMgr         piece.PieceManager
+	stats            stats.Stats
+	seeding          bool
+	seedingAlgorithm int
+	slots            int
+	uploadCapacity   int
+	round            int
+	optimistic       string
+	connected        map[string]time.Time
+	lastUnchoked     map[string]time.Time
+	quit             chan int
 }
 
 func NewChoke(
@@ -53,23 +83,113 @@ func NewChoke(
 	quit chan int) Choke {
 
 	return &choke{
-		peerMgr:  peerMgr,
-		pieceMgr: pieceMgr,
-		stats:    stats,
-		quit:     quit,
+		peerMgr:      peerMgr,
+		pieceMgr:     pieceMgr,
+		stats:        stats,
+		quit:         quit,
+		connected:    make(map[string]time.Time),
+		lastUnchoked: make(map[string]time.Time),
 	}
 }
 
+// SetUploadSlots fixes the number of upload slots, otherwise the number of
+// slots scales with the upload capacity
+func (c *choke) SetUploadSlots(slots int) {
+	c.slots = slots
+}
+
+func (c *choke) SetUploadCapacity(bytesPerSecond int) {
+	c.uploadCapacity = bytesPerSecond
+}
+
+func (c *choke) SetSeedingAlgorithm(algorithm int) {
+	c.seedingAlgorithm = algorithm
+}
+
+func (c *choke) uploadSlots() int {
+	if c.slots > 0 {
+		return c.slots
+	}
+	if c.uploadCapacity > 0 {
+		slots := c.uploadCapacity / UPLOAD_RATE_PER_SLOT
+		if slots < MIN_UPLOAD_SLOTS {
+			return MIN_UPLOAD_SLOTS
+		}
+		if slots > MAX_UPLOAD_SLOTS {
+			return MAX_UPLOAD_SLOTS
+		}
+		return slots
+	}
+	return DOWNLOADERS
+}
+
 func sortBySpeed(peers []*PeerInfo) {
-	sort.Slice(peers, func(i, j int) bool {
+	sort.SliceStable(peers, func(i, j int) bool {
 		return peers[i].speed > peers[j].speed
 	})
 }
 
+// Round-robin - peers unchoked within the last ROUND_ROBIN_PERIOD keep their
+// slots, remaining slots go to the peers that were unchoked the longest ago
+func (c *choke) sortByRoundRobin(peers []*PeerInfo, now time.Time) {
+	recentlyUnchoked := func(peerInfo *PeerInfo) bool {
+		return !peerInfo.State.clientChoking &&
+			now.Sub(c.lastUnchoked[peerInfo.ID]) < ROUND_ROBIN_PERIOD*time.Second
+	}
+	sort.SliceStable(peers, func(i, j int) bool {
+		ri, rj := recentlyUnchoked(peers[i]), recentlyUnchoked(peers[j])
+		if ri != rj {
+			return ri
+		}
+		if ri {
+			return c.lastUnchoked[peers[i].ID].After(c.lastUnchoked[peers[j].ID])
+		}
+		return c.lastUnchoked[peers[i].ID].Before(c.lastUnchoked[peers[j].ID])
+	})
+}
+
+// Fastest upload - peers that download from the client the fastest,
+// breaking ties by the most recently unchoked
+func (c *choke) sortByFastestUpload(peers []*PeerInfo) {
+	sort.SliceStable(peers, func(i, j int) bool {
+		if peers[i].speed != peers[j].speed {
+			return peers[i].speed > peers[j].speed
+		}
+		return c.lastUnchoked[peers[i].ID].After(c.lastUnchoked[peers[j].ID])
+	})
+}
+
+// Choose a random peer, newly connected peers are NEW_PEER_WEIGHT times as likely
+func (c *choke) pickOptimistic(peers []*PeerInfo, now time.Time) *PeerInfo {
+	weights := make([]int, len(peers))
+	total := 0
+	for i, peerInfo := range peers {
+		weights[i] = 1
+		if now.Sub(c.connected[peerInfo.ID]) < NEW_PEER_PERIOD*time.Second {
+			weights[i] = NEW_PEER_WEIGHT
+		}
+		total += weights[i]
+	}
+	if total == 0 {
+		return nil
+	}
+	r := randIntn(total)
+	for i, peerInfo := range peers {
+		if r < weights[i] {
+			return peerInfo
+		}
+		r -= weights[i]
+	}
+	return nil
+}
+
 func (c *choke) choke() {
+	now := timeNow()
 	peers := c.peerMgr.GetPeerList()
+	c.seeding = c.pieceMgr.GetPiecesDownloaded() == c.torrent.NumPieces
 
 	peerInfos := []*PeerInfo{}
+	connected := make(map[string]time.Time)
 	for _, peer := range peers {
 		id, state, lastPiece := peer.GetPeerInfo()
 		peerInfo := &PeerInfo{
@@ -78,6 +198,17 @@ func (c *choke) choke() {
 			LastPiece: lastPiece,
 		}
 		peerInfos = append(peerInfos, peerInfo)
+		if connectedAt, ok := c.connected[id]; ok {
+			connected[id] = connectedAt
+		} else {
+			connected[id] = now
+		}
+	}
+	c.connected = connected
+	for id := range c.lastUnchoked {
+		if _, ok := connected[id]; !ok {
+			delete(c.lastUnchoked, id)
+		}
 	}
 	peerStats := c.stats.GetPeerStats()
 
@@ -87,13 +218,15 @@ func (c *choke) choke() {
 	for _, peerInfo := range peerInfos {
 		if peerStat, ok := peerStats[peerInfo.ID]; ok {
 			if c.seeding {
-				peerInfo.speed = peerStat.UploadRate
-			} else {
+				// Rate the peer downloads from the client
 				peerInfo.speed = peerStat.DownloadRate
+			} else {
+				// Rate the peer uploads to the client
+				peerInfo.speed = peerStat.UploadRate
 			}
 		}
-		if peerInfo.State.clientInterested && !peerInfo.State.peerChoking {
-			if time.Now().Unix()-peerInfo.LastPiece > SNUBBED_PERIOD {
+		if !c.seeding && peerInfo.State.clientInterested && !peerInfo.State.peerChoking {
+			if now.Unix()-peerInfo.LastPiece > SNUBBED_PERIOD {
 				peerInfo.snubbedClient = true
 			}
 		}
@@ -103,48 +236,67 @@ func (c *choke) choke() {
 			notInterested = append(notInterested, peerInfo)
 		}
 	}
-	fmt.Println("interested", interested)
-	fmt.Println("notInterested", notInterested)
 
-	// Sort in descending order of peer upload speed
-	sortBySpeed(interested)
-	sortBySpeed(notInterested)
+	regularSlots := c.uploadSlots() - 1
+	if c.seeding {
+		if c.seedingAlgorithm == FASTEST_UPLOAD {
+			c.sortByFastestUpload(interested)
+		} else {
+			c.sortByRoundRobin(interested, now)
+		}
+		for i := 0; i < len(interested) && i < regularSlots; i++ {
+			interested[i].shouldUnchoke = true
+		}
+	} else {
+		// Sort in descending order of peer upload speed
+		sortBySpeed(interested)
+		sortBySpeed(notInterested)
 
-	// unchoke fastest 4 uploading clients s.t. they continue to upload to the client
-	// (keep the client unchoked) i.e. choose the client as one their 4 active downloaders
-	speedThreshold := 0
-	for i := 0; i < len(interested) && i < DOWNLOADERS-1; i++ {
-		interested[i].shouldUnchoke = true
-		speedThreshold = interested[i].speed
-	}
-	// unchoke all uninterested peers with better upload rates s.t. when they become
-	// interested and start downloading from the client, they might choose the client
-	// as one of their 4 active downloaders i.e. unchoke the client
-	for i := 0; i < len(notInterested) && notInterested[i].speed > speedThreshold; i++ {
-		notInterested[i].shouldUnchoke = true
+		// unchoke fastest uploading clients s.t. they continue to upload to the client
+		// (keep the client unchoked) i.e. choose the client as one their active downloaders
+		speedThreshold := 0
+		for i := 0; i < len(interested) && i < regularSlots; i++ {
+			interested[i].shouldUnchoke = true
+			speedThreshold = interested[i].speed
+		}
+		// unchoke all uninterested peers with better upload rates s.t. when they become
+		// interested and start downloading from the client, they might choose the client
+		// as one of their active downloaders i.e. unchoke the client
+		for i := 0; i < len(notInterested) && notInterested[i].speed > speedThreshold; i++ {
+			notInterested[i].shouldUnchoke = true
+		}
 	}
 
 	// optimistically unchoke a single interested peer - charity upload for peers
-	// newly connecting to the swarm
-	if len(interested) > DOWNLOADERS-1 {
-		interested = interested[DOWNLOADERS-1:]
-		rand.Seed(time.Now().UnixNano())
-		rand.Shuffle(len(interested), func(i, j int) {
-			interested[i], interested[j] = interested[j], interested[i]
-		})
-		for _, peer := range interested {
-			if peer.State.peerInterested {
-				peer.shouldUnchoke = true
-				break
-			}
+	// newly connecting to the swarm. The optimistic unchoke rotates every
+	// OPTIMISTIC_UNCHOKE_INTERVAL, or sooner if the peer leaves, loses interest
+	// or earns a regular slot
+	candidates := []*PeerInfo{}
+	var optimistic *PeerInfo
+	if len(interested) > regularSlots {
+		candidates = interested[regularSlots:]
+	}
+	for _, peerInfo := range candidates {
+		if peerInfo.ID == c.optimistic {
+			optimistic = peerInfo
 		}
 	}
+	if optimistic == nil || c.round%(OPTIMISTIC_UNCHOKE_INTERVAL/CHOKE_INTERVAL) == 0 {
+		optimistic = c.pickOptimistic(candidates, now)
+	}
+	c.optimistic = ""
+	if optimistic != nil {
+		optimistic.shouldUnchoke = true
+		c.optimistic = optimistic.ID
+	}
+	c.round++
 
 	// apply unchoke/choke
 	for i, peerInfo := range peerInfos {
 		if peerInfo.shouldUnchoke && peerInfo.State.clientChoking {
 			fmt.Print(peerInfo.ID, "unchoke")
 			peers[i].SendUnchoke()
+			c.lastUnchoked[peerInfo.ID] = now
 		}
 		if !peerInfo.shouldUnchoke && !peerInfo.State.clientChoking {
 			fmt.Print(peerInfo.ID, "choke")
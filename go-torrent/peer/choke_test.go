@@ -1,88 +1,204 @@
 package peer
 
 import (
+	"math/rand"
 	"testing"
 	"time"
+
+	"github.com/Charana123/torrent/go-torrent/stats"
+	"github.com/Charana123/torrent/go-torrent/torrent"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 )
 
-func (m *mockPeerManager) GetPeerList() []*PeerInfo {
+func (m *mockPeerManager) GetPeerList() []Peer {
 	args := m.Called()
-	return args.Get(0).([]*PeerInfo)
+	return args.Get(0).([]Peer)
 }
 
-func (m *mockWire) SendUnchoke() error {
+func (m *mockPieceManager) GetPiecesDownloaded() int {
 	args := m.Called()
-	return args.Error(0)
+	return args.Int(0)
+}
+
+type mockPeer struct {
+	Peer
+	mock.Mock
 }
 
-func (m *mockWire) SendChoke() error {
+func (m *mockPeer) GetPeerInfo() (string, connState, int64) {
 	args := m.Called()
-	return args.Error(0)
+	return args.String(0), args.Get(1).(connState), args.Get(2).(int64)
 }
 
-func TestChoke(t *testing.T) {
+func (m *mockPeer) SendUnchoke() {
+	m.Called()
+}
 
+func (m *mockPeer) SendChoke() {
+	m.Called()
+}
+
+type mockStats struct {
+	stats.Stats
+	mock.Mock
+}
+
+func (m *mockStats) GetPeerStats() map[string]*stats.PeerStat {
+	args := m.Called()
+	return args.Get(0).(map[string]*stats.PeerStat)
+}
+
+func newMockPeer(id string, state connState, lastPiece int64) *mockPeer {
+	p := &mockPeer{}
+	p.On("GetPeerInfo").Return(id, state, lastPiece)
+	return p
+}
+
+func newTestChoke(peers []Peer, peerStats map[string]*stats.PeerStat, piecesDownloaded int) *choke {
 	pm := &mockPeerManager{}
-	w1 := &mockWire{}
-	w1.On("SendUnchoke").Return(nil)
-	w2 := &mockWire{}
-	w3 := &mockWire{}
-	w3.On("SendUnchoke").Return(nil)
-	w4 := &mockWire{}
-	w4.On("SendChoke").Return(nil)
+	pm.On("GetPeerList").Return(peers)
+	pieceMgr := &mockPieceManager{}
+	pieceMgr.On("GetPiecesDownloaded").Return(piecesDownloaded)
+	s := &mockStats{}
+	s.On("GetPeerStats").Return(peerStats)
 
+	c := NewChoke(pm, pieceMgr, s, make(chan int)).(*choke)
+	c.torrent = &torrent.Torrent{NumPieces: 10}
+	return c
+}
+
+func TestChoke(t *testing.T) {
 	lastPiece := time.Now().Unix()
 
-	pm.On("GetPeerList").Return([]*PeerInfo{
-		&PeerInfo{
-			id:   "0.0.0.0",
-			wire: w1,
-			state: connState{
-				peerInterested: true,
-				clientChoking:  true,
-			},
-			lastPiece: lastPiece,
-			speed:     10,
-		},
-		&PeerInfo{
-			id:   "0.0.0.1",
-			wire: w2,
-			state: connState{
-				peerInterested: true,
-				clientChoking:  false,
-			},
-			lastPiece: lastPiece,
-			speed:     20,
-		},
-		&PeerInfo{
-			id:   "0.0.0.2",
-			wire: w3,
-			state: connState{
-				peerInterested: false,
-				clientChoking:  true,
-			},
-			lastPiece: lastPiece,
-			speed:     15,
-		},
-		&PeerInfo{
-			id:   "0.0.0.3",
-			wire: w4,
-			state: connState{
-				peerInterested: false,
-				clientChoking:  false,
-			},
-			lastPiece: lastPiece,
-			speed:     5,
-		},
-	})
-
-	quit := make(chan int)
-	newChoke(pm, quit)
-	<-time.After(time.Duration(2) * time.Second)
-	close(quit)
-	pm.AssertExpectations(t)
-	w1.AssertExpectations(t)
-	w2.AssertExpectations(t)
-	w3.AssertExpectations(t)
-	w4.AssertExpectations(t)
+	p1 := newMockPeer("0.0.0.0", connState{peerInterested: true, clientChoking: true}, lastPiece)
+	p1.On("SendUnchoke").Return().Once()
+	p2 := newMockPeer("0.0.0.1", connState{peerInterested: true, clientChoking: false}, lastPiece)
+	p3 := newMockPeer("0.0.0.2", connState{peerInterested: false, clientChoking: true}, lastPiece)
+	p3.On("SendUnchoke").Return().Once()
+	p4 := newMockPeer("0.0.0.3", connState{peerInterested: false, clientChoking: false}, lastPiece)
+	p4.On("SendChoke").Return().Once()
+
+	c := newTestChoke([]Peer{p1, p2, p3, p4}, map[string]*stats.PeerStat{
+		"0.0.0.0": &stats.PeerStat{UploadRate: 10},
+		"0.0.0.1": &stats.PeerStat{UploadRate: 20},
+		"0.0.0.2": &stats.PeerStat{UploadRate: 15},
+		"0.0.0.3": &stats.PeerStat{UploadRate: 5},
+	}, 0)
+	// 2 regular slots and an optimistic unchoke
+	c.SetUploadSlots(3)
+	c.choke()
+
+	p1.AssertExpectations(t)
+	p2.AssertExpectations(t)
+	p3.AssertExpectations(t)
+	p4.AssertExpectations(t)
+}
+
+func TestSeedingRoundRobin(t *testing.T) {
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	randIntn = func(n int) int { return 0 }
+	defer func() {
+		timeNow = time.Now
+		randIntn = rand.Intn
+	}()
+
+	// unchoked for longer than the round-robin period
+	p1 := newMockPeer("0.0.0.0", connState{peerInterested: true, clientChoking: false}, 0)
+	p1.On("SendChoke").Return().Once()
+	// never unchoked
+	p2 := newMockPeer("0.0.0.1", connState{peerInterested: true, clientChoking: true}, 0)
+	p2.On("SendUnchoke").Return().Once()
+	// unchoked the longest ago
+	p3 := newMockPeer("0.0.0.2", connState{peerInterested: true, clientChoking: true}, 0)
+	p3.On("SendUnchoke").Return().Once()
+
+	c := newTestChoke([]Peer{p1, p2, p3}, map[string]*stats.PeerStat{
+		"0.0.0.0": &stats.PeerStat{DownloadRate: 100},
+	}, 10)
+	c.lastUnchoked["0.0.0.0"] = now.Add(-40 * time.Second)
+	c.lastUnchoked["0.0.0.2"] = now.Add(-100 * time.Second)
+	// a regular slot and an optimistic unchoke
+	c.SetUploadSlots(2)
+	c.choke()
+
+	assert.True(t, c.seeding)
+	assert.Equal(t, "0.0.0.2", c.optimistic)
+	p1.AssertExpectations(t)
+	p2.AssertExpectations(t)
+	p3.AssertExpectations(t)
+}
+
+func TestOptimisticUnchokeRotation(t *testing.T) {
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	defer func() {
+		timeNow = time.Now
+		randIntn = rand.Intn
+	}()
+
+	peers := []Peer{}
+	for _, id := range []string{"0.0.0.0", "0.0.0.1", "0.0.0.2"} {
+		p := newMockPeer(id, connState{peerInterested: true, clientChoking: true}, now.Unix())
+		p.On("SendUnchoke").Return()
+		peers = append(peers, p)
+	}
+	c := newTestChoke(peers, map[string]*stats.PeerStat{
+		"0.0.0.0": &stats.PeerStat{UploadRate: 100},
+	}, 0)
+	c.SetUploadSlots(2)
+
+	randIntn = func(n int) int { return 0 }
+	c.choke()
+	assert.Equal(t, "0.0.0.1", c.optimistic)
+
+	// optimistic unchoke is kept until OPTIMISTIC_UNCHOKE_INTERVAL has passed
+	randIntn = func(n int) int { return n - 1 }
+	for i := 1; i < OPTIMISTIC_UNCHOKE_INTERVAL/CHOKE_INTERVAL; i++ {
+		now = now.Add(CHOKE_INTERVAL * time.Second)
+		c.choke()
+		assert.Equal(t, "0.0.0.1", c.optimistic)
+	}
+	now = now.Add(CHOKE_INTERVAL * time.Second)
+	c.choke()
+	assert.Equal(t, "0.0.0.2", c.optimistic)
+}
+
+func TestPickOptimisticNewPeers(t *testing.T) {
+	now := time.Now()
+	defer func() {
+		randIntn = rand.Intn
+	}()
+
+	c := newTestChoke([]Peer{}, map[string]*stats.PeerStat{}, 0)
+	c.connected["old"] = now.Add(-5 * time.Minute)
+	c.connected["new"] = now
+	peerInfos := []*PeerInfo{&PeerInfo{ID: "old"}, &PeerInfo{ID: "new"}}
+
+	picks := map[string]int{}
+	for r := 0; r < 1+NEW_PEER_WEIGHT; r++ {
+		randIntn = func(n int) int {
+			assert.Equal(t, 1+NEW_PEER_WEIGHT, n)
+			return r
+		}
+		picks[c.pickOptimistic(peerInfos, now).ID]++
+	}
+	assert.Equal(t, 1, picks["old"])
+	assert.Equal(t, NEW_PEER_WEIGHT, picks["new"])
+}
+
+func TestUploadSlots(t *testing.T) {
+	c := newTestChoke([]Peer{}, map[string]*stats.PeerStat{}, 0)
+	assert.Equal(t, DOWNLOADERS, c.uploadSlots())
+
+	c.SetUploadCapacity(100 * 1024)
+	assert.Equal(t, 20, c.uploadSlots())
+	c.SetUploadCapacity(1024)
+	assert.Equal(t, MIN_UPLOAD_SLOTS, c.uploadSlots())
+	c.SetUploadCapacity(100 * 1024 * 1024)
+	assert.Equal(t, MAX_UPLOAD_SLOTS, c.uploadSlots())
+
+	c.SetUploadSlots(8)
+	assert.Equal(t, 8, c.uploadSlots())
 }
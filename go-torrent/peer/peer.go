@@ -43,6 +43,7 @@ type peer struct {
 	torrent               *torrent.Torrent
 	peerMgr               PeerManager
 	pieceMgr              piece.PieceManager
+	superSeed             SuperSeed
 	mdMgr                 piece.MetadataManager
 	wire                  wire.Wire
 	stats                 stats.Stats
@@ -51,6 +52,9 @@ type peer struct {
 	lastPiece             int64
 	lastMessageSent       time.Time
 	blockRecieved         bool
+	// Info-hash of the peer's swarm, and of every swarm of the torrent
+	infoHash   []byte
+	infoHashes [][]byte
 }
 
 type connState struct {
@@ -68,6 +72,7 @@ func NewPeer(
 	storage storage.Storage,
 	peerMgr PeerManager,
 	pieceMgr piece.PieceManager,
+	superSeed SuperSeed,
 	stats stats.Stats) *peer {
 
 	peer := &peer{
@@ -78,6 +83,7 @@ func NewPeer(
 		storage:               storage,
 		peerMgr:               peerMgr,
 		pieceMgr:              pieceMgr,
+		superSeed:             superSeed,
 		stats:                 stats,
 		readRequestCancelChan: make(map[string]chan int),
 		state: connState{
@@ -134,15 +140,22 @@ func (p *peer) Stop(err error, preFunc func(), restart bool) bool {
 		}
 		p.peerMgr.RemovePeer(p.id)
 		p.pieceMgr.PeerStopped(p.id, p.peerBitfield)
+		if p.superSeeding() {
+			p.superSeed.PeerStopped(p.id)
+		}
 		if restart {
 			fmt.Println("restarting peer")
-			p.peerMgr.AddPeer(p.id, nil)
+			p.peerMgr.ReconnectPeer(p.id)
 		}
 		return true
 	}
 	return false
 }
 
+func (p *peer) superSeeding() bool {
+	return p.superSeed != nil && p.superSeed.Active()
+}
+
 func (p *peer) GetPeerInfo() (string, connState, int64) {
 	return p.id, p.state, p.lastPiece
 }
@@ -153,6 +166,10 @@ func (p *peer) StartDownloading(tor *torrent.Torrent) {
 }
 
 func (p *peer) checkInterestForPeer() {
+	if p.pieceMgr.GetPiecesDownloaded() == p.torrent.NumPieces {
+		// Client is seeding, there's nothing to be interested in
+		return
+	}
 	// If client doesn't have piece in peer bitfield, become interested
 	clientBitField := p.pieceMgr.GetBitField()
 	for pieceIndex := 0; pieceIndex < p.torrent.NumPieces; pieceIndex++ {
@@ -194,10 +211,14 @@ func (p *peer) Start() {
 		p.wire = newWire(conn.(*net.TCPConn), time.Duration(time.Minute*2))
 	}
 
-	// send handshake
-	err := p.wire.SendHandshake(19, "BitTorrent protocol", p.torrent.InfoHash, torrent.PEER_ID)
-	if p.Stop(err, nil, false) {
-		return
+	// Incoming connections are answered with the info-hash of their
+	// handshake, the swarm they're from
+	incoming := p.infoHash == nil
+	if !incoming {
+		err := p.wire.SendHandshake(19, "BitTorrent protocol", p.infoHash, torrent.PEER_ID)
+		if p.Stop(err, nil, false) {
+			return
+		}
 	}
 
 	// recieve handshake
@@ -208,10 +229,17 @@ func (p *peer) Start() {
 	if !p.closed &&
 		(length != 19 ||
 			protocol != "BitTorrent protocol" ||
-			!bytes.Equal(infoHash, p.torrent.InfoHash)) {
+			!p.validInfoHash(infoHash)) {
 		p.Stop(fmt.Errorf("Malformed handshake"), nil, false)
 		return
 	}
+	if incoming {
+		p.infoHash = infoHash
+		err := p.wire.SendHandshake(19, "BitTorrent protocol", p.infoHash, torrent.PEER_ID)
+		if p.Stop(err, nil, false) {
+			return
+		}
+	}
 
 	if p.torrent == nil && reservedBytes[5]&0x10 > 0 {
 		p.wire.SendExtended()
@@ -234,10 +262,20 @@ func (p *peer) Start() {
 
 	// send bitfield
 	bitfield := p.pieceMgr.GetBitField()
+	if p.superSeeding() {
+		// Pose as a peer without any pieces, pieces are revealed one at a time
+		bitfield = make([]byte, len(bitfield))
+	}
 	err3 := p.wire.SendBitField(bitfield)
 	if p.Stop(err3, nil, false) {
 		return
 	}
+	if p.superSeeding() {
+		err := p.superSeed.OfferPiece(p.id, p.wire)
+		if p.Stop(err, nil, false) {
+			return
+		}
+	}
 
 	// handle all subsequent messages
 	for {
@@ -254,6 +292,24 @@ func (p *peer) Start() {
 	}
 }
 
+// The info-hash of the peer's handshake is the one it was sent, or for
+// incoming connections that of one of the torrent's swarms
+func (p *peer) validInfoHash(infoHash []byte) bool {
+	if p.infoHash != nil {
+		return bytes.Equal(infoHash, p.infoHash)
+	}
+	infoHashes := p.infoHashes
+	if len(infoHashes) == 0 && p.torrent != nil {
+		infoHashes = p.torrent.InfoHashes()
+	}
+	for _, h := range infoHashes {
+		if bytes.Equal(infoHash, h) {
+			return true
+		}
+	}
+	return false
+}
+
 func (p *peer) decodeMessage(messageID uint8, payload *bytes.Buffer) {
 	switch messageID {
 	case wire.EXTENDED:
@@ -326,10 +382,19 @@ func (p *peer) decodeMessage(messageID uint8, payload *bytes.Buffer) {
 	case wire.NOT_INTERESTED:
 		p.state.peerInterested = false
 	case wire.HAVE:
-		var pieceIndex int
-		binary.Read(payload, binary.BigEndian, &pieceIndex)
+		var pi int32
+		binary.Read(payload, binary.BigEndian, &pi)
+		pieceIndex := int(pi)
+		if p.peerBitfield == nil && p.torrent != nil {
+			// Peers without any pieces may not send a bitfield
+			bitfield := bitmap.New(p.torrent.NumPieces)
+			p.peerBitfield = &bitfield
+		}
 		p.pieceMgr.PieceHave(p.id, pieceIndex)
 		p.peerBitfield.Set(pieceIndex, true)
+		if p.superSeeding() {
+			p.superSeed.PieceHave(p.id, pieceIndex)
+		}
 
 		// If client doesn't have piece, become interested
 		if p.torrent != nil {
@@ -348,6 +413,9 @@ func (p *peer) decodeMessage(messageID uint8, payload *bytes.Buffer) {
 			if havePiece {
 				p.peerBitfield.Set(pieceIndex, true)
 				p.pieceMgr.PieceHave(p.id, pieceIndex)
+				if p.superSeeding() {
+					p.superSeed.PieceHave(p.id, pieceIndex)
+				}
 			}
 		}
 		fmt.Println("peer: ", p.id, " bitfield: ", p.peerBitfield)
@@ -358,12 +426,15 @@ func (p *peer) decodeMessage(messageID uint8, payload *bytes.Buffer) {
 	case wire.REQUEST:
 		fmt.Print("REQUEST")
 		if !p.state.clientChoking && p.state.peerInterested {
-			var pieceIndex int
-			binary.Read(payload, binary.BigEndian, &pieceIndex)
-			var blockByteOffset int
-			binary.Read(payload, binary.BigEndian, &blockByteOffset)
-			var length int
-			binary.Read(payload, binary.BigEndian, &length)
+			var pi, bbo, l int32
+			binary.Read(payload, binary.BigEndian, &pi)
+			binary.Read(payload, binary.BigEndian, &bbo)
+			binary.Read(payload, binary.BigEndian, &l)
+			pieceIndex, blockByteOffset, length := int(pi), int(bbo), int(l)
+			if p.superSeeding() && !p.superSeed.CanUpload(p.id, pieceIndex) {
+				// Piece hasn't been revealed to the peer
+				return
+			}
 
 			requestID := strconv.Itoa(pieceIndex) + strconv.Itoa(blockByteOffset) + strconv.Itoa(length)
 			quit := make(chan int)
@@ -405,18 +476,22 @@ func (p *peer) decodeMessage(messageID uint8, payload *bytes.Buffer) {
 			blockIndex := blockByteOffset / piece.BLOCK_SIZE
 			fmt.Println("PEER:", p.id, "PIECE", pieceIndex, "BLOCK", blockIndex)
 			go func() {
-				downloadedPiece, peers, err := p.pieceMgr.WriteBlock(p.id, pieceIndex, blockIndex, blockData)
-				if p.Stop(err, func() {
-					if downloadedPiece && peers != nil {
-						p.peerMgr.BanPeers(peers)
-					}
-				}, false) {
+				downloadedPiece, bannedPeers, err := p.pieceMgr.WriteBlock(p.id, pieceIndex, blockIndex, blockData)
+				if p.Stop(err, nil, false) {
 					return
 				}
+				if bannedPeers != nil {
+					// Peers that sent corrupt blocks
+					p.peerMgr.BanPeers(bannedPeers)
+				}
 				if downloadedPiece {
 					p.peerMgr.BroadcastHave(pieceIndex)
 				}
 				p.stats.UpdatePeer(p.id, blockLength, 0)
+				if diskIO, ok := p.storage.(storage.DiskIO); ok {
+					// Stop requesting blocks while the disk falls behind
+					diskIO.WaitWritable()
+				}
 				p.pieceMgr.SendBlockRequests(p.id, p.wire, p.peerBitfield)
 			}()
 			p.lastPiece = time.Now().Unix()
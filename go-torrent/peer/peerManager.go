@@ -1,11 +1,13 @@
 package peer
 
 import (
+	"bytes"
 	"fmt"
 	"net"
 	"sync"
 	"time"
 
+	"github.com/Charana123/torrent/go-torrent/ipfilter"
 	"github.com/Charana123/torrent/go-torrent/stats"
 	"github.com/Charana123/torrent/go-torrent/storage"
 	"github.com/Charana123/torrent/go-torrent/wire"
@@ -20,11 +22,27 @@ const (
 	PEER_TIMEOUT = 120
 )
 
+// Sources of peers, see AddPeer
+const (
+	PEER_SOURCE_TRACKER  = 0
+	PEER_SOURCE_INCOMING = 1
+	PEER_SOURCE_MAGNET   = 2
+	PEER_SOURCE_DHT      = 3
+	PEER_SOURCE_PEX      = 4
+	PEER_SOURCE_LSD      = 5
+)
+
 type PeerManager interface {
-	AddPeer(id string, conn net.Conn)
+	// infoHash is of the swarm the peer was found in, it's sent in the
+	// handshake. nil for incoming connections, whose handshake gives it, and
+	// for the first swarm.
+	AddPeer(id string, conn net.Conn, source int, infoHash []byte)
+	ReconnectPeer(id string)
 	RemovePeer(id string)
 	GetPeerList() []Peer
 	StopPeers()
+	// Stops the peers the trackers of the swarm with the info-hash added
+	StopTrackerPeers(infoHash []byte)
 	BroadcastHave(pieceIndex int)
 	BanPeers(peers mapset.Set)
 	BanPeerThisInterval(id string)
@@ -37,43 +55,79 @@ type peerManager struct {
 	torrent                 *torrent.Torrent
 	mdMgr                   piece.MetadataManager
 	pieceMgr                piece.PieceManager
+	superSeed               SuperSeed
 	storage                 storage.Storage
 	stats                   stats.Stats
+	ipFilter                ipfilter.IPFilter
 	peers                   map[string]Peer
+	peerSources             map[string]int
 	numPeers                int
 	maxPeers                int
 	bannedPeers             mapset.Set
 	peersBannedThisInterval mapset.Set
+	// Info-hashes of the swarms the torrent is part of (hybrid torrents are
+	// part of two), and the swarm of each peer
+	infoHashes     [][]byte
+	peerInfoHashes map[string][]byte
 }
 
 func NewPeerManager(
 	torrent *torrent.Torrent,
 	pieceMgr piece.PieceManager,
+	superSeed SuperSeed,
 	mdMgr piece.MetadataManager,
 	storage storage.Storage,
-	stats stats.Stats) PeerManager {
+	stats stats.Stats,
+	ipFilter ipfilter.IPFilter,
+	infoHashes [][]byte) PeerManager {
 
 	return &peerManager{
 		torrent:                 torrent,
 		mdMgr:                   mdMgr,
 		pieceMgr:                pieceMgr,
+		superSeed:               superSeed,
 		storage:                 storage,
 		stats:                   stats,
+		ipFilter:                ipFilter,
 		peers:                   make(map[string]Peer),
+		peerSources:             make(map[string]int),
 		bannedPeers:             mapset.NewSet(),
 		peersBannedThisInterval: mapset.NewSet(),
 		maxPeers:                100,
+		infoHashes:              infoHashes,
+		peerInfoHashes:          make(map[string][]byte),
 	}
 }
 
 func (pm *peerManager) Init(tor *torrent.Torrent) {
 	pm.Lock()
-	defer pm.Unlock()
-
 	pm.torrent = tor
-	for _, peer := range pm.peers {
+	disallowedPeers := []Peer{}
+	for id, peer := range pm.peers {
+		if !PeerSourceAllowed(tor, pm.peerSources[id]) {
+			// Peers of magnet links are found before the torrent is known
+			// to be private
+			disallowedPeers = append(disallowedPeers, peer)
+			continue
+		}
 		peer.StartDownloading(pm.torrent)
 	}
+	pm.Unlock()
+
+	for _, peer := range disallowedPeers {
+		peer.Stop(fmt.Errorf("Private torrent, peer not from a tracker"), nil, false)
+	}
+}
+
+// PeerSourceAllowed reports whether peers from the source may be used for
+// the torrent. Private torrents (BEP 0027) only get peers from their own
+// trackers, they aren't announced to or looked up in the DHT, PEX or LSD.
+// Incoming connections are accepted, their peers found us through the trackers.
+func PeerSourceAllowed(tor *torrent.Torrent, source int) bool {
+	if tor == nil || !tor.IsPrivate() {
+		return true
+	}
+	return source == PEER_SOURCE_TRACKER || source == PEER_SOURCE_INCOMING
 }
 
 func (pm *peerManager) BanPeerThisInterval(id string) {
@@ -92,9 +146,19 @@ func (pm *peerManager) NewInterval() {
 
 func (pm *peerManager) BanPeers(peers mapset.Set) {
 	pm.Lock()
-	defer pm.Unlock()
+	pm.bannedPeers = pm.bannedPeers.Union(peers)
+	connectedPeers := []Peer{}
+	for id := range peers.Iter() {
+		if peer, ok := pm.peers[id.(string)]; ok {
+			connectedPeers = append(connectedPeers, peer)
+		}
+	}
+	pm.Unlock()
 
-	pm.bannedPeers.Union(peers)
+	// Disconnect banned peers, outside the lock as stopping a peer removes it
+	for _, peer := range connectedPeers {
+		peer.Stop(fmt.Errorf("Peer banned"), nil, false)
+	}
 }
 
 func (pm *peerManager) BroadcastHave(pieceIndex int) {
@@ -110,10 +174,23 @@ func (pm *peerManager) BroadcastHave(pieceIndex int) {
 }
 
 func (pm *peerManager) StopPeers() {
+	// Stopping a peer removes it, peers are stopped outside the lock
+	for _, peer := range pm.GetPeerList() {
+		peer.Stop(fmt.Errorf("Peer gracefully shutdown"), nil, false)
+	}
+}
+
+func (pm *peerManager) StopTrackerPeers(infoHash []byte) {
 	pm.RLock()
-	defer pm.RUnlock()
+	peers := []Peer{}
+	for id, peer := range pm.peers {
+		if pm.peerSources[id] == PEER_SOURCE_TRACKER && bytes.Equal(pm.peerInfoHashes[id], infoHash) {
+			peers = append(peers, peer)
+		}
+	}
+	pm.RUnlock()
 
-	for _, peer := range pm.peers {
+	for _, peer := range peers {
 		peer.Stop(fmt.Errorf("Peer gracefully shutdown"), nil, false)
 	}
 }
@@ -129,16 +206,51 @@ func (pm *peerManager) GetPeerList() []Peer {
 	return peers
 }
 
-func (pm *peerManager) AddPeer(id string, conn net.Conn) {
+var startPeer = func(peer Peer) {
+	go peer.Start()
+}
+
+func (pm *peerManager) AddPeer(id string, conn net.Conn, source int, infoHash []byte) {
+	pm.Lock()
+	defer pm.Unlock()
+
+	pm.addPeer(id, conn, source, infoHash)
+}
+
+// Reconnects to a stopped peer, e.g. one that choked us while we were interested
+func (pm *peerManager) ReconnectPeer(id string) {
 	pm.Lock()
 	defer pm.Unlock()
 
+	source, ok := pm.peerSources[id]
+	if !ok {
+		return
+	}
+	pm.addPeer(id, nil, source, pm.peerInfoHashes[id])
+}
+
+func (pm *peerManager) addPeer(id string, conn net.Conn, source int, infoHash []byte) {
+	if !PeerSourceAllowed(pm.torrent, source) {
+		if conn != nil {
+			conn.Close()
+		}
+		return
+	}
 	if pm.bannedPeers.Contains(id) || pm.peersBannedThisInterval.Contains(id) {
 		// Peer has been banned
 		return
 	}
-	if pm.numPeers > pm.maxPeers {
-		// Connected to too many peers
+	if pm.ipFilter != nil && pm.ipFilter.Blocked(peerIP(id)) {
+		// Peer is blocklisted, every peer source (trackers, incoming
+		// connections, PEX, DHT, LSD) adds peers through here
+		if conn != nil {
+			conn.Close()
+		}
+		return
+	}
+	if pm.numPeers > pm.maxPeers && source != PEER_SOURCE_LSD {
+		// Connected to too many peers, peers on the local network are
+		// connected to regardless as they're the fastest to download from
 		return
 	}
 	if _, ok := pm.peers[id]; ok {
@@ -158,11 +270,28 @@ func (pm *peerManager) AddPeer(id string, conn net.Conn) {
 		pm.storage,
 		pm,
 		pm.pieceMgr,
+		pm.superSeed,
 		pm.stats,
 	)
+	if infoHash == nil && conn == nil && len(pm.infoHashes) > 0 {
+		infoHash = pm.infoHashes[0]
+	}
+	peer.infoHash = infoHash
+	peer.infoHashes = pm.infoHashes
 	pm.peers[id] = peer
+	pm.peerSources[id] = source
+	pm.peerInfoHashes[id] = infoHash
 	pm.numPeers++
-	go peer.Start()
+	startPeer(peer)
+}
+
+func peerIP(id string) net.IP {
+	host, _, err := net.SplitHostPort(id)
+	if err != nil {
+		// Incoming connections are identified by IP only
+		host = id
+	}
+	return net.ParseIP(host)
 }
 
 func (pm *peerManager) RemovePeer(id string) {
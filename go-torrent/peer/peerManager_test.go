@@ -1 +1,30 @@
 package peer
+
+import (
+	"testing"
+)
+
+func TestStopTrackerPeers(t *testing.T) {
+	infoHashV1 := []byte("v1")
+	infoHashV2 := []byte("v2")
+	pm := NewPeerManager(nil, nil, nil, nil, nil, nil, nil, [][]byte{infoHashV1, infoHashV2}).(*peerManager)
+	peers := map[string]*mockPeer{}
+	addPeer := func(id string, source int, infoHash []byte) {
+		peers[id] = &mockPeer{}
+		pm.peers[id] = peers[id]
+		pm.peerSources[id] = source
+		pm.peerInfoHashes[id] = infoHash
+	}
+	addPeer("tracker", PEER_SOURCE_TRACKER, infoHashV1)
+	addPeer("otherSwarm", PEER_SOURCE_TRACKER, infoHashV2)
+	addPeer("incoming", PEER_SOURCE_INCOMING, nil)
+	addPeer("lsd", PEER_SOURCE_LSD, infoHashV1)
+	peers["tracker"].On("Stop")
+
+	// Only the peers of the swarm's trackers are dropped
+	pm.StopTrackerPeers(infoHashV1)
+	peers["tracker"].AssertExpectations(t)
+	for _, id := range []string{"otherSwarm", "incoming", "lsd"} {
+		peers[id].AssertNotCalled(t, "Stop")
+	}
+}
@@ -1,6 +1,7 @@
 package peer
 
 import (
+	"bytes"
 	"errors"
 	"net"
 	"testing"
@@ -25,9 +26,9 @@ func (m *mockWire) SendHandshake(length uint8, protocol string, infohash []byte,
 	return args.Error(0)
 }
 
-func (m *mockWire) ReadHandshake() (uint8, string, []byte, []byte, error) {
+func (m *mockWire) ReadHandshake() (uint8, string, []byte, []byte, []byte, error) {
 	args := m.Called()
-	return args.Get(0).(uint8), args.String(1), args.Get(2).([]byte), args.Get(3).([]byte), args.Error(4)
+	return args.Get(0).(uint8), args.String(1), args.Get(2).([]byte), args.Get(3).([]byte), args.Get(4).([]byte), args.Error(5)
 }
 
 func (m *mockWire) SendBitField(bitfield []byte) error {
@@ -35,9 +36,9 @@ func (m *mockWire) SendBitField(bitfield []byte) error {
 	return args.Error(0)
 }
 
-func (m *mockWire) ReadMessage() (int, byte, []byte, error) {
+func (m *mockWire) ReadMessage() (int32, byte, []byte, error) {
 	args := m.Called()
-	return args.Int(0), args.Get(1).(byte), args.Get(2).([]byte), args.Error(3)
+	return args.Get(0).(int32), args.Get(1).(byte), args.Get(2).([]byte), args.Error(3)
 }
 
 func (m *mockWire) Close() {
@@ -60,7 +61,7 @@ func (m *mockPieceManager) PeerStopped(id string, peerBitfield *bitmap.Bitmap) {
 
 func preFunc(t *testing.T) (*torrent.Torrent, *mockPieceManager, *mockWire) {
 	mockWire := &mockWire{}
-	newWire = func(conn net.Conn) wire.Wire {
+	newWire = func(conn *net.TCPConn, timeoutDuration time.Duration) wire.Wire {
 		return mockWire
 	}
 
@@ -78,6 +79,7 @@ func preFunc(t *testing.T) (*torrent.Torrent, *mockPieceManager, *mockWire) {
 	mockWire.On("ReadHandshake").Return(
 		uint8(19),
 		"BitTorrent protocol",
+		make([]byte, 8),
 		tor.InfoHash,
 		([]uint8)(nil),
 		nil)
@@ -104,7 +106,7 @@ func TestPeerDisconnect(t *testing.T) {
 	tor, mockPieceMgr, mockWire := preFunc(t)
 
 	connSIG := make(chan time.Time)
-	mockWire.On("ReadMessage").WaitUntil(connSIG).Return(0, byte(0), ([]uint8)(nil), errors.New(""))
+	mockWire.On("ReadMessage").WaitUntil(connSIG).Return(int32(0), byte(0), ([]uint8)(nil), errors.New(""))
 
 	peerID := "0.0.0.0"
 	mockPeerMgr := &mockPeerManager{}
@@ -113,14 +115,17 @@ func TestPeerDisconnect(t *testing.T) {
 	mockPieceMgr.On("PeerStopped", peerID, (*bitmap.Bitmap)(nil)).Return()
 
 	mockWire.On("Close").Return()
-	NewPeer(
+	go NewPeer(
 		peerID,
 		mockWire,
 		tor,
 		nil,
+		nil,
 		mockPeerMgr,
 		mockPieceMgr,
-	)
+		nil,
+		nil,
+	).Start()
 	<-time.After(time.Second)
 	close(connSIG)
 	<-time.After(time.Second)
@@ -128,3 +133,33 @@ func TestPeerDisconnect(t *testing.T) {
 	mockPieceMgr.AssertExpectations(t)
 	mockPeerMgr.AssertExpectations(t)
 }
+
+// Peers are sent the info-hash of the swarm they were found in, incoming
+// connections are answered with the info-hash of their handshake
+func TestHandshakeInfoHash(t *testing.T) {
+	v1InfoHash := bytes.Repeat([]byte{1}, 20)
+	v2InfoHash := bytes.Repeat([]byte{2}, 20)
+	for _, incoming := range []bool{false, true} {
+		mockWire := &mockWire{}
+		mockWire.On("SendHandshake", uint8(19), "BitTorrent protocol", v2InfoHash, torrent.PEER_ID).Return(nil).Once()
+		mockWire.On("ReadHandshake").Return(uint8(19), "BitTorrent protocol", make([]byte, 8), v2InfoHash, ([]uint8)(nil), nil)
+		mockWire.On("SendBitField", []byte{}).Return(nil)
+		mockWire.On("ReadMessage").Return(int32(0), byte(0), ([]uint8)(nil), errors.New(""))
+		mockWire.On("Close").Return()
+		mockPieceMgr := &mockPieceManager{}
+		mockPieceMgr.On("GetBitField").Return([]byte{})
+		mockPieceMgr.On("PeerStopped", "0.0.0.0", (*bitmap.Bitmap)(nil)).Return()
+		mockPeerMgr := &mockPeerManager{}
+		mockPeerMgr.On("RemovePeer", "0.0.0.0").Return()
+
+		// The torrent of a magnet link isn't known yet
+		p := NewPeer("0.0.0.0", mockWire, nil, nil, nil, mockPeerMgr, mockPieceMgr, nil, nil)
+		p.infoHashes = [][]byte{v1InfoHash, v2InfoHash}
+		if !incoming {
+			p.infoHash = v2InfoHash
+		}
+		p.Start()
+		mockWire.AssertExpectations(t)
+		mockPieceMgr.AssertExpectations(t)
+	}
+}
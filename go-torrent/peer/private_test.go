@@ -0,0 +1,73 @@
+package peer
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/Charana123/torrent/go-torrent/torrent"
+	"github.com/stretchr/testify/assert"
+)
+
+func (m *mockPeer) Stop(err error, preFunc func(), restart bool) bool {
+	m.Called()
+	return true
+}
+
+func (m *mockPeer) StartDownloading(tor *torrent.Torrent) {
+	m.Called(tor)
+}
+
+func newPrivateTorrent() *torrent.Torrent {
+	return &torrent.Torrent{MetaInfo: torrent.MetaInfo{Info: torrent.Info{Private: 1}}}
+}
+
+func addPeerFromEverySource(tor *torrent.Torrent) []string {
+	pm := NewPeerManager(tor, nil, nil, nil, nil, nil, nil, nil)
+	sources := []int{PEER_SOURCE_TRACKER, PEER_SOURCE_INCOMING, PEER_SOURCE_MAGNET,
+		PEER_SOURCE_DHT, PEER_SOURCE_PEX, PEER_SOURCE_LSD}
+	for _, source := range sources {
+		pm.AddPeer(fmt.Sprintf("10.0.0.%d:6881", source), nil, source, nil)
+	}
+	ids := []string{}
+	for _, peer := range pm.GetPeerList() {
+		id, _, _ := peer.GetPeerInfo()
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestPrivatePeerSources(t *testing.T) {
+	start := startPeer
+	defer func() { startPeer = start }()
+	startPeer = func(peer Peer) {}
+
+	// Only the torrent's trackers and incoming connections are peer sources
+	ids := addPeerFromEverySource(newPrivateTorrent())
+	assert.ElementsMatch(t, []string{
+		fmt.Sprintf("10.0.0.%d:6881", PEER_SOURCE_TRACKER),
+		fmt.Sprintf("10.0.0.%d:6881", PEER_SOURCE_INCOMING),
+	}, ids)
+
+	ids = addPeerFromEverySource(&torrent.Torrent{})
+	assert.Len(t, ids, 6)
+}
+
+func TestPrivateMagnetPeersDropped(t *testing.T) {
+	tor := newPrivateTorrent()
+	trackerPeer := &mockPeer{}
+	trackerPeer.On("StartDownloading", tor)
+	magnetPeer := &mockPeer{}
+	magnetPeer.On("Stop")
+
+	pm := NewPeerManager(nil, nil, nil, nil, nil, nil, nil, nil).(*peerManager)
+	pm.peers["tracker"] = trackerPeer
+	pm.peerSources["tracker"] = PEER_SOURCE_TRACKER
+	pm.peers["magnet"] = magnetPeer
+	pm.peerSources["magnet"] = PEER_SOURCE_MAGNET
+
+	// The torrent is known to be private once the metadata is downloaded
+	pm.Init(tor)
+	trackerPeer.AssertExpectations(t)
+	magnetPeer.AssertExpectations(t)
+	magnetPeer.AssertNotCalled(t, "StartDownloading", tor)
+}
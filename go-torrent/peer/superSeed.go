@@ -0,0 +1,176 @@
+package peer
+
+import (
+	"sync"
+
+	"github.com/Charana123/torrent/go-torrent/torrent"
+	"github.com/Charana123/torrent/go-torrent/wire"
+	bitmap "github.com/boljen/go-bitmap"
+)
+
+// BEP 0016 - Superseeding
+// The seed advertises an empty bitfield and reveals a single piece to each
+// peer with a HAVE message. A peer is only offered another piece once the
+// piece it was given is seen at another peer (through that peer's HAVE
+// messages) i.e. the peer has passed it on to the swarm.
+type SuperSeed interface {
+	Init(tor *torrent.Torrent)
+	Active() (active bool)
+	OfferPiece(id string, wire wire.Wire) (err error)
+	PieceHave(id string, pieceIndex int)
+	CanUpload(id string, pieceIndex int) (canUpload bool)
+	PeerStopped(id string)
+}
+
+type superSeed struct {
+	sync.Mutex
+	tor          *torrent.Torrent
+	peers        map[string]*superSeedPeer
+	availability []int
+	offers       []int
+}
+
+type superSeedPeer struct {
+	wire      wire.Wire
+	bitfield  bitmap.Bitmap
+	announced bitmap.Bitmap
+	piece     int
+	uploading bool
+}
+
+func NewSuperSeed() SuperSeed {
+	return &superSeed{
+		peers: make(map[string]*superSeedPeer),
+	}
+}
+
+// Init activates superseeding, the client must have every piece of the torrent
+func (ss *superSeed) Init(tor *torrent.Torrent) {
+	ss.Lock()
+	defer ss.Unlock()
+
+	ss.tor = tor
+	ss.availability = make([]int, tor.NumPieces)
+	ss.offers = make([]int, tor.NumPieces)
+}
+
+func (ss *superSeed) Active() bool {
+	ss.Lock()
+	defer ss.Unlock()
+	return ss.tor != nil
+}
+
+func (ss *superSeed) getPeer(id string) *superSeedPeer {
+	p, ok := ss.peers[id]
+	if !ok {
+		p = &superSeedPeer{
+			bitfield:  bitmap.New(ss.tor.NumPieces),
+			announced: bitmap.New(ss.tor.NumPieces),
+			piece:     -1,
+		}
+		ss.peers[id] = p
+	}
+	return p
+}
+
+// Choose the piece the peer doesn't have that is offered to the fewest peers,
+// breaking ties by rarity in the swarm
+func (ss *superSeed) pickPiece(p *superSeedPeer) int {
+	piece := -1
+	for pieceIndex := 0; pieceIndex < ss.tor.NumPieces; pieceIndex++ {
+		if p.bitfield.Get(pieceIndex) || p.announced.Get(pieceIndex) {
+			continue
+		}
+		if piece == -1 ||
+			ss.offers[pieceIndex] < ss.offers[piece] ||
+			ss.offers[pieceIndex] == ss.offers[piece] && ss.availability[pieceIndex] < ss.availability[piece] {
+			piece = pieceIndex
+		}
+	}
+	return piece
+}
+
+func (ss *superSeed) offer(p *superSeedPeer) error {
+	if p.piece != -1 {
+		ss.offers[p.piece]--
+	}
+	p.piece = ss.pickPiece(p)
+	p.uploading = false
+	if p.piece == -1 {
+		// Peer has every piece
+		return nil
+	}
+	ss.offers[p.piece]++
+	p.announced.Set(p.piece, true)
+	return p.wire.SendHave(p.piece)
+}
+
+// OfferPiece reveals the first piece to a newly connected peer
+func (ss *superSeed) OfferPiece(id string, wire wire.Wire) error {
+	ss.Lock()
+	defer ss.Unlock()
+
+	p := ss.getPeer(id)
+	p.wire = wire
+	if p.piece != -1 {
+		return nil
+	}
+	return ss.offer(p)
+}
+
+func (ss *superSeed) PieceHave(id string, pieceIndex int) {
+	ss.Lock()
+	defer ss.Unlock()
+
+	p := ss.getPeer(id)
+	if p.bitfield.Get(pieceIndex) {
+		return
+	}
+	p.bitfield.Set(pieceIndex, true)
+	ss.availability[pieceIndex]++
+
+	// The peer already had the piece we offered it, without downloading it from us
+	if p.piece == pieceIndex && !p.uploading && p.wire != nil {
+		ss.offer(p)
+	}
+
+	// The piece has propagated, peers we gave it to are offered another piece
+	for otherID, other := range ss.peers {
+		if otherID != id && other.piece == pieceIndex && other.wire != nil {
+			ss.offer(other)
+		}
+	}
+}
+
+// CanUpload reports whether the peer may request blocks of the piece i.e.
+// the piece has been revealed to it
+func (ss *superSeed) CanUpload(id string, pieceIndex int) bool {
+	ss.Lock()
+	defer ss.Unlock()
+
+	p, ok := ss.peers[id]
+	if !ok || pieceIndex < 0 || pieceIndex >= ss.tor.NumPieces || !p.announced.Get(pieceIndex) {
+		return false
+	}
+	if p.piece == pieceIndex {
+		p.uploading = true
+	}
+	return true
+}
+
+func (ss *superSeed) PeerStopped(id string) {
+	ss.Lock()
+	defer ss.Unlock()
+
+	if p, ok := ss.peers[id]; ok {
+		if p.piece != -1 {
+			ss.offers[p.piece]--
+		}
+		for pieceIndex := 0; pieceIndex < ss.tor.NumPieces; pieceIndex++ {
+			if p.bitfield.Get(pieceIndex) {
+				ss.availability[pieceIndex]--
+			}
+		}
+		delete(ss.peers, id)
+	}
+}
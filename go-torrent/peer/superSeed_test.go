@@ -0,0 +1,46 @@
+package peer
+
+import (
+	"testing"
+
+	"github.com/Charana123/torrent/go-torrent/torrent"
+	"github.com/stretchr/testify/assert"
+)
+
+func (m *mockWire) SendHave(pieceIndex int) error {
+	args := m.Called(pieceIndex)
+	return args.Error(0)
+}
+
+func TestSuperSeed(t *testing.T) {
+	ss := NewSuperSeed()
+	assert.False(t, ss.Active())
+	ss.Init(&torrent.Torrent{NumPieces: 3})
+	assert.True(t, ss.Active())
+
+	peerID1 := "0.0.0.0"
+	peerID2 := "0.0.0.1"
+	w1 := &mockWire{}
+	w1.On("SendHave", 0).Return(nil).Once()
+	w1.On("SendHave", 2).Return(nil).Once()
+	w2 := &mockWire{}
+	w2.On("SendHave", 1).Return(nil).Once()
+
+	// each peer is offered a different piece
+	ss.OfferPiece(peerID1, w1)
+	ss.OfferPiece(peerID2, w2)
+
+	// peers may only download the pieces revealed to them
+	assert.True(t, ss.CanUpload(peerID1, 0))
+	assert.False(t, ss.CanUpload(peerID1, 1))
+	assert.True(t, ss.CanUpload(peerID2, 1))
+
+	// peer1 announcing its own piece doesn't earn it another piece
+	ss.PieceHave(peerID1, 0)
+	// peer2 has received piece 0 from peer1, so peer1 is offered the next piece
+	ss.PieceHave(peerID2, 0)
+	assert.True(t, ss.CanUpload(peerID1, 2))
+
+	w1.AssertExpectations(t)
+	w2.AssertExpectations(t)
+}
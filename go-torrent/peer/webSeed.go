@@ -0,0 +1,355 @@
+package peer
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Charana123/torrent/go-torrent/piece"
+	"github.com/Charana123/torrent/go-torrent/stats"
+	"github.com/Charana123/torrent/go-torrent/storage"
+	"github.com/Charana123/torrent/go-torrent/torrent"
+	"github.com/Charana123/torrent/go-torrent/wire"
+	bitmap "github.com/boljen/go-bitmap"
+)
+
+const (
+	// BEP 0019 - WebSeed - HTTP/FTP Seeding (GetRight style)
+	URL_LIST = 0
+	// BEP 0017 - HTTP Seeding (Hoffman style)
+	HTTP_SEEDS = 1
+
+	WEB_SEED_MIN_BACKOFF = 30   // seconds
+	WEB_SEED_MAX_BACKOFF = 3600 // seconds
+	// Wait when the web seed has no blocks to download e.g. the remaining
+	// pieces are being downloaded from peers
+	WEB_SEED_IDLE_INTERVAL = 10 // seconds
+	// Web seeds are downloaded from while the swarm is small, i.e. while
+	// connected to fewer peers
+	WEB_SEED_MAX_PEERS = 10
+)
+
+var httpClient = &http.Client{Timeout: time.Duration(2 * time.Minute)}
+
+// A web seed is a pseudo-peer that has every piece. Its blocks are chosen by
+// the piece manager like any other peer's, each piece is fetched with HTTP
+// requests and verified by PieceManager.WriteBlock.
+type WebSeed interface {
+	Start()
+}
+
+type webSeed struct {
+	url      string
+	style    int
+	torrent  *torrent.Torrent
+	pieceMgr piece.PieceManager
+	peerMgr  PeerManager
+	storage  storage.Storage
+	stats    stats.Stats
+	bitfield bitmap.Bitmap
+	backoff  time.Duration
+	quit     chan int
+}
+
+type blockRequest struct {
+	pieceIndex int
+	begin      int
+	length     int
+}
+
+// Records the block requests the piece manager makes of the web seed
+type requestRecorder struct {
+	wire.Wire
+	requests []blockRequest
+}
+
+func (r *requestRecorder) SendRequest(pieceIndex, begin, length int) error {
+	r.requests = append(r.requests, blockRequest{pieceIndex, begin, length})
+	return nil
+}
+
+func (r *requestRecorder) SendUnInterested() error {
+	return nil
+}
+
+// Returned by seeds that are busy, the seed asks to wait before retrying
+type retryError struct {
+	retryAfter time.Duration
+}
+
+func (err *retryError) Error() string {
+	return fmt.Sprintf("web seed busy, retry after %v", err.retryAfter)
+}
+
+func NewWebSeed(
+	url string,
+	style int,
+	tor *torrent.Torrent,
+	pieceMgr piece.PieceManager,
+	peerMgr PeerManager,
+	storage storage.Storage,
+	stats stats.Stats,
+	quit chan int) WebSeed {
+
+	bitfield := bitmap.New(tor.NumPieces)
+	for pieceIndex := 0; pieceIndex < tor.NumPieces; pieceIndex++ {
+		bitfield.Set(pieceIndex, true)
+	}
+	return &webSeed{
+		url:      url,
+		style:    style,
+		torrent:  tor,
+		pieceMgr: pieceMgr,
+		peerMgr:  peerMgr,
+		storage:  storage,
+		stats:    stats,
+		bitfield: bitfield,
+		quit:     quit,
+	}
+}
+
+func (ws *webSeed) Start() {
+	wait := time.Duration(0)
+	for {
+		select {
+		case <-ws.quit:
+			ws.pieceMgr.PeerChoked(ws.url)
+			return
+		case <-time.After(wait):
+			if ws.pieceMgr.GetPiecesDownloaded() == ws.torrent.NumPieces {
+				return
+			}
+			wait = ws.download()
+		}
+	}
+}
+
+// Downloads the blocks of a piece, returns how long to wait until the next
+// download
+func (ws *webSeed) download() time.Duration {
+	if len(ws.peerMgr.GetPeerList()) >= WEB_SEED_MAX_PEERS {
+		// The swarm is large enough, the seed's blocks are left to the peers
+		return WEB_SEED_IDLE_INTERVAL * time.Second
+	}
+	// Request every remaining block of the piece, s.t. the piece is fetched
+	// with a single HTTP request
+	recorder := &requestRecorder{}
+	if diskIO, ok := ws.storage.(storage.DiskIO); ok {
+		// Stop requesting blocks while the disk falls behind
+		diskIO.WaitWritable()
+	}
+	for {
+		numRequests := len(recorder.requests)
+		ws.pieceMgr.SendBlockRequests(ws.url, recorder, &ws.bitfield)
+		if len(recorder.requests) == numRequests {
+			break
+		}
+	}
+	if len(recorder.requests) == 0 {
+		return WEB_SEED_IDLE_INTERVAL * time.Second
+	}
+
+	requests := recorder.requests
+	pieceIndex := requests[0].pieceIndex
+	begin := requests[0].begin
+	end := begin
+	for _, r := range requests {
+		begin = min(begin, r.begin)
+		end = max(end, r.begin+r.length)
+	}
+
+	data, err := ws.fetch(pieceIndex, begin, end-begin)
+	if err != nil {
+		return ws.failed(err)
+	}
+
+	for _, r := range requests {
+		block := data[r.begin-begin : r.begin-begin+r.length]
+		downloadedPiece, bannedPeers, err := ws.pieceMgr.WriteBlock(ws.url, r.pieceIndex, r.begin/piece.BLOCK_SIZE, block)
+		if err != nil {
+			return ws.failed(err)
+		}
+		ws.stats.UpdatePeer(ws.url, len(block), 0)
+		if bannedPeers != nil {
+			ws.peerMgr.BanPeers(bannedPeers)
+			if bannedPeers.Contains(ws.url) {
+				return ws.failed(fmt.Errorf("web seed sent corrupt data"))
+			}
+		}
+		if downloadedPiece {
+			ws.peerMgr.BroadcastHave(r.pieceIndex)
+		}
+	}
+	// The seed succeeded
+	ws.backoff = 0
+	return 0
+}
+
+// Gives up the web seed's blocks to other peers and backs off the seed,
+// the backoff doubles with each consecutive failure
+func (ws *webSeed) failed(err error) time.Duration {
+	fmt.Println("WEBSEED:", ws.url, err)
+	ws.pieceMgr.PeerChoked(ws.url)
+	if ws.backoff == 0 {
+		ws.backoff = WEB_SEED_MIN_BACKOFF * time.Second
+	} else {
+		ws.backoff = ws.backoff * 2
+	}
+	if ws.backoff > WEB_SEED_MAX_BACKOFF*time.Second {
+		ws.backoff = WEB_SEED_MAX_BACKOFF * time.Second
+	}
+	if err, ok := err.(*retryError); ok && err.retryAfter > ws.backoff {
+		return err.retryAfter
+	}
+	return ws.backoff
+}
+
+func (ws *webSeed) fetch(pieceIndex, begin, length int) ([]byte, error) {
+	var data []byte
+	var err error
+	if ws.style == HTTP_SEEDS {
+		data, err = ws.fetchPiece(pieceIndex, begin, length)
+	} else {
+		data, err = ws.fetchFiles(pieceIndex*ws.torrent.MetaInfo.Info.PieceLength+begin, length)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != length {
+		return nil, fmt.Errorf("web seed sent %d bytes, expected %d", len(data), length)
+	}
+	return data, nil
+}
+
+// GetRight style seeds serve the torrent's files, a range of the torrent's
+// data spanning several files is fetched with a request per file
+func (ws *webSeed) fetchFiles(globalOffset, length int) ([]byte, error) {
+	files := ws.torrent.MetaInfo.Info.Files
+	fileOffsets := ws.storage.GetFileOffsets()
+	data := make([]byte, 0, length)
+	for fileIndex := 0; fileIndex < len(files) && fileIndex < len(fileOffsets) && length > 0; fileIndex++ {
+		fileOffset := globalOffset - fileOffsets[fileIndex]
+		if fileOffset < 0 || fileOffset >= files[fileIndex].Length {
+			continue
+		}
+		fileLength := min(length, files[fileIndex].Length-fileOffset)
+		if files[fileIndex].IsPadding() {
+			// Padding files aren't served
+			data = append(data, make([]byte, fileLength)...)
+		} else {
+			fileData, err := ws.get(ws.fileURL(files[fileIndex]), fileOffset, fileLength)
+			if err != nil {
+				return nil, err
+			}
+			data = append(data, fileData...)
+		}
+		globalOffset += fileLength
+		length -= fileLength
+	}
+	if length > 0 {
+		return nil, fmt.Errorf("reading beyond end of last file")
+	}
+	return data, nil
+}
+
+// A URL ending in / is the directory containing the torrent, otherwise it's
+// the file itself in single file torrents
+func (ws *webSeed) fileURL(file torrent.File) string {
+	info := ws.torrent.MetaInfo.Info
+	if info.Length > 0 {
+		// Single File Mode
+		if strings.HasSuffix(ws.url, "/") {
+			return ws.url + url.PathEscape(info.Name)
+		}
+		return ws.url
+	}
+	path := []string{url.PathEscape(info.Name)}
+	for _, name := range file.Path {
+		path = append(path, url.PathEscape(name))
+	}
+	return strings.TrimSuffix(ws.url, "/") + "/" + strings.Join(path, "/")
+}
+
+func (ws *webSeed) get(fileURL string, offset, length int) ([]byte, error) {
+	req, err := http.NewRequest("GET", fileURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return data, nil
+	case http.StatusOK:
+		// The server ignored the range and sent the whole file
+		if offset+length > len(data) {
+			return nil, fmt.Errorf("file shorter than expected")
+		}
+		return data[offset : offset+length], nil
+	case http.StatusServiceUnavailable:
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			return nil, &retryError{time.Duration(seconds) * time.Second}
+		}
+	}
+	return nil, fmt.Errorf("web seed responded %s", resp.Status)
+}
+
+// Hoffman style seeds serve ranges of a piece by info-hash and piece index,
+// a busy seed responds 503 with the number of seconds to wait
+func (ws *webSeed) fetchPiece(pieceIndex, begin, length int) ([]byte, error) {
+	q := url.Values{}
+	q.Set("info_hash", string(ws.torrent.InfoHash))
+	q.Set("piece", strconv.Itoa(pieceIndex))
+	q.Set("ranges", fmt.Sprintf("%d-%d", begin, begin+length-1))
+	separator := "?"
+	if strings.Contains(ws.url, "?") {
+		separator = "&"
+	}
+	resp, err := httpClient.Get(ws.url + separator + q.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		if seconds, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+			return nil, &retryError{time.Duration(seconds) * time.Second}
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("web seed responded %s for info-hash %s", resp.Status, hex.EncodeToString(ws.torrent.InfoHash))
+	}
+	return data, nil
+}
+
+func min(i, j int) int {
+	if i < j {
+		return i
+	}
+	return j
+}
+
+func max(i, j int) int {
+	if i > j {
+		return i
+	}
+	return j
+}
@@ -0,0 +1,196 @@
+package peer
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Charana123/torrent/go-torrent/piece"
+	"github.com/Charana123/torrent/go-torrent/storage"
+	"github.com/Charana123/torrent/go-torrent/torrent"
+	bitmap "github.com/boljen/go-bitmap"
+	mapset "github.com/deckarep/golang-set"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func (m *mockStats) UpdatePeer(id string, uploaded int, downloaded int) {
+	m.Called(id, uploaded, downloaded)
+}
+
+func (m *mockPeerManager) BroadcastHave(pieceIndex int) {
+	m.Called(pieceIndex)
+}
+
+func (m *mockPeerManager) BanPeers(peers mapset.Set) {
+	m.Called(peers)
+}
+
+type mockStorage struct {
+	storage.Storage
+	mock.Mock
+}
+
+func (m *mockStorage) WritePieceRequest(pieceIndex int, data []byte) error {
+	args := m.Called(pieceIndex, data)
+	return args.Error(0)
+}
+
+func (m *mockStorage) Completed() error {
+	args := m.Called()
+	return args.Error(0)
+}
+
+func (m *mockStorage) GetFileOffsets() []int {
+	args := m.Called()
+	return args.Get(0).([]int)
+}
+
+// Two files, the first piece spans both of them
+func newWebSeedTorrent() (*torrent.Torrent, []byte, []byte) {
+	pieceLength := 2 * piece.BLOCK_SIZE
+	file1 := bytes.Repeat([]byte{1}, 20000)
+	file2 := bytes.Repeat([]byte{2}, 30000)
+	data := append(append([]byte{}, file1...), file2...)
+	pieces := ""
+	for offset := 0; offset < len(data); offset += pieceLength {
+		checksum := sha1.Sum(data[offset:min(offset+pieceLength, len(data))])
+		pieces += string(checksum[:])
+	}
+	tor := &torrent.Torrent{
+		InfoHash:  bytes.Repeat([]byte{1}, 20),
+		Length:    len(data),
+		NumPieces: 2,
+		MetaInfo: torrent.MetaInfo{
+			Info: torrent.Info{
+				Name:        "root",
+				PieceLength: pieceLength,
+				Pieces:      pieces,
+				Files: []torrent.File{
+					torrent.File{Length: len(file1), Path: []string{"name1"}},
+					torrent.File{Length: len(file2), Path: []string{"sub", "name2"}},
+				},
+			},
+		},
+	}
+	return tor, file1, file2
+}
+
+func newTestWebSeed(url string, style int, tor *torrent.Torrent) (*webSeed, *mockStorage, *mockPeerManager, *mockStats) {
+	s := &mockStorage{}
+	s.On("GetFileOffsets").Return([]int{0, 20000})
+	s.On("WritePieceRequest", mock.Anything, mock.Anything).Return(nil)
+	s.On("Completed").Return(nil)
+	pieceMgr := piece.NewRarestFirstPieceManager(s)
+	pieceMgr.Init(tor, bitmap.New(tor.NumPieces))
+	peerMgr := &mockPeerManager{}
+	peerMgr.On("BroadcastHave", mock.Anything).Return()
+	peerMgr.On("GetPeerList").Return([]Peer{})
+	st := &mockStats{}
+	st.On("UpdatePeer", url, mock.Anything, 0).Return()
+	ws := NewWebSeed(url, style, tor, pieceMgr, peerMgr, s, st, make(chan int)).(*webSeed)
+	return ws, s, peerMgr, st
+}
+
+func TestWebSeed(t *testing.T) {
+	tor, file1, file2 := newWebSeedTorrent()
+	files := map[string][]byte{
+		"/seed/root/name1":     file1,
+		"/seed/root/sub/name2": file2,
+	}
+	failures := 2
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if failures > 0 {
+			failures--
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		data, ok := files[r.URL.Path]
+		if !ok {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		http.ServeContent(rw, r, r.URL.Path, time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	url := server.URL + "/seed/"
+	ws, s, peerMgr, st := newTestWebSeed(url, URL_LIST, tor)
+
+	// Failing seeds back off
+	assert.Equal(t, WEB_SEED_MIN_BACKOFF*time.Second, ws.download())
+	assert.Equal(t, 2*WEB_SEED_MIN_BACKOFF*time.Second, ws.download())
+
+	// Each piece is fetched with a range request per file
+	assert.Equal(t, time.Duration(0), ws.download())
+	assert.Equal(t, time.Duration(0), ws.download())
+	assert.Equal(t, 2, ws.pieceMgr.GetPiecesDownloaded())
+	data := append(append([]byte{}, file1...), file2...)
+	s.AssertCalled(t, "WritePieceRequest", 0, data[:tor.MetaInfo.Info.PieceLength])
+	s.AssertCalled(t, "WritePieceRequest", 1, data[tor.MetaInfo.Info.PieceLength:])
+	peerMgr.AssertCalled(t, "BroadcastHave", 0)
+	peerMgr.AssertCalled(t, "BroadcastHave", 1)
+
+	// The web seed is a pseudo-peer
+	st.AssertCalled(t, "UpdatePeer", url, piece.BLOCK_SIZE, 0)
+
+	// Nothing left to download
+	assert.Equal(t, WEB_SEED_IDLE_INTERVAL*time.Second, ws.download())
+}
+
+func TestHTTPSeed(t *testing.T) {
+	tor, file1, file2 := newWebSeedTorrent()
+	data := append(append([]byte{}, file1...), file2...)
+	busy := true
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if busy {
+			busy = false
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			rw.Write([]byte("120"))
+			return
+		}
+		q := r.URL.Query()
+		assert.Equal(t, string(tor.InfoHash), q.Get("info_hash"))
+		var pieceIndex, begin, end int
+		fmt.Sscanf(q.Get("piece"), "%d", &pieceIndex)
+		fmt.Sscanf(q.Get("ranges"), "%d-%d", &begin, &end)
+		offset := pieceIndex * tor.MetaInfo.Info.PieceLength
+		rw.Write(data[offset+begin : offset+end+1])
+	}))
+	defer server.Close()
+
+	ws, _, _, _ := newTestWebSeed(server.URL+"/seed", HTTP_SEEDS, tor)
+
+	// Busy seeds ask to wait longer than the backoff
+	assert.Equal(t, 120*time.Second, ws.download())
+	assert.Equal(t, time.Duration(0), ws.download())
+	assert.Equal(t, time.Duration(0), ws.download())
+	assert.Equal(t, 2, ws.pieceMgr.GetPiecesDownloaded())
+}
+
+func TestWebSeedLargeSwarm(t *testing.T) {
+	tor, _, _ := newWebSeedTorrent()
+	requested := false
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		requested = true
+	}))
+	defer server.Close()
+
+	ws, _, _, _ := newTestWebSeed(server.URL+"/seed/", URL_LIST, tor)
+	peers := []Peer{}
+	for i := 0; i < WEB_SEED_MAX_PEERS; i++ {
+		peers = append(peers, &mockPeer{})
+	}
+	peerMgr := &mockPeerManager{}
+	peerMgr.On("GetPeerList").Return(peers)
+	ws.peerMgr = peerMgr
+
+	// The seed isn't used while there are enough peers
+	assert.Equal(t, WEB_SEED_IDLE_INTERVAL*time.Second, ws.download())
+	assert.False(t, requested)
+	assert.Equal(t, 0, ws.pieceMgr.GetPiecesDownloaded())
+}
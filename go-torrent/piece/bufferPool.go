@@ -0,0 +1,81 @@
+package piece
+
+import "sync"
+
+const (
+	// Memory of the blocks of partial pieces across every torrent
+	DEFAULT_MAX_BLOCK_MEMORY = 268435456 // 256 MiB
+)
+
+// BufferPool hands out block sized buffers for the blocks of partial pieces.
+// Buffers are reused once they're put back, and the memory of the buffers
+// in use is counted against a limit shared by every torrent.
+type BufferPool interface {
+	Get() (buf []byte)
+	Put(buf []byte)
+	SetMaxMemory(maxMemory int)
+	// Beyond the limit, partial pieces are flushed to storage
+	UnderPressure() bool
+	GetStats() (inUse, maxMemory int)
+}
+
+type bufferPool struct {
+	sync.Mutex
+	buffers   sync.Pool
+	inUse     int
+	maxMemory int
+}
+
+// Shared by the piece managers of every torrent
+var sharedBufferPool = NewBufferPool(DEFAULT_MAX_BLOCK_MEMORY)
+
+func NewBufferPool(maxMemory int) BufferPool {
+	bp := &bufferPool{
+		maxMemory: maxMemory,
+	}
+	bp.buffers.New = func() interface{} {
+		return make([]byte, BLOCK_SIZE)
+	}
+	return bp
+}
+
+// GetBufferPool returns the pool shared by the piece managers of every torrent
+func GetBufferPool() BufferPool {
+	return sharedBufferPool
+}
+
+func (bp *bufferPool) Get() []byte {
+	buf := bp.buffers.Get().([]byte)
+	bp.Lock()
+	bp.inUse += cap(buf)
+	bp.Unlock()
+	return buf[:cap(buf)]
+}
+
+func (bp *bufferPool) Put(buf []byte) {
+	bp.Lock()
+	bp.inUse -= cap(buf)
+	bp.Unlock()
+	bp.buffers.Put(buf[:cap(buf)])
+}
+
+func (bp *bufferPool) SetMaxMemory(maxMemory int) {
+	bp.Lock()
+	defer bp.Unlock()
+
+	bp.maxMemory = maxMemory
+}
+
+func (bp *bufferPool) UnderPressure() bool {
+	bp.Lock()
+	defer bp.Unlock()
+
+	return bp.inUse > bp.maxMemory
+}
+
+func (bp *bufferPool) GetStats() (int, int) {
+	bp.Lock()
+	defer bp.Unlock()
+
+	return bp.inUse, bp.maxMemory
+}
@@ -3,11 +3,10 @@ package piece
 import (
 	"bytes"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 
-	"github.com/jackpal/bencode-go"
-
 	"github.com/Charana123/torrent/go-torrent/torrent"
 	"github.com/Charana123/torrent/go-torrent/wire"
 )
@@ -79,12 +78,23 @@ func (mdMgr *metadataManager) WritePiece(pieceIndex int, piece []byte) bool {
 	mdMgr.piecesDownloaded++
 	copy(mdMgr.metadata[pieceIndex*METADATA_PIECE_SIZE:], piece)
 	if mdMgr.piecesDownloaded == mdMgr.numMetaPieces {
-		infoHash, _ := hex.DecodeString(mdMgr.muri.InfoHashHex)
-		metadataHash := sha1.Sum(mdMgr.metadata)
-		if bytes.Equal(metadataHash[:], infoHash) {
-			info := &torrent.Info{}
-			bencode.Unmarshal(bytes.NewBuffer(mdMgr.metadata), info)
-			tor := torrent.NewTorrentFromMagnetURI(mdMgr.muri, info)
+		var verified bool
+		if mdMgr.muri.InfoHashHex != "" {
+			infoHash, _ := hex.DecodeString(mdMgr.muri.InfoHashHex)
+			metadataHash := sha1.Sum(mdMgr.metadata)
+			verified = bytes.Equal(metadataHash[:], infoHash)
+		} else {
+			// v2 only magnet links
+			infoHash, _ := hex.DecodeString(mdMgr.muri.InfoHashV2Hex)
+			metadataHash := sha256.Sum256(mdMgr.metadata)
+			verified = bytes.Equal(metadataHash[:], infoHash)
+		}
+		if verified {
+			tor, err := torrent.NewTorrentFromMagnetURI(mdMgr.muri, mdMgr.metadata)
+			if err != nil {
+				fmt.Println("metadata rejected:", err)
+				return false
+			}
 			mdMgr.dowloadedChan <- tor
 		} else {
 			fmt.Println("metadata verification failed")
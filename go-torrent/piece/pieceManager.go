@@ -16,10 +16,13 @@ type PieceManager interface {
 	GetPiecesDownloaded() (piecesDownloaded int)
 	GetBitField() (clientBitfield []byte)
 	VerifyBitField(bitfield bitmap.Bitmap)
+	PieceLost(pieceIndex int)
 	PeerChoked(id string)
 	Init(tor *torrent.Torrent, clientBitfield bitmap.Bitmap)
 	PeerStopped(id string, peerBitfield *bitmap.Bitmap)
 	PieceHave(id string, pieceIndex int)
+	GetAvailability() (distributedCopies float64)
+	GetSeeders() (seeders int)
 	WriteBlock(id string, pieceIndex, blockIndex int, data []byte) (downloadedPiece bool, bannedPeers mapset.Set, err error)
 	SendBlockRequests(id string, wire wire.Wire, peerBitfield *bitmap.Bitmap) (err error)
 }
@@ -3,8 +3,8 @@ package piece
 import (
 	"bytes"
 	"crypto/sha1"
-	"encoding/binary"
 	"fmt"
+	"hash"
 	"math"
 	"sort"
 	"sync"
@@ -19,15 +19,17 @@ import (
 
 type rarestFirst struct {
 	sync.RWMutex
-	clientBitField       bitmap.Bitmap
-	tor                  *torrent.Torrent
-	numBlocks            int
-	numBlocksInLastPiece int
-	lengthOfLastBlock    int
-	peerToPiece          map[string]int
-	pieceInfo            []*pieceInfo
-	storage              storage.Storage
-	piecesDownloaded     int
+	clientBitField   bitmap.Bitmap
+	tor              *torrent.Torrent
+	peerToPiece      map[string]int
+	pieceInfo        []*pieceInfo
+	storage          storage.Storage
+	piecesDownloaded int
+	buffers          BufferPool
+	// Pieces holding the buffers of downloaded blocks
+	partialPieces map[int]bool
+	// Number of pieces each peer has, peers with every piece are seeders
+	peerPieces map[string]int
 }
 
 type pieceInfo struct {
@@ -35,21 +37,37 @@ type pieceInfo struct {
 	downloading bool
 	blocks      []*blockInfo
 	availabilty int
-	peers       mapset.Set
+	// hashes of the blocks of previous failed attempts at the piece,
+	// by block index and the peer that sent the block
+	failedBlocks []map[string][20]byte
+	// Blocks downloaded in order from the start of the piece, they're hashed
+	// as they arrive in v1 torrents
+	contiguous int
+	hash       hash.Hash
+	// Blocks from the start of the piece written to storage under memory
+	// pressure, their buffers are released
+	flushed int
 }
 
 type blockInfo struct {
 	downloaded  bool
 	downloading bool
-	data        []byte
+	// A buffer of the BufferPool until the block is flushed
+	data []byte
+	// Hash of the block once it's flushed
+	hash [20]byte
+	peer string
 }
 
 func NewRarestFirstPieceManager(
 	storage storage.Storage) PieceManager {
 
 	pm := &rarestFirst{
-		storage:     storage,
-		peerToPiece: make(map[string]int),
+		storage:       storage,
+		peerToPiece:   make(map[string]int),
+		buffers:       GetBufferPool(),
+		partialPieces: make(map[int]bool),
+		peerPieces:    make(map[string]int),
 	}
 
 	return pm
@@ -59,25 +77,17 @@ func (pm *rarestFirst) Init(tor *torrent.Torrent, clientBitfield bitmap.Bitmap)
 
 	pm.tor = tor
 	pm.clientBitField = clientBitfield
-	bytesInLastPiece := pm.tor.Length - ((pm.tor.NumPieces - 1) * pm.tor.MetaInfo.Info.PieceLength)
-	pm.numBlocksInLastPiece = int(math.Ceil(float64(bytesInLastPiece) / float64(BLOCK_SIZE)))
-	pm.lengthOfLastBlock = bytesInLastPiece - (pm.numBlocksInLastPiece-1)*BLOCK_SIZE
-	pm.numBlocks = pm.tor.MetaInfo.Info.PieceLength / BLOCK_SIZE
 
 	pis := make([]*pieceInfo, 0)
 	for i := 0; i < pm.tor.NumPieces; i++ {
 		pi := &pieceInfo{}
 		pi.blocks = make([]*blockInfo, 0)
-		if i == pm.tor.NumPieces-1 {
-			for j := 0; j < pm.numBlocksInLastPiece; j++ {
-				pi.blocks = append(pi.blocks, &blockInfo{})
-			}
-		} else {
-			for j := 0; j < pm.numBlocks; j++ {
-				pi.blocks = append(pi.blocks, &blockInfo{})
-			}
+		// The last piece, and the last piece of each file in v2 torrents, is shorter
+		numBlocks := int(math.Ceil(float64(pm.tor.PieceSize(i)) / float64(BLOCK_SIZE)))
+		for j := 0; j < numBlocks; j++ {
+			pi.blocks = append(pi.blocks, &blockInfo{})
 		}
-		pi.peers = mapset.NewSet()
+		pi.failedBlocks = make([]map[string][20]byte, len(pi.blocks))
 		pis = append(pis, pi)
 	}
 	pm.pieceInfo = pis
@@ -89,6 +99,14 @@ func (pm *rarestFirst) Init(tor *torrent.Torrent, clientBitfield bitmap.Bitmap)
 	}
 }
 
+func (pm *rarestFirst) blockLength(pieceIndex, blockIndex int) int {
+	pieceSize := pm.tor.PieceSize(pieceIndex)
+	if (blockIndex+1)*BLOCK_SIZE > pieceSize {
+		return pieceSize - blockIndex*BLOCK_SIZE
+	}
+	return BLOCK_SIZE
+}
+
 func (pm *rarestFirst) GetPiecesDownloaded() int {
 	pm.RLock()
 	defer pm.RUnlock()
@@ -103,16 +121,28 @@ func (pm *rarestFirst) VerifyBitField(bitfield bitmap.Bitmap) {
 	for i := 0; i < pm.clientBitField.Len(); i++ {
 		if pm.clientBitField.Get(i) && !bitfield.Get(i) {
 			pm.pieceInfo[i].downloaded = false
-			pm.pieceInfo[i].downloading = false
-			for bi := 0; bi < len(pm.pieceInfo[i].blocks); bi++ {
-				pm.pieceInfo[i].blocks[bi].downloaded = false
-				pm.pieceInfo[i].blocks[bi].downloading = false
-			}
+			pm.resetPiece(i)
 		}
 	}
 	pm.clientBitField = bitfield
 }
 
+// The piece is no longer in storage e.g. it was evicted from memory, it's
+// downloaded again. Partial pieces lose the blocks that were flushed.
+func (pm *rarestFirst) PieceLost(pieceIndex int) {
+	pm.Lock()
+	defer pm.Unlock()
+
+	if pm.clientBitField.Get(pieceIndex) {
+		pm.pieceInfo[pieceIndex].downloaded = false
+		pm.resetPiece(pieceIndex)
+		pm.clientBitField.Set(pieceIndex, false)
+		pm.piecesDownloaded--
+	} else if pm.pieceInfo[pieceIndex].flushed > 0 {
+		pm.resetPiece(pieceIndex)
+	}
+}
+
 func (pm *rarestFirst) GetBitField() []byte {
 	pm.RLock()
 	defer pm.RUnlock()
@@ -145,6 +175,7 @@ func (pm *rarestFirst) PeerStopped(id string, peerBitfield *bitmap.Bitmap) {
 			}
 		}
 	}
+	delete(pm.peerPieces, id)
 
 	if pieceIndex, ok := pm.peerToPiece[id]; ok {
 		pm.pieceInfo[pieceIndex].downloading = false
@@ -160,6 +191,48 @@ func (pm *rarestFirst) PieceHave(id string, pieceIndex int) {
 	defer pm.Unlock()
 
 	pm.pieceInfo[pieceIndex].availabilty++
+	pm.peerPieces[id]++
+}
+
+// Distributed copies of the torrent among the peers, the number of peers
+// having the rarest piece plus the fraction of pieces more common than it
+func (pm *rarestFirst) GetAvailability() float64 {
+	pm.RLock()
+	defer pm.RUnlock()
+
+	if len(pm.pieceInfo) == 0 {
+		return 0
+	}
+	rarest := pm.pieceInfo[0].availabilty
+	for _, pi := range pm.pieceInfo {
+		if pi.availabilty < rarest {
+			rarest = pi.availabilty
+		}
+	}
+	moreCommon := 0
+	for _, pi := range pm.pieceInfo {
+		if pi.availabilty > rarest {
+			moreCommon++
+		}
+	}
+	return float64(rarest) + float64(moreCommon)/float64(len(pm.pieceInfo))
+}
+
+// Number of peers having every piece
+func (pm *rarestFirst) GetSeeders() int {
+	pm.RLock()
+	defer pm.RUnlock()
+
+	if pm.tor == nil {
+		return 0
+	}
+	seeders := 0
+	for _, pieces := range pm.peerPieces {
+		if pieces >= pm.tor.NumPieces {
+			seeders++
+		}
+	}
+	return seeders
 }
 
 func (pm *rarestFirst) WriteBlock(id string, pieceIndex, blockIndex int, data []byte) (bool, mapset.Set, error) {
@@ -173,49 +246,218 @@ func (pm *rarestFirst) WriteBlock(id string, pieceIndex, blockIndex int, data []
 	if !pm.pieceInfo[pieceIndex].blocks[blockIndex].downloading {
 		return false, (mapset.Set)(nil), fmt.Errorf("downloaded incorrent block")
 	}
-	if ((pieceIndex != pm.tor.NumPieces-1 || blockIndex != pm.numBlocksInLastPiece-1) && len(data) != BLOCK_SIZE) ||
-		((pieceIndex == pm.tor.NumPieces-1 && blockIndex == pm.numBlocksInLastPiece-1) && len(data) != pm.lengthOfLastBlock) {
+	if len(data) != pm.blockLength(pieceIndex, blockIndex) {
 		return false, (mapset.Set)(nil), fmt.Errorf("incorrent block size")
 	}
-	pm.pieceInfo[pieceIndex].blocks[blockIndex].downloaded = true
-	pm.pieceInfo[pieceIndex].blocks[blockIndex].downloading = false
-	pm.pieceInfo[pieceIndex].blocks[blockIndex].data = data
-	pm.pieceInfo[pieceIndex].peers.Add(id)
+	pi := pm.pieceInfo[pieceIndex]
+	block := pi.blocks[blockIndex]
+	block.downloaded = true
+	block.downloading = false
+	block.data = pm.buffers.Get()[:len(data)]
+	copy(block.data, data)
+	block.peer = id
+	pm.partialPieces[pieceIndex] = true
+	pm.hashBlocks(pieceIndex)
+	if pm.buffers.UnderPressure() {
+		pm.flushPartialPieces()
+	}
 
 	// If all blocks for piece are downloaded, set piece as downloaded
-	for i := 0; i < len(pm.pieceInfo[pieceIndex].blocks); i++ {
-		block := pm.pieceInfo[pieceIndex].blocks[i]
-		if !block.downloaded {
-			return false, (mapset.Set)(nil), nil
-		}
+	if pi.contiguous < len(pi.blocks) {
+		return false, (mapset.Set)(nil), nil
 	}
 
-	// Check piece's checksum
-	piece := &bytes.Buffer{}
-	for _, block := range pm.pieceInfo[pieceIndex].blocks {
-		binary.Write(piece, binary.BigEndian, block.data)
+	// Check piece's checksum, the piece is downloaded again if its flushed
+	// blocks can't be read
+	pieceData, err := pm.pieceData(pieceIndex)
+	if err != nil {
+		pm.resetPiece(pieceIndex)
+		delete(pm.peerToPiece, id)
+		return false, (mapset.Set)(nil), err
 	}
-	pieceData := piece.Bytes()
-	expectedChecksum := []byte(pm.tor.MetaInfo.Info.Pieces[20*pieceIndex : 20*(pieceIndex+1)])
-	actualChecksum := sha1.Sum(pieceData)
-	if !bytes.Equal(expectedChecksum[:], actualChecksum[:]) {
-		return true, pm.pieceInfo[pieceIndex].peers, fmt.Errorf("Checksum invalid")
+	if !pm.verifyPiece(pieceIndex, pieceData) {
+		bannedPeers := pm.pieceFailed(pieceIndex)
+		delete(pm.peerToPiece, id)
+		return false, bannedPeers, nil
 	}
 
 	// Write piece to disk
-	err := pm.storage.WritePieceRequest(pieceIndex, pieceData)
+	err = pm.storage.WritePieceRequest(pieceIndex, pieceData)
 	if err != nil {
-		return true, nil, err
+		pm.resetPiece(pieceIndex)
+		delete(pm.peerToPiece, id)
+		return false, (mapset.Set)(nil), err
 	}
 
 	// Set piece as downloaded
-	pm.pieceInfo[pieceIndex].downloaded = true
-	pm.pieceInfo[pieceIndex].downloading = false
+	pi.downloaded = true
+	pi.downloading = false
 	delete(pm.peerToPiece, id)
 	pm.clientBitField.Set(pieceIndex, true)
 	pm.piecesDownloaded++
+	if pm.piecesDownloaded == pm.tor.NumPieces {
+		err = pm.storage.Completed()
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	return true, pm.pieceSucceeded(pieceIndex), nil
+}
+
+// Hashes the blocks downloaded in order from the start of the piece, s.t.
+// the piece is hashed as its blocks arrive rather than once it's complete
+func (pm *rarestFirst) hashBlocks(pieceIndex int) {
+	pi := pm.pieceInfo[pieceIndex]
+	for pi.contiguous < len(pi.blocks) && pi.blocks[pi.contiguous].downloaded {
+		if pm.tor.IsV1() {
+			if pi.hash == nil {
+				pi.hash = sha1.New()
+			}
+			pi.hash.Write(pi.blocks[pi.contiguous].data)
+		}
+		pi.contiguous++
+	}
+}
+
+// v2 pieces are verified against the merkle tree once they're complete
+func (pm *rarestFirst) verifyPiece(pieceIndex int, pieceData []byte) bool {
+	if !pm.tor.IsV1() {
+		return pm.tor.VerifyPiece(pieceIndex, pieceData)
+	}
+	pi := pm.pieceInfo[pieceIndex]
+	if pi.hash == nil {
+		return false
+	}
+	expectedChecksum := []byte(pm.tor.MetaInfo.Info.Pieces[20*pieceIndex : 20*(pieceIndex+1)])
+	return bytes.Equal(expectedChecksum, pi.hash.Sum(nil))
+}
+
+// The piece's blocks, the flushed blocks are read back from storage
+func (pm *rarestFirst) pieceData(pieceIndex int) ([]byte, error) {
+	pi := pm.pieceInfo[pieceIndex]
+	pieceData := make([]byte, 0, pm.tor.PieceSize(pieceIndex))
+	if pi.flushed > 0 {
+		flushedData, err := pm.storage.BlockReadRequest(pieceIndex, 0, pi.flushed*BLOCK_SIZE)
+		if err != nil {
+			return nil, err
+		}
+		pieceData = append(pieceData, flushedData...)
+	}
+	for _, block := range pi.blocks[pi.flushed:] {
+		pieceData = append(pieceData, block.data...)
+	}
+	return pieceData, nil
+}
 
-	return true, pm.pieceInfo[pieceIndex].peers, nil
+// Under memory pressure the blocks downloaded in order from the start of
+// each partial piece are written to storage, and their buffers released
+func (pm *rarestFirst) flushPartialPieces() {
+	for pieceIndex := range pm.partialPieces {
+		pi := pm.pieceInfo[pieceIndex]
+		if pi.flushed == pi.contiguous || pi.contiguous == len(pi.blocks) {
+			continue
+		}
+		// Pieces are written from their start
+		data, err := pm.pieceData(pieceIndex)
+		if err == nil {
+			data = data[:pi.contiguous*BLOCK_SIZE]
+			err = pm.storage.WritePieceRequest(pieceIndex, data)
+		}
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		for _, block := range pi.blocks[pi.flushed:pi.contiguous] {
+			block.hash = sha1.Sum(block.data)
+			pm.buffers.Put(block.data)
+			block.data = nil
+		}
+		pi.flushed = pi.contiguous
+	}
+}
+
+func blockHash(block *blockInfo) [20]byte {
+	if block.data == nil {
+		return block.hash
+	}
+	return sha1.Sum(block.data)
+}
+
+// Releases the piece's buffers s.t. it's downloaded again
+func (pm *rarestFirst) resetPiece(pieceIndex int) {
+	pi := pm.pieceInfo[pieceIndex]
+	pi.downloading = false
+	pi.contiguous = 0
+	pi.flushed = 0
+	pi.hash = nil
+	for _, block := range pi.blocks {
+		if block.data != nil {
+			pm.buffers.Put(block.data)
+		}
+		block.downloaded = false
+		block.downloading = false
+		block.data = nil
+		block.peer = ""
+	}
+	delete(pm.partialPieces, pieceIndex)
+}
+
+// Smart ban - when a piece fails its checksum we can't tell which of the
+// peers that contributed to it sent the corrupt blocks. The hash of each
+// block is remembered along with the peer that sent it, and the piece is
+// downloaded again. Once the piece passes its checksum, the peers whose
+// blocks differ from the correct ones are banned.
+func (pm *rarestFirst) pieceFailed(pieceIndex int) mapset.Set {
+	pi := pm.pieceInfo[pieceIndex]
+
+	peers := mapset.NewSet()
+	for blockIndex, block := range pi.blocks {
+		if pi.failedBlocks[blockIndex] == nil {
+			pi.failedBlocks[blockIndex] = make(map[string][20]byte)
+		}
+		pi.failedBlocks[blockIndex][block.peer] = blockHash(block)
+		peers.Add(block.peer)
+	}
+
+	// Reset the piece s.t. it is downloaded again
+	pm.resetPiece(pieceIndex)
+
+	// If a single peer sent every block, it's the one that sent the corrupt data
+	if peers.Cardinality() == 1 {
+		for blockIndex := range pi.failedBlocks {
+			pi.failedBlocks[blockIndex] = nil
+		}
+		return peers
+	}
+	return (mapset.Set)(nil)
+}
+
+func (pm *rarestFirst) pieceSucceeded(pieceIndex int) mapset.Set {
+	pi := pm.pieceInfo[pieceIndex]
+
+	bannedPeers := mapset.NewSet()
+	for blockIndex, block := range pi.blocks {
+		if len(pi.failedBlocks[blockIndex]) > 0 {
+			blockHash := blockHash(block)
+			for peer, failedBlockHash := range pi.failedBlocks[blockIndex] {
+				if failedBlockHash != blockHash {
+					bannedPeers.Add(peer)
+				}
+			}
+		}
+		pi.failedBlocks[blockIndex] = nil
+		if block.data != nil {
+			pm.buffers.Put(block.data)
+		}
+		block.data = nil
+	}
+	pi.hash = nil
+	delete(pm.partialPieces, pieceIndex)
+	if bannedPeers.Cardinality() == 0 {
+		return (mapset.Set)(nil)
+	}
+	return bannedPeers
 }
 
 func (pm *rarestFirst) SendBlockRequests(id string, wire wire.Wire, peerBitfield *bitmap.Bitmap) error {
@@ -258,12 +500,7 @@ func (pm *rarestFirst) SendBlockRequests(id string, wire wire.Wire, peerBitfield
 
 	for blockIndex, block := range pm.pieceInfo[pieceIndex].blocks {
 		if !block.downloaded && !block.downloading {
-			var err error
-			if pieceIndex == pm.tor.NumPieces-1 && blockIndex == pm.numBlocksInLastPiece-1 {
-				err = wire.SendRequest(pieceIndex, blockIndex*BLOCK_SIZE, pm.lengthOfLastBlock)
-			} else {
-				err = wire.SendRequest(pieceIndex, blockIndex*BLOCK_SIZE, BLOCK_SIZE)
-			}
+			err := wire.SendRequest(pieceIndex, blockIndex*BLOCK_SIZE, pm.blockLength(pieceIndex, blockIndex))
 			if err != nil {
 				return err
 			}
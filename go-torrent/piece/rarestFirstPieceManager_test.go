@@ -2,6 +2,7 @@ package piece
 
 import (
 	"bytes"
+	"crypto/sha1"
 	"fmt"
 	"testing"
 
@@ -12,6 +13,8 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 
+	mapset "github.com/deckarep/golang-set"
+
 	"github.com/Charana123/torrent/go-torrent/torrent"
 )
 
@@ -41,14 +44,6 @@ func (m *mockWire) SendUnInterested() error {
 }
 
 func TestPieceCompleted(t *testing.T) {
-	tor := &torrent.Torrent{
-		NumPieces: 3,
-		MetaInfo: torrent.MetaInfo{
-			Info: torrent.Info{
-				PieceLength: 65536, // 2^16
-			},
-		},
-	}
 	block1 := make([]byte, BLOCK_SIZE)
 	block2 := make([]byte, BLOCK_SIZE)
 	block3 := make([]byte, BLOCK_SIZE)
@@ -59,6 +54,19 @@ func TestPieceCompleted(t *testing.T) {
 		block3[i] = 3
 		block4[i] = 4
 	}
+	checksum := sha1.Sum(bytes.Join([][]byte{block1, block2, block3, block4}, nil))
+	pieces := make([]byte, 3*20)
+	copy(pieces[20:40], checksum[:])
+	tor := &torrent.Torrent{
+		NumPieces: 3,
+		Length:    3 * 65536,
+		MetaInfo: torrent.MetaInfo{
+			Info: torrent.Info{
+				PieceLength: 65536, // 2^16
+				Pieces:      string(pieces),
+			},
+		},
+	}
 
 	disk := &mockDisk{}
 	disk.On("WritePieceRequest", 1, mock.MatchedBy(func(piece []byte) bool {
@@ -74,14 +82,15 @@ func TestPieceCompleted(t *testing.T) {
 		return true
 	})).Return(nil).Once()
 
-	pm := NewRarestFirstPieceManager(tor, disk)
+	pm := NewRarestFirstPieceManager(disk)
+	pm.Init(tor, bitmap.New(3))
 
 	MAX_OUTSTANDING_REQUESTS = 3
 	wire := &mockWire{}
 	wire.On("SendRequest", 1, 0, BLOCK_SIZE).Return(nil).Once()
-	wire.On("SendRequest", 1, 1, BLOCK_SIZE).Return(nil).Once()
-	wire.On("SendRequest", 1, 2, BLOCK_SIZE).Return(nil).Once()
-	wire.On("SendRequest", 1, 3, BLOCK_SIZE).Return(nil).Once()
+	wire.On("SendRequest", 1, BLOCK_SIZE, BLOCK_SIZE).Return(nil).Once()
+	wire.On("SendRequest", 1, 2*BLOCK_SIZE, BLOCK_SIZE).Return(nil).Once()
+	wire.On("SendRequest", 1, 3*BLOCK_SIZE, BLOCK_SIZE).Return(nil).Once()
 	wire.On("SendUnInterested").Return(nil).Once()
 	peerID := "0.0.0.0"
 	peerBitField := bitmap.New(3)
@@ -104,10 +113,36 @@ func TestPieceCompleted(t *testing.T) {
 	wire.AssertExpectations(t)
 }
 
+func TestPieceLost(t *testing.T) {
+	tor := &torrent.Torrent{
+		NumPieces: 3,
+		Length:    3 * 65536,
+		MetaInfo: torrent.MetaInfo{
+			Info: torrent.Info{
+				PieceLength: 65536,
+				Pieces:      string(make([]byte, 3*20)),
+			},
+		},
+	}
+	clientBitField := bitmap.New(3)
+	clientBitField.Set(1, true)
+	pm := NewRarestFirstPieceManager(&mockDisk{})
+	pm.Init(tor, clientBitField)
+	assert.Equal(t, 1, pm.GetPiecesDownloaded())
+
+	// The piece is no longer advertised and is downloaded again
+	pm.PieceLost(1)
+	assert.Equal(t, 0, pm.GetPiecesDownloaded())
+	assert.False(t, bitmap.Bitmap(pm.GetBitField()).Get(1))
+	pm.PieceLost(1)
+	assert.Equal(t, 0, pm.GetPiecesDownloaded())
+}
+
 func TestPeerChoked(t *testing.T) {
 
 	tor := &torrent.Torrent{
 		NumPieces: 3,
+		Length:    3 * 65536,
 		MetaInfo: torrent.MetaInfo{
 			Info: torrent.Info{
 				PieceLength: 65536, // 2^16
@@ -128,17 +163,18 @@ func TestPeerChoked(t *testing.T) {
 		block4[i] = 4
 	}
 
-	pm := NewRarestFirstPieceManager(tor, nil)
+	pm := NewRarestFirstPieceManager(nil)
+	pm.Init(tor, bitmap.New(3))
 
 	MAX_OUTSTANDING_REQUESTS = 2
 	wire1 := &mockWire{}
 	wire1.On("SendRequest", 1, 0, BLOCK_SIZE).Return(nil).Once()
-	wire1.On("SendRequest", 1, 1, BLOCK_SIZE).Return(nil).Once()
-	wire1.On("SendRequest", 1, 2, BLOCK_SIZE).Return(nil).Once()
+	wire1.On("SendRequest", 1, BLOCK_SIZE, BLOCK_SIZE).Return(nil).Once()
+	wire1.On("SendRequest", 1, 2*BLOCK_SIZE, BLOCK_SIZE).Return(nil).Once()
 	wire2 := &mockWire{}
 	wire2.On("SendRequest", 1, 0, BLOCK_SIZE).Return(nil).Once()
-	wire2.On("SendRequest", 1, 2, BLOCK_SIZE).Return(nil).Once()
-	wire2.On("SendRequest", 1, 3, BLOCK_SIZE).Return(nil).Once()
+	wire2.On("SendRequest", 1, 2*BLOCK_SIZE, BLOCK_SIZE).Return(nil).Once()
+	wire2.On("SendRequest", 1, 3*BLOCK_SIZE, BLOCK_SIZE).Return(nil).Once()
 	peerID1 := "0.0.0.0"
 	peerID2 := "0.0.0.1"
 
@@ -161,10 +197,246 @@ func TestPeerChoked(t *testing.T) {
 	pm.SendBlockRequests(peerID2, wire2, &peerBitField2)
 	pm.WriteBlock(peerID2, 1, 2, block4)
 	pm.SendBlockRequests(peerID2, wire2, &peerBitField2)
-	err := pm.WriteBlock(peerID2, 1, 3, block4)
-	assert.Equal(t, err, fmt.Errorf("checksum failed"))
-	pm.SendBlockRequests(peerID2, wire2, &peerBitField2)
+	// the piece fails its checksum
+	downloadedPiece, _, err := pm.WriteBlock(peerID2, 1, 3, block4)
+	assert.False(t, downloadedPiece)
+	assert.Nil(t, err)
 
 	wire1.AssertExpectations(t)
 	wire2.AssertExpectations(t)
 }
+
+func TestSmartBan(t *testing.T) {
+	goodBlock0 := bytes.Repeat([]byte{1}, BLOCK_SIZE)
+	goodBlock1 := bytes.Repeat([]byte{2}, BLOCK_SIZE)
+	badBlock0 := bytes.Repeat([]byte{3}, BLOCK_SIZE)
+
+	pieces := make([]byte, 3*20)
+	checksum := sha1.Sum(append(append([]byte{}, goodBlock0...), goodBlock1...))
+	copy(pieces[20:40], checksum[:])
+	tor := &torrent.Torrent{
+		NumPieces: 3,
+		Length:    3 * 2 * BLOCK_SIZE,
+		MetaInfo: torrent.MetaInfo{
+			Info: torrent.Info{
+				PieceLength: 2 * BLOCK_SIZE,
+				Pieces:      string(pieces),
+			},
+		},
+	}
+
+	disk := &mockDisk{}
+	disk.On("WritePieceRequest", 1, mock.Anything).Return(nil).Once()
+
+	pm := NewRarestFirstPieceManager(disk)
+	pm.Init(tor, bitmap.New(3))
+	MAX_OUTSTANDING_REQUESTS = 1
+
+	peerID1 := "0.0.0.0"
+	peerID2 := "0.0.0.1"
+	peerBitField := bitmap.New(3)
+	peerBitField.Set(1, true)
+
+	wire1 := &mockWire{}
+	wire1.On("SendRequest", 1, 0, BLOCK_SIZE).Return(nil).Once()
+	wire2 := &mockWire{}
+	wire2.On("SendRequest", 1, BLOCK_SIZE, BLOCK_SIZE).Return(nil).Twice()
+	wire2.On("SendRequest", 1, 0, BLOCK_SIZE).Return(nil).Once()
+
+	// peer1 sends a corrupt block then chokes the client
+	pm.SendBlockRequests(peerID1, wire1, &peerBitField)
+	pm.WriteBlock(peerID1, 1, 0, badBlock0)
+	pm.PeerChoked(peerID1)
+
+	// peer2 completes the piece, which fails its checksum - neither peer is banned
+	pm.SendBlockRequests(peerID2, wire2, &peerBitField)
+	downloadedPiece, bannedPeers, err := pm.WriteBlock(peerID2, 1, 1, goodBlock1)
+	assert.False(t, downloadedPiece)
+	assert.Nil(t, bannedPeers)
+	assert.Nil(t, err)
+
+	// peer2 downloads the whole piece again, only peer1 is banned
+	pm.SendBlockRequests(peerID2, wire2, &peerBitField)
+	pm.WriteBlock(peerID2, 1, 0, goodBlock0)
+	pm.SendBlockRequests(peerID2, wire2, &peerBitField)
+	downloadedPiece, bannedPeers, err = pm.WriteBlock(peerID2, 1, 1, goodBlock1)
+	assert.True(t, downloadedPiece)
+	assert.Nil(t, err)
+	assert.True(t, bannedPeers.Equal(mapset.NewSet(peerID1)))
+
+	disk.AssertExpectations(t)
+	wire1.AssertExpectations(t)
+	wire2.AssertExpectations(t)
+}
+
+func TestFlushPartialPieces(t *testing.T) {
+	blocks := [][]byte{}
+	piece := []byte{}
+	for i := 0; i < 4; i++ {
+		block := bytes.Repeat([]byte{byte(i + 1)}, BLOCK_SIZE)
+		blocks = append(blocks, block)
+		piece = append(piece, block...)
+	}
+	checksum := sha1.Sum(piece)
+	tor := &torrent.Torrent{
+		NumPieces: 1,
+		Length:    len(piece),
+		MetaInfo: torrent.MetaInfo{
+			Info: torrent.Info{
+				PieceLength: len(piece),
+				Pieces:      string(checksum[:]),
+			},
+		},
+	}
+	disk := storage.NewMemoryStorage(0)
+	disk.Init(tor)
+
+	pm := NewRarestFirstPieceManager(disk).(*rarestFirst)
+	// Always under memory pressure
+	buffers := NewBufferPool(0)
+	pm.buffers = buffers
+	pm.Init(tor, bitmap.New(1))
+	MAX_OUTSTANDING_REQUESTS = 4
+	wire := &mockWire{}
+	for i := 0; i < 4; i++ {
+		wire.On("SendRequest", 0, i*BLOCK_SIZE, BLOCK_SIZE).Return(nil).Once()
+	}
+	peerID := "0.0.0.0"
+	peerBitField := bitmap.New(1)
+	peerBitField.Set(0, true)
+	pm.SendBlockRequests(peerID, wire, &peerBitField)
+
+	// Blocks in order from the start of the piece are flushed
+	pm.WriteBlock(peerID, 0, 0, blocks[0])
+	pm.WriteBlock(peerID, 0, 1, blocks[1])
+	pm.WriteBlock(peerID, 0, 3, blocks[3])
+	inUse, _ := buffers.GetStats()
+	assert.Equal(t, BLOCK_SIZE, inUse)
+	flushed, err := disk.BlockReadRequest(0, 0, 2*BLOCK_SIZE)
+	assert.Nil(t, err)
+	assert.Equal(t, piece[:2*BLOCK_SIZE], flushed)
+
+	downloadedPiece, bannedPeers, err := pm.WriteBlock(peerID, 0, 2, blocks[2])
+	assert.True(t, downloadedPiece)
+	assert.Nil(t, bannedPeers)
+	assert.Nil(t, err)
+	inUse, _ = buffers.GetStats()
+	assert.Equal(t, 0, inUse)
+	written, err := disk.BlockReadRequest(0, 0, len(piece))
+	assert.Nil(t, err)
+	assert.Equal(t, piece, written)
+	wire.AssertExpectations(t)
+}
+
+func TestWritePieceFailed(t *testing.T) {
+	block := bytes.Repeat([]byte{1}, BLOCK_SIZE)
+	checksum := sha1.Sum(block)
+	// The torrent isn't completed by the piece
+	tor := &torrent.Torrent{
+		NumPieces: 2,
+		Length:    2 * BLOCK_SIZE,
+		MetaInfo: torrent.MetaInfo{
+			Info: torrent.Info{
+				PieceLength: BLOCK_SIZE,
+				Pieces:      string(append(checksum[:], make([]byte, 20)...)),
+			},
+		},
+	}
+	disk := &mockDisk{}
+	disk.On("WritePieceRequest", 0, block).Return(fmt.Errorf("write failed")).Once()
+	disk.On("WritePieceRequest", 0, block).Return(nil).Once()
+	pm := NewRarestFirstPieceManager(disk)
+	pm.Init(tor, bitmap.New(2))
+	wire := &mockWire{}
+	wire.On("SendRequest", 0, 0, BLOCK_SIZE).Return(nil).Twice()
+	peerID := "0.0.0.0"
+	peerBitField := bitmap.New(2)
+	peerBitField.Set(0, true)
+
+	pm.SendBlockRequests(peerID, wire, &peerBitField)
+	downloadedPiece, _, err := pm.WriteBlock(peerID, 0, 0, block)
+	assert.False(t, downloadedPiece)
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, pm.GetPiecesDownloaded())
+
+	// The piece is requested again
+	pm.SendBlockRequests(peerID, wire, &peerBitField)
+	downloadedPiece, _, err = pm.WriteBlock(peerID, 0, 0, block)
+	assert.True(t, downloadedPiece)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, pm.GetPiecesDownloaded())
+	disk.AssertExpectations(t)
+	wire.AssertExpectations(t)
+}
+
+func TestPartialPieceLost(t *testing.T) {
+	tor := &torrent.Torrent{
+		NumPieces: 1,
+		Length:    4 * BLOCK_SIZE,
+		MetaInfo: torrent.MetaInfo{
+			Info: torrent.Info{
+				PieceLength: 4 * BLOCK_SIZE,
+				Pieces:      string(make([]byte, 20)),
+			},
+		},
+	}
+	disk := storage.NewMemoryStorage(0)
+	disk.Init(tor)
+	pm := NewRarestFirstPieceManager(disk).(*rarestFirst)
+	// Always under memory pressure
+	pm.buffers = NewBufferPool(0)
+	pm.Init(tor, bitmap.New(1))
+	MAX_OUTSTANDING_REQUESTS = 4
+	wire := &mockWire{}
+	wire.On("SendRequest", 0, mock.Anything, BLOCK_SIZE).Return(nil)
+	peerID := "0.0.0.0"
+	peerBitField := bitmap.New(1)
+	peerBitField.Set(0, true)
+	pm.SendBlockRequests(peerID, wire, &peerBitField)
+	pm.WriteBlock(peerID, 0, 0, bytes.Repeat([]byte{1}, BLOCK_SIZE))
+	pm.WriteBlock(peerID, 0, 1, bytes.Repeat([]byte{2}, BLOCK_SIZE))
+	assert.Equal(t, 2, pm.pieceInfo[0].flushed)
+
+	// The flushed blocks are downloaded again
+	pm.PieceLost(0)
+	assert.Equal(t, 0, pm.pieceInfo[0].flushed)
+	assert.Equal(t, 0, pm.pieceInfo[0].contiguous)
+	for _, block := range pm.pieceInfo[0].blocks {
+		assert.False(t, block.downloaded)
+	}
+}
+
+func TestAvailability(t *testing.T) {
+	tor := &torrent.Torrent{
+		NumPieces: 4,
+		Length:    4 * BLOCK_SIZE,
+		MetaInfo: torrent.MetaInfo{
+			Info: torrent.Info{
+				PieceLength: BLOCK_SIZE,
+			},
+		},
+	}
+	pm := NewRarestFirstPieceManager(nil)
+	pm.Init(tor, bitmap.New(4))
+	assert.Equal(t, 0.0, pm.GetAvailability())
+	assert.Equal(t, 0, pm.GetSeeders())
+
+	// A seeder and a peer with half the pieces
+	seederID := "0.0.0.0"
+	peerID := "0.0.0.1"
+	for pieceIndex := 0; pieceIndex < 4; pieceIndex++ {
+		pm.PieceHave(seederID, pieceIndex)
+	}
+	pm.PieceHave(peerID, 0)
+	pm.PieceHave(peerID, 1)
+	assert.Equal(t, 1.5, pm.GetAvailability())
+	assert.Equal(t, 1, pm.GetSeeders())
+
+	seederBitfield := bitmap.New(4)
+	for pieceIndex := 0; pieceIndex < 4; pieceIndex++ {
+		seederBitfield.Set(pieceIndex, true)
+	}
+	pm.PeerStopped(seederID, &seederBitfield)
+	assert.Equal(t, 0.5, pm.GetAvailability())
+	assert.Equal(t, 0, pm.GetSeeders())
+}
@@ -55,7 +55,7 @@ func (sv *server) Serve() {
 					return
 				}
 				tcpAddr := conn.RemoteAddr().(*net.TCPAddr)
-				sv.pm.AddPeer(tcpAddr.IP.String(), conn)
+				sv.pm.AddPeer(tcpAddr.IP.String(), conn, peer.PEER_SOURCE_INCOMING, nil)
 				sig <- 0
 			}()
 
@@ -16,7 +16,8 @@ type mockListener struct {
 
 func (m *mockListener) Accept() (net.Conn, error) {
 	args := m.Called()
-	return args.Get(0).(net.Conn), args.Error(1)
+	conn, _ := args.Get(0).(net.Conn)
+	return conn, args.Error(1)
 }
 
 func (m *mockListener) Addr() net.Addr {
@@ -34,15 +35,21 @@ type mockPM struct {
 	mock.Mock
 }
 
-func (pm *mockPM) AddPeer(peer *peer) {
-	pm.Called(peer)
+func (pm *mockPM) AddPeer(id string, conn net.Conn, source int, infoHash []byte) {
+	pm.Called(id, conn, source, infoHash)
 }
 
-type mockNetError struct {
-	net.Error
+type mockNetError struct{}
+
+func (e *mockNetError) Error() string {
+	return "timeout"
 }
 
-func (pm *mockPM) Timeout() bool {
+func (e *mockNetError) Timeout() bool {
+	return true
+}
+
+func (e *mockNetError) Temporary() bool {
 	return true
 }
 
@@ -51,34 +58,30 @@ type mockConn struct {
 }
 
 func (pm *mockConn) RemoteAddr() net.Addr {
-	return &mockAddr{}
-}
-
-type mockAddr struct {
-	net.Addr
-}
-
-func (pm *mockAddr) String() string {
-	return "0.0.0.0"
+	return &net.TCPAddr{IP: net.ParseIP("10.0.0.1")}
 }
 
 func TestServer(t *testing.T) {
 	ml := &mockListener{}
 	ml.On("Addr").Return(&net.TCPAddr{Port: 8181}, nil)
-	ml.On("Accept").Return(&mockConn{}, nil)
-	ml.On("Accept").After(time.Second * time.Duration(3)).Return(&mockNetError{})
+	conn := &mockConn{}
+	ml.On("Accept").Return(conn, nil).Once()
+	ml.On("Accept").Return(nil, &mockNetError{})
 	ml.On("Close").Return(nil)
 
 	listen = func(network, address string) (net.Listener, error) {
 		return ml, nil
 	}
 	pm := &mockPM{}
-	pm.On("AddPeer", mock.MatchedBy(func(peer *peer) bool {
-		return peer.id == "0.0.0.0"
-	})).Return()
+	// Incoming connections are answered with the info-hash of their handshake
+	pm.On("AddPeer", "10.0.0.1", conn, peer.PEER_SOURCE_INCOMING, ([]byte)(nil)).Return()
 
 	quit := make(chan int)
-	newServer(pm, quit)
+	sv, err := NewServer(pm, quit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sv.Serve()
 	<-time.After(time.Second)
 	close(quit)
 	<-time.After(time.Second)
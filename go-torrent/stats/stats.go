@@ -11,6 +11,7 @@ type Stats interface {
 	GetTrackerStats() (uploaded int, downloaded int, left int)
 	GetPeerStats() (peerStats map[string]*PeerStat)
 	UpdatePeer(id string, uploaded int, downloaded int)
+	GetRates() (uploadRate int, downloadRate int)
 }
 
 const (
@@ -67,6 +68,14 @@ func (s *stats) GetTrackerStats() (int, int, int) {
 	return s.trackerStats.TotalUpload, s.trackerStats.TotalDownload, s.trackerStats.Left
 }
 
+// Client's rates as of the last GetPeerStats, without updating them
+func (s *stats) GetRates() (int, int) {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.clientStats.UploadRate, s.clientStats.DownloadRate
+}
+
 func (s *stats) UpdatePeer(id string, uploaded int, downloaded int) {
 	s.Lock()
 	defer s.Unlock()
@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Charana123/torrent/go-torrent/torrent"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllocationModes(t *testing.T) {
+	for _, allocation := range []int{ALLOCATE_SPARSE, ALLOCATE_FULL, ALLOCATE_ON_WRITE} {
+		savePath := t.TempDir()
+		tor := multiFileTorrent(16, torrent.File{Length: 100000, Path: []string{"a"}})
+		s := NewRandomAccessStorageAt(savePath).(*randomAccessStorage)
+		s.pool = NewFilePool(8)
+		s.SetAllocationMode(allocation)
+		assert.Nil(t, s.Init(tor))
+
+		info, err := os.Stat(filepath.Join(savePath, "root", "a"))
+		assert.Nil(t, err)
+		if allocation == ALLOCATE_ON_WRITE {
+			assert.Equal(t, int64(0), info.Size())
+		} else {
+			assert.Equal(t, int64(100000), info.Size())
+		}
+
+		assert.Nil(t, s.WritePieceRequest(1, bytes.Repeat([]byte{1}, 16)))
+		// Unwritten pieces are zeros, including past the end of files
+		// allocated on write
+		block, err := s.BlockReadRequest(0, 0, 16)
+		assert.Nil(t, err)
+		assert.Equal(t, make([]byte, 16), block)
+		block, err = s.BlockReadRequest(2, 0, 16)
+		assert.Nil(t, err)
+		assert.Equal(t, make([]byte, 16), block)
+		block, err = s.BlockReadRequest(1, 0, 16)
+		assert.Nil(t, err)
+		assert.Equal(t, bytes.Repeat([]byte{1}, 16), block)
+	}
+}
+
+func TestPreallocateWithoutFallocate(t *testing.T) {
+	file, err := afero.NewMemMapFs().OpenFile("a", os.O_CREATE|os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	assert.Nil(t, preallocate(file, 100000))
+	info, err := file.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(100000), info.Size())
+}
+
+func TestDiskFull(t *testing.T) {
+	defer func() { freeSpace = diskFreeSpace }()
+	freeSpace = func(directory string) (int64, error) {
+		return 1000, nil
+	}
+
+	savePath := t.TempDir()
+	tor := multiFileTorrent(16,
+		torrent.File{Length: 600, Path: []string{"a"}},
+		torrent.File{Length: 600, Path: []string{"b"}})
+	s := NewRandomAccessStorageAt(savePath)
+	err := s.Init(tor)
+	assert.True(t, IsDiskFull(err))
+	// Nothing is created
+	_, err = os.Stat(filepath.Join(savePath, "root"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Files already on disk only need the rest of their length
+	assert.Nil(t, os.MkdirAll(filepath.Join(savePath, "root"), 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(savePath, "root", "a"), make([]byte, 600), 0644))
+	s = NewRandomAccessStorageAt(savePath)
+	assert.Nil(t, s.Init(tor))
+}
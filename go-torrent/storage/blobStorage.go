@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Charana123/torrent/go-torrent/torrent"
+	"github.com/boljen/go-bitmap"
+)
+
+const (
+	// Peers request pieces a block at a time, recently read pieces are
+	// kept rather than fetched again for every block
+	BLOB_CACHE_SIZE = 16777216 // 16 MiB
+)
+
+// BlobStore stores objects by key e.g. an S3 compatible object store
+type BlobStore interface {
+	// Get returns nil data for objects that don't exist
+	Get(key string) (data []byte, err error)
+	Put(key string, data []byte) (err error)
+}
+
+// blobStorage stores each of the torrent's pieces as an object, keyed by
+// the torrent's info-hash and the piece's index
+type blobStorage struct {
+	sync.RWMutex
+	store       BlobStore
+	prefix      string
+	torrent     *torrent.Torrent
+	fileOffsets []int
+	cache       *pieceCache
+}
+
+// NewBlobStorage stores pieces under prefix in the store
+func NewBlobStorage(store BlobStore, prefix string) Storage {
+	return &blobStorage{
+		store:  store,
+		prefix: prefix,
+		cache:  newPieceCache(BLOB_CACHE_SIZE),
+	}
+}
+
+func (b *blobStorage) Init(tor *torrent.Torrent) error {
+	b.Lock()
+	defer b.Unlock()
+
+	b.torrent = tor
+	b.fileOffsets = FileOffsets(tor)
+	return nil
+}
+
+func (b *blobStorage) key(pieceIndex int) string {
+	return b.prefix + hex.EncodeToString(b.torrent.InfoHash) + "/" + strconv.Itoa(pieceIndex)
+}
+
+func (b *blobStorage) readPiece(pieceIndex int) ([]byte, error) {
+	if piece, ok := b.cache.get(pieceIndex); ok {
+		return piece, nil
+	}
+	piece, err := b.store.Get(b.key(pieceIndex))
+	if err != nil || piece == nil {
+		return nil, err
+	}
+	b.cache.put(pieceIndex, piece)
+	return piece, nil
+}
+
+func (b *blobStorage) BlockReadRequest(pieceIndex, blockByteOffset, blockLength int) ([]byte, error) {
+	err := checkBlockRequest(b.torrent, pieceIndex, blockByteOffset, blockLength)
+	if err != nil {
+		return nil, err
+	}
+	piece, err := b.readPiece(pieceIndex)
+	if err != nil {
+		return nil, err
+	}
+	if piece == nil {
+		return nil, fmt.Errorf("Piece %d isn't stored", pieceIndex)
+	}
+	if blockByteOffset+blockLength > len(piece) {
+		return nil, fmt.Errorf("reading beyond end of piece")
+	}
+	return piece[blockByteOffset : blockByteOffset+blockLength : blockByteOffset+blockLength], nil
+}
+
+func (b *blobStorage) WritePieceRequest(pieceIndex int, data []byte) error {
+	if pieceIndex < 0 || pieceIndex >= b.torrent.NumPieces {
+		return fmt.Errorf("Invalid piece index")
+	}
+	piece := make([]byte, len(data))
+	copy(piece, data)
+	err := b.store.Put(b.key(pieceIndex), piece)
+	if err != nil {
+		return err
+	}
+	b.cache.put(pieceIndex, piece)
+	return nil
+}
+
+func (b *blobStorage) GetCurrentDownloadState() (bitmap.Bitmap, bool, int) {
+	// Missing pieces are nil, they fail verification
+	return currentDownloadState(b.torrent, func(pieceIndex, blockByteOffset, blockLength int) ([]byte, error) {
+		return b.readPiece(pieceIndex)
+	})
+}
+
+func (b *blobStorage) GetFileOffsets() []int {
+	b.RLock()
+	defer b.RUnlock()
+
+	return b.fileOffsets
+}
+
+// There are no files to apply attributes to
+func (b *blobStorage) Completed() error {
+	return nil
+}
+
+// httpBlobStore stores objects with plain GET and PUT requests to a bucket's
+// URL e.g. a MinIO bucket with an anonymous read-write policy. Requests
+// aren't signed.
+type httpBlobStore struct {
+	bucketURL string
+	client    *http.Client
+}
+
+// NewHTTPBlobStore stores objects under bucketURL e.g.
+// http://localhost:9000/torrents
+func NewHTTPBlobStore(bucketURL string, client *http.Client) BlobStore {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &httpBlobStore{
+		bucketURL: strings.TrimSuffix(bucketURL, "/"),
+		client:    client,
+	}
+}
+
+func (s *httpBlobStore) Get(key string) ([]byte, error) {
+	rsp, err := s.client.Get(s.bucketURL + "/" + key)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", key, rsp.Status)
+	}
+	return ioutil.ReadAll(rsp.Body)
+}
+
+func (s *httpBlobStore) Put(key string, data []byte) error {
+	req, err := http.NewRequest(http.MethodPut, s.bucketURL+"/"+key, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	rsp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK && rsp.StatusCode != http.StatusCreated && rsp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("PUT %s: %s", key, rsp.Status)
+	}
+	return nil
+}
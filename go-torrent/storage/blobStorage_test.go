@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/Charana123/torrent/go-torrent/torrent"
+	"github.com/stretchr/testify/assert"
+)
+
+// An object store serving a single bucket
+type fakeObjectStore struct {
+	sync.Mutex
+	objects map[string][]byte
+	gets    int
+}
+
+func (s *fakeObjectStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+		s.gets++
+		object, ok := s.objects[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(object)
+	case http.MethodPut:
+		object, _ := ioutil.ReadAll(r.Body)
+		s.objects[r.URL.Path] = object
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestBlobStorage(t *testing.T) {
+	objectStore := &fakeObjectStore{objects: make(map[string][]byte)}
+	server := httptest.NewServer(objectStore)
+	defer server.Close()
+
+	tor := multiFileTorrent(16, torrent.File{Length: 40, Path: []string{"a"}})
+	tor.InfoHash = []byte{0xab, 0xcd}
+	store := NewHTTPBlobStore(server.URL+"/bucket/", nil)
+	s := NewBlobStorage(store, "torrents/")
+	assert.Nil(t, s.Init(tor))
+
+	_, err := s.BlockReadRequest(0, 0, 16)
+	assert.NotNil(t, err)
+	for pieceIndex := 0; pieceIndex < tor.NumPieces; pieceIndex++ {
+		piece := bytes.Repeat([]byte{byte(pieceIndex + 1)}, tor.PieceSize(pieceIndex))
+		assert.Nil(t, s.WritePieceRequest(pieceIndex, piece))
+	}
+	assert.Equal(t, bytes.Repeat([]byte{3}, 8), objectStore.objects["/bucket/torrents/abcd/2"])
+
+	// Pieces are read from the store once they're no longer cached
+	s = NewBlobStorage(store, "torrents/")
+	assert.Nil(t, s.Init(tor))
+	gets := objectStore.gets
+	block, err := s.BlockReadRequest(1, 4, 8)
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{2}, 8), block)
+	block, err = s.BlockReadRequest(1, 8, 8)
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{2}, 8), block)
+	assert.Equal(t, gets+1, objectStore.gets)
+}
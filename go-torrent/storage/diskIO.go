@@ -0,0 +1,526 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/Charana123/torrent/go-torrent/torrent"
+	"github.com/boljen/go-bitmap"
+)
+
+const (
+	DISK_IO_THREADS = 4
+	// Jobs queued per priority
+	DISK_QUEUE_SIZE = 64
+	// Peers stop requesting blocks while more verified pieces than this are
+	// waiting to be written
+	MAX_PENDING_WRITE_BYTES = 67108864 // 64 MiB
+	// Consecutive pieces waiting to be written are written at once, up to this
+	MAX_COALESCED_WRITE_BYTES = 4194304 // 4 MiB
+	// Pieces read for peers are cached
+	READ_CACHE_SIZE = 33554432 // 32 MiB
+	// Pieces read ahead of the pieces peers request
+	READ_AHEAD_PIECES = 2
+)
+
+// Disk job priorities, queued jobs of a higher priority run first
+const (
+	// Blocks requested by peers or read for streaming
+	PRIORITY_READ = 0
+	// Writing verified pieces
+	PRIORITY_WRITE = 1
+	// Read-ahead and hashing pieces to check the download state
+	PRIORITY_BACKGROUND = 2
+)
+
+// DiskIO runs the reads and writes of a torrent's storage on a few threads
+// of its own. Verified pieces are written back asynchronously, consecutive
+// pieces with a single write. Pieces read for peers are cached, and the
+// following pieces are read ahead.
+type DiskIO interface {
+	Storage
+	// Start runs the disk jobs until quit is closed, pieces waiting to be
+	// written are written before it returns
+	Start()
+	// WaitWritable blocks while the pieces waiting to be written exceed
+	// MAX_PENDING_WRITE_BYTES, peers stop requesting blocks meanwhile
+	WaitWritable()
+	// Errors receives the errors of asynchronous writes e.g. to a full disk
+	Errors() <-chan error
+	// evicted is called with each piece the storage evicts, if it evicts any
+	SetEvicted(evicted func(pieceIndex int))
+	// CompletedThen completes the storage like Completed, then calls then
+	// with the storage it wraps e.g. to read the files back from disk
+	CompletedThen(then func(s Storage)) error
+	GetStats() (cacheHits, cacheMisses, coalescedWrites, pendingWriteBytes int)
+}
+
+// Storage that writes data spanning several consecutive pieces at once
+type rangeWriter interface {
+	writeRange(globalOffset int, data []byte) error
+}
+
+// Storage that tracks the pieces found on disk e.g. to rename the files
+// that are complete
+type verifiedMarker interface {
+	markVerified(bitfield bitmap.Bitmap)
+}
+
+// Storage that releases its memory mappings when the torrent is stopped
+type unmapper interface {
+	unmapAll()
+}
+
+type diskIO struct {
+	sync.Mutex
+	// Signalled as pending writes are written
+	written       *sync.Cond
+	storage       Storage
+	torrent       *torrent.Torrent
+	queues        []chan func()
+	quit          chan int
+	pendingWrites map[int][]byte
+	pendingBytes  int
+	// Times each piece was written, reads of a piece written meanwhile
+	// aren't cached
+	writes       map[int]int
+	flushing     bool
+	completed    bool
+	errors       chan error
+	cache        *pieceCache
+	readingAhead map[int]bool
+	hits         int
+	misses       int
+	coalesced    int
+	// Called once the storage is completed
+	completedThen []func(s Storage)
+}
+
+func NewDiskIO(storage Storage, quit chan int) DiskIO {
+	d := &diskIO{
+		storage:       storage,
+		quit:          quit,
+		pendingWrites: make(map[int][]byte),
+		writes:        make(map[int]int),
+		cache:         newPieceCache(READ_CACHE_SIZE),
+		readingAhead:  make(map[int]bool),
+		errors:        make(chan error, 1),
+	}
+	d.written = sync.NewCond(d)
+	for priority := PRIORITY_READ; priority <= PRIORITY_BACKGROUND; priority++ {
+		d.queues = append(d.queues, make(chan func(), DISK_QUEUE_SIZE))
+	}
+	return d
+}
+
+func (d *diskIO) Start() {
+	wg := &sync.WaitGroup{}
+	for i := 0; i < DISK_IO_THREADS; i++ {
+		wg.Add(1)
+		go func() {
+			d.work()
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	d.flush()
+	if u, ok := d.storage.(unmapper); ok {
+		u.unmapAll()
+	}
+}
+
+func (d *diskIO) work() {
+	for {
+		// Reads first, then writes, then background jobs
+		select {
+		case job := <-d.queues[PRIORITY_READ]:
+			job()
+			continue
+		default:
+		}
+		select {
+		case job := <-d.queues[PRIORITY_READ]:
+			job()
+			continue
+		case job := <-d.queues[PRIORITY_WRITE]:
+			job()
+			continue
+		default:
+		}
+		select {
+		case <-d.quit:
+			return
+		case job := <-d.queues[PRIORITY_READ]:
+			job()
+		case job := <-d.queues[PRIORITY_WRITE]:
+			job()
+		case job := <-d.queues[PRIORITY_BACKGROUND]:
+			job()
+		}
+	}
+}
+
+// Runs the job and waits for it. Once the torrent is stopped, jobs run on the
+// caller's goroutine.
+func (d *diskIO) run(priority int, job func()) {
+	done := make(chan int)
+	once := &sync.Once{}
+	do := func() {
+		once.Do(func() {
+			job()
+			close(done)
+		})
+	}
+	select {
+	case d.queues[priority] <- do:
+	case <-d.quit:
+		do()
+		return
+	}
+	select {
+	case <-done:
+	case <-d.quit:
+		// The job may never be dequeued, it runs once either way
+		do()
+	}
+}
+
+func (d *diskIO) Init(tor *torrent.Torrent) error {
+	err := d.storage.Init(tor)
+	if err != nil {
+		return err
+	}
+	d.Lock()
+	defer d.Unlock()
+
+	d.torrent = tor
+	return nil
+}
+
+// Returns the piece if it's waiting to be written or cached, otherwise the
+// times it was written
+func (d *diskIO) cached(pieceIndex int) ([]byte, int, bool) {
+	d.Lock()
+	defer d.Unlock()
+
+	if piece, ok := d.pendingWrites[pieceIndex]; ok {
+		d.hits++
+		return piece, 0, true
+	}
+	if piece, ok := d.cache.get(pieceIndex); ok {
+		d.hits++
+		return piece, 0, true
+	}
+	return nil, d.writes[pieceIndex], false
+}
+
+// Reads the piece from storage and caches it, unless it was written since
+func (d *diskIO) load(pieceIndex, writes int) ([]byte, error) {
+	piece, err := d.storage.BlockReadRequest(pieceIndex, 0, d.torrent.PieceSize(pieceIndex))
+	if err != nil {
+		return nil, err
+	}
+	d.Lock()
+	defer d.Unlock()
+
+	d.misses++
+	if d.writes[pieceIndex] == writes {
+		d.cache.put(pieceIndex, piece)
+	}
+	return piece, nil
+}
+
+func (d *diskIO) readPiece(pieceIndex, priority int) ([]byte, error) {
+	piece, writes, ok := d.cached(pieceIndex)
+	if ok {
+		return piece, nil
+	}
+	var err error
+	d.run(priority, func() {
+		piece, err = d.load(pieceIndex, writes)
+	})
+	return piece, err
+}
+
+// Peers request the blocks of a piece in order, and often the following pieces
+func (d *diskIO) readAhead(pieceIndex int) {
+	for i := pieceIndex + 1; i <= pieceIndex+READ_AHEAD_PIECES && i < d.torrent.NumPieces; i++ {
+		d.Lock()
+		cached := d.cache.contains(i)
+		_, pending := d.pendingWrites[i]
+		if cached || pending || d.readingAhead[i] {
+			d.Unlock()
+			continue
+		}
+		d.readingAhead[i] = true
+		d.Unlock()
+
+		i := i
+		select {
+		case d.queues[PRIORITY_BACKGROUND] <- func() {
+			// Read on the disk thread, it mustn't wait for another job
+			if _, writes, ok := d.cached(i); !ok {
+				d.load(i, writes)
+			}
+			d.Lock()
+			delete(d.readingAhead, i)
+			d.Unlock()
+		}:
+		default:
+			// The disk is busy
+			d.Lock()
+			delete(d.readingAhead, i)
+			d.Unlock()
+		}
+	}
+}
+
+func (d *diskIO) BlockReadRequest(pieceIndex, blockByteOffset, blockLength int) ([]byte, error) {
+	err := checkBlockRequest(d.torrent, pieceIndex, blockByteOffset, blockLength)
+	if err != nil {
+		return nil, err
+	}
+	piece, err := d.readPiece(pieceIndex, PRIORITY_READ)
+	if err != nil {
+		return nil, err
+	}
+	if blockByteOffset+blockLength > len(piece) {
+		return nil, fmt.Errorf("reading beyond end of piece")
+	}
+	d.readAhead(pieceIndex)
+	return piece[blockByteOffset : blockByteOffset+blockLength : blockByteOffset+blockLength], nil
+}
+
+// The piece is written asynchronously, the data mustn't be modified
+// afterwards. Errors writing it are received from Errors, it stays pending
+// meanwhile.
+func (d *diskIO) WritePieceRequest(pieceIndex int, piece []byte) error {
+	d.Lock()
+	if pending, ok := d.pendingWrites[pieceIndex]; ok {
+		d.pendingBytes -= len(pending)
+	}
+	d.pendingWrites[pieceIndex] = piece
+	d.pendingBytes += len(piece)
+	d.writes[pieceIndex]++
+	d.cache.remove(pieceIndex)
+	d.Unlock()
+
+	d.scheduleFlush()
+	return nil
+}
+
+func (d *diskIO) CompletedThen(then func(s Storage)) error {
+	d.Lock()
+	d.completedThen = append(d.completedThen, then)
+	d.Unlock()
+
+	return d.Completed()
+}
+
+func (d *diskIO) scheduleFlush() {
+	d.Lock()
+	if d.flushing {
+		d.Unlock()
+		return
+	}
+	d.flushing = true
+	d.Unlock()
+
+	select {
+	case d.queues[PRIORITY_WRITE] <- d.flushJob:
+	case <-d.quit:
+		d.flushJob()
+	}
+}
+
+// A single flush job is queued or running at a time. Pieces that failed to
+// be written are retried by the next write rather than straight away.
+func (d *diskIO) flushJob() {
+	err := d.flush()
+	d.Lock()
+	d.flushing = false
+	reschedule := err == nil && (len(d.pendingWrites) > 0 || d.completed)
+	d.Unlock()
+	if reschedule {
+		d.scheduleFlush()
+	}
+}
+
+// Writes the pending pieces, consecutive pieces are written at once. Pieces
+// that fail to be written stay pending, they're still read from memory.
+func (d *diskIO) flush() error {
+	d.Lock()
+	pieceIndexes := []int{}
+	pieces := make(map[int][]byte)
+	for pieceIndex, piece := range d.pendingWrites {
+		pieceIndexes = append(pieceIndexes, pieceIndex)
+		pieces[pieceIndex] = piece
+	}
+	completed := d.completed
+	completedThen := d.completedThen
+	d.completed = false
+	d.completedThen = nil
+	d.Unlock()
+	sort.Ints(pieceIndexes)
+
+	var err error
+	rw, coalesce := d.storage.(rangeWriter)
+	for len(pieceIndexes) > 0 {
+		n := 1
+		if coalesce {
+			// Every piece but the last must be whole, the last pieces of the
+			// files of v2 torrents are shorter
+			length := len(pieces[pieceIndexes[0]])
+			for n < len(pieceIndexes) &&
+				pieceIndexes[n] == pieceIndexes[n-1]+1 &&
+				len(pieces[pieceIndexes[n-1]]) == d.torrent.MetaInfo.Info.PieceLength &&
+				length+len(pieces[pieceIndexes[n]]) <= MAX_COALESCED_WRITE_BYTES {
+				length += len(pieces[pieceIndexes[n]])
+				n++
+			}
+		}
+		var writeErr error
+		if n == 1 {
+			writeErr = d.storage.WritePieceRequest(pieceIndexes[0], pieces[pieceIndexes[0]])
+		} else {
+			data := make([]byte, 0, n*d.torrent.MetaInfo.Info.PieceLength)
+			for _, pieceIndex := range pieceIndexes[:n] {
+				data = append(data, pieces[pieceIndex]...)
+			}
+			writeErr = rw.writeRange(pieceIndexes[0]*d.torrent.MetaInfo.Info.PieceLength, data)
+		}
+		if writeErr != nil {
+			fmt.Println("disk:", writeErr)
+			err = writeErr
+			select {
+			case d.errors <- writeErr:
+			default:
+				// An error is already waiting to be received
+			}
+		}
+
+		d.Lock()
+		if n > 1 {
+			d.coalesced++
+		}
+		for _, pieceIndex := range pieceIndexes[:n] {
+			// Unless the piece failed to be written, or was written again
+			// meanwhile
+			pending, ok := d.pendingWrites[pieceIndex]
+			if writeErr == nil && ok && &pending[0] == &pieces[pieceIndex][0] {
+				delete(d.pendingWrites, pieceIndex)
+				d.pendingBytes -= len(pending)
+			}
+		}
+		d.written.Broadcast()
+		d.Unlock()
+		pieceIndexes = pieceIndexes[n:]
+	}
+
+	d.Lock()
+	if completed && len(d.pendingWrites) > 0 {
+		// Completed once the remaining pieces are written
+		d.completed = true
+		d.completedThen = append(d.completedThen, completedThen...)
+		completed = false
+	}
+	d.Unlock()
+	if completed {
+		err := d.storage.Completed()
+		if err != nil {
+			fmt.Println(err)
+		}
+		// The files may have been moved to the completed directory
+		d.cache.clear()
+		for _, then := range completedThen {
+			go then(d.storage)
+		}
+	}
+	return err
+}
+
+func (d *diskIO) WaitWritable() {
+	d.Lock()
+	defer d.Unlock()
+
+	for d.pendingBytes > MAX_PENDING_WRITE_BYTES {
+		// Pieces that fail to be written stay pending
+		select {
+		case <-d.quit:
+			return
+		default:
+		}
+		d.written.Wait()
+	}
+}
+
+// Pieces waiting to be written are read as they are, the rest are read at
+// a lower priority than reads for peers
+func (d *diskIO) GetCurrentDownloadState() (bitmap.Bitmap, bool, int) {
+	bitfield, completed, left := currentDownloadState(d.torrent, func(pieceIndex, blockByteOffset, blockLength int) ([]byte, error) {
+		d.Lock()
+		piece, ok := d.pendingWrites[pieceIndex]
+		d.Unlock()
+		if ok {
+			return piece, nil
+		}
+		var err error
+		d.run(PRIORITY_BACKGROUND, func() {
+			piece, err = d.storage.BlockReadRequest(pieceIndex, blockByteOffset, blockLength)
+		})
+		return piece, err
+	})
+	if marker, ok := d.storage.(verifiedMarker); ok {
+		marker.markVerified(bitfield)
+	}
+	return bitfield, completed, left
+}
+
+func (d *diskIO) GetFileOffsets() []int {
+	return d.storage.GetFileOffsets()
+}
+
+// The storage is completed once the pieces waiting to be written are
+// written, errors are printed
+func (d *diskIO) Completed() error {
+	d.Lock()
+	d.completed = true
+	d.Unlock()
+
+	d.scheduleFlush()
+	return nil
+}
+
+// Moves the storage's files, reads and writes wait meanwhile. Pieces read
+// before the move are no longer cached.
+func (d *diskIO) Move(newPath string, adopt bool, progress func(moved, total int64)) error {
+	mover, ok := d.storage.(Mover)
+	if !ok {
+		return fmt.Errorf("Storage can't be moved")
+	}
+	err := mover.Move(newPath, adopt, progress)
+	d.cache.clear()
+	return err
+}
+
+// Pieces evicted by the storage are no longer cached either
+func (d *diskIO) SetEvicted(evicted func(pieceIndex int)) {
+	if evicting, ok := d.storage.(EvictingStorage); ok {
+		evicting.SetEvicted(func(pieceIndex int) {
+			d.cache.remove(pieceIndex)
+			evicted(pieceIndex)
+		})
+	}
+}
+
+func (d *diskIO) Errors() <-chan error {
+	return d.errors
+}
+
+func (d *diskIO) GetStats() (int, int, int, int) {
+	d.Lock()
+	defer d.Unlock()
+
+	return d.hits, d.misses, d.coalesced, d.pendingBytes
+}
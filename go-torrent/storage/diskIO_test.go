@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Charana123/torrent/go-torrent/torrent"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func waitWritten(d DiskIO) {
+	for {
+		_, _, _, pendingWriteBytes := d.GetStats()
+		if pendingWriteBytes == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDiskIO(t *testing.T) {
+	appFS = afero.NewMemMapFs()
+	openFile = appFS.OpenFile
+	defer func() {
+		appFS = afero.NewOsFs()
+		openFile = appFS.OpenFile
+	}()
+
+	tor := multiFileTorrent(16,
+		torrent.File{Length: 30, Path: []string{"a"}},
+		torrent.File{Length: 34, Path: []string{"b"}})
+	s := NewRandomAccessStorageAt("save").(*randomAccessStorage)
+	s.pool = NewFilePool(8)
+	quit := make(chan int)
+	d := NewDiskIO(s, quit)
+	assert.Nil(t, d.Init(tor))
+
+	// Written once the disk threads start, in a single write
+	for _, pieceIndex := range []int{2, 0, 1} {
+		piece := bytes.Repeat([]byte{byte(pieceIndex + 1)}, tor.PieceSize(pieceIndex))
+		assert.Nil(t, d.WritePieceRequest(pieceIndex, piece))
+	}
+	block, err := d.BlockReadRequest(1, 0, 8)
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{2}, 8), block)
+
+	stopped := make(chan int)
+	go func() {
+		d.Start()
+		close(stopped)
+	}()
+	waitWritten(d)
+	_, _, coalescedWrites, _ := d.GetStats()
+	assert.Equal(t, 1, coalescedWrites)
+	a, err := afero.ReadFile(appFS, "save/root/a")
+	assert.Nil(t, err)
+	assert.Equal(t, append(bytes.Repeat([]byte{1}, 16), bytes.Repeat([]byte{2}, 14)...), a)
+
+	// Read from disk, then cached
+	block, err = d.BlockReadRequest(0, 8, 8)
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{1}, 8), block)
+	block, err = d.BlockReadRequest(0, 0, 8)
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{1}, 8), block)
+	cacheHits, cacheMisses, _, _ := d.GetStats()
+	assert.Equal(t, 2, cacheHits)
+	assert.True(t, cacheMisses >= 1)
+
+	// Pieces written again aren't read from the cache
+	assert.Nil(t, d.WritePieceRequest(0, bytes.Repeat([]byte{9}, 16)))
+	block, err = d.BlockReadRequest(0, 0, 8)
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{9}, 8), block)
+
+	// Pieces waiting to be written are written once stopped
+	assert.Nil(t, d.WritePieceRequest(3, bytes.Repeat([]byte{4}, 16)))
+	close(quit)
+	<-stopped
+	b, err := afero.ReadFile(appFS, "save/root/b")
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{4}, 16), b[18:])
+	// Jobs run on the caller's goroutine
+	block, err = d.BlockReadRequest(3, 0, 16)
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{4}, 16), block)
+}
+
+type failingStorage struct {
+	Storage
+	sync.Mutex
+	failing bool
+}
+
+func (f *failingStorage) WritePieceRequest(pieceIndex int, data []byte) error {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.failing {
+		return fmt.Errorf("write failed")
+	}
+	return f.Storage.WritePieceRequest(pieceIndex, data)
+}
+
+func TestDiskIOWriteFailed(t *testing.T) {
+	tor := multiFileTorrent(16, torrent.File{Length: 32, Path: []string{"a"}})
+	s := &failingStorage{Storage: NewMemoryStorage(0), failing: true}
+	assert.Nil(t, s.Init(tor))
+	quit := make(chan int)
+	d := NewDiskIO(s, quit)
+	assert.Nil(t, d.Init(tor))
+	stopped := make(chan int)
+	go func() {
+		d.Start()
+		close(stopped)
+	}()
+
+	assert.Nil(t, d.WritePieceRequest(0, bytes.Repeat([]byte{1}, 16)))
+	assert.NotNil(t, <-d.Errors())
+	// The piece stays pending, it's read from memory
+	_, _, _, pendingWriteBytes := d.GetStats()
+	assert.Equal(t, 16, pendingWriteBytes)
+	block, err := d.BlockReadRequest(0, 0, 16)
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{1}, 16), block)
+	// The error isn't returned by the following write
+	assert.Nil(t, d.WritePieceRequest(1, bytes.Repeat([]byte{2}, 16)))
+
+	// Written again once stopped
+	s.Lock()
+	s.failing = false
+	s.Unlock()
+	close(quit)
+	<-stopped
+	_, _, _, pendingWriteBytes = d.GetStats()
+	assert.Equal(t, 0, pendingWriteBytes)
+	block, err = s.Storage.BlockReadRequest(0, 0, 16)
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{1}, 16), block)
+	block, err = s.Storage.BlockReadRequest(1, 0, 16)
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{2}, 16), block)
+}
+
+func TestDiskIOReadAhead(t *testing.T) {
+	tor := multiFileTorrent(16, torrent.File{Length: 64, Path: []string{"a"}})
+	s := NewMemoryStorage(0)
+	assert.Nil(t, s.Init(tor))
+	for pieceIndex := 0; pieceIndex < tor.NumPieces; pieceIndex++ {
+		assert.Nil(t, s.WritePieceRequest(pieceIndex, bytes.Repeat([]byte{byte(pieceIndex)}, 16)))
+	}
+	quit := make(chan int)
+	defer close(quit)
+	d := NewDiskIO(s, quit)
+	assert.Nil(t, d.Init(tor))
+	go d.Start()
+
+	_, err := d.BlockReadRequest(0, 0, 16)
+	assert.Nil(t, err)
+	// The following pieces are read ahead
+	for {
+		_, cacheMisses, _, _ := d.GetStats()
+		if cacheMisses == 1+READ_AHEAD_PIECES {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	block, err := d.BlockReadRequest(2, 0, 16)
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{2}, 16), block)
+	cacheHits, _, _, _ := d.GetStats()
+	assert.Equal(t, 1, cacheHits)
+}
+
+func TestDiskIOCompletedThen(t *testing.T) {
+	tor := multiFileTorrent(16, torrent.File{Length: 32, Path: []string{"a"}})
+	s := NewMemoryStorage(0)
+	assert.Nil(t, s.Init(tor))
+	quit := make(chan int)
+	defer close(quit)
+	d := NewDiskIO(s, quit)
+	assert.Nil(t, d.Init(tor))
+
+	for pieceIndex := 0; pieceIndex < tor.NumPieces; pieceIndex++ {
+		assert.Nil(t, d.WritePieceRequest(pieceIndex, bytes.Repeat([]byte{byte(pieceIndex + 1)}, 16)))
+	}
+	completed := make(chan Storage)
+	assert.Nil(t, d.CompletedThen(func(s Storage) {
+		completed <- s
+	}))
+	go d.Start()
+
+	// Called with the wrapped storage, once the pieces are written to it
+	assert.Equal(t, s, <-completed)
+	for pieceIndex := 0; pieceIndex < tor.NumPieces; pieceIndex++ {
+		block, err := s.BlockReadRequest(pieceIndex, 0, 16)
+		assert.Nil(t, err)
+		assert.Equal(t, bytes.Repeat([]byte{byte(pieceIndex + 1)}, 16), block)
+	}
+}
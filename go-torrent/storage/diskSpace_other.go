@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package storage
+
+import "fmt"
+
+// Free space isn't checked on this platform
+func diskFreeSpace(directory string) (int64, error) {
+	return 0, fmt.Errorf("Free disk space unknown")
+}
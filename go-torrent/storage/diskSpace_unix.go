@@ -0,0 +1,16 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package storage
+
+import "syscall"
+
+// Bytes available to unprivileged users on the file system of the directory
+func diskFreeSpace(directory string) (int64, error) {
+	stat := &syscall.Statfs_t{}
+	err := syscall.Statfs(directory, stat)
+	if err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
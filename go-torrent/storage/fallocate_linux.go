@@ -0,0 +1,27 @@
+package storage
+
+import (
+	"syscall"
+
+	"github.com/spf13/afero"
+)
+
+// Allocates the file's blocks up to length, false where fallocate isn't
+// supported by the file system
+func fallocate(file afero.File, length int64) (bool, error) {
+	// fallocate rejects an empty range
+	if length == 0 {
+		return true, nil
+	}
+	f, ok := file.(interface {
+		Fd() uintptr
+	})
+	if !ok {
+		return false, nil
+	}
+	err := syscall.Fallocate(int(f.Fd()), 0, 0, length)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package storage
+
+import "github.com/spf13/afero"
+
+// Files are preallocated by writing zeros on this platform
+func fallocate(file afero.File, length int64) (bool, error) {
+	return false, nil
+}
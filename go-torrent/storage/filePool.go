@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"container/list"
+	"os"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	// Well under the usual limit of 1024 descriptors per process, which are
+	// shared with peer connections
+	DEFAULT_MAX_OPEN_FILES = 512
+)
+
+// FilePool keeps the files of every torrent open up to a maximum, closing
+// the least recently used files beyond it. Files are opened on their first
+// read or write.
+type FilePool interface {
+	// Acquire returns the open file, it isn't closed before it's released
+	Acquire(path string) (file afero.File, err error)
+	Release(path string)
+	// Closes the file once it's released e.g. before it's moved
+	Close(path string)
+	SetMaxOpenFiles(maxOpenFiles int)
+	GetStats() (hits, misses, evictions, openFiles int)
+}
+
+type pooledFile struct {
+	path   string
+	file   afero.File
+	refs   int
+	closed bool
+}
+
+type filePool struct {
+	sync.Mutex
+	maxOpenFiles int
+	files        map[string]*list.Element
+	// Most recently used first
+	lru       *list.List
+	hits      int
+	misses    int
+	evictions int
+}
+
+// Shared by the storage of every torrent
+var sharedFilePool = NewFilePool(DEFAULT_MAX_OPEN_FILES)
+
+func NewFilePool(maxOpenFiles int) FilePool {
+	return &filePool{
+		maxOpenFiles: maxOpenFiles,
+		files:        make(map[string]*list.Element),
+		lru:          list.New(),
+	}
+}
+
+// GetFilePool returns the pool shared by the storage of every torrent
+func GetFilePool() FilePool {
+	return sharedFilePool
+}
+
+func (fp *filePool) Acquire(path string) (afero.File, error) {
+	fp.Lock()
+	defer fp.Unlock()
+
+	if e, ok := fp.files[path]; ok {
+		fp.hits++
+		pf := e.Value.(*pooledFile)
+		pf.refs++
+		fp.lru.MoveToFront(e)
+		return pf.file, nil
+	}
+	fp.misses++
+	// Make room before opening the file, to stay under the maximum
+	fp.evict(fp.maxOpenFiles - 1)
+	file, err := openFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fp.files[path] = fp.lru.PushFront(&pooledFile{
+		path: path,
+		file: file,
+		refs: 1,
+	})
+	return file, nil
+}
+
+func (fp *filePool) Release(path string) {
+	fp.Lock()
+	defer fp.Unlock()
+
+	e, ok := fp.files[path]
+	if !ok {
+		return
+	}
+	pf := e.Value.(*pooledFile)
+	pf.refs--
+	if pf.refs == 0 && pf.closed {
+		fp.remove(e)
+		return
+	}
+	fp.evict(fp.maxOpenFiles)
+}
+
+func (fp *filePool) Close(path string) {
+	fp.Lock()
+	defer fp.Unlock()
+
+	e, ok := fp.files[path]
+	if !ok {
+		return
+	}
+	pf := e.Value.(*pooledFile)
+	if pf.refs > 0 {
+		// Closed when it's released
+		pf.closed = true
+		return
+	}
+	fp.remove(e)
+}
+
+func (fp *filePool) SetMaxOpenFiles(maxOpenFiles int) {
+	fp.Lock()
+	defer fp.Unlock()
+
+	fp.maxOpenFiles = maxOpenFiles
+	fp.evict(fp.maxOpenFiles)
+}
+
+func (fp *filePool) GetStats() (int, int, int, int) {
+	fp.Lock()
+	defer fp.Unlock()
+
+	return fp.hits, fp.misses, fp.evictions, fp.lru.Len()
+}
+
+// Closes the least recently used files that aren't in use until at most
+// maxOpenFiles are open. Files in use are never closed, the pool goes over
+// its maximum when more files are in use at once.
+func (fp *filePool) evict(maxOpenFiles int) {
+	e := fp.lru.Back()
+	for fp.lru.Len() > maxOpenFiles && e != nil {
+		prev := e.Prev()
+		if e.Value.(*pooledFile).refs == 0 {
+			fp.remove(e)
+			fp.evictions++
+		}
+		e = prev
+	}
+}
+
+func (fp *filePool) remove(e *list.Element) {
+	pf := e.Value.(*pooledFile)
+	pf.file.Close()
+	fp.lru.Remove(e)
+	delete(fp.files, pf.path)
+}
@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/Charana123/torrent/go-torrent/torrent"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+// Counts the files open at once
+type countedFile struct {
+	afero.File
+	counter *openCounter
+}
+
+func (f *countedFile) Close() error {
+	f.counter.Lock()
+	f.counter.open--
+	f.counter.Unlock()
+	return f.File.Close()
+}
+
+type openCounter struct {
+	sync.Mutex
+	open    int
+	maxOpen int
+}
+
+func (c *openCounter) openFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	file, err := appFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.open++
+	if c.open > c.maxOpen {
+		c.maxOpen = c.open
+	}
+	return &countedFile{File: file, counter: c}, nil
+}
+
+func TestFilePool(t *testing.T) {
+	appFS = afero.NewMemMapFs()
+	counter := &openCounter{}
+	openFile = counter.openFile
+	defer func() {
+		appFS = afero.NewOsFs()
+		openFile = appFS.OpenFile
+	}()
+
+	numFiles := 5000
+	fileLength := 100
+	files := []torrent.File{}
+	for i := 0; i < numFiles; i++ {
+		files = append(files, torrent.File{Length: fileLength, Path: []string{fmt.Sprintf("file%d", i)}})
+	}
+	pieceLength := 256
+	length := numFiles * fileLength
+	tor := &torrent.Torrent{
+		NumPieces: (length + pieceLength - 1) / pieceLength,
+		Length:    length,
+		MetaInfo: torrent.MetaInfo{
+			Info: torrent.Info{
+				PieceLength: pieceLength,
+				Name:        "root",
+				Files:       files,
+			},
+		},
+	}
+	pool := NewFilePool(64)
+	s := NewRandomAccessStorageAt("save").(*randomAccessStorage)
+	s.pool = pool
+	assert.Nil(t, s.Init(tor))
+	// Files are created, but not kept open
+	assert.Equal(t, 0, counter.open)
+	_, err := appFS.Stat("save/root/file4999")
+	assert.Nil(t, err)
+
+	for pieceIndex := 0; pieceIndex < tor.NumPieces; pieceIndex++ {
+		piece := bytes.Repeat([]byte{byte(pieceIndex)}, tor.PieceSize(pieceIndex))
+		assert.Nil(t, s.WritePieceRequest(pieceIndex, piece))
+	}
+	for pieceIndex := 0; pieceIndex < tor.NumPieces; pieceIndex++ {
+		piece, err := s.BlockReadRequest(pieceIndex, 0, tor.PieceSize(pieceIndex))
+		assert.Nil(t, err)
+		assert.Equal(t, bytes.Repeat([]byte{byte(pieceIndex)}, tor.PieceSize(pieceIndex)), piece)
+	}
+
+	assert.True(t, counter.maxOpen <= 64)
+	hits, misses, evictions, openFiles := pool.GetStats()
+	assert.Equal(t, 64, openFiles)
+	assert.Equal(t, counter.open, openFiles)
+	// Every file is opened to write it and again to read it
+	assert.Equal(t, 2*numFiles, misses)
+	assert.Equal(t, misses-64, evictions)
+	assert.True(t, hits > 0)
+
+	pool.SetMaxOpenFiles(8)
+	_, _, _, openFiles = pool.GetStats()
+	assert.Equal(t, 8, openFiles)
+}
+
+func TestFilePoolInUse(t *testing.T) {
+	appFS = afero.NewMemMapFs()
+	openFile = appFS.OpenFile
+	defer func() {
+		appFS = afero.NewOsFs()
+		openFile = appFS.OpenFile
+	}()
+
+	pool := NewFilePool(1)
+	a, err := pool.Acquire("a")
+	assert.Nil(t, err)
+	_, err = pool.Acquire("b")
+	assert.Nil(t, err)
+	// Files in use aren't closed
+	_, _, evictions, openFiles := pool.GetStats()
+	assert.Equal(t, 0, evictions)
+	assert.Equal(t, 2, openFiles)
+	_, err = a.WriteAt([]byte{1}, 0)
+	assert.Nil(t, err)
+
+	pool.Release("a")
+	_, _, evictions, openFiles = pool.GetStats()
+	assert.Equal(t, 1, evictions)
+	assert.Equal(t, 1, openFiles)
+
+	// Closed files are closed once they're released
+	pool.Close("b")
+	_, _, _, openFiles = pool.GetStats()
+	assert.Equal(t, 1, openFiles)
+	pool.Release("b")
+	_, _, _, openFiles = pool.GetStats()
+	assert.Equal(t, 0, openFiles)
+}
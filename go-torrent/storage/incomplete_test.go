@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Charana123/torrent/go-torrent/torrent"
+	"github.com/boljen/go-bitmap"
+	"github.com/stretchr/testify/assert"
+)
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestPartSuffix(t *testing.T) {
+	savePath := t.TempDir()
+	tor := multiFileTorrent(16,
+		torrent.File{Length: 20, Path: []string{"a"}},
+		torrent.File{Length: 20, Path: []string{"b"}})
+	s := NewRandomAccessStorageAt(savePath).(*randomAccessStorage)
+	s.pool = NewFilePool(8)
+	s.SetIncomplete(".part", "")
+	assert.Nil(t, s.Init(tor))
+	assert.True(t, exists(filepath.Join(savePath, "root", "a.part")))
+	assert.True(t, exists(filepath.Join(savePath, "root", "b.part")))
+
+	// a spans the first two pieces
+	assert.Nil(t, s.WritePieceRequest(0, bytes.Repeat([]byte{1}, 16)))
+	assert.False(t, exists(filepath.Join(savePath, "root", "a")))
+	assert.Nil(t, s.WritePieceRequest(1, bytes.Repeat([]byte{2}, 16)))
+	assert.True(t, exists(filepath.Join(savePath, "root", "a")))
+	assert.False(t, exists(filepath.Join(savePath, "root", "a.part")))
+	assert.True(t, exists(filepath.Join(savePath, "root", "b.part")))
+
+	// Renamed files are read and written at their new path
+	block, err := s.BlockReadRequest(1, 0, 16)
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{2}, 16), block)
+	assert.Nil(t, s.WritePieceRequest(2, bytes.Repeat([]byte{3}, 8)))
+	assert.True(t, exists(filepath.Join(savePath, "root", "b")))
+	assert.False(t, exists(filepath.Join(savePath, "root", "b.part")))
+	block, err = s.BlockReadRequest(0, 0, 16)
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{1}, 16), block)
+
+	// Complete files are found at their final path when the storage is
+	// initialised again
+	s = NewRandomAccessStorageAt(savePath).(*randomAccessStorage)
+	s.pool = NewFilePool(8)
+	s.SetIncomplete(".part", "")
+	assert.Nil(t, s.Init(tor))
+	assert.False(t, exists(filepath.Join(savePath, "root", "a.part")))
+	block, err = s.BlockReadRequest(2, 0, 8)
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{3}, 8), block)
+}
+
+func TestIncompleteDirectory(t *testing.T) {
+	savePath := t.TempDir()
+	incompleteDirectory := t.TempDir()
+	completedDirectory := t.TempDir()
+	tor := multiFileTorrent(16,
+		torrent.File{Length: 20, Path: []string{"dir", "a"}},
+		torrent.File{Length: 20, Path: []string{"b"}})
+	s := NewRandomAccessStorageAt(savePath).(*randomAccessStorage)
+	s.pool = NewFilePool(8)
+	s.SetIncomplete("", incompleteDirectory)
+	s.SetCompletedDirectory(completedDirectory)
+	assert.Nil(t, s.Init(tor))
+	assert.True(t, exists(filepath.Join(incompleteDirectory, "root", "dir", "a")))
+	assert.False(t, exists(filepath.Join(savePath, "root", "dir", "a")))
+
+	assert.Nil(t, s.WritePieceRequest(0, bytes.Repeat([]byte{1}, 16)))
+	assert.Nil(t, s.WritePieceRequest(1, bytes.Repeat([]byte{2}, 16)))
+	assert.True(t, exists(filepath.Join(savePath, "root", "dir", "a")))
+	assert.False(t, exists(filepath.Join(incompleteDirectory, "root", "dir", "a")))
+	assert.Nil(t, s.WritePieceRequest(2, bytes.Repeat([]byte{3}, 8)))
+
+	// The whole torrent is moved once it's complete
+	assert.Nil(t, s.Completed())
+	assert.True(t, exists(filepath.Join(completedDirectory, "root", "dir", "a")))
+	assert.True(t, exists(filepath.Join(completedDirectory, "root", "b")))
+	assert.False(t, exists(filepath.Join(savePath, "root")))
+	block, err := s.BlockReadRequest(1, 0, 16)
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{2}, 16), block)
+
+	// and found there when the storage is initialised again
+	s = NewRandomAccessStorageAt(savePath).(*randomAccessStorage)
+	s.pool = NewFilePool(8)
+	s.SetIncomplete("", incompleteDirectory)
+	s.SetCompletedDirectory(completedDirectory)
+	assert.Nil(t, s.Init(tor))
+	assert.False(t, exists(filepath.Join(savePath, "root")))
+	block, err = s.BlockReadRequest(2, 0, 8)
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{3}, 8), block)
+}
+
+func TestPartSuffixResume(t *testing.T) {
+	savePath := t.TempDir()
+	tor := multiFileTorrent(16,
+		torrent.File{Length: 20, Path: []string{"a"}},
+		torrent.File{Length: 20, Path: []string{"b"}})
+	s := NewRandomAccessStorageAt(savePath).(*randomAccessStorage)
+	s.pool = NewFilePool(8)
+	s.SetIncomplete(".part", "")
+	assert.Nil(t, s.Init(tor))
+
+	// The first two pieces were found on disk after a restart
+	bitfield := bitmap.New(tor.NumPieces)
+	bitfield.Set(0, true)
+	bitfield.Set(1, true)
+	s.markVerified(bitfield)
+	assert.True(t, exists(filepath.Join(savePath, "root", "a")))
+	assert.True(t, exists(filepath.Join(savePath, "root", "b.part")))
+}
@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Charana123/torrent/go-torrent/torrent"
+)
+
+func (d *randomAccessStorage) SetLayout(layout int, paths []string, avoidCollisions bool) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.layout = layout
+	d.layoutPaths = paths
+	d.avoidCollisions = avoidCollisions
+}
+
+func (d *randomAccessStorage) GetLayoutPaths() []string {
+	d.RLock()
+	defer d.RUnlock()
+
+	return append([]string(nil), d.layoutPaths...)
+}
+
+// Lays out the torrent's files under the directory, unless they were laid
+// out before
+func (d *randomAccessStorage) layOut(directory string) error {
+	files := d.torrent.MetaInfo.Info.Files
+	if d.layoutPaths != nil {
+		if len(d.layoutPaths) != len(files) {
+			return fmt.Errorf("Layout has %d paths, the torrent has %d files", len(d.layoutPaths), len(files))
+		}
+		for fileIndex, path := range d.layoutPaths {
+			if path == "" && !files[fileIndex].IsPadding() {
+				return fmt.Errorf("File %v isn't laid out", files[fileIndex].Path)
+			}
+		}
+		return nil
+	}
+
+	// Files in the way are the torrent's own when they're only read
+	avoidCollisions := d.avoidCollisions && !d.readOnly
+	paths := make([][]string, len(files))
+	for fileIndex, file := range files {
+		if !file.IsPadding() {
+			paths[fileIndex] = d.layoutPath(fileIndex)
+		}
+	}
+	switch {
+	case d.layout == LAYOUT_ORIGINAL && avoidCollisions && len(files) > 0:
+		// Another torrent of the same name, the torrent's directory (or
+		// file) is renamed
+		name := d.torrent.MetaInfo.Info.Name
+		for n := 1; pathExists(directory, name); n++ {
+			name = uniqueName(d.torrent.MetaInfo.Info.Name, n, d.torrent.MetaInfo.Info.Length > 0)
+		}
+		for _, path := range paths {
+			if path != nil {
+				path[0] = name
+			}
+		}
+	case d.layout == LAYOUT_FLAT || d.layout == LAYOUT_STRIP_ROOT:
+		// Files are renamed, files of the torrent may also share a name
+		// in the flat layout
+		taken := map[string]bool{}
+		for _, path := range paths {
+			if path == nil {
+				continue
+			}
+			name := path[len(path)-1]
+			for n := 1; taken[filepath.Join(path...)] || (avoidCollisions && pathExists(directory, path...)); n++ {
+				path[len(path)-1] = uniqueName(name, n, true)
+			}
+			taken[filepath.Join(path...)] = true
+		}
+	}
+
+	d.layoutPaths = make([]string, len(files))
+	for fileIndex, path := range paths {
+		if path != nil {
+			d.layoutPaths[fileIndex] = filepath.Join(path...)
+		}
+	}
+	return nil
+}
+
+// Path components of the file in the layout
+func (d *randomAccessStorage) layoutPath(fileIndex int) []string {
+	info := d.torrent.MetaInfo.Info
+	path := info.Files[fileIndex].Path
+	if info.Length > 0 {
+		// Single File Mode, the file is named after the torrent
+		path = nil
+	}
+	switch d.layout {
+	case LAYOUT_INFO_HASH:
+		return append([]string{hex.EncodeToString(d.torrent.InfoHash), info.Name}, path...)
+	case LAYOUT_FLAT:
+		if len(path) > 0 {
+			return []string{path[len(path)-1]}
+		}
+		return []string{info.Name}
+	case LAYOUT_STRIP_ROOT:
+		if len(path) > 0 {
+			return append([]string(nil), path...)
+		}
+		return []string{info.Name}
+	default:
+		return append([]string{info.Name}, path...)
+	}
+}
+
+// Directory the torrent's sub-directories are laid out under, in the layouts
+// that keep them
+func (d *randomAccessStorage) torrentDirectory(directory string) (string, error) {
+	if d.layout == LAYOUT_FLAT {
+		return "", fmt.Errorf("The flat layout doesn't keep the torrent's directories")
+	}
+	for fileIndex, file := range d.torrent.MetaInfo.Info.Files {
+		if d.layoutPaths[fileIndex] == "" {
+			continue
+		}
+		path := strings.Split(d.layoutPaths[fileIndex], string(filepath.Separator))
+		return joinPath(directory, path[:len(path)-len(file.Path)]...)
+	}
+	return directory, nil
+}
+
+// Path of the file in the layout under the directory
+func (d *randomAccessStorage) filePath(directory string, fileIndex int) (string, error) {
+	return joinPath(directory, d.layoutPaths[fileIndex])
+}
+
+// Inserts the number before the file's extension e.g. "name (1).ext"
+func uniqueName(name string, n int, isFile bool) string {
+	ext := ""
+	if isFile {
+		ext = filepath.Ext(name)
+	}
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), n, ext)
+}
+
+func pathExists(directory string, path ...string) bool {
+	joined, err := joinPath(directory, path...)
+	if err != nil {
+		return false
+	}
+	_, err = appFS.Stat(joined)
+	return err == nil
+}
+
+// Path the symlink points to, the torrent's file at SymlinkPath or a path
+// under the torrent's directory
+func (d *randomAccessStorage) symlinkTarget(file torrent.File) (string, error) {
+	for fileIndex, target := range d.torrent.MetaInfo.Info.Files {
+		if d.layoutPaths[fileIndex] != "" && strings.Join(target.Path, "/") == strings.Join(file.SymlinkPath, "/") {
+			return d.filePath(d.rootDirectory, fileIndex)
+		}
+	}
+	torrentDirectory, err := d.torrentDirectory(d.rootDirectory)
+	if err != nil {
+		return "", err
+	}
+	target, err := joinPath(torrentDirectory, file.SymlinkPath...)
+	if err != nil {
+		return "", fmt.Errorf("Symlink %v points outside of the torrent", file.Path)
+	}
+	return target, nil
+}
+
+// RemoveLayout removes the files laid out at paths under the directory, with
+// or without the suffix of incomplete files, and the directories left empty
+func RemoveLayout(directory string, paths []string, suffix string) error {
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		joined, err := joinPath(directory, path)
+		if err != nil {
+			return err
+		}
+		for _, name := range []string{joined, joined + suffix} {
+			err = appFS.Remove(name)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		removeEmptyParents(joined, directory)
+	}
+	return nil
+}
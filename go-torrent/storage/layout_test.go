@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/Charana123/torrent/go-torrent/torrent"
+	"github.com/stretchr/testify/assert"
+)
+
+func layoutTorrent() *torrent.Torrent {
+	tor := multiFileTorrent(16,
+		torrent.File{Length: 10, Path: []string{"dir", "a.txt"}},
+		torrent.File{Length: 6, Path: []string{".pad", "6"}, Attr: "p"},
+		torrent.File{Length: 10, Path: []string{"a.txt"}})
+	tor.InfoHash = []byte("aaaaaaaaaaaaaaaaaaaa")
+	return tor
+}
+
+func TestLayouts(t *testing.T) {
+	layouts := map[int][]string{
+		LAYOUT_ORIGINAL:   {filepath.Join("root", "dir", "a.txt"), "", filepath.Join("root", "a.txt")},
+		LAYOUT_INFO_HASH:  {filepath.Join("6161616161616161616161616161616161616161", "root", "dir", "a.txt"), "", filepath.Join("6161616161616161616161616161616161616161", "root", "a.txt")},
+		LAYOUT_STRIP_ROOT: {filepath.Join("dir", "a.txt"), "", "a.txt"},
+		// The files share a name
+		LAYOUT_FLAT: {"a.txt", "", "a (1).txt"},
+	}
+	for layout, paths := range layouts {
+		savePath := t.TempDir()
+		s := NewRandomAccessStorageAt(savePath).(*randomAccessStorage)
+		s.SetLayout(layout, nil, true)
+		assert.Nil(t, s.Init(layoutTorrent()))
+		assert.Equal(t, paths, s.GetLayoutPaths())
+		assert.True(t, exists(filepath.Join(savePath, paths[0])))
+		assert.True(t, exists(filepath.Join(savePath, paths[2])))
+	}
+
+	// Single File Mode
+	tor := multiFileTorrent(16)
+	tor.Length = 10
+	tor.NumPieces = 1
+	tor.MetaInfo.Info.Length = 10
+	tor.MetaInfo.Info.Name = "file.txt"
+	s := NewRandomAccessStorageAt(t.TempDir()).(*randomAccessStorage)
+	s.SetLayout(LAYOUT_STRIP_ROOT, nil, true)
+	assert.Nil(t, s.Init(tor))
+	assert.Equal(t, []string{"file.txt"}, s.GetLayoutPaths())
+}
+
+func TestLayoutCollisions(t *testing.T) {
+	savePath := t.TempDir()
+	s := NewRandomAccessStorageAt(savePath).(*randomAccessStorage)
+	s.SetLayout(LAYOUT_ORIGINAL, nil, true)
+	assert.Nil(t, s.Init(layoutTorrent()))
+
+	// Another torrent of the same name
+	other := NewRandomAccessStorageAt(savePath).(*randomAccessStorage)
+	other.SetLayout(LAYOUT_ORIGINAL, nil, true)
+	assert.Nil(t, other.Init(layoutTorrent()))
+	assert.Equal(t, filepath.Join("root (1)", "a.txt"), other.GetLayoutPaths()[2])
+	other = NewRandomAccessStorageAt(savePath).(*randomAccessStorage)
+	other.SetLayout(LAYOUT_STRIP_ROOT, nil, true)
+	assert.Nil(t, other.Init(layoutTorrent()))
+	assert.Equal(t, []string{filepath.Join("dir", "a.txt"), "", "a.txt"}, other.GetLayoutPaths())
+	other = NewRandomAccessStorageAt(filepath.Join(savePath, "root")).(*randomAccessStorage)
+	other.SetLayout(LAYOUT_STRIP_ROOT, nil, true)
+	assert.Nil(t, other.Init(layoutTorrent()))
+	assert.Equal(t, []string{filepath.Join("dir", "a (1).txt"), "", "a (1).txt"}, other.GetLayoutPaths())
+
+	// The torrent's own files are found at the paths it was laid out at
+	paths := s.GetLayoutPaths()
+	s = NewRandomAccessStorageAt(savePath).(*randomAccessStorage)
+	s.SetLayout(LAYOUT_ORIGINAL, paths, true)
+	assert.Nil(t, s.Init(layoutTorrent()))
+	assert.Equal(t, paths, s.GetLayoutPaths())
+	// Data that's already there isn't avoided
+	s = NewRandomAccessStorageAt(savePath).(*randomAccessStorage)
+	s.SetLayout(LAYOUT_ORIGINAL, nil, false)
+	assert.Nil(t, s.Init(layoutTorrent()))
+	assert.Equal(t, paths, s.GetLayoutPaths())
+
+	assert.Nil(t, RemoveLayout(savePath, paths, ".part"))
+	assert.False(t, exists(filepath.Join(savePath, "root", "a.txt")))
+	assert.False(t, exists(filepath.Join(savePath, "root", "dir", "a.txt")))
+	// The files of the other torrents are kept
+	assert.True(t, exists(filepath.Join(savePath, "root", "dir", "a (1).txt")))
+	assert.True(t, exists(filepath.Join(savePath, "root (1)")))
+}
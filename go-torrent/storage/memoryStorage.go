@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/Charana123/torrent/go-torrent/torrent"
+	"github.com/boljen/go-bitmap"
+)
+
+// memoryStorage keeps the torrent's pieces in memory and never touches the
+// disk e.g. to stream torrents. Beyond its limit the least recently used
+// pieces are evicted, they're no longer served to peers.
+type memoryStorage struct {
+	sync.RWMutex
+	torrent     *torrent.Torrent
+	fileOffsets []int
+	pieces      *pieceCache
+	evicted     func(pieceIndex int)
+}
+
+// NewMemoryStorage keeps at most maxBytes of pieces in memory, 0 is unlimited
+func NewMemoryStorage(maxBytes int) Storage {
+	return &memoryStorage{
+		pieces: newPieceCache(maxBytes),
+	}
+}
+
+func (m *memoryStorage) Init(tor *torrent.Torrent) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.torrent = tor
+	m.fileOffsets = FileOffsets(tor)
+	return nil
+}
+
+func (m *memoryStorage) BlockReadRequest(pieceIndex, blockByteOffset, blockLength int) ([]byte, error) {
+	err := checkBlockRequest(m.torrent, pieceIndex, blockByteOffset, blockLength)
+	if err != nil {
+		return nil, err
+	}
+	piece, ok := m.pieces.get(pieceIndex)
+	if !ok {
+		return nil, fmt.Errorf("Piece %d isn't in memory", pieceIndex)
+	}
+	if blockByteOffset+blockLength > len(piece) {
+		return nil, fmt.Errorf("reading beyond end of piece")
+	}
+	return piece[blockByteOffset : blockByteOffset+blockLength : blockByteOffset+blockLength], nil
+}
+
+func (m *memoryStorage) WritePieceRequest(pieceIndex int, data []byte) error {
+	if pieceIndex < 0 || pieceIndex >= m.torrent.NumPieces {
+		return fmt.Errorf("Invalid piece index")
+	}
+	piece := make([]byte, len(data))
+	copy(piece, data)
+	evicted := m.pieces.put(pieceIndex, piece)
+	m.RLock()
+	onEvicted := m.evicted
+	m.RUnlock()
+	if onEvicted != nil {
+		for _, pieceIndex := range evicted {
+			onEvicted(pieceIndex)
+		}
+	}
+	return nil
+}
+
+func (m *memoryStorage) SetEvicted(evicted func(pieceIndex int)) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.evicted = evicted
+}
+
+func (m *memoryStorage) GetCurrentDownloadState() (bitmap.Bitmap, bool, int) {
+	return currentDownloadState(m.torrent, func(pieceIndex, blockByteOffset, blockLength int) ([]byte, error) {
+		// Missing pieces fail verification
+		piece, _ := m.pieces.get(pieceIndex)
+		return piece, nil
+	})
+}
+
+func (m *memoryStorage) GetFileOffsets() []int {
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.fileOffsets
+}
+
+// There are no files to apply attributes to
+func (m *memoryStorage) Completed() error {
+	return nil
+}
+
+// Offset of each file within the torrent's data, as randomAccessStorage
+// lays the files out
+func FileOffsets(tor *torrent.Torrent) []int {
+	if len(tor.MetaInfo.Info.Files) == 0 {
+		// Single File Mode
+		return []int{0}
+	}
+	offsets := []int{}
+	offset := 0
+	for _, file := range tor.MetaInfo.Info.Files {
+		offsets = append(offsets, offset)
+		offset += file.Length
+		if tor.IsV2() && !tor.IsV1() && !file.IsPadding() && !file.IsSymlink() {
+			// Files of v2 torrents start on a piece boundary
+			pieceLength := tor.MetaInfo.Info.PieceLength
+			offset = (offset + pieceLength - 1) / pieceLength * pieceLength
+		}
+	}
+	return offsets
+}
+
+func checkBlockRequest(tor *torrent.Torrent, pieceIndex, blockByteOffset, blockLength int) error {
+	if pieceIndex < 0 || pieceIndex >= tor.NumPieces {
+		return fmt.Errorf("Invalid piece index")
+	}
+	if blockByteOffset > tor.MetaInfo.Info.PieceLength {
+		return fmt.Errorf("begin (byte offset within piece) larger than piece")
+	}
+	if blockLength > tor.MetaInfo.Info.PieceLength {
+		return fmt.Errorf("block size cannot be larger than piece size")
+	}
+	return nil
+}
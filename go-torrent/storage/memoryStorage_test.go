@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Charana123/torrent/go-torrent/torrent"
+	"github.com/stretchr/testify/assert"
+)
+
+func multiFileTorrent(pieceLength int, files ...torrent.File) *torrent.Torrent {
+	length := 0
+	for _, file := range files {
+		length += file.Length
+	}
+	return &torrent.Torrent{
+		NumPieces: (length + pieceLength - 1) / pieceLength,
+		Length:    length,
+		MetaInfo: torrent.MetaInfo{
+			Info: torrent.Info{
+				PieceLength: pieceLength,
+				Name:        "root",
+				Files:       files,
+			},
+		},
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	tor := multiFileTorrent(16,
+		torrent.File{Length: 20, Path: []string{"a"}},
+		torrent.File{Length: 20, Path: []string{"b"}})
+	s := NewMemoryStorage(32)
+	evicted := []int{}
+	s.(EvictingStorage).SetEvicted(func(pieceIndex int) {
+		evicted = append(evicted, pieceIndex)
+	})
+	assert.Nil(t, s.Init(tor))
+	assert.Equal(t, []int{0, 20}, s.GetFileOffsets())
+
+	for pieceIndex := 0; pieceIndex < tor.NumPieces; pieceIndex++ {
+		piece := bytes.Repeat([]byte{byte(pieceIndex + 1)}, tor.PieceSize(pieceIndex))
+		assert.Nil(t, s.WritePieceRequest(pieceIndex, piece))
+	}
+	// The first piece was evicted
+	assert.Equal(t, []int{0}, evicted)
+	_, err := s.BlockReadRequest(0, 0, 16)
+	assert.NotNil(t, err)
+	block, err := s.BlockReadRequest(1, 4, 8)
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{2}, 8), block)
+	block, err = s.BlockReadRequest(2, 0, 8)
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{3}, 8), block)
+	_, err = s.BlockReadRequest(2, 4, 8)
+	assert.NotNil(t, err)
+
+	// Piece 2 was read last, piece 1 is evicted
+	assert.Nil(t, s.WritePieceRequest(0, bytes.Repeat([]byte{1}, 16)))
+	assert.Equal(t, []int{0, 1}, evicted)
+	_, err = s.BlockReadRequest(1, 0, 16)
+	assert.NotNil(t, err)
+	_, err = s.BlockReadRequest(2, 0, 8)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,287 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package storage
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/Charana123/torrent/go-torrent/torrent"
+	"github.com/boljen/go-bitmap"
+)
+
+const (
+	// Files are mapped in windows, large files needn't fit the address space
+	MMAP_WINDOW_SIZE = 67108864 // 64 MiB
+)
+
+// mmapStorage reads and writes the torrent's files through memory mappings.
+// Files are created like randomAccessStorage creates them, windows of the
+// files are mapped on their first read or write and stay mapped until the
+// torrent is stopped.
+type mmapStorage struct {
+	*randomAccessStorage
+	msyncPolicy int
+	// Held while the mappings are read or written, files are moved with it
+	// locked
+	ioLock      sync.RWMutex
+	windowsLock sync.Mutex
+	// Mapped windows of each file, by window index
+	windows [][][]byte
+}
+
+func NewMmapStorage(dataDirectory string, msyncPolicy int) Storage {
+	d := &mmapStorage{
+		randomAccessStorage: NewRandomAccessStorage(dataDirectory).(*randomAccessStorage),
+		msyncPolicy:         msyncPolicy,
+	}
+	d.relocated = d.unmap
+	d.SetAllocationMode(ALLOCATE_FULL)
+	return d
+}
+
+func NewMmapStorageAt(savePath string, msyncPolicy int) Storage {
+	d := &mmapStorage{
+		randomAccessStorage: NewRandomAccessStorageAt(savePath).(*randomAccessStorage),
+		msyncPolicy:         msyncPolicy,
+	}
+	d.relocated = d.unmap
+	d.SetAllocationMode(ALLOCATE_FULL)
+	return d
+}
+
+// Writes to a mapping of a sparse file on a full disk raise SIGBUS, which
+// kills the process. Files are always fully allocated, s.t. the disk can't
+// fill up under the mappings.
+func (d *mmapStorage) SetAllocationMode(allocation int) {
+	d.randomAccessStorage.SetAllocationMode(ALLOCATE_FULL)
+}
+
+func (d *mmapStorage) Init(tor *torrent.Torrent) error {
+	err := d.randomAccessStorage.Init(tor)
+	if err != nil {
+		return err
+	}
+	d.windowsLock.Lock()
+	defer d.windowsLock.Unlock()
+
+	d.windows = make([][][]byte, len(d.paths))
+	for fileIndex, file := range d.torrent.MetaInfo.Info.Files {
+		numWindows := (file.Length + MMAP_WINDOW_SIZE - 1) / MMAP_WINDOW_SIZE
+		d.windows[fileIndex] = make([][]byte, numWindows)
+	}
+	return nil
+}
+
+// Returns the mapped window of the file containing fileOffset, and the
+// window's offset within the file
+func (d *mmapStorage) window(fileIndex, fileOffset int) ([]byte, int, error) {
+	windowIndex := fileOffset / MMAP_WINDOW_SIZE
+	windowOffset := windowIndex * MMAP_WINDOW_SIZE
+	d.windowsLock.Lock()
+	window := d.windows[fileIndex][windowIndex]
+	d.windowsLock.Unlock()
+	if window != nil {
+		return window, windowOffset, nil
+	}
+
+	// The file lock is taken before the windows lock, files are unmapped
+	// under their lock when they're copied to a new path
+	d.fileLocks[fileIndex].Lock()
+	defer d.fileLocks[fileIndex].Unlock()
+	d.windowsLock.Lock()
+	defer d.windowsLock.Unlock()
+	if d.windows[fileIndex][windowIndex] != nil {
+		return d.windows[fileIndex][windowIndex], windowOffset, nil
+	}
+
+	f, err := openFile(d.paths[fileIndex], os.O_RDWR, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	// The mapping outlives the file descriptor
+	defer f.Close()
+	fd, ok := f.(interface {
+		Fd() uintptr
+	})
+	if !ok {
+		return nil, 0, fmt.Errorf("File %s can't be memory mapped", d.paths[fileIndex])
+	}
+	length := min(MMAP_WINDOW_SIZE, d.torrent.MetaInfo.Info.Files[fileIndex].Length-windowOffset)
+	window, err = syscall.Mmap(int(fd.Fd()), int64(windowOffset), length, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, 0, err
+	}
+	d.windows[fileIndex][windowIndex] = window
+	return window, windowOffset, nil
+}
+
+// Files renamed keep their mappings, files copied to another filesystem are
+// unmapped and mapped again from their new path.
+func (d *mmapStorage) unmap(fileIndex int) {
+	d.windowsLock.Lock()
+	defer d.windowsLock.Unlock()
+
+	for windowIndex, window := range d.windows[fileIndex] {
+		if window != nil {
+			syscall.Munmap(window)
+			d.windows[fileIndex][windowIndex] = nil
+		}
+	}
+}
+
+// Unmaps every file once the torrent is stopped, files read or written
+// afterwards are mapped again
+func (d *mmapStorage) unmapAll() {
+	d.ioLock.Lock()
+	defer d.ioLock.Unlock()
+
+	for fileIndex := range d.windows {
+		d.unmap(fileIndex)
+	}
+}
+
+// Calls f with the mapped memory of each file window the torrent's data from
+// globalOffset spans, padding files (which aren't mapped) are nil
+func (d *mmapStorage) forEachRange(globalOffset, length int, f func(mapped []byte, n int) error) error {
+	d.ioLock.RLock()
+	defer d.ioLock.RUnlock()
+
+	fileIndex, fileOffset, err := d.find(globalOffset)
+	if err != nil {
+		return err
+	}
+	for length > 0 {
+		if fileIndex >= len(d.paths) {
+			return fmt.Errorf("beyond end of last file")
+		}
+		n := min(d.torrent.MetaInfo.Info.Files[fileIndex].Length-fileOffset, length)
+		var mapped []byte
+		if d.finalPaths[fileIndex] != "" && n > 0 {
+			window, windowOffset, err := d.window(fileIndex, fileOffset)
+			if err != nil {
+				return err
+			}
+			n = min(n, windowOffset+len(window)-fileOffset)
+			mapped = window[fileOffset-windowOffset : fileOffset-windowOffset+n : fileOffset-windowOffset+n]
+		}
+		err := f(mapped, n)
+		if err != nil {
+			return err
+		}
+		length -= n
+		fileOffset += n
+		if fileOffset >= d.torrent.MetaInfo.Info.Files[fileIndex].Length {
+			fileIndex++
+			fileOffset = 0
+		}
+	}
+	return nil
+}
+
+// Blocks are copied out of the mappings, they're cached and sent to peers
+// after the files may have been unmapped
+func (d *mmapStorage) BlockReadRequest(pieceIndex, blockByteOffset, blockLength int) ([]byte, error) {
+	if d.readOnly {
+		// Files are read without mapping them
+		return d.randomAccessStorage.BlockReadRequest(pieceIndex, blockByteOffset, blockLength)
+	}
+	err := checkBlockRequest(d.torrent, pieceIndex, blockByteOffset, blockLength)
+	if err != nil {
+		return nil, err
+	}
+
+	globalOffset := pieceIndex*d.torrent.MetaInfo.Info.PieceLength + blockByteOffset
+	block := make([]byte, 0, blockLength)
+	err = d.forEachRange(globalOffset, blockLength, func(mapped []byte, n int) error {
+		if mapped == nil {
+			mapped = make([]byte, n)
+		}
+		block = append(block, mapped...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+func (d *mmapStorage) WritePieceRequest(pieceIndex int, data []byte) error {
+	return d.writeRange(pieceIndex*d.torrent.MetaInfo.Info.PieceLength, data)
+}
+
+func (d *mmapStorage) writeRange(globalOffset int, data []byte) error {
+	length := len(data)
+	err := d.forEachRange(globalOffset, len(data), func(mapped []byte, n int) error {
+		if mapped != nil {
+			copy(mapped, data[:n])
+			err := msync(mapped, d.msyncPolicy)
+			if err != nil {
+				return err
+			}
+		}
+		data = data[n:]
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Complete files may be copied from the incomplete directory
+	d.ioLock.Lock()
+	defer d.ioLock.Unlock()
+	return d.markWritten(globalOffset, length)
+}
+
+func (d *mmapStorage) GetCurrentDownloadState() (bitmap.Bitmap, bool, int) {
+	bitfield, completed, left := currentDownloadState(d.torrent, d.BlockReadRequest)
+	d.markVerified(bitfield)
+	return bitfield, completed, left
+}
+
+func (d *mmapStorage) markVerified(bitfield bitmap.Bitmap) {
+	d.ioLock.Lock()
+	defer d.ioLock.Unlock()
+
+	d.randomAccessStorage.markVerified(bitfield)
+}
+
+// Reads and writes of the mappings block until the files are moved
+func (d *mmapStorage) Move(newPath string, adopt bool, progress func(moved, total int64)) error {
+	d.ioLock.Lock()
+	defer d.ioLock.Unlock()
+
+	return d.randomAccessStorage.Move(newPath, adopt, progress)
+}
+
+func (d *mmapStorage) Completed() error {
+	d.ioLock.Lock()
+	defer d.ioLock.Unlock()
+
+	return d.randomAccessStorage.Completed()
+}
+
+func msync(mapped []byte, msyncPolicy int) error {
+	var flags uintptr
+	switch msyncPolicy {
+	case MSYNC_ASYNC:
+		flags = syscall.MS_ASYNC
+	case MSYNC_SYNC:
+		flags = syscall.MS_SYNC
+	default:
+		return nil
+	}
+	// msync takes a page aligned address
+	address := uintptr(unsafe.Pointer(&mapped[0]))
+	pageSize := uintptr(os.Getpagesize())
+	alignedAddress := address &^ (pageSize - 1)
+	length := uintptr(len(mapped)) + address - alignedAddress
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, alignedAddress, length, flags)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
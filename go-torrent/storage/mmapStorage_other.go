@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package storage
+
+// Files aren't memory mapped on this platform, the random access storage is
+// used instead
+func NewMmapStorage(dataDirectory string, msyncPolicy int) Storage {
+	return NewRandomAccessStorage(dataDirectory)
+}
+
+func NewMmapStorageAt(savePath string, msyncPolicy int) Storage {
+	return NewRandomAccessStorageAt(savePath)
+}
@@ -0,0 +1,161 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/Charana123/torrent/go-torrent/torrent"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMmapStorage(t *testing.T) {
+	savePath := t.TempDir()
+	tor := multiFileTorrent(16,
+		torrent.File{Length: 10, Path: []string{"a"}},
+		torrent.File{Length: 6, Path: []string{".pad", "6"}, Attr: "p"},
+		torrent.File{Length: 40, Path: []string{"dir", "b"}},
+		torrent.File{Length: 0, Path: []string{"empty"}},
+		torrent.File{Length: 5, Path: []string{"c"}})
+	s := NewMmapStorageAt(savePath, MSYNC_SYNC)
+	assert.Nil(t, s.Init(tor))
+
+	data := []byte{}
+	for pieceIndex := 0; pieceIndex < tor.NumPieces; pieceIndex++ {
+		piece := bytes.Repeat([]byte{byte(pieceIndex + 1)}, tor.PieceSize(pieceIndex))
+		if pieceIndex == 0 {
+			// Padding is zeros
+			copy(piece[10:], make([]byte, 6))
+		}
+		assert.Nil(t, s.WritePieceRequest(pieceIndex, piece))
+		data = append(data, piece...)
+	}
+
+	// Written through to the files
+	a, err := ioutil.ReadFile(filepath.Join(savePath, "root", "a"))
+	assert.Nil(t, err)
+	assert.Equal(t, data[:10], a)
+	b, err := ioutil.ReadFile(filepath.Join(savePath, "root", "dir", "b"))
+	assert.Nil(t, err)
+	assert.Equal(t, data[16:56], b)
+	c, err := ioutil.ReadFile(filepath.Join(savePath, "root", "c"))
+	assert.Nil(t, err)
+	assert.Equal(t, data[56:], c)
+
+	// Within a file
+	block, err := s.BlockReadRequest(1, 4, 8)
+	assert.Nil(t, err)
+	assert.Equal(t, data[20:28], block)
+	assert.Equal(t, 8, cap(block))
+	// Across files, including the padding file
+	block, err = s.BlockReadRequest(0, 0, 16)
+	assert.Nil(t, err)
+	assert.Equal(t, data[:16], block)
+	block, err = s.BlockReadRequest(3, 0, tor.PieceSize(3))
+	assert.Nil(t, err)
+	assert.Equal(t, data[48:], block)
+
+	_, err = s.BlockReadRequest(tor.NumPieces, 0, 16)
+	assert.NotNil(t, err)
+}
+
+// The size of blocks requested by peers
+const benchmarkBlockSize = 16384
+
+func benchmarkTorrent() *torrent.Torrent {
+	files := []torrent.File{}
+	for i := 0; i < 16; i++ {
+		files = append(files, torrent.File{Length: 1048576, Path: []string{string(rune('a' + i))}})
+	}
+	return multiFileTorrent(262144, files...)
+}
+
+func benchmarkRead(b *testing.B, s Storage) {
+	tor := benchmarkTorrent()
+	assert.Nil(b, s.Init(tor))
+	b.SetBytes(benchmarkBlockSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		begin := i % (tor.Length / benchmarkBlockSize) * benchmarkBlockSize
+		pieceIndex := begin / tor.MetaInfo.Info.PieceLength
+		_, err := s.BlockReadRequest(pieceIndex, begin%tor.MetaInfo.Info.PieceLength, benchmarkBlockSize)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkWrite(b *testing.B, s Storage) {
+	tor := benchmarkTorrent()
+	assert.Nil(b, s.Init(tor))
+	piece := bytes.Repeat([]byte{1}, tor.MetaInfo.Info.PieceLength)
+	b.SetBytes(int64(len(piece)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := s.WritePieceRequest(i%tor.NumPieces, piece)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRandomAccessRead(b *testing.B) {
+	benchmarkRead(b, NewRandomAccessStorageAt(b.TempDir()))
+}
+
+func BenchmarkMmapRead(b *testing.B) {
+	benchmarkRead(b, NewMmapStorageAt(b.TempDir(), MSYNC_NONE))
+}
+
+func BenchmarkRandomAccessWrite(b *testing.B) {
+	benchmarkWrite(b, NewRandomAccessStorageAt(b.TempDir()))
+}
+
+func BenchmarkMmapWrite(b *testing.B) {
+	benchmarkWrite(b, NewMmapStorageAt(b.TempDir(), MSYNC_NONE))
+}
+
+func BenchmarkMmapWriteAsync(b *testing.B) {
+	benchmarkWrite(b, NewMmapStorageAt(b.TempDir(), MSYNC_ASYNC))
+}
+
+func TestMmapMove(t *testing.T) {
+	appFS = crossDeviceFs{afero.NewOsFs()}
+	defer func() { appFS = afero.NewOsFs() }()
+	savePath := t.TempDir()
+	newPath := t.TempDir()
+	tor, data := movedTorrent()
+	s := NewMmapStorageAt(savePath, MSYNC_NONE).(*mmapStorage)
+	assert.Nil(t, s.Init(tor))
+	writeTorrent(t, s, tor, data[:32])
+	cached, err := s.BlockReadRequest(0, 0, 16)
+	assert.Nil(t, err)
+
+	assert.Nil(t, s.Move(newPath, false, nil))
+	// Blocks read before the files were unmapped are still readable
+	assert.Equal(t, data[:16], cached)
+	// The copied files are mapped again
+	assert.Nil(t, s.WritePieceRequest(2, data[32:]))
+	block, err := s.BlockReadRequest(0, 0, 16)
+	assert.Nil(t, err)
+	assert.Equal(t, data[:16], block)
+	s.unmapAll()
+	assert.Equal(t, data[:16], block)
+	b, err := ioutil.ReadFile(filepath.Join(newPath, "root", "b"))
+	assert.Nil(t, err)
+	assert.Equal(t, data[20:], b)
+}
+
+func TestMmapAllocation(t *testing.T) {
+	s := NewMmapStorageAt(t.TempDir(), MSYNC_NONE).(*mmapStorage)
+	assert.Equal(t, ALLOCATE_FULL, s.allocation)
+	s.SetAllocationMode(ALLOCATE_ON_WRITE)
+	assert.Equal(t, ALLOCATE_FULL, s.allocation)
+	s.SetAllocationMode(ALLOCATE_SPARSE)
+	assert.Equal(t, ALLOCATE_FULL, s.allocation)
+}
@@ -0,0 +1,278 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// Files moved across filesystems are copied in chunks of this size
+	MOVE_BUFFER_SIZE = 1048576 // 1 MiB
+)
+
+// Moves the torrent's files under newPath while it's running. Reads and
+// writes block until the files are moved, the pool reopens them by their new
+// paths.
+func (d *randomAccessStorage) Move(newPath string, adopt bool, progress func(moved, total int64)) error {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.torrent == nil {
+		return fmt.Errorf("Storage isn't initialised")
+	}
+	return d.moveTo(newPath, adopt, progress)
+}
+
+// Moves the torrent's files under directory, renaming them or copying them
+// to another filesystem. With adopt, files already under directory whose
+// pieces verify are kept rather than overwritten. Files still under the
+// incomplete directory stay there.
+func (d *randomAccessStorage) moveTo(directory string, adopt bool, progress func(moved, total int64)) error {
+	for _, fileLock := range d.fileLocks {
+		fileLock.Lock()
+		defer fileLock.Unlock()
+	}
+	var err error
+	newPaths := make([]string, len(d.paths))
+	newFinalPaths := make([]string, len(d.paths))
+	total := int64(0)
+	for fileIndex := range d.paths {
+		if d.finalPaths[fileIndex] == "" {
+			continue
+		}
+		newFinalPaths[fileIndex], err = d.filePath(directory, fileIndex)
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.paths[fileIndex] == d.finalPaths[fileIndex]:
+			newPaths[fileIndex] = newFinalPaths[fileIndex]
+		case d.incompleteDirectory == "":
+			newPaths[fileIndex] = newFinalPaths[fileIndex] + d.partSuffix
+		default:
+			newPaths[fileIndex] = d.paths[fileIndex]
+		}
+		if newPaths[fileIndex] != d.paths[fileIndex] {
+			total += int64(d.torrent.MetaInfo.Info.Files[fileIndex].Length)
+		}
+	}
+
+	adopted := map[int]bool{}
+	if adopt {
+		adopted = d.adoptable(newPaths)
+	}
+	moved := int64(0)
+	oldPaths := make([]string, len(d.paths))
+	movedFiles := []int{}
+	for fileIndex := range d.paths {
+		if newPaths[fileIndex] == d.paths[fileIndex] {
+			continue
+		}
+		d.pool.Close(d.paths[fileIndex])
+		length := int64(d.torrent.MetaInfo.Info.Files[fileIndex].Length)
+		if adopted[fileIndex] {
+			err = appFS.Remove(d.paths[fileIndex])
+		} else {
+			err = mkdirAll(filepath.Dir(newPaths[fileIndex]))
+			if err == nil {
+				var copied bool
+				copied, err = moveFile(d.paths[fileIndex], newPaths[fileIndex], func(n int64) {
+					if progress != nil {
+						progress(moved+n, total)
+					}
+				})
+				if copied && d.relocated != nil {
+					defer d.relocated(fileIndex)
+				}
+			}
+		}
+		if err != nil {
+			d.rollback(movedFiles, oldPaths, newFinalPaths, directory)
+			return err
+		}
+		oldPaths[fileIndex] = d.paths[fileIndex]
+		movedFiles = append(movedFiles, fileIndex)
+		d.paths[fileIndex] = newPaths[fileIndex]
+		moved += length
+		if progress != nil {
+			progress(moved, total)
+		}
+	}
+	for _, fileIndex := range movedFiles {
+		removeEmptyParents(oldPaths[fileIndex], d.rootDirectory)
+	}
+	copy(d.finalPaths, newFinalPaths)
+	d.rootDirectory = directory
+	return nil
+}
+
+// Moves the files moved so far back to their old paths once a move fails,
+// s.t. the files stay under the root directory the torrent is saved to. A
+// file that can't be moved back is kept at its new path.
+func (d *randomAccessStorage) rollback(movedFiles []int, oldPaths, newFinalPaths []string, directory string) {
+	for i := len(movedFiles) - 1; i >= 0; i-- {
+		fileIndex := movedFiles[i]
+		d.pool.Close(d.paths[fileIndex])
+		_, err := moveFile(d.paths[fileIndex], oldPaths[fileIndex], func(n int64) {})
+		if err != nil {
+			fmt.Println("Moving back", d.paths[fileIndex], err)
+			d.finalPaths[fileIndex] = newFinalPaths[fileIndex]
+			continue
+		}
+		removeEmptyParents(d.paths[fileIndex], directory)
+		d.paths[fileIndex] = oldPaths[fileIndex]
+	}
+}
+
+// Files already at their new path which are as long as the torrent's files
+// and all of whose pieces verify, reading the other files from their current
+// paths
+func (d *randomAccessStorage) adoptable(newPaths []string) map[int]bool {
+	adopted := map[int]bool{}
+	paths := make([]string, len(d.paths))
+	for fileIndex := range d.paths {
+		paths[fileIndex] = d.paths[fileIndex]
+		if newPaths[fileIndex] == d.paths[fileIndex] {
+			continue
+		}
+		info, err := appFS.Stat(newPaths[fileIndex])
+		if err == nil && info.Size() == int64(d.torrent.MetaInfo.Info.Files[fileIndex].Length) {
+			adopted[fileIndex] = true
+		}
+	}
+
+	pieceLength := d.torrent.MetaInfo.Info.PieceLength
+	for fileIndex := range adopted {
+		file := d.torrent.MetaInfo.Info.Files[fileIndex]
+		if file.Length == 0 {
+			continue
+		}
+		paths[fileIndex] = newPaths[fileIndex]
+		first := d.fileOffsets[fileIndex] / pieceLength
+		last := (d.fileOffsets[fileIndex] + file.Length - 1) / pieceLength
+		for pieceIndex := first; pieceIndex <= last; pieceIndex++ {
+			piece, err := d.readPieceFrom(paths, pieceIndex)
+			if err != nil || !d.torrent.VerifyPiece(pieceIndex, piece) {
+				delete(adopted, fileIndex)
+				break
+			}
+		}
+		paths[fileIndex] = d.paths[fileIndex]
+	}
+	return adopted
+}
+
+// Reads the piece from the files at paths rather than through the pool, the
+// caller holds the file locks
+func (d *randomAccessStorage) readPieceFrom(paths []string, pieceIndex int) ([]byte, error) {
+	globalOffset := pieceIndex * d.torrent.MetaInfo.Info.PieceLength
+	fileIndex, fileOffset, err := d.find(globalOffset)
+	if err != nil {
+		return nil, err
+	}
+	piece := make([]byte, d.torrent.PieceSize(pieceIndex))
+	for data := piece; len(data) > 0; fileIndex++ {
+		if fileIndex >= len(paths) {
+			return nil, fmt.Errorf("reading beyond end of last file")
+		}
+		length := min(d.torrent.MetaInfo.Info.Files[fileIndex].Length-fileOffset, len(data))
+		if d.finalPaths[fileIndex] != "" {
+			err := readAt(paths[fileIndex], data[:length], int64(fileOffset))
+			if err != nil {
+				return nil, err
+			}
+		}
+		data = data[length:]
+		fileOffset = 0
+	}
+	return piece, nil
+}
+
+func readAt(path string, data []byte, offset int64) error {
+	file, err := openFile(path, os.O_RDONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.ReadAt(data, offset)
+	if err == io.EOF {
+		// Files allocated on write are zeros past their end
+		err = nil
+	}
+	return err
+}
+
+// Renames the file, or copies it when it's moved to another filesystem.
+// progress is called with the bytes copied so far.
+func moveFile(oldPath, newPath string, progress func(n int64)) (bool, error) {
+	err := appFS.Rename(oldPath, newPath)
+	if err == nil {
+		return false, nil
+	}
+	// e.g. EXDEV, the file is copied and removed instead
+	err = copyFile(oldPath, newPath, progress)
+	if err != nil {
+		appFS.Remove(newPath)
+		return false, err
+	}
+	return true, appFS.Remove(oldPath)
+}
+
+func copyFile(oldPath, newPath string, progress func(n int64)) error {
+	src, err := openFile(oldPath, os.O_RDONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	dst, err := openFile(newPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, MOVE_BUFFER_SIZE)
+	copied := int64(0)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			_, writeErr := dst.Write(buf[:n])
+			if writeErr != nil {
+				dst.Close()
+				return writeErr
+			}
+			copied += int64(n)
+			progress(copied)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			dst.Close()
+			return err
+		}
+	}
+	// The original is removed once the copy is on disk
+	err = dst.Sync()
+	if err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// Removes the directories the file was in up to the root directory, while
+// they're empty
+func removeEmptyParents(path, rootDirectory string) {
+	rootDirectory = filepath.Clean(rootDirectory)
+	for directory := filepath.Dir(path); directory != rootDirectory && strings.HasPrefix(directory, rootDirectory+string(filepath.Separator)); directory = filepath.Dir(directory) {
+		if appFS.Remove(directory) != nil {
+			// Not empty
+			return
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"crypto/sha1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Charana123/torrent/go-torrent/torrent"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+// Files can't be renamed, as if they were moved to another filesystem
+type crossDeviceFs struct {
+	afero.Fs
+}
+
+func (fs crossDeviceFs) Rename(oldname, newname string) error {
+	return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EXDEV}
+}
+
+func movedTorrent() (*torrent.Torrent, []byte) {
+	tor := multiFileTorrent(16,
+		torrent.File{Length: 20, Path: []string{"dir", "a"}},
+		torrent.File{Length: 20, Path: []string{"b"}})
+	data := []byte{}
+	for i := 0; i < tor.Length; i++ {
+		data = append(data, byte(i))
+	}
+	for pieceIndex := 0; pieceIndex < tor.NumPieces; pieceIndex++ {
+		checksum := sha1.Sum(data[pieceIndex*16 : pieceIndex*16+tor.PieceSize(pieceIndex)])
+		tor.MetaInfo.Info.Pieces += string(checksum[:])
+	}
+	return tor, data
+}
+
+func writeTorrent(t *testing.T, s Storage, tor *torrent.Torrent, data []byte) {
+	for pieceIndex := 0; pieceIndex < tor.NumPieces; pieceIndex++ {
+		assert.Nil(t, s.WritePieceRequest(pieceIndex, data[pieceIndex*16:pieceIndex*16+tor.PieceSize(pieceIndex)]))
+	}
+}
+
+func TestMove(t *testing.T) {
+	defer func() { appFS = afero.NewOsFs() }()
+	for _, fs := range []afero.Fs{afero.NewOsFs(), crossDeviceFs{afero.NewOsFs()}} {
+		appFS = fs
+		savePath := t.TempDir()
+		newPath := t.TempDir()
+		tor, data := movedTorrent()
+		s := NewRandomAccessStorageAt(savePath).(*randomAccessStorage)
+		s.pool = NewFilePool(8)
+		assert.Nil(t, s.Init(tor))
+		writeTorrent(t, s, tor, data)
+
+		var moved, total int64
+		assert.Nil(t, s.Move(newPath, false, func(m, n int64) {
+			assert.True(t, m >= moved)
+			moved, total = m, n
+		}))
+		assert.Equal(t, int64(40), total)
+		assert.Equal(t, total, moved)
+		a, err := ioutil.ReadFile(filepath.Join(newPath, "root", "dir", "a"))
+		assert.Nil(t, err)
+		assert.Equal(t, data[:20], a)
+		assert.False(t, exists(filepath.Join(savePath, "root")))
+
+		// Reads and writes carry on at the new path
+		block, err := s.BlockReadRequest(1, 0, 16)
+		assert.Nil(t, err)
+		assert.Equal(t, data[16:32], block)
+		assert.Nil(t, s.WritePieceRequest(2, make([]byte, 8)))
+		b, err := ioutil.ReadFile(filepath.Join(newPath, "root", "b"))
+		assert.Nil(t, err)
+		assert.Equal(t, make([]byte, 8), b[12:])
+	}
+}
+
+func TestMoveFailed(t *testing.T) {
+	savePath := t.TempDir()
+	newPath := t.TempDir()
+	tor, data := movedTorrent()
+	s := NewRandomAccessStorageAt(savePath).(*randomAccessStorage)
+	s.pool = NewFilePool(8)
+	assert.Nil(t, s.Init(tor))
+	writeTorrent(t, s, tor, data)
+	finalPaths := append([]string{}, s.finalPaths...)
+
+	// b can't be moved over a directory, a is moved back
+	assert.Nil(t, os.MkdirAll(filepath.Join(newPath, "root", "b", "c"), 0755))
+	assert.NotNil(t, s.Move(newPath, false, nil))
+	a, err := ioutil.ReadFile(filepath.Join(savePath, "root", "dir", "a"))
+	assert.Nil(t, err)
+	assert.Equal(t, data[:20], a)
+	assert.False(t, exists(filepath.Join(newPath, "root", "dir")))
+	assert.Equal(t, finalPaths, s.finalPaths)
+	block, err := s.BlockReadRequest(0, 0, 16)
+	assert.Nil(t, err)
+	assert.Equal(t, data[:16], block)
+}
+
+func TestMoveAdopt(t *testing.T) {
+	savePath := t.TempDir()
+	newPath := t.TempDir()
+	tor, data := movedTorrent()
+	s := NewRandomAccessStorageAt(savePath).(*randomAccessStorage)
+	s.pool = NewFilePool(8)
+	assert.Nil(t, s.Init(tor))
+	writeTorrent(t, s, tor, data)
+
+	// a is already at the destination, b is corrupt
+	a := filepath.Join(newPath, "root", "dir", "a")
+	assert.Nil(t, os.MkdirAll(filepath.Dir(a), 0755))
+	assert.Nil(t, ioutil.WriteFile(a, data[:20], 0644))
+	modTime := time.Now().Add(-time.Hour)
+	assert.Nil(t, os.Chtimes(a, modTime, modTime))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(newPath, "root", "b"), make([]byte, 20), 0644))
+
+	assert.Nil(t, s.Move(newPath, true, nil))
+	info, err := os.Stat(a)
+	assert.Nil(t, err)
+	assert.True(t, info.ModTime().Equal(modTime))
+	b, err := ioutil.ReadFile(filepath.Join(newPath, "root", "b"))
+	assert.Nil(t, err)
+	assert.Equal(t, data[20:], b)
+	assert.False(t, exists(filepath.Join(savePath, "root")))
+}
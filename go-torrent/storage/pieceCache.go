@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"container/list"
+	"sync"
+)
+
+// pieceCache keeps pieces in memory up to a number of bytes, evicting the
+// least recently used pieces beyond it
+type pieceCache struct {
+	sync.Mutex
+	// 0 is unlimited
+	maxBytes int
+	bytes    int
+	pieces   map[int]*list.Element
+	// Most recently used first
+	lru       *list.List
+	evictions int
+}
+
+type cachedPiece struct {
+	pieceIndex int
+	data       []byte
+}
+
+func newPieceCache(maxBytes int) *pieceCache {
+	return &pieceCache{
+		maxBytes: maxBytes,
+		pieces:   make(map[int]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+func (c *pieceCache) get(pieceIndex int) ([]byte, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	e, ok := c.pieces[pieceIndex]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*cachedPiece).data, true
+}
+
+// Unlike get, the piece isn't marked as used
+func (c *pieceCache) contains(pieceIndex int) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	_, ok := c.pieces[pieceIndex]
+	return ok
+}
+
+// The piece mustn't be modified once it's cached, returns the pieces evicted
+// to make room for it
+func (c *pieceCache) put(pieceIndex int, data []byte) []int {
+	c.Lock()
+	defer c.Unlock()
+
+	if e, ok := c.pieces[pieceIndex]; ok {
+		c.bytes -= len(e.Value.(*cachedPiece).data)
+		c.lru.Remove(e)
+	}
+	c.pieces[pieceIndex] = c.lru.PushFront(&cachedPiece{pieceIndex: pieceIndex, data: data})
+	c.bytes += len(data)
+	evicted := []int{}
+	// The most recently used piece is kept even when it's larger than the cache
+	for c.maxBytes > 0 && c.bytes > c.maxBytes && c.lru.Len() > 1 {
+		e := c.lru.Back()
+		c.bytes -= len(e.Value.(*cachedPiece).data)
+		c.lru.Remove(e)
+		delete(c.pieces, e.Value.(*cachedPiece).pieceIndex)
+		evicted = append(evicted, e.Value.(*cachedPiece).pieceIndex)
+		c.evictions++
+	}
+	return evicted
+}
+
+func (c *pieceCache) remove(pieceIndex int) {
+	c.Lock()
+	defer c.Unlock()
+
+	if e, ok := c.pieces[pieceIndex]; ok {
+		c.bytes -= len(e.Value.(*cachedPiece).data)
+		c.lru.Remove(e)
+		delete(c.pieces, pieceIndex)
+	}
+}
+
+func (c *pieceCache) clear() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.bytes = 0
+	c.pieces = make(map[int]*list.Element)
+	c.lru.Init()
+}
@@ -2,100 +2,428 @@ package storage
 
 import (
 	"bytes"
-	"crypto/sha1"
 	"encoding/binary"
-	"encoding/hex"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 
 	underscore "github.com/ahl5esoft/golang-underscore"
+	"github.com/spf13/afero"
 
 	"github.com/Charana123/torrent/go-torrent/torrent"
 	"github.com/boljen/go-bitmap"
-	"github.com/spf13/afero"
 )
 
 type randomAccessStorage struct {
 	sync.RWMutex
-	torrent       *torrent.Torrent
-	fileLocks     []*sync.Mutex
-	files         []afero.File
-	fileOffsets   []int
+	torrent     *torrent.Torrent
+	fileLocks   []*sync.Mutex
+	paths       []string // current path of each file, empty for files that aren't on disk
+	fileOffsets []int
+	pool        FilePool
+	allocation  int
+	// Final path of each file, empty for files that aren't on disk
+	finalPaths          []string
+	partSuffix          string
+	incompleteDirectory string
+	completedDirectory  string
+	// One of the LAYOUT_ constants, the paths of the files relative to the
+	// root directory once they're laid out
+	layout          int
+	layoutPaths     []string
+	avoidCollisions bool
+	// Pieces written in full, files are complete once all their pieces are
+	piecesWritten bitmap.Bitmap
+	// Called with the file's lock held once it's copied to a new path
+	relocated     func(fileIndex int)
 	dataDirectory string
+	savePath      string
+	// Directory the files are laid out under
 	rootDirectory string
+	// Files are only read, without the file pool
+	readOnly bool
 }
 
 func NewRandomAccessStorage(dataDirectory string) Storage {
 	return &randomAccessStorage{
 		dataDirectory: dataDirectory,
+		pool:          sharedFilePool,
+		layout:        LAYOUT_INFO_HASH,
 	}
 }
 
-func openOrCreateFile(path string, length int) afero.File {
-	file, err := openFile(path, os.O_CREATE|os.O_RDWR, 0755)
-	fail(err)
-	err = file.Truncate(int64(length))
-	fail(err)
-	return file
+// Torrent data is kept directly under savePath rather than in a directory
+// named after the info-hash e.g. to seed a torrent created from savePath/name
+func NewRandomAccessStorageAt(savePath string) Storage {
+	return &randomAccessStorage{
+		savePath: savePath,
+		pool:     sharedFilePool,
+	}
+}
+
+// Files are created according to the allocation mode, they're opened by the
+// file pool when they're read or written
+func createFile(path string, length, allocation int) error {
+	file, err := openFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	switch allocation {
+	case ALLOCATE_FULL:
+		err = preallocate(file, int64(length))
+	case ALLOCATE_SPARSE:
+		err = file.Truncate(int64(length))
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
 }
 
-func (d *randomAccessStorage) Init(tor *torrent.Torrent) {
+// Allocates every block of the file, with fallocate where it's available
+// and otherwise by writing zeros past the end of the file
+func preallocate(file afero.File, length int64) error {
+	ok, err := fallocate(file, length)
+	if ok || err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	zeros := make([]byte, 65536)
+	for offset := info.Size(); offset < length; offset += int64(len(zeros)) {
+		n := int(min64(int64(len(zeros)), length-offset))
+		_, err := file.WriteAt(zeros[:n], offset)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func min64(i, j int64) int64 {
+	if i < j {
+		return i
+	}
+	return j
+}
+
+// One of ALLOCATE_SPARSE, ALLOCATE_FULL or ALLOCATE_ON_WRITE, takes effect
+// when the storage is initialised
+func (d *randomAccessStorage) SetAllocationMode(allocation int) {
 	d.Lock()
 	defer d.Unlock()
 
-	d.torrent = tor
-	infoHashHex := hex.EncodeToString(d.torrent.InfoHash)
-	d.rootDirectory = strings.Join([]string{d.dataDirectory, infoHashHex}, "/")
-
-	if len(d.torrent.MetaInfo.Info.Files) > 0 {
-		// Multiple File Mode
-
-		// Create root directory
-		rootDirectory := strings.Join([]string{d.rootDirectory, d.torrent.MetaInfo.Info.Name}, "/")
-		if _, err := appFS.Stat(rootDirectory); os.IsNotExist(err) {
-			err := appFS.MkdirAll(rootDirectory, 0755)
-			fail(err)
-		}
-
-		// Create sub-directories and create/open file handlers
-		offset := 0
-		for _, file := range d.torrent.MetaInfo.Info.Files {
-			subdir := strings.Join(append([]string{rootDirectory}, file.Path[:len(file.Path)-1]...), "/")
-			if _, err := appFS.Stat(subdir); os.IsNotExist(err) {
-				err := appFS.MkdirAll(subdir, 0755)
-				fail(err)
-			}
-			path := strings.Join(append([]string{rootDirectory}, file.Path...), "/")
-			d.files = append(d.files, openOrCreateFile(path, file.Length))
-			d.fileLocks = append(d.fileLocks, &sync.Mutex{})
-			d.fileOffsets = append(d.fileOffsets, offset)
-			offset += file.Length
-		}
-	} else {
-		// Create root directory
-		if _, err := appFS.Stat(d.rootDirectory); os.IsNotExist(err) {
-			err := appFS.Mkdir(d.rootDirectory, 0755)
-			fail(err)
-		}
-		// Single File Mode
-		fileName := strings.Join([]string{d.rootDirectory, d.torrent.MetaInfo.Info.Name}, "/")
-		file := openOrCreateFile(fileName, d.torrent.MetaInfo.Info.Length)
-		d.files = append(d.files, file)
-		d.fileLocks = append(d.fileLocks, &sync.Mutex{})
-		d.fileOffsets = append(d.fileOffsets, 0)
+	d.allocation = allocation
+}
+
+// Space the torrent's files still need on disk, beyond their current size
+func (d *randomAccessStorage) requiredSpace(paths []string, lengths []int) int64 {
+	required := int64(0)
+	for i, path := range paths {
+		size := int64(0)
+		if info, err := appFS.Stat(path); err == nil {
+			size = info.Size()
+		}
+		if int64(lengths[i]) > size {
+			required += int64(lengths[i]) - size
+		}
+	}
+	return required
+}
+
+// Checks the disk the torrent is saved to has room for the files
+func (d *randomAccessStorage) checkDiskSpace(paths []string, lengths []int) error {
+	directory := d.rootDirectory
+	for {
+		if _, err := appFS.Stat(directory); err == nil || filepath.Dir(directory) == directory {
+			break
+		}
+		directory = filepath.Dir(directory)
+	}
+	available, err := freeSpace(directory)
+	if err != nil {
+		// Unknown on this platform or file system
+		return nil
+	}
+	required := d.requiredSpace(paths, lengths)
+	if required > available {
+		return fmt.Errorf("%w: %d bytes required, %d bytes available", ErrDiskFull, required, available)
+	}
+	return nil
+}
+
+// Joins the path components under the directory, the path must not leave it
+func joinPath(directory string, path ...string) (string, error) {
+	joined := filepath.Join(append([]string{directory}, path...)...)
+	if joined != filepath.Clean(directory) && !strings.HasPrefix(joined, filepath.Clean(directory)+string(filepath.Separator)) {
+		return "", fmt.Errorf("Path %q is outside of %q", strings.Join(path, "/"), directory)
+	}
+	return joined, nil
+}
+
+func mkdirAll(directory string) error {
+	if _, err := appFS.Stat(directory); os.IsNotExist(err) {
+		return appFS.MkdirAll(directory, 0755)
+	}
+	return nil
+}
 
+func (d *randomAccessStorage) Init(tor *torrent.Torrent) error {
+	d.Lock()
+	defer d.Unlock()
+
+	err := d.locate(tor)
+	if err != nil {
+		return err
+	}
+
+	// Check the disk has room for the files before creating them
+	paths := []string{}
+	lengths := []int{}
+	for fileIndex, file := range d.torrent.MetaInfo.Info.Files {
+		if d.paths[fileIndex] != "" {
+			paths = append(paths, d.paths[fileIndex])
+			lengths = append(lengths, file.Length)
+		}
+	}
+	err = d.checkDiskSpace(paths, lengths)
+	if err != nil {
+		return err
+	}
+
+	// Create sub-directories and files
+	for fileIndex, file := range d.torrent.MetaInfo.Info.Files {
+		if d.paths[fileIndex] == "" {
+			continue
+		}
+		err = mkdirAll(filepath.Dir(d.paths[fileIndex]))
+		if err != nil {
+			return err
+		}
+		err = createFile(d.paths[fileIndex], file.Length, d.allocation)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Opens the torrent's files for reading e.g. to verify a stopped torrent.
+// The files aren't created and the layout doesn't avoid collisions, files
+// are opened for each read and closed after it, missing files fail to read.
+func (d *randomAccessStorage) InitReadOnly(tor *torrent.Torrent) error {
+	d.Lock()
+	defer d.Unlock()
+
+	d.readOnly = true
+	return d.locate(tor)
+}
+
+// Finds the path of each of the torrent's files and its offset within the
+// torrent
+func (d *randomAccessStorage) locate(tor *torrent.Torrent) error {
+	d.torrent = tor
+	d.paths = nil
+	d.finalPaths = nil
+	d.fileLocks = nil
+	d.fileOffsets = nil
+	d.rootDirectory = d.dataDirectory
+	if d.savePath != "" {
+		d.rootDirectory = d.savePath
+	}
+	if d.torrent.MetaInfo.Info.Length > 0 && len(d.torrent.MetaInfo.Info.Files) == 0 {
+		// Single File Mode, the torrent's only file is named after it
 		d.torrent.MetaInfo.Info.Files = append(d.torrent.MetaInfo.Info.Files, torrent.File{
 			Length: d.torrent.MetaInfo.Info.Length,
 			Path:   []string{d.torrent.MetaInfo.Info.Name},
+			Attr:   d.torrent.MetaInfo.Info.Attr,
 		})
 	}
+	err := d.layOut(d.rootDirectory)
+	if err != nil {
+		return err
+	}
+	if d.completedDirectory != "" {
+		for fileIndex := range d.torrent.MetaInfo.Info.Files {
+			if d.layoutPaths[fileIndex] != "" && pathExists(d.completedDirectory, d.layoutPaths[fileIndex]) {
+				// The torrent was moved once it was completed
+				d.rootDirectory = d.completedDirectory
+				break
+			}
+		}
+	}
+
+	offset := 0
+	for fileIndex, file := range d.torrent.MetaInfo.Info.Files {
+		d.fileLocks = append(d.fileLocks, &sync.Mutex{})
+		d.fileOffsets = append(d.fileOffsets, offset)
+		offset += file.Length
+		if file.IsPadding() || file.IsSymlink() {
+			// Padding files are only zeros, symlinks are created on completion
+			d.finalPaths = append(d.finalPaths, "")
+			d.paths = append(d.paths, "")
+			continue
+		}
+		finalPath, err := d.filePath(d.rootDirectory, fileIndex)
+		if err != nil {
+			return err
+		}
+		path, err := d.incompletePath(fileIndex, finalPath)
+		if err != nil {
+			return err
+		}
+		d.finalPaths = append(d.finalPaths, finalPath)
+		d.paths = append(d.paths, path)
+		if d.torrent.IsV2() && !d.torrent.IsV1() {
+			// Files of v2 torrents start on a piece boundary
+			pieceLength := d.torrent.MetaInfo.Info.PieceLength
+			offset = (offset + pieceLength - 1) / pieceLength * pieceLength
+		}
+	}
+	d.piecesWritten = bitmap.New(d.torrent.NumPieces)
+	return nil
+}
+
+// Path of the file until it's complete, files already at their final path
+// were completed before
+func (d *randomAccessStorage) incompletePath(fileIndex int, finalPath string) (string, error) {
+	if d.partSuffix == "" && d.incompleteDirectory == "" {
+		return finalPath, nil
+	}
+	if d.torrent.MetaInfo.Info.Files[fileIndex].Length == 0 {
+		// Empty files are complete
+		return finalPath, nil
+	}
+	if _, err := appFS.Stat(finalPath); err == nil {
+		return finalPath, nil
+	}
+	path := finalPath
+	if d.incompleteDirectory != "" {
+		var err error
+		path, err = d.filePath(d.incompleteDirectory, fileIndex)
+		if err != nil {
+			return "", err
+		}
+	}
+	return path + d.partSuffix, nil
+}
+
+// Files are downloaded with the suffix e.g. ".part" and/or under the
+// incomplete directory, and renamed once every piece of the file is written.
+// Takes effect when the storage is initialised.
+func (d *randomAccessStorage) SetIncomplete(suffix, incompleteDirectory string) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.partSuffix = suffix
+	d.incompleteDirectory = incompleteDirectory
+}
+
+// The torrent's files are moved under completedDirectory once every piece is
+// downloaded
+func (d *randomAccessStorage) SetCompletedDirectory(completedDirectory string) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.completedDirectory = completedDirectory
+}
+
+// Marks the pieces within the range that were written in full, the files
+// all of whose pieces are written are renamed to their final path
+func (d *randomAccessStorage) markWritten(globalOffset, length int) error {
+	pieceLength := d.torrent.MetaInfo.Info.PieceLength
+	end := globalOffset + length
+	d.Lock()
+	for pieceIndex := globalOffset / pieceLength; pieceIndex < d.torrent.NumPieces && pieceIndex*pieceLength < end; pieceIndex++ {
+		if pieceIndex*pieceLength >= globalOffset && pieceIndex*pieceLength+d.torrent.PieceSize(pieceIndex) <= end {
+			d.piecesWritten.Set(pieceIndex, true)
+		}
+	}
+	d.Unlock()
+
+	fileIndex, _, err := d.find(globalOffset)
+	if err != nil {
+		return err
+	}
+	for ; fileIndex < len(d.paths) && d.fileOffsets[fileIndex] < end; fileIndex++ {
+		err := d.completeFile(fileIndex, false)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Marks the pieces found on disk as written, completing their files
+func (d *randomAccessStorage) markVerified(bitfield bitmap.Bitmap) {
+	pieceLength := d.torrent.MetaInfo.Info.PieceLength
+	for pieceIndex := 0; pieceIndex < d.torrent.NumPieces; pieceIndex++ {
+		if !bitfield.Get(pieceIndex) {
+			continue
+		}
+		err := d.markWritten(pieceIndex*pieceLength, d.torrent.PieceSize(pieceIndex))
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// Renames the file to its final path once all its pieces are written, or
+// regardless of its pieces once the torrent is complete
+func (d *randomAccessStorage) completeFile(fileIndex int, completed bool) error {
+	file := d.torrent.MetaInfo.Info.Files[fileIndex]
+	if !completed && file.Length > 0 {
+		pieceLength := d.torrent.MetaInfo.Info.PieceLength
+		first := d.fileOffsets[fileIndex] / pieceLength
+		last := (d.fileOffsets[fileIndex] + file.Length - 1) / pieceLength
+		d.RLock()
+		for pieceIndex := first; pieceIndex <= last; pieceIndex++ {
+			if !d.piecesWritten.Get(pieceIndex) {
+				d.RUnlock()
+				return nil
+			}
+		}
+		d.RUnlock()
+	}
+
+	d.fileLocks[fileIndex].Lock()
+	defer d.fileLocks[fileIndex].Unlock()
+
+	if d.paths[fileIndex] == d.finalPaths[fileIndex] {
+		// Already complete, or not on disk
+		return nil
+	}
+	// The file is closed before it's renamed, the pool reopens it by its
+	// new path
+	d.pool.Close(d.paths[fileIndex])
+	err := mkdirAll(filepath.Dir(d.finalPaths[fileIndex]))
+	if err != nil {
+		return err
+	}
+	// The incomplete directory may be on another filesystem
+	copied, err := moveFile(d.paths[fileIndex], d.finalPaths[fileIndex], func(n int64) {})
+	if err != nil {
+		return err
+	}
+	if d.incompleteDirectory != "" {
+		removeEmptyParents(d.paths[fileIndex], d.incompleteDirectory)
+	}
+	d.paths[fileIndex] = d.finalPaths[fileIndex]
+	if copied && d.relocated != nil {
+		d.relocated(fileIndex)
+	}
+	return nil
 }
 
 func (d *randomAccessStorage) find(globalOffset int) (int, int, error) {
 	i := 0
-	j := len(d.files)
+	j := len(d.paths)
 	for i < j {
 		fileIndex := (i + j) / 2
 		if globalOffset >= d.fileOffsets[fileIndex] &&
@@ -112,6 +440,14 @@ func (d *randomAccessStorage) find(globalOffset int) (int, int, error) {
 	return 0, 0, fmt.Errorf("File doesn't exist")
 }
 
+// Offset of each file within the torrent's data, by file index
+func (d *randomAccessStorage) GetFileOffsets() []int {
+	d.RLock()
+	defer d.RUnlock()
+
+	return d.fileOffsets
+}
+
 func min(i, j int) int {
 	if i < j {
 		return i
@@ -119,22 +455,51 @@ func min(i, j int) int {
 	return j
 }
 
+func (d *randomAccessStorage) readAt(path string, data []byte, fileOffset int) error {
+	if d.readOnly {
+		file, err := openFile(path, os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		_, err = file.ReadAt(data, int64(fileOffset))
+		file.Close()
+		return err
+	}
+	file, err := d.pool.Acquire(path)
+	if err != nil {
+		return err
+	}
+	_, err = file.ReadAt(data, int64(fileOffset))
+	d.pool.Release(path)
+	return err
+}
+
 func (d *randomAccessStorage) readBlock(fileIndex, fileOffset, blockLength int) ([]byte, error) {
 
 	blockData := &bytes.Buffer{}
-	for i := 0; i < 2 && blockLength > 0; i++ {
+	// Blocks span as many files as they overlap, torrents may have many small files
+	for blockLength > 0 {
 		length := min(d.torrent.MetaInfo.Info.Files[fileIndex].Length-fileOffset, blockLength)
 		data := make([]byte, length)
 
-		d.fileLocks[fileIndex].Lock()
-		_, err := d.files[fileIndex].ReadAt(data, int64(fileOffset))
-		d.fileLocks[fileIndex].Unlock()
-		fail(err)
+		if d.finalPaths[fileIndex] != "" {
+			d.fileLocks[fileIndex].Lock()
+			err := d.readAt(d.paths[fileIndex], data, fileOffset)
+			d.fileLocks[fileIndex].Unlock()
+			if err == io.EOF {
+				// Files allocated on write are only as long as their last
+				// written piece, the rest is zeros
+				err = nil
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
 		binary.Write(blockData, binary.BigEndian, data)
 
 		blockLength -= length
 		fileIndex++
-		if blockLength > 0 && fileIndex >= len(d.files) {
+		if blockLength > 0 && fileIndex >= len(d.paths) {
 			return ([]byte)(nil), fmt.Errorf("reading beyond end of last file")
 		}
 		fileOffset = 0
@@ -156,7 +521,9 @@ func (d *randomAccessStorage) BlockReadRequest(pieceIndex, blockByteOffset, bloc
 
 	globalOffset := pieceIndex*d.torrent.MetaInfo.Info.PieceLength + blockByteOffset
 	fileIndex, fileOffset, err := d.find(globalOffset)
-	fail(err)
+	if err != nil {
+		return nil, err
+	}
 	block, err := d.readBlock(fileIndex, fileOffset, blockLength)
 	if err != nil {
 		return nil, err
@@ -166,16 +533,25 @@ func (d *randomAccessStorage) BlockReadRequest(pieceIndex, blockByteOffset, bloc
 
 func (d *randomAccessStorage) writePiece(fileIndex, fileOffset int, data []byte) error {
 
-	for i := 0; i < 2 && len(data) > 0; i++ {
+	for len(data) > 0 {
 		length := min(d.torrent.MetaInfo.Info.Files[fileIndex].Length-fileOffset, len(data))
-		d.fileLocks[fileIndex].Lock()
-		d.files[fileIndex].WriteAt(data[:length], int64(fileOffset))
-		d.fileLocks[fileIndex].Unlock()
+		if d.finalPaths[fileIndex] != "" {
+			d.fileLocks[fileIndex].Lock()
+			file, err := d.pool.Acquire(d.paths[fileIndex])
+			if err == nil {
+				_, err = file.WriteAt(data[:length], int64(fileOffset))
+				d.pool.Release(d.paths[fileIndex])
+			}
+			d.fileLocks[fileIndex].Unlock()
+			if err != nil {
+				return err
+			}
+		}
 
 		// after writing, check
 		data = data[length:]
 		fileIndex++
-		if len(data) > 0 && fileIndex >= len(d.files) {
+		if len(data) > 0 && fileIndex >= len(d.paths) {
 			fmt.Println("fileIndex: ", fileIndex)
 			return fmt.Errorf("writing beyond end of last file")
 		}
@@ -187,30 +563,55 @@ func (d *randomAccessStorage) writePiece(fileIndex, fileOffset int, data []byte)
 func (d *randomAccessStorage) WritePieceRequest(pieceIndex int, data []byte) error {
 	globalOffset := pieceIndex * d.torrent.MetaInfo.Info.PieceLength
 	fileIndex, fileOffset, err := d.find(globalOffset)
-	fail(err)
+	if err != nil {
+		return err
+	}
 	err = d.writePiece(fileIndex, fileOffset, data)
 	if err != nil {
 		return err
 	}
-	return nil
+	return d.markWritten(globalOffset, len(data))
+}
+
+// Writes data spanning several consecutive pieces at once
+func (d *randomAccessStorage) writeRange(globalOffset int, data []byte) error {
+	fileIndex, fileOffset, err := d.find(globalOffset)
+	if err != nil {
+		return err
+	}
+	err = d.writePiece(fileIndex, fileOffset, data)
+	if err != nil {
+		return err
+	}
+	return d.markWritten(globalOffset, len(data))
 }
 
 func (d *randomAccessStorage) GetCurrentDownloadState() (bitmap.Bitmap, bool, int) {
-	clientBitfield := bitmap.New(d.torrent.NumPieces)
+	bitfield, completed, left := currentDownloadState(d.torrent, d.BlockReadRequest)
+	d.markVerified(bitfield)
+	return bitfield, completed, left
+}
+
+// Checks the pieces read with readBlock against their hashes
+func currentDownloadState(tor *torrent.Torrent, readBlock func(pieceIndex, blockByteOffset, length int) ([]byte, error)) (bitmap.Bitmap, bool, int) {
+	clientBitfield := bitmap.New(tor.NumPieces)
+	if tor.Verified {
+		// Only the initial check is skipped
+		tor.Verified = false
+		for pieceIndex := 0; pieceIndex < tor.NumPieces; pieceIndex++ {
+			clientBitfield.Set(pieceIndex, true)
+		}
+		return clientBitfield, true, 0
+	}
 	// read pieces sequentially, validating the checksums
-	for pieceIndex := 0; pieceIndex < d.torrent.NumPieces; pieceIndex++ {
-		var piece []byte
-		var err error
-		if pieceIndex == d.torrent.NumPieces-1 {
-			bytesInLastPiece := d.torrent.Length - ((d.torrent.NumPieces - 1) * d.torrent.MetaInfo.Info.PieceLength)
-			piece, err = d.BlockReadRequest(pieceIndex, 0, bytesInLastPiece)
-		} else {
-			piece, err = d.BlockReadRequest(pieceIndex, 0, d.torrent.MetaInfo.Info.PieceLength)
+	for pieceIndex := 0; pieceIndex < tor.NumPieces; pieceIndex++ {
+		piece, err := readBlock(pieceIndex, 0, tor.PieceSize(pieceIndex))
+		if err != nil {
+			// Unreadable pieces are downloaded again
+			fmt.Println(err)
+			continue
 		}
-		fail(err)
-		expectedChecksum := []byte(d.torrent.MetaInfo.Info.Pieces)[pieceIndex*20 : (pieceIndex+1)*20]
-		actualChecksum := sha1.Sum(piece)
-		if bytes.Equal(expectedChecksum, actualChecksum[:]) {
+		if tor.VerifyPiece(pieceIndex, piece) {
 			clientBitfield.Set(pieceIndex, true)
 		}
 	}
@@ -220,11 +621,68 @@ func (d *randomAccessStorage) GetCurrentDownloadState() (bitmap.Bitmap, bool, in
 		Chain(clientBitfield.Data(false)).
 		Distinct(func(b byte) bool { return b == 1 }).
 		Value(&piecesDownloaded)
-	left := d.torrent.Length - piecesDownloaded*d.torrent.MetaInfo.Info.PieceLength
+	left := tor.Length - piecesDownloaded*tor.MetaInfo.Info.PieceLength
 	completed := false
-	if piecesDownloaded == d.torrent.NumPieces {
+	if piecesDownloaded == tor.NumPieces {
 		completed = true
 	}
 
 	return clientBitfield, completed, left
 }
+
+// Renames the files that are still incomplete and moves the torrent to the
+// completed directory, then applies the file attributes (BEP 0047),
+// executable files are made executable and symlinks are created
+func (d *randomAccessStorage) Completed() error {
+	d.Lock()
+	defer d.Unlock()
+
+	for fileIndex := range d.paths {
+		err := d.completeFile(fileIndex, true)
+		if err != nil {
+			return err
+		}
+	}
+	if d.completedDirectory != "" && d.completedDirectory != d.rootDirectory {
+		err := d.moveTo(d.completedDirectory, false, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	for fileIndex, file := range d.torrent.MetaInfo.Info.Files {
+		if file.IsPadding() {
+			continue
+		}
+		path, err := d.filePath(d.rootDirectory, fileIndex)
+		if err != nil {
+			return err
+		}
+		if file.IsExecutable() && !file.IsSymlink() {
+			err := appFS.Chmod(path, 0755)
+			if err != nil {
+				return err
+			}
+		}
+		if file.IsSymlink() {
+			target, err := d.symlinkTarget(file)
+			if err != nil {
+				return err
+			}
+			subdir := filepath.Dir(path)
+			err = mkdirAll(subdir)
+			if err != nil {
+				return err
+			}
+			target, err = filepath.Rel(subdir, target)
+			if err != nil {
+				return err
+			}
+			err = symlink(target, path)
+			if err != nil && !os.IsExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
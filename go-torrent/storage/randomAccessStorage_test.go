@@ -1,107 +1,124 @@
 package storage
 
 import (
+	"bytes"
 	"os"
 	"testing"
-	"time"
 
 	"github.com/Charana123/torrent/go-torrent/torrent"
 	"github.com/spf13/afero"
-	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/assert"
 )
 
-var mi *torrent.MetaInfo = &torrent.MetaInfo{
-	Info: torrent.Info{
-		PieceLength: 256, // 2^8
-		Name:        "root",
-		Files: []torrent.File{
-			torrent.File{
-				Length: 300,
-				Path:   []string{"sub1", "name1"},
-			},
-			torrent.File{
-				Length: 300,
-				Path:   []string{"sub1", "sub2", "name2"},
-			},
-		},
-	}}
+func newTestTorrent() *torrent.Torrent {
+	return multiFileTorrent(256,
+		torrent.File{Length: 300, Path: []string{"sub1", "name1"}},
+		torrent.File{Length: 300, Path: []string{"sub1", "sub2", "name2"}})
+}
 
-func TestInit(t *testing.T) {
+// The storage's files are created in memory
+func newMemStorage(t *testing.T, tor *torrent.Torrent) *randomAccessStorage {
 	appFS = afero.NewMemMapFs()
 	openFile = appFS.OpenFile
-	NewDisk(mi)
-
-	<-time.After(time.Second)
-	if _, err := appFS.Stat("root"); os.IsNotExist(err) {
-		t.Error(err)
-	}
-	if _, err := appFS.Stat("root/sub1/name1"); os.IsNotExist(err) {
-		t.Error(err)
-	}
-	if _, err := appFS.Stat("root/sub1/sub2/name2"); os.IsNotExist(err) {
-		t.Error(err)
-	}
-}
-
-type mockFile struct {
-	mock.Mock
-	afero.File
+	t.Cleanup(func() {
+		appFS = afero.NewOsFs()
+		openFile = appFS.OpenFile
+	})
+	s := NewRandomAccessStorageAt("save").(*randomAccessStorage)
+	s.pool = NewFilePool(8)
+	assert.Nil(t, s.Init(tor))
+	return s
 }
 
-func (m *mockFile) WriteAt(b []byte, off int64) (int, error) {
-	args := m.Called(b, off)
-	return args.Int(0), args.Error(1)
-}
-
-func (m *mockFile) ReadAt(b []byte, off int64) (int, error) {
-	args := m.Called(b, off)
-	return args.Int(0), args.Error(1)
-}
+func TestInit(t *testing.T) {
+	newMemStorage(t, newTestTorrent())
 
-func mockOpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
-	return &mockFile{}, nil
+	for _, path := range []string{"save/root", "save/root/sub1/name1", "save/root/sub1/sub2/name2"} {
+		_, err := appFS.Stat(path)
+		assert.Nil(t, err, path)
+	}
+	fileInfo, _ := appFS.Stat("save/root/sub1/name1")
+	assert.Equal(t, int64(300), fileInfo.Size())
 }
 
 func TestBlockReadRequest(t *testing.T) {
-	appFS = afero.NewMemMapFs()
-	openFile = mockOpenFile
-
-	disk := NewDisk(mi).(*disk)
-
-	// read 0th-index piece at offset 281, length 19
-	mf1 := disk.files[0].(*mockFile)
-	mf1.On("ReadAt", mock.MatchedBy(func(buf []byte) bool {
-		return len(buf) == 19
-	}), int64(281)).Return(19, nil)
-	// read 1th-index piece at offset 0, length 109
-	mf2 := disk.files[1].(*mockFile)
-	mf2.On("ReadAt", mock.MatchedBy(func(buf []byte) bool {
-		return len(buf) == 109
-	}), int64(0)).Return(109, nil)
-
-	disk.BlockReadRequest(1, 25, 128)
-	mf1.AssertExpectations(t)
-	mf2.AssertExpectations(t)
+	s := newMemStorage(t, newTestTorrent())
+	file1 := bytes.Repeat([]byte{1}, 300)
+	file2 := bytes.Repeat([]byte{2}, 300)
+	assert.Nil(t, afero.WriteFile(appFS, "save/root/sub1/name1", file1, 0644))
+	assert.Nil(t, afero.WriteFile(appFS, "save/root/sub1/sub2/name2", file2, 0644))
+
+	// 19 bytes from the end of name1 at offset 281, 109 from the start of name2
+	block, err := s.BlockReadRequest(1, 25, 128)
+	assert.Nil(t, err)
+	assert.Equal(t, append(file1[281:], file2[:109]...), block)
 }
 
 func TestWritePieceRequest(t *testing.T) {
-	appFS = afero.NewMemMapFs()
-	openFile = mockOpenFile
-
-	disk := NewDisk(mi).(*disk)
+	s := newMemStorage(t, newTestTorrent())
+	piece := make([]byte, 256)
+	for i := range piece {
+		piece[i] = byte(i)
+	}
 
-	// read 0th-index piece at offset 281, length 19
-	mf1 := disk.files[0].(*mockFile) // 256
-	mf1.On("WriteAt", mock.MatchedBy(func(buf []byte) bool {
-		return len(buf) == 44
-	}), int64(256)).Return(44, nil)
-	// read 1th-index piece at offset 0, length 109
-	mf2 := disk.files[1].(*mockFile)
-	mf2.On("WriteAt", mock.MatchedBy(func(buf []byte) bool {
-		return len(buf) == 212
-	}), int64(0)).Return(212, nil)
+	// 44 bytes at the end of name1 from offset 256, 212 at the start of name2
+	assert.Nil(t, s.WritePieceRequest(1, piece))
+	file1, _ := afero.ReadFile(appFS, "save/root/sub1/name1")
+	assert.Equal(t, piece[:44], file1[256:])
+	file2, _ := afero.ReadFile(appFS, "save/root/sub1/sub2/name2")
+	assert.Equal(t, piece[44:], file2[:212])
+}
 
-	disk.WritePieceRequest(1, make([]byte, 256))
-	mf1.AssertExpectations(t)
-	mf2.AssertExpectations(t)
+func TestPaddingAndAttributes(t *testing.T) {
+	appFS = afero.NewMemMapFs()
+	openFile = appFS.OpenFile
+	links := map[string]string{}
+	symlink = func(oldname, newname string) error {
+		links[newname] = oldname
+		return nil
+	}
+	defer func() {
+		appFS = afero.NewOsFs()
+		openFile = appFS.OpenFile
+		symlink = os.Symlink
+	}()
+
+	tor := &torrent.Torrent{
+		NumPieces: 2,
+		Length:    512,
+		MetaInfo: torrent.MetaInfo{
+			Info: torrent.Info{
+				PieceLength: 256,
+				Name:        "root",
+				Files: []torrent.File{
+					torrent.File{Length: 200, Path: []string{"bin", "run"}, Attr: "x"},
+					torrent.File{Length: 56, Path: []string{".pad", "56"}, Attr: "p"},
+					torrent.File{Length: 256, Path: []string{"data"}},
+					torrent.File{Length: 0, Path: []string{"sub", "link"}, Attr: "l", SymlinkPath: []string{"bin", "run"}},
+				},
+			},
+		},
+	}
+	s := NewRandomAccessStorageAt("save").(*randomAccessStorage)
+	s.pool = NewFilePool(8)
+	s.Init(tor)
+
+	// Padding files aren't created, writes to them are dropped and reads are zeros
+	_, err := appFS.Stat("save/root/.pad")
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, s.WritePieceRequest(0, bytes.Repeat([]byte{1}, 256)))
+	block, err := s.BlockReadRequest(0, 0, 256)
+	assert.Nil(t, err)
+	assert.Equal(t, append(bytes.Repeat([]byte{1}, 200), make([]byte, 56)...), block)
+
+	assert.Nil(t, s.Completed())
+	fileInfo, _ := appFS.Stat("save/root/bin/run")
+	assert.Equal(t, os.FileMode(0755), fileInfo.Mode().Perm())
+	fileInfo, _ = appFS.Stat("save/root/data")
+	assert.Equal(t, os.FileMode(0644), fileInfo.Mode().Perm())
+	assert.Equal(t, map[string]string{"save/root/sub/link": "../bin/run"}, links)
+
+	// Symlinks can't point outside of the torrent
+	tor.MetaInfo.Info.Files[3].SymlinkPath = []string{"..", "..", "etc", "passwd"}
+	assert.NotNil(t, s.Completed())
 }
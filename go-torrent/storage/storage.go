@@ -1,7 +1,9 @@
 package storage
 
 import (
-	"log"
+	"errors"
+	"os"
+	"syscall"
 
 	"github.com/Charana123/torrent/go-torrent/torrent"
 
@@ -10,18 +12,116 @@ import (
 	"github.com/spf13/afero"
 )
 
+// Storage backends
+const (
+	RANDOM_ACCESS_STORAGE = 0
+	// Memory mapped files, where they're supported
+	MMAP_STORAGE = 1
+)
+
+// How files are allocated when they're created
+const (
+	// Files are truncated to their length, blocks are allocated as they're
+	// written
+	ALLOCATE_SPARSE = 0
+	// Every block is allocated up front, s.t. the disk can't fill up during
+	// the download
+	ALLOCATE_FULL = 1
+	// Files grow as pieces are written
+	ALLOCATE_ON_WRITE = 2
+)
+
+// How the torrent's files are laid out under the directory it's saved to
+const (
+	// Under a directory (or file) named after the torrent
+	LAYOUT_ORIGINAL = 0
+	// Under the torrent's name within a directory named after its info-hash
+	LAYOUT_INFO_HASH = 1
+	// Every file directly under the directory, without sub-directories
+	LAYOUT_FLAT = 2
+	// The torrent's files and sub-directories directly under the directory
+	LAYOUT_STRIP_ROOT = 3
+)
+
+// When pieces written to memory mapped files are flushed with msync
+const (
+	// Modified pages are written back by the kernel
+	MSYNC_NONE = 0
+	// Written back asynchronously after every piece
+	MSYNC_ASYNC = 1
+	// Written back before WritePieceRequest returns
+	MSYNC_SYNC = 2
+)
+
 var appFS = afero.NewOsFs()
 var openFile = appFS.OpenFile
+var symlink = os.Symlink
+var freeSpace = diskFreeSpace
+
+// Storage that allocates files in one of the allocation modes
+type Allocator interface {
+	SetAllocationMode(allocation int)
+}
+
+// Storage that lays the torrent's files out under the directory it's saved to
+type LayoutStorage interface {
+	// SetLayout lays the files out in one of the layouts. Given paths, e.g.
+	// from the resume state, the files are found at them instead. Otherwise
+	// with avoidCollisions, files of other torrents in the way are avoided by
+	// renaming the torrent's files.
+	SetLayout(layout int, paths []string, avoidCollisions bool)
+	// Paths of the files relative to the directory, once the storage is
+	// initialised. Padding files don't have a path.
+	GetLayoutPaths() []string
+}
+
+// Storage whose files can be moved while the torrent is running
+type Mover interface {
+	// Move moves the torrent's files under newPath, renaming them or copying
+	// them to another filesystem, progress is called with the bytes moved.
+	// With adopt, files already under newPath are kept rather than
+	// overwritten if their pieces verify.
+	Move(newPath string, adopt bool, progress func(moved, total int64)) error
+}
+
+// Storage that downloads files under a temporary name and renames them once
+// they're complete
+type IncompleteStorage interface {
+	// Files are downloaded with the suffix e.g. ".part" and/or under the
+	// incomplete directory
+	SetIncomplete(suffix, incompleteDirectory string)
+	// The torrent is moved under the directory once it's complete
+	SetCompletedDirectory(completedDirectory string)
+}
+
+// Storage whose files can be read without creating them
+type ReadOnlyStorage interface {
+	// InitReadOnly finds the torrent's files like Init, without creating
+	// them or keeping them open
+	InitReadOnly(tor *torrent.Torrent) error
+}
+
+// Storage that evicts pieces it stored e.g. to bound its memory, evicted is
+// called with each piece evicted s.t. it's downloaded again
+type EvictingStorage interface {
+	SetEvicted(evicted func(pieceIndex int))
+}
 
 type Storage interface {
-	Init(tor *torrent.Torrent)
+	Init(tor *torrent.Torrent) (err error)
 	BlockReadRequest(pieceIndex, blockByteOffset, length int) (blockData []byte, err error)
 	WritePieceRequest(pieceIndex int, data []byte) (err error)
 	GetCurrentDownloadState() (clientBitfield bitmap.Bitmap, completed bool, left int)
+	GetFileOffsets() (fileOffsets []int)
+	// Called once every piece is downloaded
+	Completed() (err error)
 }
 
-func fail(err error) {
-	if err != nil {
-		log.Fatalln(err)
-	}
+// ErrDiskFull is returned when the disk doesn't have room for the torrent
+var ErrDiskFull = errors.New("Not enough disk space")
+
+// IsDiskFull is true of errors checking for disk space and of writes to a
+// full disk
+func IsDiskFull(err error) bool {
+	return errors.Is(err, ErrDiskFull) || errors.Is(err, syscall.ENOSPC)
 }
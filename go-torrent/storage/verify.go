@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"hash"
+	"strings"
+
+	"github.com/Charana123/torrent/go-torrent/torrent"
+)
+
+// Range of a file's data, within one of the torrent's pieces
+type FileRange struct {
+	PieceIndex int
+	Offset     int
+	Length     int
+}
+
+// FileReport is the result of checking a file against its md5sum (BEP 0003)
+// or sha1 (BEP 0047), and the pieces of the torrent overlapping it
+type FileReport struct {
+	FileIndex int
+	Path      []string
+	// "md5" or "sha1", empty if the file carries neither
+	Checksum string
+	// The file matches its checksum, if it has one, and none of the pieces
+	// it overlaps is corrupt
+	OK bool
+	// Ranges of the file within corrupt pieces
+	Corrupt []FileRange
+}
+
+// VerificationReport lists the corrupt pieces and the files they affect,
+// and the files checked against their own checksums
+type VerificationReport struct {
+	CorruptPieces []int
+	// Files with a checksum or overlapping corrupt pieces
+	Files []FileReport
+}
+
+func (r *VerificationReport) OK() bool {
+	for _, file := range r.Files {
+		if !file.OK {
+			return false
+		}
+	}
+	return len(r.CorruptPieces) == 0
+}
+
+type fileChecksum struct {
+	kind     string
+	expected []byte
+	hash     hash.Hash
+}
+
+// Checksum of the file, nil if it doesn't carry one. The sha1 is either the
+// 20 byte digest or its hex encoding.
+func checksumOf(tor *torrent.Torrent, file torrent.File) *fileChecksum {
+	md5sum := file.Md5sum
+	if md5sum == "" && tor.MetaInfo.Info.Length > 0 {
+		// Single File Mode
+		md5sum = tor.MetaInfo.Info.Md5sum
+	}
+	if expected, err := hex.DecodeString(strings.TrimSpace(md5sum)); err == nil && len(expected) == md5.Size {
+		return &fileChecksum{kind: "md5", expected: expected, hash: md5.New()}
+	}
+	expected := []byte(file.Sha1)
+	if len(file.Sha1) == 2*sha1.Size {
+		expected, _ = hex.DecodeString(file.Sha1)
+	}
+	if len(expected) == sha1.Size {
+		return &fileChecksum{kind: "sha1", expected: expected, hash: sha1.New()}
+	}
+	return nil
+}
+
+// VerifyFiles reads every piece from the storage, checking it against its
+// hash and the files carrying a checksum against it. Corrupt pieces are
+// mapped to the ranges of the files they overlap with the storage's file
+// offsets.
+func VerifyFiles(tor *torrent.Torrent, s Storage) *VerificationReport {
+	files := tor.MetaInfo.Info.Files
+	if len(files) == 0 {
+		// Single File Mode, the storage didn't add the torrent's only file
+		files = []torrent.File{{
+			Length: tor.MetaInfo.Info.Length,
+			Path:   []string{tor.MetaInfo.Info.Name},
+		}}
+	}
+	offsets := s.GetFileOffsets()
+	if len(offsets) != len(files) {
+		offsets = FileOffsets(tor)
+	}
+	checksums := make([]*fileChecksum, len(files))
+	reports := make([]*FileReport, len(files))
+	for fileIndex, file := range files {
+		if file.IsPadding() || file.IsSymlink() {
+			continue
+		}
+		checksums[fileIndex] = checksumOf(tor, file)
+		reports[fileIndex] = &FileReport{
+			FileIndex: fileIndex,
+			Path:      file.Path,
+			OK:        true,
+		}
+		if checksums[fileIndex] != nil {
+			reports[fileIndex].Checksum = checksums[fileIndex].kind
+		}
+	}
+
+	report := &VerificationReport{}
+	pieceLength := tor.MetaInfo.Info.PieceLength
+	for pieceIndex := 0; pieceIndex < tor.NumPieces; pieceIndex++ {
+		pieceSize := tor.PieceSize(pieceIndex)
+		piece, err := s.BlockReadRequest(pieceIndex, 0, pieceSize)
+		corrupt := err != nil || len(piece) != pieceSize || !tor.VerifyPiece(pieceIndex, piece)
+		if corrupt {
+			report.CorruptPieces = append(report.CorruptPieces, pieceIndex)
+		}
+		start := pieceIndex * pieceLength
+		end := start + pieceSize
+		for fileIndex, file := range files {
+			if reports[fileIndex] == nil || offsets[fileIndex] >= end || offsets[fileIndex]+file.Length <= start {
+				continue
+			}
+			from := max(offsets[fileIndex], start)
+			to := min(offsets[fileIndex]+file.Length, end)
+			if corrupt {
+				reports[fileIndex].OK = false
+				reports[fileIndex].Corrupt = append(reports[fileIndex].Corrupt, FileRange{
+					PieceIndex: pieceIndex,
+					Offset:     from - offsets[fileIndex],
+					Length:     to - from,
+				})
+			}
+			if checksums[fileIndex] != nil && err == nil && len(piece) == pieceSize {
+				checksums[fileIndex].hash.Write(piece[from-start : to-start])
+			}
+		}
+	}
+
+	for fileIndex, r := range reports {
+		if r == nil {
+			continue
+		}
+		if checksum := checksums[fileIndex]; checksum != nil && !bytes.Equal(checksum.hash.Sum(nil), checksum.expected) {
+			r.OK = false
+		}
+		if r.Checksum != "" || !r.OK {
+			report.Files = append(report.Files, *r)
+		}
+	}
+	return report
+}
+
+func max(i, j int) int {
+	if i > j {
+		return i
+	}
+	return j
+}
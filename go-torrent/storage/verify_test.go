@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Charana123/torrent/go-torrent/torrent"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyFiles(t *testing.T) {
+	data := []byte{}
+	for i := 0; i < 50; i++ {
+		data = append(data, byte(i))
+	}
+	md5sum := md5.Sum(data[:20])
+	sha1sum := sha1.Sum(data[20:40])
+	tor := multiFileTorrent(16,
+		torrent.File{Length: 20, Path: []string{"a"}, Md5sum: hex.EncodeToString(md5sum[:])},
+		torrent.File{Length: 20, Path: []string{"b"}, Sha1: string(sha1sum[:])},
+		torrent.File{Length: 10, Path: []string{"c"}})
+	for pieceIndex := 0; pieceIndex < tor.NumPieces; pieceIndex++ {
+		checksum := sha1.Sum(data[pieceIndex*16 : pieceIndex*16+tor.PieceSize(pieceIndex)])
+		tor.MetaInfo.Info.Pieces += string(checksum[:])
+	}
+	s := NewRandomAccessStorageAt(t.TempDir())
+	assert.Nil(t, s.Init(tor))
+	writeTorrent(t, s, tor, data)
+
+	report := VerifyFiles(tor, s)
+	assert.True(t, report.OK())
+	assert.Empty(t, report.CorruptPieces)
+	assert.Equal(t, []FileReport{
+		{FileIndex: 0, Path: []string{"a"}, Checksum: "md5", OK: true},
+		{FileIndex: 1, Path: []string{"b"}, Checksum: "sha1", OK: true},
+	}, report.Files)
+
+	// The third piece spans b and c
+	assert.Nil(t, s.WritePieceRequest(2, make([]byte, 16)))
+	report = VerifyFiles(tor, s)
+	assert.False(t, report.OK())
+	assert.Equal(t, []int{2}, report.CorruptPieces)
+	assert.Equal(t, []FileReport{
+		{FileIndex: 0, Path: []string{"a"}, Checksum: "md5", OK: true},
+		{FileIndex: 1, Path: []string{"b"}, Checksum: "sha1", Corrupt: []FileRange{{PieceIndex: 2, Offset: 12, Length: 8}}},
+		{FileIndex: 2, Path: []string{"c"}, Corrupt: []FileRange{{PieceIndex: 2, Offset: 0, Length: 8}}},
+	}, report.Files)
+}
+
+func TestVerifyReadOnly(t *testing.T) {
+	data := make([]byte, 50)
+	tor := multiFileTorrent(16,
+		torrent.File{Length: 40, Path: []string{"a"}},
+		torrent.File{Length: 10, Path: []string{"b"}})
+	for pieceIndex := 0; pieceIndex < tor.NumPieces; pieceIndex++ {
+		checksum := sha1.Sum(data[pieceIndex*16 : pieceIndex*16+tor.PieceSize(pieceIndex)])
+		tor.MetaInfo.Info.Pieces += string(checksum[:])
+	}
+	savePath := t.TempDir()
+	s := NewRandomAccessStorageAt(savePath)
+	assert.Nil(t, s.Init(tor))
+	writeTorrent(t, s, tor, data)
+	assert.Nil(t, os.Remove(filepath.Join(savePath, "root", "b")))
+
+	// Missing files are corrupt rather than created
+	readOnly := NewRandomAccessStorageAt(savePath).(*randomAccessStorage)
+	readOnly.SetAllocationMode(ALLOCATE_FULL)
+	readOnly.pool = NewFilePool(8)
+	assert.Nil(t, readOnly.InitReadOnly(tor))
+	report := VerifyFiles(tor, readOnly)
+	assert.Equal(t, []int{2, 3}, report.CorruptPieces)
+	assert.Equal(t, []FileReport{
+		{FileIndex: 0, Path: []string{"a"}, Corrupt: []FileRange{{PieceIndex: 2, Offset: 32, Length: 8}}},
+		{FileIndex: 1, Path: []string{"b"}, Corrupt: []FileRange{{PieceIndex: 2, Offset: 0, Length: 8}, {PieceIndex: 3, Offset: 8, Length: 2}}},
+	}, report.Files)
+	_, err := os.Stat(filepath.Join(savePath, "root", "b"))
+	assert.True(t, os.IsNotExist(err))
+	// Files aren't kept open
+	_, misses, _, _ := readOnly.pool.GetStats()
+	assert.Equal(t, 0, misses)
+}
+
+func TestVerifySingleFile(t *testing.T) {
+	data := []byte("single file mode")
+	md5sum := md5.Sum(data)
+	checksum := sha1.Sum(data)
+	tor := &torrent.Torrent{
+		NumPieces: 1,
+		Length:    len(data),
+		MetaInfo: torrent.MetaInfo{
+			Info: torrent.Info{
+				PieceLength: 16,
+				Pieces:      string(checksum[:]),
+				Name:        "file",
+				Length:      len(data),
+				Md5sum:      hex.EncodeToString(md5sum[:]),
+			},
+		},
+	}
+	s := NewMemoryStorage(0)
+	assert.Nil(t, s.Init(tor))
+	assert.Nil(t, s.WritePieceRequest(0, data))
+	report := VerifyFiles(tor, s)
+	assert.True(t, report.OK())
+	assert.Equal(t, []FileReport{{FileIndex: 0, Path: []string{"file"}, Checksum: "md5", OK: true}}, report.Files)
+}
@@ -0,0 +1,272 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+const (
+	MIN_PIECE_LENGTH  = 16384    // 16 KiB
+	MAX_PIECE_LENGTH  = 16777216 // 16 MiB
+	TARGET_NUM_PIECES = 1500
+)
+
+type CreateOptions struct {
+	// Piece length in bytes, chosen from the total size if 0
+	PieceLength int
+	// Tiers of tracker URLs (BEP 0012)
+	AnnounceList [][]string
+	// Web seed URLs (BEP 0019)
+	URLList []string
+	Private bool
+	Comment string
+	// Defaults to "go-torrent"
+	CreatedBy string
+	// Defaults to the current time
+	CreationDate time.Time
+	// Distinguishes otherwise identical torrents, e.g. across private trackers
+	Source string
+}
+
+type createFile struct {
+	diskPath string
+	path     []string
+	length   int
+	offset   int
+}
+
+// Create builds a torrent from the file or directory at root, writing its
+// metainfo to w. Files are added in lexical order. The returned torrent is
+// marked as verified, it can be seeded from the parent directory of root
+// without checking the data.
+func Create(root string, w io.Writer, opts CreateOptions) (*Torrent, error) {
+	files, length, singleFile, err := walkFiles(root)
+	if err != nil {
+		return nil, err
+	}
+	pieceLength := opts.PieceLength
+	if pieceLength == 0 {
+		pieceLength = choosePieceLength(length)
+	}
+	if pieceLength <= 0 {
+		return nil, fmt.Errorf("Invalid piece length")
+	}
+	pieces, err := hashPieces(files, length, pieceLength)
+	if err != nil {
+		return nil, err
+	}
+
+	info := map[string]interface{}{
+		"name":         filepath.Base(root),
+		"piece length": pieceLength,
+		"pieces":       pieces,
+	}
+	if singleFile {
+		info["length"] = length
+	} else {
+		fileList := []interface{}{}
+		for _, file := range files {
+			fileList = append(fileList, map[string]interface{}{
+				"length": file.length,
+				"path":   file.path,
+			})
+		}
+		info["files"] = fileList
+	}
+	if opts.Private {
+		info["private"] = 1
+	}
+	if opts.Source != "" {
+		info["source"] = opts.Source
+	}
+
+	metaInfo := map[string]interface{}{
+		"info": info,
+	}
+	if len(opts.AnnounceList) > 0 && len(opts.AnnounceList[0]) > 0 {
+		metaInfo["announce"] = opts.AnnounceList[0][0]
+		if len(opts.AnnounceList) > 1 || len(opts.AnnounceList[0]) > 1 {
+			metaInfo["announce-list"] = opts.AnnounceList
+		}
+	}
+	if len(opts.URLList) > 0 {
+		metaInfo["url-list"] = opts.URLList
+	}
+	if opts.Comment != "" {
+		metaInfo["comment"] = opts.Comment
+	}
+	createdBy := opts.CreatedBy
+	if createdBy == "" {
+		createdBy = "go-torrent"
+	}
+	metaInfo["created by"] = createdBy
+	creationDate := opts.CreationDate
+	if creationDate.IsZero() {
+		creationDate = time.Now()
+	}
+	metaInfo["creation date"] = creationDate.Unix()
+
+	metaInfoBencode := &bytes.Buffer{}
+	err = bencode.Marshal(metaInfoBencode, metaInfo)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(metaInfoBencode.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	tor, err := NewTorrent(bytes.NewReader(metaInfoBencode.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	tor.Verified = true
+	return tor, nil
+}
+
+func walkFiles(root string) ([]*createFile, int, bool, error) {
+	rootInfo, err := os.Stat(root)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if rootInfo.Mode().IsRegular() {
+		file := &createFile{
+			diskPath: root,
+			length:   int(rootInfo.Size()),
+		}
+		return []*createFile{file}, file.length, true, nil
+	}
+
+	files := []*createFile{}
+	length := 0
+	// filepath.Walk visits files in lexical order
+	err = filepath.Walk(root, func(diskPath string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fileInfo.Mode().IsRegular() {
+			return nil
+		}
+		relPath, err := filepath.Rel(root, diskPath)
+		if err != nil {
+			return err
+		}
+		files = append(files, &createFile{
+			diskPath: diskPath,
+			path:     strings.Split(filepath.ToSlash(relPath), "/"),
+			length:   int(fileInfo.Size()),
+			offset:   length,
+		})
+		length += int(fileInfo.Size())
+		return nil
+	})
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if len(files) == 0 {
+		return nil, 0, false, fmt.Errorf("No files to create torrent from")
+	}
+	return files, length, false, nil
+}
+
+// Smallest power of two piece length that keeps the number of pieces
+// around TARGET_NUM_PIECES
+func choosePieceLength(length int) int {
+	pieceLength := MIN_PIECE_LENGTH
+	for pieceLength < MAX_PIECE_LENGTH && length/pieceLength > TARGET_NUM_PIECES {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+func readPiece(files []*createFile, offset int, piece []byte) error {
+	for _, file := range files {
+		if len(piece) == 0 {
+			break
+		}
+		if offset >= file.offset+file.length {
+			continue
+		}
+		fileOffset := offset - file.offset
+		length := file.length - fileOffset
+		if length > len(piece) {
+			length = len(piece)
+		}
+		f, err := os.Open(file.diskPath)
+		if err != nil {
+			return err
+		}
+		_, err = f.ReadAt(piece[:length], int64(fileOffset))
+		f.Close()
+		if err != nil {
+			return err
+		}
+		piece = piece[length:]
+		offset += length
+	}
+	return nil
+}
+
+// Hashes pieces in parallel, one worker per CPU
+func hashPieces(files []*createFile, length, pieceLength int) (string, error) {
+	numPieces := (length + pieceLength - 1) / pieceLength
+	pieces := make([]byte, numPieces*20)
+	pieceIndexes := make(chan int)
+	errs := make(chan error, runtime.NumCPU())
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			piece := make([]byte, pieceLength)
+			for pieceIndex := range pieceIndexes {
+				pieceOffset := pieceIndex * pieceLength
+				pieceData := piece[:min(pieceLength, length-pieceOffset)]
+				err := readPiece(files, pieceOffset, pieceData)
+				if err != nil {
+					errs <- err
+					return
+				}
+				checksum := sha1.Sum(pieceData)
+				copy(pieces[pieceIndex*20:], checksum[:])
+			}
+		}()
+	}
+
+	var err error
+	for pieceIndex := 0; pieceIndex < numPieces && err == nil; pieceIndex++ {
+		select {
+		case pieceIndexes <- pieceIndex:
+		case err = <-errs:
+		}
+	}
+	close(pieceIndexes)
+	wg.Wait()
+	if err != nil {
+		return "", err
+	}
+	select {
+	case err = <-errs:
+		return "", err
+	default:
+	}
+	return string(pieces), nil
+}
+
+func min(i, j int) int {
+	if i < j {
+		return i
+	}
+	return j
+}
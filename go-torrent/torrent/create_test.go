@@ -0,0 +1,73 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreate(t *testing.T) {
+	directory, err := ioutil.TempDir("", "create")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	root := filepath.Join(directory, "root")
+	os.MkdirAll(filepath.Join(root, "sub1", "sub2"), 0755)
+	file1 := bytes.Repeat([]byte{1}, 30000)
+	file2 := bytes.Repeat([]byte{2}, 20000)
+	ioutil.WriteFile(filepath.Join(root, "sub1", "sub2", "name2"), file2, 0644)
+	ioutil.WriteFile(filepath.Join(root, "name1"), file1, 0644)
+
+	creationDate := time.Unix(1500000000, 0)
+	metaInfo := &bytes.Buffer{}
+	tor, err := Create(root, metaInfo, CreateOptions{
+		AnnounceList: [][]string{[]string{"http://tracker1/announce"}, []string{"http://tracker2/announce"}},
+		Private:      true,
+		Comment:      "comment",
+		CreationDate: creationDate,
+		Source:       "source",
+	})
+	assert.Nil(t, err)
+	assert.True(t, tor.Verified)
+	assert.Equal(t, 50000, tor.Length)
+	assert.Equal(t, MIN_PIECE_LENGTH, tor.MetaInfo.Info.PieceLength)
+	assert.Equal(t, 4, tor.NumPieces)
+	assert.Equal(t, "root", tor.MetaInfo.Info.Name)
+	assert.Equal(t, []File{
+		File{Length: 30000, Path: []string{"name1"}},
+		File{Length: 20000, Path: []string{"sub1", "sub2", "name2"}},
+	}, tor.MetaInfo.Info.Files)
+	assert.Equal(t, 1, tor.MetaInfo.Info.Private)
+	assert.Equal(t, "source", tor.MetaInfo.Info.Source)
+	assert.Equal(t, "http://tracker1/announce", tor.MetaInfo.Announce)
+	assert.Equal(t, 2, len(tor.MetaInfo.AnnounceList))
+	assert.Equal(t, "comment", tor.MetaInfo.Comment)
+	assert.Equal(t, "go-torrent", tor.MetaInfo.CreatedBy)
+	assert.Equal(t, int(creationDate.Unix()), tor.MetaInfo.CreationDate)
+
+	data := append(file1, file2...)
+	for pieceIndex := 0; pieceIndex < tor.NumPieces; pieceIndex++ {
+		end := min((pieceIndex+1)*MIN_PIECE_LENGTH, len(data))
+		checksum := sha1.Sum(data[pieceIndex*MIN_PIECE_LENGTH : end])
+		assert.Equal(t, string(checksum[:]), tor.MetaInfo.Info.Pieces[pieceIndex*20:(pieceIndex+1)*20])
+	}
+
+	// the written metainfo parses to the same torrent
+	parsed, err := NewTorrent(bytes.NewReader(metaInfo.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, tor.InfoHash, parsed.InfoHash)
+}
+
+func TestChoosePieceLength(t *testing.T) {
+	assert.Equal(t, MIN_PIECE_LENGTH, choosePieceLength(0))
+	assert.Equal(t, 1048576, choosePieceLength(1024*1048576))
+	assert.Equal(t, MAX_PIECE_LENGTH, choosePieceLength(1024*1024*1048576))
+}
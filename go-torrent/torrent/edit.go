@@ -0,0 +1,183 @@
+package torrent
+
+import (
+	"bytes"
+	"net"
+	"net/url"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// Fields outside of the info dictionary (announce, announce-list, url-list,
+// comment, created by, creation date) are edited by changing MetaInfo, the
+// info-hash is unchanged and Bencode keeps every other key as it was read.
+// Editing the info dictionary, e.g. with SetPrivate or SetSource, makes the
+// torrent a different torrent with a new info-hash.
+
+// Trackers returns the torrent's tracker tiers, a torrent without an
+// announce-list has a single tier of its announce URL
+func (tor *Torrent) Trackers() [][]string {
+	if len(tor.MetaInfo.AnnounceList) > 0 {
+		return tor.MetaInfo.AnnounceList
+	}
+	if tor.MetaInfo.Announce != "" {
+		return [][]string{{tor.MetaInfo.Announce}}
+	}
+	return nil
+}
+
+// SetTrackers sets the tracker tiers (BEP 0012), the announce URL is the
+// first tracker for clients without announce-list support
+func (tor *Torrent) SetTrackers(announceList [][]string) {
+	tiers := [][]string{}
+	for _, tier := range announceList {
+		if len(tier) > 0 {
+			tiers = append(tiers, tier)
+		}
+	}
+	tor.MetaInfo.Announce = ""
+	tor.MetaInfo.AnnounceList = nil
+	if len(tiers) == 0 {
+		return
+	}
+	tor.MetaInfo.Announce = tiers[0][0]
+	if len(tiers) > 1 || len(tiers[0]) > 1 {
+		tor.MetaInfo.AnnounceList = tiers
+	}
+}
+
+// AddTracker adds the tracker to the tier, a tier past the last tier adds a
+// new tier
+func (tor *Torrent) AddTracker(tracker string, tier int) {
+	tiers := [][]string{}
+	for _, t := range tor.Trackers() {
+		for _, tr := range t {
+			if tr == tracker {
+				return
+			}
+		}
+		tiers = append(tiers, append([]string{}, t...))
+	}
+	if tier < 0 || tier >= len(tiers) {
+		tiers = append(tiers, []string{tracker})
+	} else {
+		tiers[tier] = append(tiers[tier], tracker)
+	}
+	tor.SetTrackers(tiers)
+}
+
+// RemoveTracker removes the tracker from every tier, returning whether it
+// was found
+func (tor *Torrent) RemoveTracker(tracker string) bool {
+	removed := false
+	tiers := [][]string{}
+	for _, t := range tor.Trackers() {
+		tier := []string{}
+		for _, tr := range t {
+			if tr == tracker {
+				removed = true
+				continue
+			}
+			tier = append(tier, tr)
+		}
+		tiers = append(tiers, tier)
+	}
+	if removed {
+		tor.SetTrackers(tiers)
+	}
+	return removed
+}
+
+// ReplaceTrackerHost points the trackers and web seeds on oldHost to newHost,
+// keeping their scheme, port and path. Returns the number of URLs changed.
+func (tor *Torrent) ReplaceTrackerHost(oldHost, newHost string) int {
+	replaced := 0
+	replace := func(urls []string) []string {
+		if urls == nil {
+			return nil
+		}
+		replacedURLs := []string{}
+		for _, rawurl := range urls {
+			u, err := url.Parse(rawurl)
+			if err == nil && u.Hostname() == oldHost {
+				if port := u.Port(); port != "" {
+					u.Host = net.JoinHostPort(newHost, port)
+				} else {
+					u.Host = newHost
+				}
+				rawurl = u.String()
+				replaced++
+			}
+			replacedURLs = append(replacedURLs, rawurl)
+		}
+		return replacedURLs
+	}
+
+	if tor.MetaInfo.Announce != "" {
+		tor.MetaInfo.Announce = replace([]string{tor.MetaInfo.Announce})[0]
+	}
+	announceList := [][]string{}
+	for _, tier := range tor.MetaInfo.AnnounceList {
+		announceList = append(announceList, replace(tier))
+	}
+	if len(announceList) > 0 {
+		tor.MetaInfo.AnnounceList = announceList
+	}
+	tor.MetaInfo.URLList = replace(tor.MetaInfo.URLList)
+	tor.MetaInfo.HTTPSeeds = replace(tor.MetaInfo.HTTPSeeds)
+	return replaced
+}
+
+// SetPrivate sets the private flag (BEP 0027), the info-hash changes
+func (tor *Torrent) SetPrivate(private bool) error {
+	var value interface{}
+	if private {
+		value = 1
+	}
+	err := tor.setInfoKey("private", value)
+	if err != nil {
+		return err
+	}
+	tor.MetaInfo.Info.Private = 0
+	if private {
+		tor.MetaInfo.Info.Private = 1
+	}
+	return nil
+}
+
+// SetSource sets the source string, an empty source removes it. The
+// info-hash changes.
+func (tor *Torrent) SetSource(source string) error {
+	var value interface{}
+	if source != "" {
+		value = source
+	}
+	err := tor.setInfoKey("source", value)
+	if err != nil {
+		return err
+	}
+	tor.MetaInfo.Info.Source = source
+	return nil
+}
+
+// Re-encodes the key of the info dictionary, nil removes it. The other keys
+// are kept as they are.
+func (tor *Torrent) setInfoKey(key string, value interface{}) error {
+	info, err := parseRawDict(tor.RawInfo)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		info.delete(key)
+	} else {
+		b := &bytes.Buffer{}
+		err := bencode.Marshal(b, value)
+		if err != nil {
+			return err
+		}
+		info.set(key, b.Bytes())
+	}
+	tor.RawInfo = info.bytes()
+	tor.hashInfo()
+	return nil
+}
@@ -0,0 +1,62 @@
+package torrent
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newEditTorrent() *Torrent {
+	tor, _ := Create("create.go", &bytes.Buffer{}, CreateOptions{
+		AnnounceList: [][]string{{"http://tracker.internal:8080/announce"}, {"udp://tracker.example:80"}},
+		URLList:      []string{"http://tracker.internal/seed/"},
+	})
+	return tor
+}
+
+func TestEditMetaInfo(t *testing.T) {
+	tor := newEditTorrent()
+	infoHash := tor.InfoHash
+
+	assert.Equal(t, 3, tor.ReplaceTrackerHost("tracker.internal", "tracker.example.org"))
+	tor.AddTracker("http://backup.example/announce", 1)
+	assert.True(t, tor.RemoveTracker("udp://tracker.example:80"))
+	assert.False(t, tor.RemoveTracker("udp://tracker.example:80"))
+	tor.MetaInfo.Comment = "comment"
+
+	edited, err := NewTorrent(bytes.NewReader(tor.Bencode()))
+	assert.Nil(t, err)
+	assert.Equal(t, infoHash, edited.InfoHash)
+	assert.Equal(t, "http://tracker.example.org:8080/announce", edited.MetaInfo.Announce)
+	assert.Equal(t, [][]string{{"http://tracker.example.org:8080/announce"}, {"http://backup.example/announce"}}, edited.Trackers())
+	assert.Equal(t, []string{"http://tracker.example.org/seed/"}, edited.MetaInfo.URLList)
+	assert.Equal(t, "comment", edited.MetaInfo.Comment)
+
+	// A single tracker doesn't need an announce-list
+	edited.SetTrackers([][]string{{"http://tracker.example.org/announce"}, {}})
+	assert.Nil(t, edited.MetaInfo.AnnounceList)
+	assert.NotContains(t, string(edited.Bencode()), "announce-list")
+}
+
+func TestEditInfo(t *testing.T) {
+	tor := newEditTorrent()
+	infoHash := tor.InfoHash
+
+	assert.Nil(t, tor.SetPrivate(true))
+	assert.Nil(t, tor.SetSource("tracker.example"))
+	assert.NotEqual(t, infoHash, tor.InfoHash)
+
+	edited, err := NewTorrent(bytes.NewReader(tor.Bencode()))
+	assert.Nil(t, err)
+	assert.Equal(t, tor.InfoHash, edited.InfoHash)
+	assert.Equal(t, 1, edited.MetaInfo.Info.Private)
+	assert.Equal(t, "tracker.example", edited.MetaInfo.Info.Source)
+
+	// Reverting the edits gives the original info dictionary
+	assert.Nil(t, edited.SetPrivate(false))
+	assert.Nil(t, edited.SetSource(""))
+	assert.Equal(t, infoHash, edited.InfoHash)
+	assert.False(t, strings.Contains(string(edited.RawInfo), "private"))
+}
@@ -0,0 +1,261 @@
+package torrent
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Multihash prefix of a SHA-256 digest, 0x12 (sha2-256) 0x20 (32 bytes)
+const SHA256_MULTIHASH_PREFIX = "1220"
+
+type MagnetURI struct {
+	// dn
+	Name string
+	// SHA-1 info-hash (xt=urn:btih)
+	InfoHashHex string
+	// SHA-256 info-hash of v2 torrents (xt=urn:btmh), without the multihash prefix
+	InfoHashV2Hex string
+	// tr
+	Trackers []string
+	// ws, web seeds (BEP 0019)
+	WebSeeds []string
+	// x.pe, peer addresses (BEP 0009)
+	Peers []string
+	// xl, exact length in bytes
+	Length int
+	// so, indexes of the files to download (BEP 0053)
+	SelectOnly []int
+	// kt, keywords
+	Keywords []string
+}
+
+// ParseMagnetURI parses a magnet link (BEP 0009). Parameters may be repeated
+// or numbered e.g. tr.1, hybrid torrents have both a btih and a btmh exact topic.
+func ParseMagnetURI(magnetURI string) (*MagnetURI, error) {
+	u, err := url.Parse(magnetURI)
+	if err != nil {
+		return nil, fmt.Errorf("Malformed magnet URI: %v", err)
+	}
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("Malformed magnet URI: not a magnet link")
+	}
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("Malformed magnet URI: %v", err)
+	}
+
+	muri := &MagnetURI{}
+	keys := []string{}
+	for key := range query {
+		keys = append(keys, key)
+	}
+	// Numbered parameters in order of their number, tr.2 before tr.10
+	sort.Slice(keys, func(i, j int) bool {
+		nameI, numberI := parameterName(keys[i])
+		nameJ, numberJ := parameterName(keys[j])
+		if nameI != nameJ {
+			return nameI < nameJ
+		}
+		return numberI < numberJ
+	})
+	for _, key := range keys {
+		name, _ := parameterName(key)
+		for _, value := range query[key] {
+			switch name {
+			case "xt":
+				err = muri.parseExactTopic(value)
+			case "dn":
+				muri.Name = value
+			case "tr":
+				muri.Trackers = append(muri.Trackers, value)
+			case "ws":
+				muri.WebSeeds = append(muri.WebSeeds, value)
+			case "x.pe":
+				muri.Peers = append(muri.Peers, value)
+			case "xl":
+				muri.Length, err = strconv.Atoi(value)
+			case "so":
+				muri.SelectOnly, err = parseSelectOnly(value)
+			case "kt":
+				muri.Keywords = append(muri.Keywords, strings.Fields(value)...)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("Malformed magnet URI: %s: %v", key, err)
+			}
+		}
+	}
+	if muri.InfoHashHex == "" && muri.InfoHashV2Hex == "" {
+		return nil, fmt.Errorf("Malformed magnet URI: missing BitTorrent info-hash")
+	}
+	return muri, nil
+}
+
+// Strips the number of numbered parameters e.g. xt.1, unnumbered parameters
+// are numbered -1
+func parameterName(key string) (string, int) {
+	if i := strings.LastIndex(key, "."); i != -1 {
+		if number, err := strconv.Atoi(key[i+1:]); err == nil {
+			return key[:i], number
+		}
+	}
+	return key, -1
+}
+
+// Exact topics of other networks are ignored
+func (muri *MagnetURI) parseExactTopic(xt string) error {
+	switch {
+	case strings.HasPrefix(xt, "urn:btih:"):
+		infoHash := xt[len("urn:btih:"):]
+		switch len(infoHash) {
+		case 40:
+			if _, err := hex.DecodeString(infoHash); err != nil {
+				return err
+			}
+			muri.InfoHashHex = strings.ToLower(infoHash)
+		case 32:
+			decoded, err := base32.StdEncoding.DecodeString(strings.ToUpper(infoHash))
+			if err != nil {
+				return err
+			}
+			muri.InfoHashHex = hex.EncodeToString(decoded)
+		default:
+			return fmt.Errorf("invalid info-hash length")
+		}
+	case strings.HasPrefix(xt, "urn:btmh:"):
+		infoHash := strings.ToLower(xt[len("urn:btmh:"):])
+		if !strings.HasPrefix(infoHash, SHA256_MULTIHASH_PREFIX) || len(infoHash) != 68 {
+			return fmt.Errorf("unsupported multihash")
+		}
+		if _, err := hex.DecodeString(infoHash); err != nil {
+			return err
+		}
+		muri.InfoHashV2Hex = infoHash[len(SHA256_MULTIHASH_PREFIX):]
+	}
+	return nil
+}
+
+// File indexes and inclusive ranges e.g. 0,2,4-6
+func parseSelectOnly(so string) ([]int, error) {
+	fileIndexes := []int{}
+	for _, r := range strings.Split(so, ",") {
+		bounds := strings.SplitN(r, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil || first < 0 {
+			return nil, fmt.Errorf("invalid file index %q", r)
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, err = strconv.Atoi(bounds[1])
+			if err != nil || last < first {
+				return nil, fmt.Errorf("invalid file range %q", r)
+			}
+		}
+		for fileIndex := first; fileIndex <= last; fileIndex++ {
+			fileIndexes = append(fileIndexes, fileIndex)
+		}
+	}
+	sort.Ints(fileIndexes)
+	return fileIndexes, nil
+}
+
+func formatSelectOnly(fileIndexes []int) string {
+	sorted := append([]int{}, fileIndexes...)
+	sort.Ints(sorted)
+	ranges := []string{}
+	for i := 0; i < len(sorted); {
+		j := i
+		for j+1 < len(sorted) && sorted[j+1] <= sorted[j]+1 {
+			j++
+		}
+		if sorted[i] == sorted[j] {
+			ranges = append(ranges, strconv.Itoa(sorted[i]))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", sorted[i], sorted[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(ranges, ",")
+}
+
+// String formats the magnet link, it can be parsed with ParseMagnetURI
+func (muri *MagnetURI) String() string {
+	params := []string{}
+	if muri.InfoHashHex != "" {
+		params = append(params, "xt=urn:btih:"+muri.InfoHashHex)
+	}
+	if muri.InfoHashV2Hex != "" {
+		params = append(params, "xt=urn:btmh:"+SHA256_MULTIHASH_PREFIX+muri.InfoHashV2Hex)
+	}
+	if muri.Name != "" {
+		params = append(params, "dn="+url.QueryEscape(muri.Name))
+	}
+	if muri.Length > 0 {
+		params = append(params, "xl="+strconv.Itoa(muri.Length))
+	}
+	for _, tracker := range muri.Trackers {
+		params = append(params, "tr="+url.QueryEscape(tracker))
+	}
+	for _, webSeed := range muri.WebSeeds {
+		params = append(params, "ws="+url.QueryEscape(webSeed))
+	}
+	for _, peer := range muri.Peers {
+		params = append(params, "x.pe="+url.QueryEscape(peer))
+	}
+	if len(muri.SelectOnly) > 0 {
+		params = append(params, "so="+formatSelectOnly(muri.SelectOnly))
+	}
+	if len(muri.Keywords) > 0 {
+		params = append(params, "kt="+url.QueryEscape(strings.Join(muri.Keywords, " ")))
+	}
+	return "magnet:?" + strings.Join(params, "&")
+}
+
+// Info-hashes of the swarms the magnet link joins, see Torrent.InfoHashes
+func (muri *MagnetURI) InfoHashes() ([][]byte, error) {
+	infoHashes := [][]byte{}
+	if muri.InfoHashHex != "" {
+		infoHash, err := hex.DecodeString(muri.InfoHashHex)
+		if err != nil || len(infoHash) != 20 {
+			return nil, fmt.Errorf("Malformed info-hash")
+		}
+		infoHashes = append(infoHashes, infoHash)
+	}
+	if muri.InfoHashV2Hex != "" {
+		infoHash, err := hex.DecodeString(muri.InfoHashV2Hex)
+		if err != nil || len(infoHash) != 32 {
+			return nil, fmt.Errorf("Malformed info-hash")
+		}
+		infoHashes = append(infoHashes, infoHash[:20])
+	}
+	if len(infoHashes) == 0 {
+		return nil, fmt.Errorf("Missing info-hash")
+	}
+	return infoHashes, nil
+}
+
+// Magnet link of the torrent, with its trackers and web seeds
+func (tor *Torrent) Magnet() *MagnetURI {
+	muri := &MagnetURI{
+		Name:     tor.MetaInfo.Info.Name,
+		WebSeeds: tor.MetaInfo.URLList,
+	}
+	if tor.IsV1() || !tor.IsV2() {
+		muri.InfoHashHex = hex.EncodeToString(tor.InfoHash)
+	}
+	if tor.IsV2() {
+		muri.InfoHashV2Hex = hex.EncodeToString(tor.InfoHashV2)
+	}
+	if len(tor.MetaInfo.AnnounceList) > 0 {
+		for _, tier := range tor.MetaInfo.AnnounceList {
+			muri.Trackers = append(muri.Trackers, tier...)
+		}
+	} else if tor.MetaInfo.Announce != "" {
+		muri.Trackers = []string{tor.MetaInfo.Announce}
+	}
+	return muri
+}
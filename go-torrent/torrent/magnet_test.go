@@ -0,0 +1,93 @@
+package torrent
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	bencode "github.com/jackpal/bencode-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMagnetURI(t *testing.T) {
+	muri, err := ParseMagnetURI("magnet:?xt=urn:btih:C12FE1C06BBA254A9DC9F519B335AA7C1367A88A" +
+		"&xt=urn:btmh:1220caf1e1c30e81cb361b9ee167c4aa64228a7fa4fa9f6105232b28ad099f3a302e" +
+		"&dn=My+Torrent&tr.1=udp%3A%2F%2Ftracker.example%3A80&tr.2=http%3A%2F%2Fexample.org%2Fannounce" +
+		"&ws=http%3A%2F%2Fseed.example%2Ffile&x.pe=10.0.0.1%3A6881&xl=1024&so=0,2,4-6&kt=linux+iso")
+	assert.Nil(t, err)
+	assert.Equal(t, "c12fe1c06bba254a9dc9f519b335aa7c1367a88a", muri.InfoHashHex)
+	assert.Equal(t, "caf1e1c30e81cb361b9ee167c4aa64228a7fa4fa9f6105232b28ad099f3a302e", muri.InfoHashV2Hex)
+	assert.Equal(t, "My Torrent", muri.Name)
+	assert.Equal(t, []string{"udp://tracker.example:80", "http://example.org/announce"}, muri.Trackers)
+	assert.Equal(t, []string{"http://seed.example/file"}, muri.WebSeeds)
+	assert.Equal(t, []string{"10.0.0.1:6881"}, muri.Peers)
+	assert.Equal(t, 1024, muri.Length)
+	assert.Equal(t, []int{0, 2, 4, 5, 6}, muri.SelectOnly)
+	assert.Equal(t, []string{"linux", "iso"}, muri.Keywords)
+
+	// Parsing the generated link gives the same magnet URI
+	reparsed, err := ParseMagnetURI(muri.String())
+	assert.Nil(t, err)
+	assert.Equal(t, muri, reparsed)
+	assert.Contains(t, muri.String(), "so=0,2,4-6")
+
+	// Numbered parameters in order of their number
+	trackers := ""
+	for i := 1; i <= 10; i++ {
+		trackers += fmt.Sprintf("&tr.%d=http%%3A%%2F%%2Ftracker%d.example", i, i)
+	}
+	muri, err = ParseMagnetURI("magnet:?xt=urn:btih:C12FE1C06BBA254A9DC9F519B335AA7C1367A88A" + trackers)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, len(muri.Trackers))
+	for i, tracker := range muri.Trackers {
+		assert.Equal(t, fmt.Sprintf("http://tracker%d.example", i+1), tracker)
+	}
+
+	// Base32 info-hash
+	muri, err = ParseMagnetURI("magnet:?xt=urn:btih:YEX6DQDLXISUVHOJ6UM3GNNKPQJWPKEK")
+	assert.Nil(t, err)
+	assert.Equal(t, "c12fe1c06bba254a9dc9f519b335aa7c1367a88a", muri.InfoHashHex)
+}
+
+func TestParseMagnetURIInvalid(t *testing.T) {
+	invalid := []string{
+		"http://example.org/?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a",
+		"magnet:?dn=name",
+		"magnet:?xt=urn:btih:c12fe1",
+		"magnet:?xt=urn:btih:z12fe1c06bba254a9dc9f519b335aa7c1367a88a",
+		"magnet:?xt=urn:btmh:1114caf1e1c30e81cb361b9ee167c4aa64228a7f",
+		"magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&so=3-1",
+		"magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&xl=big",
+	}
+	for _, uri := range invalid {
+		_, err := ParseMagnetURI(uri)
+		assert.NotNil(t, err, uri)
+	}
+}
+
+func TestTorrentMagnet(t *testing.T) {
+	metaInfo := &bytes.Buffer{}
+	bencode.Marshal(metaInfo, map[string]interface{}{
+		"announce":      "http://example.org/announce",
+		"announce-list": [][]string{{"http://example.org/announce"}, {"udp://tracker.example:80"}},
+		"url-list":      "http://seed.example/",
+		"info": map[string]interface{}{
+			"name":         "name",
+			"length":       1,
+			"piece length": MIN_PIECE_LENGTH,
+			"pieces":       strings.Repeat("a", 20),
+		},
+	})
+	tor, err := NewTorrent(bytes.NewReader(metaInfo.Bytes()))
+	assert.Nil(t, err)
+
+	muri, err := ParseMagnetURI(tor.Magnet().String())
+	assert.Nil(t, err)
+	infoHashes, err := muri.InfoHashes()
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{tor.InfoHash}, infoHashes)
+	assert.Equal(t, "name", muri.Name)
+	assert.Equal(t, []string{"http://example.org/announce", "udp://tracker.example:80"}, muri.Trackers)
+	assert.Equal(t, []string{"http://seed.example/"}, muri.WebSeeds)
+}
@@ -0,0 +1,164 @@
+package torrent
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// Longest file name most filesystems allow, in bytes
+	MAX_NAME_LENGTH = 255
+	// Characters forbidden in file names on common filesystems
+	FORBIDDEN_CHARACTERS = "/\\:*?\"<>|"
+)
+
+// Device names Windows reserves regardless of extension
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// Makes the torrent's name and file paths safe to create on disk. Parent
+// directory components are rejected, empty and current directory components
+// are dropped, forbidden characters are stripped and over-long names are
+// clamped. Files whose paths collide case-insensitively are renamed.
+func (tor *Torrent) sanitizePaths() error {
+	info := &tor.MetaInfo.Info
+	name := info.Name
+	if info.NameUTF8 != "" && utf8.ValidString(info.NameUTF8) {
+		name = info.NameUTF8
+	}
+	if name == ".." {
+		return fmt.Errorf("Invalid torrent name %q", name)
+	}
+	info.Name = sanitizeName(name)
+	if info.Name == "" {
+		return fmt.Errorf("Invalid torrent name %q", name)
+	}
+
+	files := make(map[string]bool)
+	directories := make(map[string]bool)
+	for i := range info.Files {
+		file := &info.Files[i]
+		path := file.Path
+		if len(file.PathUTF8) > 0 && validUTF8(file.PathUTF8) {
+			path = file.PathUTF8
+		}
+		sanitizedPath, err := sanitizePath(path)
+		if err != nil {
+			return err
+		}
+		if file.IsSymlink() {
+			file.SymlinkPath, err = sanitizePath(file.SymlinkPath)
+			if err != nil {
+				return fmt.Errorf("Invalid symlink %q: %v", strings.Join(path, "/"), err)
+			}
+		}
+		if !file.IsPadding() {
+			// Padding files aren't created, they may share a path
+			sanitizedPath, err = uniquePath(sanitizedPath, files, directories)
+			if err != nil {
+				return err
+			}
+		}
+		file.Path = sanitizedPath
+	}
+	return nil
+}
+
+func sanitizePath(path []string) ([]string, error) {
+	sanitizedPath := []string{}
+	for _, component := range path {
+		if component == ".." {
+			return nil, fmt.Errorf("Invalid path %q, parent directory components aren't allowed", strings.Join(path, "/"))
+		}
+		component = sanitizeName(component)
+		if component == "" {
+			continue
+		}
+		sanitizedPath = append(sanitizedPath, component)
+	}
+	if len(sanitizedPath) == 0 {
+		return nil, fmt.Errorf("Invalid path %q", strings.Join(path, "/"))
+	}
+	return sanitizedPath, nil
+}
+
+// Returns "" for names that are empty or the current directory
+func sanitizeName(name string) string {
+	name = strings.ToValidUTF8(name, "_")
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(FORBIDDEN_CHARACTERS, r) {
+			return -1
+		}
+		return r
+	}, name)
+	// Windows drops trailing dots and spaces
+	name = strings.TrimRight(name, ". ")
+	if name == "" {
+		return ""
+	}
+	base := strings.ToUpper(strings.SplitN(name, ".", 2)[0])
+	if reservedNames[base] {
+		name = "_" + name
+	}
+	return clampName(name)
+}
+
+// Shortens the name to MAX_NAME_LENGTH bytes keeping its extension, without
+// splitting a UTF-8 sequence
+func clampName(name string) string {
+	if len(name) <= MAX_NAME_LENGTH {
+		return name
+	}
+	ext := filepath.Ext(name)
+	if len(ext) > MAX_NAME_LENGTH/2 {
+		ext = ""
+	}
+	base := name[:MAX_NAME_LENGTH-len(ext)]
+	for !utf8.ValidString(base) {
+		base = base[:len(base)-1]
+	}
+	return base + ext
+}
+
+// Renames a file whose path collides case-insensitively with a file or
+// directory of a previous file, e.g. "name (1).ext"
+func uniquePath(path []string, files, directories map[string]bool) ([]string, error) {
+	for i := 1; i < len(path); i++ {
+		directory := strings.ToLower(strings.Join(path[:i], "/"))
+		if files[directory] {
+			return nil, fmt.Errorf("Invalid path %q, %q is a file", strings.Join(path, "/"), strings.Join(path[:i], "/"))
+		}
+	}
+
+	name := path[len(path)-1]
+	ext := filepath.Ext(name)
+	uniquePath := append([]string{}, path...)
+	for n := 1; ; n++ {
+		key := strings.ToLower(strings.Join(uniquePath, "/"))
+		if !files[key] && !directories[key] {
+			files[key] = true
+			break
+		}
+		uniquePath[len(path)-1] = clampName(fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), n, ext))
+	}
+	for i := 1; i < len(path); i++ {
+		directories[strings.ToLower(strings.Join(path[:i], "/"))] = true
+	}
+	return uniquePath, nil
+}
+
+func validUTF8(path []string) bool {
+	for _, component := range path {
+		if !utf8.ValidString(component) {
+			return false
+		}
+	}
+	return true
+}
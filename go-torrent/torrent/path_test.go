@@ -0,0 +1,80 @@
+package torrent
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	bencode "github.com/jackpal/bencode-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestTorrent(name string, files []interface{}) (*Torrent, error) {
+	metaInfo := &bytes.Buffer{}
+	bencode.Marshal(metaInfo, map[string]interface{}{
+		"info": map[string]interface{}{
+			"name":         name,
+			"piece length": MIN_PIECE_LENGTH,
+			"pieces":       strings.Repeat("a", 20),
+			"files":        files,
+		},
+	})
+	return NewTorrent(bytes.NewReader(metaInfo.Bytes()))
+}
+
+func testFile(path ...string) map[string]interface{} {
+	return map[string]interface{}{"length": 1, "path": path}
+}
+
+func TestSanitizePaths(t *testing.T) {
+	tor, err := newTestTorrent("/root:", []interface{}{
+		testFile("", "sub", ".", "name1"),
+		testFile("sub", "na<me>2"),
+		testFile("con.txt"),
+		testFile("sub", "NAME1"),
+		testFile(strings.Repeat("a", 300) + ".txt"),
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "root", tor.MetaInfo.Info.Name)
+	assert.Equal(t, []string{"sub", "name1"}, tor.MetaInfo.Info.Files[0].Path)
+	assert.Equal(t, []string{"sub", "name2"}, tor.MetaInfo.Info.Files[1].Path)
+	assert.Equal(t, []string{"_con.txt"}, tor.MetaInfo.Info.Files[2].Path)
+	// Case-insensitive collision
+	assert.Equal(t, []string{"sub", "NAME1 (1)"}, tor.MetaInfo.Info.Files[3].Path)
+	// Clamped keeping the extension
+	assert.Equal(t, strings.Repeat("a", MAX_NAME_LENGTH-4)+".txt", tor.MetaInfo.Info.Files[4].Path[0])
+}
+
+func TestSanitizePathsRejected(t *testing.T) {
+	_, err := newTestTorrent("root", []interface{}{testFile("sub", "..", "..", "etc", "passwd")})
+	assert.NotNil(t, err)
+	_, err = newTestTorrent("..", []interface{}{testFile("name1")})
+	assert.NotNil(t, err)
+	_, err = newTestTorrent("root", []interface{}{testFile("", ".")})
+	assert.NotNil(t, err)
+	// A file can't also be a directory
+	_, err = newTestTorrent("root", []interface{}{testFile("sub"), testFile("SUB", "name1")})
+	assert.NotNil(t, err)
+}
+
+func TestUTF8Paths(t *testing.T) {
+	files := []interface{}{map[string]interface{}{
+		"length":     1,
+		"path":       []string{"\xff\xfe"},
+		"path.utf-8": []string{"名前"},
+	}}
+	metaInfo := &bytes.Buffer{}
+	bencode.Marshal(metaInfo, map[string]interface{}{
+		"info": map[string]interface{}{
+			"name":         "\xff",
+			"name.utf-8":   "ルート",
+			"piece length": MIN_PIECE_LENGTH,
+			"pieces":       strings.Repeat("a", 20),
+			"files":        files,
+		},
+	})
+	tor, err := NewTorrent(bytes.NewReader(metaInfo.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, "ルート", tor.MetaInfo.Info.Name)
+	assert.Equal(t, []string{"名前"}, tor.MetaInfo.Info.Files[0].Path)
+}
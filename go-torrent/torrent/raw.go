@@ -0,0 +1,208 @@
+package torrent
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// Decoding into structs loses key order, integer formatting and unknown keys.
+// The info-hash is the hash of the exact info bytes, so the raw value of each
+// dictionary key is kept and only the values that are changed are re-encoded.
+
+type rawDict struct {
+	keys   []string
+	values map[string][]byte
+}
+
+func newRawDict() *rawDict {
+	return &rawDict{values: make(map[string][]byte)}
+}
+
+// Splits a bencoded dictionary into the raw bencoded value of each key
+func parseRawDict(data []byte) (*rawDict, error) {
+	if len(data) == 0 || data[0] != 'd' {
+		return nil, fmt.Errorf("Malformed torrent file")
+	}
+	dict := newRawDict()
+	i := 1
+	for i < len(data) && data[i] != 'e' {
+		keyEnd, err := skipValue(data, i)
+		if err != nil {
+			return nil, err
+		}
+		if data[i] < '0' || data[i] > '9' {
+			return nil, fmt.Errorf("Malformed torrent file")
+		}
+		key := string(data[bytes.IndexByte(data[i:], ':')+i+1 : keyEnd])
+		valueEnd, err := skipValue(data, keyEnd)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := dict.values[key]; ok {
+			return nil, fmt.Errorf("Malformed torrent file, duplicate key %q", key)
+		}
+		dict.keys = append(dict.keys, key)
+		dict.values[key] = data[keyEnd:valueEnd]
+		i = valueEnd
+	}
+	if i >= len(data) {
+		return nil, fmt.Errorf("Malformed torrent file")
+	}
+	return dict, nil
+}
+
+// Returns the index following the bencoded value starting at i
+func skipValue(data []byte, i int) (int, error) {
+	if i >= len(data) {
+		return 0, fmt.Errorf("Malformed torrent file")
+	}
+	switch {
+	case data[i] == 'i':
+		end := bytes.IndexByte(data[i:], 'e')
+		if end == -1 {
+			return 0, fmt.Errorf("Malformed torrent file")
+		}
+		if _, err := strconv.ParseInt(string(data[i+1:i+end]), 10, 64); err != nil {
+			return 0, fmt.Errorf("Malformed torrent file")
+		}
+		return i + end + 1, nil
+	case data[i] == 'l' || data[i] == 'd':
+		i++
+		for i < len(data) && data[i] != 'e' {
+			var err error
+			i, err = skipValue(data, i)
+			if err != nil {
+				return 0, err
+			}
+		}
+		if i >= len(data) {
+			return 0, fmt.Errorf("Malformed torrent file")
+		}
+		return i + 1, nil
+	case data[i] >= '0' && data[i] <= '9':
+		colon := bytes.IndexByte(data[i:], ':')
+		if colon == -1 {
+			return 0, fmt.Errorf("Malformed torrent file")
+		}
+		length, err := strconv.Atoi(string(data[i : i+colon]))
+		if err != nil || length < 0 || i+colon+1+length > len(data) {
+			return 0, fmt.Errorf("Malformed torrent file")
+		}
+		return i + colon + 1 + length, nil
+	}
+	return 0, fmt.Errorf("Malformed torrent file")
+}
+
+// Sets the key to the bencoded value, new keys are inserted in sorted order
+func (dict *rawDict) set(key string, value []byte) {
+	if _, ok := dict.values[key]; !ok {
+		i := sort.Search(len(dict.keys), func(i int) bool { return dict.keys[i] > key })
+		dict.keys = append(dict.keys[:i], append([]string{key}, dict.keys[i:]...)...)
+	}
+	dict.values[key] = value
+}
+
+func (dict *rawDict) delete(key string) {
+	if _, ok := dict.values[key]; !ok {
+		return
+	}
+	delete(dict.values, key)
+	for i, k := range dict.keys {
+		if k == key {
+			dict.keys = append(dict.keys[:i], dict.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+func (dict *rawDict) bytes() []byte {
+	b := &bytes.Buffer{}
+	b.WriteByte('d')
+	for _, key := range dict.keys {
+		b.WriteString(strconv.Itoa(len(key)))
+		b.WriteByte(':')
+		b.WriteString(key)
+		b.Write(dict.values[key])
+	}
+	b.WriteByte('e')
+	return b.Bytes()
+}
+
+// Encoded values of the metainfo keys outside of the info dictionary, empty
+// values are left out
+func (metaInfo *MetaInfo) fields() map[string][]byte {
+	values := map[string]interface{}{
+		"announce":      metaInfo.Announce,
+		"announce-list": metaInfo.AnnounceList,
+		"creation date": metaInfo.CreationDate,
+		"comment":       metaInfo.Comment,
+		"created by":    metaInfo.CreatedBy,
+		"encoding":      metaInfo.Encoding,
+		"url-list":      metaInfo.URLList,
+		"httpseeds":     metaInfo.HTTPSeeds,
+	}
+	fields := make(map[string][]byte)
+	for key, value := range values {
+		switch v := value.(type) {
+		case string:
+			if v == "" {
+				continue
+			}
+		case int:
+			if v == 0 {
+				continue
+			}
+		case []string:
+			if len(v) == 0 {
+				continue
+			}
+		case [][]string:
+			if len(v) == 0 {
+				continue
+			}
+		}
+		b := &bytes.Buffer{}
+		bencode.Marshal(b, value)
+		fields[key] = b.Bytes()
+	}
+	return fields
+}
+
+// Bencode encodes the torrent's metainfo. Keys that weren't changed since the
+// torrent was parsed are written as they were read, an unchanged torrent is
+// written byte for byte.
+func (tor *Torrent) Bencode() []byte {
+	dict := tor.rawMetaInfo
+	if dict == nil {
+		dict = newRawDict()
+	} else {
+		dict = &rawDict{keys: append([]string{}, dict.keys...), values: make(map[string][]byte)}
+		for key, value := range tor.rawMetaInfo.values {
+			dict.values[key] = value
+		}
+	}
+	fields := tor.MetaInfo.fields()
+	for key := range tor.parsedFields {
+		if _, ok := fields[key]; !ok {
+			dict.delete(key)
+		}
+	}
+	for key, value := range fields {
+		if !bytes.Equal(value, tor.parsedFields[key]) {
+			dict.set(key, value)
+		}
+	}
+	dict.set("info", tor.RawInfo)
+	return dict.bytes()
+}
+
+// Write writes the torrent file, see Bencode
+func (tor *Torrent) Write(w io.Writer) error {
+	_, err := w.Write(tor.Bencode())
+	return err
+}
@@ -0,0 +1,58 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRawInfoHash(t *testing.T) {
+	// Unsorted info keys and an unknown key, re-encoding would change the hash
+	info := "d6:pieces20:" + strings.Repeat("a", 20) + "4:name4:name12:piece lengthi16384e6:lengthi1e7:x-extrai01ee"
+	metaInfo := "d8:announce27:http://example.org/announce7:x-extra5:value4:info" + info + "e"
+
+	tor, err := NewTorrent(strings.NewReader(metaInfo))
+	assert.Nil(t, err)
+	infoHash := sha1.Sum([]byte(info))
+	assert.Equal(t, infoHash[:], tor.InfoHash)
+	assert.Equal(t, []byte(info), tor.RawInfo)
+	assert.Equal(t, "name", tor.MetaInfo.Info.Name)
+
+	// Unchanged torrents are written byte for byte
+	assert.Equal(t, metaInfo, string(tor.Bencode()))
+
+	tor.MetaInfo.AnnounceList = [][]string{{"http://example.org/announce"}, {"udp://tracker.example:80"}}
+	tor.MetaInfo.Comment = "comment"
+	b := &bytes.Buffer{}
+	assert.Nil(t, tor.Write(b))
+	assert.Equal(t, "d8:announce27:http://example.org/announce"+
+		"13:announce-listll27:http://example.org/announceel24:udp://tracker.example:80ee"+
+		"7:comment7:comment7:x-extra5:value4:info"+info+"e", b.String())
+
+	edited, err := NewTorrent(bytes.NewReader(b.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, tor.InfoHash, edited.InfoHash)
+	assert.Equal(t, tor.MetaInfo.AnnounceList, edited.MetaInfo.AnnounceList)
+
+	// Removed fields are dropped
+	edited.MetaInfo.Comment = ""
+	assert.NotContains(t, string(edited.Bencode()), "comment")
+}
+
+func TestRawInfoMalformed(t *testing.T) {
+	malformed := []string{
+		"",
+		"d4:infoi1ee",
+		"d4:infod4:name4:name",
+		"d4:info5:abc",
+		"d4:infodee4:infodee",
+		"d4:infod4:namei1xeee",
+	}
+	for _, metaInfo := range malformed {
+		_, err := NewTorrent(strings.NewReader(metaInfo))
+		assert.NotNil(t, err, metaInfo)
+	}
+}
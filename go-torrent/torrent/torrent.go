@@ -3,11 +3,14 @@ package torrent
 import (
 	"bytes"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"math/rand"
+	"strings"
 
 	bencode "github.com/jackpal/bencode-go"
 )
@@ -25,10 +28,26 @@ func init() {
 }
 
 type Torrent struct {
-	Length    int
-	MetaInfo  MetaInfo
-	InfoHash  []byte
-	NumPieces int
+	Length   int
+	MetaInfo MetaInfo
+	InfoHash []byte
+	// SHA-256 info-hash of v2 torrents (BEP 0052)
+	InfoHashV2 []byte
+	NumPieces  int
+	// Data is known to be complete e.g. the torrent was created from it
+	Verified bool
+	// Bencoded info dictionary exactly as read, its hash is the info-hash and
+	// it's the metadata served to peers (BEP 0009)
+	RawInfo []byte
+	// Raw metainfo keys, including unknown ones, and the encoded values of the
+	// metainfo fields as parsed, see Bencode
+	rawMetaInfo  *rawDict
+	parsedFields map[string][]byte
+	// Files of the v2 file tree, the file of each piece and the first piece
+	// of each file
+	v2Files     []File
+	pieceFiles  []int
+	firstPieces []int
 }
 
 type MetaInfo struct {
@@ -39,6 +58,11 @@ type MetaInfo struct {
 	Comment      string
 	CreatedBy    string `bencode:"created by"`
 	Encoding     string
+	// Concatenated piece hashes of each file larger than a piece, by pieces root
+	PieceLayers map[string]string `bencode:"piece layers"`
+	// Web seeds, url-list (BEP 0019) and httpseeds (BEP 0017)
+	URLList   []string
+	HTTPSeeds []string
 }
 
 type Info struct {
@@ -46,60 +70,119 @@ type Info struct {
 	Pieces      string
 	Private     int
 	Name        string
+	NameUTF8    string `bencode:"name.utf-8"`
 	Length      int
 	Md5sum      string
 	Files       []File
+	Source      string
+	// Attributes of the file in single file torrents (BEP 0047)
+	Attr        string
+	MetaVersion int                    `bencode:"meta version"`
+	FileTree    map[string]interface{} `bencode:"file tree"`
 }
 
 type File struct {
-	Length int
-	Md5sum string
-	Path   []string
+	Length     int
+	Md5sum     string
+	Path       []string
+	PathUTF8   []string `bencode:"path.utf-8"`
+	PiecesRoot string   `bencode:"pieces root"`
+	// BEP 0047 - Padding files and extended file attributes
+	Attr        string
+	SymlinkPath []string `bencode:"symlink path"`
+	Sha1        string
 }
 
-func NewTorrentFromMagnetURI(muri *MagnetURI, info *Info) *Torrent {
-	infoHash, _ := hex.DecodeString(muri.InfoHashHex)
+// Padding files align the next file to a piece boundary, their data is zeros
+// and they aren't written to disk
+func (f File) IsPadding() bool {
+	return strings.Contains(f.Attr, "p")
+}
+
+func (f File) IsExecutable() bool {
+	return strings.Contains(f.Attr, "x")
+}
+
+func (f File) IsHidden() bool {
+	return strings.Contains(f.Attr, "h")
+}
+
+// Symlinks have no data, they point to SymlinkPath relative to the torrent's
+// root directory
+func (f File) IsSymlink() bool {
+	return strings.Contains(f.Attr, "l")
+}
+
+// Private torrents (BEP 0027) only use the peers of their own trackers
+func (tor *Torrent) IsPrivate() bool {
+	return tor.MetaInfo.Info.Private == 1
+}
+
+// Torrent of a magnet link whose metadata, the bencoded info dictionary, was
+// downloaded from peers
+func NewTorrentFromMagnetURI(muri *MagnetURI, rawInfo []byte) (*Torrent, error) {
 	tor := &Torrent{
-		InfoHash: infoHash,
 		MetaInfo: MetaInfo{
-			Info:         *info,
 			AnnounceList: [][]string{muri.Trackers},
+			URLList:      muri.WebSeeds,
 		},
+		RawInfo: rawInfo,
+	}
+	err := bencode.Unmarshal(bytes.NewReader(rawInfo), &tor.MetaInfo.Info)
+	if err != nil {
+		return nil, err
 	}
 	tor.NumPieces = len(tor.MetaInfo.Info.Pieces) / 20
 	for i := 0; i < len(tor.MetaInfo.Info.Files); i++ {
 		tor.Length += tor.MetaInfo.Info.Files[i].Length
 	}
-	return tor
+	if len(tor.MetaInfo.Info.Files) == 0 {
+		tor.Length = tor.MetaInfo.Info.Length
+	}
+	if muri.InfoHashHex != "" {
+		tor.InfoHash, _ = hex.DecodeString(muri.InfoHashHex)
+	}
+	if muri.InfoHashV2Hex != "" {
+		tor.InfoHashV2, _ = hex.DecodeString(muri.InfoHashV2Hex)
+		if tor.InfoHash == nil {
+			tor.InfoHash = tor.InfoHashV2[:20]
+		}
+	}
+	err = tor.initV2()
+	if err != nil {
+		return nil, err
+	}
+	err = tor.sanitizePaths()
+	if err != nil {
+		return nil, err
+	}
+	return tor, nil
 }
 
 func NewTorrent(torrentReader io.ReadSeeker) (*Torrent, error) {
 	tor := &Torrent{}
 
-	metaInfo, err := bencode.Decode(torrentReader)
+	metaInfo, err := ioutil.ReadAll(torrentReader)
 	if err != nil {
 		return nil, err
 	}
-	metaInfoMap, ok := metaInfo.(map[string]interface{})
-	if !ok {
-		return nil, fmt.Errorf("Malformed torrent file")
+	tor.rawMetaInfo, err = parseRawDict(metaInfo)
+	if err != nil {
+		return nil, err
 	}
-	infoMap, ok := metaInfoMap["info"]
-	if !ok {
+	// The info-hash is the hash of the info dictionary as it appears in the file
+	tor.RawInfo = tor.rawMetaInfo.values["info"]
+	if len(tor.RawInfo) == 0 || tor.RawInfo[0] != 'd' {
 		return nil, fmt.Errorf("Malformed torrent file")
 	}
-
-	infoBencode := &bytes.Buffer{}
-	bencode.Marshal(infoBencode, infoMap)
-	infoHash := sha1.Sum(infoBencode.Bytes())
-	tor.InfoHash = infoHash[:]
-
-	torrentReader.Seek(0, 0)
-	err = bencode.Unmarshal(torrentReader, &tor.MetaInfo)
+	err = bencode.Unmarshal(bytes.NewReader(metaInfo), &tor.MetaInfo)
 	if err != nil {
 		return nil, err
 	}
 	tor.NumPieces = len(tor.MetaInfo.Info.Pieces) / 20
+	tor.MetaInfo.URLList = stringList(tor.rawMetaInfo.values["url-list"])
+	tor.MetaInfo.HTTPSeeds = stringList(tor.rawMetaInfo.values["httpseeds"])
+	tor.parsedFields = tor.MetaInfo.fields()
 
 	// Total size of all files
 	if len(tor.MetaInfo.Info.Files) > 0 {
@@ -109,5 +192,55 @@ func NewTorrent(torrentReader io.ReadSeeker) (*Torrent, error) {
 	} else {
 		tor.Length += tor.MetaInfo.Info.Length
 	}
+
+	tor.hashInfo()
+	err = tor.initV2()
+	if err != nil {
+		return nil, err
+	}
+	err = tor.sanitizePaths()
+	if err != nil {
+		return nil, err
+	}
 	return tor, nil
 }
+
+// Computes the info-hashes from the raw info dictionary
+func (tor *Torrent) hashInfo() {
+	infoHash := sha1.Sum(tor.RawInfo)
+	tor.InfoHash = infoHash[:]
+	if tor.IsV2() {
+		infoHashV2 := sha256.Sum256(tor.RawInfo)
+		tor.InfoHashV2 = infoHashV2[:]
+		if !tor.IsV1() {
+			// v2 only torrents use the truncated info-hash in handshakes
+			tor.InfoHash = infoHashV2[:20]
+		}
+	}
+}
+
+// url-list may be a single URL or a list of URLs
+func stringList(raw []byte) []string {
+	if raw == nil {
+		return nil
+	}
+	value, err := bencode.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil
+	}
+	switch v := value.(type) {
+	case string:
+		if v != "" {
+			return []string{v}
+		}
+	case []interface{}:
+		list := []string{}
+		for _, s := range v {
+			if s, ok := s.(string); ok && s != "" {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
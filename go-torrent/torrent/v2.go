@@ -0,0 +1,261 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+)
+
+// BEP 0052 - The BitTorrent Protocol Specification v2
+// v2 torrents describe their files with a file tree. The data of each file is
+// hashed as a merkle tree of 16 KiB blocks and every file starts on a piece
+// boundary. Hybrid torrents carry both the v1 and v2 metadata, the v1 file
+// list is padded s.t. both describe the same pieces.
+
+const (
+	META_VERSION_2    = 2
+	MERKLE_BLOCK_SIZE = 16384 // 16 KiB
+)
+
+func (tor *Torrent) IsV1() bool {
+	return len(tor.MetaInfo.Info.Pieces) > 0
+}
+
+func (tor *Torrent) IsV2() bool {
+	return tor.MetaInfo.Info.MetaVersion == META_VERSION_2
+}
+
+func (tor *Torrent) IsHybrid() bool {
+	return tor.IsV1() && tor.IsV2()
+}
+
+// Info-hashes of the swarms the torrent is part of, hybrid torrents join the
+// v1 swarm and the v2 swarm (by the truncated v2 info-hash)
+func (tor *Torrent) InfoHashes() [][]byte {
+	if tor.IsHybrid() && len(tor.InfoHashV2) == sha256.Size {
+		return [][]byte{tor.InfoHash, tor.InfoHashV2[:20]}
+	}
+	return [][]byte{tor.InfoHash}
+}
+
+// HasInfoHash reports whether a handshake's info-hash is one of the torrent's
+func (tor *Torrent) HasInfoHash(infoHash []byte) bool {
+	for _, h := range tor.InfoHashes() {
+		if bytes.Equal(h, infoHash) {
+			return true
+		}
+	}
+	return false
+}
+
+// Length of the piece, v2 torrents have a short last piece in every file
+func (tor *Torrent) PieceSize(pieceIndex int) int {
+	pieceLength := tor.MetaInfo.Info.PieceLength
+	if !tor.IsV1() && tor.IsV2() && pieceIndex < len(tor.pieceFiles) {
+		fileIndex := tor.pieceFiles[pieceIndex]
+		fileOffset := (pieceIndex - tor.firstPieces[fileIndex]) * pieceLength
+		return min(pieceLength, tor.v2Files[fileIndex].Length-fileOffset)
+	}
+	if pieceIndex == tor.NumPieces-1 {
+		return tor.Length - (tor.NumPieces-1)*pieceLength
+	}
+	return pieceLength
+}
+
+// VerifyPiece checks the piece against its SHA-1 hash, or for v2 only
+// torrents against the merkle hashes of the file the piece belongs to.
+// Files larger than a piece can only be verified with their piece layers.
+func (tor *Torrent) VerifyPiece(pieceIndex int, piece []byte) bool {
+	if pieceIndex < 0 || pieceIndex >= tor.NumPieces {
+		return false
+	}
+	if tor.IsV1() {
+		expectedChecksum := []byte(tor.MetaInfo.Info.Pieces[20*pieceIndex : 20*(pieceIndex+1)])
+		actualChecksum := sha1.Sum(piece)
+		return bytes.Equal(expectedChecksum, actualChecksum[:])
+	}
+	if !tor.IsV2() || pieceIndex >= len(tor.pieceFiles) {
+		return false
+	}
+
+	pieceLength := tor.MetaInfo.Info.PieceLength
+	fileIndex := tor.pieceFiles[pieceIndex]
+	file := tor.v2Files[fileIndex]
+	leaves := blockHashes(piece)
+	if file.Length <= pieceLength {
+		// The pieces root is the root of a tree over the file's blocks alone
+		root := merkleRoot(leaves, nextPowerOfTwo(len(leaves)), [32]byte{})
+		return string(root[:]) == file.PiecesRoot
+	}
+	layer := tor.MetaInfo.PieceLayers[file.PiecesRoot]
+	i := pieceIndex - tor.firstPieces[fileIndex]
+	if len(layer) < (i+1)*sha256.Size {
+		return false
+	}
+	root := merkleRoot(leaves, pieceLength/MERKLE_BLOCK_SIZE, [32]byte{})
+	return string(root[:]) == layer[i*sha256.Size:(i+1)*sha256.Size]
+}
+
+// Populates the files and pieces of v2 torrents from the file tree. Hybrid
+// torrents are laid out by their (padded) v1 file list.
+func (tor *Torrent) initV2() error {
+	if !tor.IsV2() {
+		return nil
+	}
+	pieceLength := tor.MetaInfo.Info.PieceLength
+	if pieceLength < MERKLE_BLOCK_SIZE || pieceLength&(pieceLength-1) != 0 {
+		return fmt.Errorf("Invalid piece length")
+	}
+	files := []File{}
+	err := parseFileTree(tor.MetaInfo.Info.FileTree, []string{}, &files)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("Malformed torrent file")
+	}
+
+	tor.v2Files = files
+	tor.pieceFiles = []int{}
+	tor.firstPieces = []int{}
+	numPieces := 0
+	length := 0
+	for fileIndex, file := range files {
+		tor.firstPieces = append(tor.firstPieces, numPieces)
+		filePieces := (file.Length + pieceLength - 1) / pieceLength
+		if filePieces > 0 {
+			length = numPieces*pieceLength + file.Length
+		}
+		for i := 0; i < filePieces; i++ {
+			tor.pieceFiles = append(tor.pieceFiles, fileIndex)
+		}
+		numPieces += filePieces
+
+		if file.Length > pieceLength {
+			err := validatePieceLayer(tor.MetaInfo.PieceLayers[file.PiecesRoot], file, pieceLength)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if !tor.IsV1() {
+		tor.NumPieces = numPieces
+		tor.Length = length
+		if len(files) == 1 && len(files[0].Path) == 1 && files[0].Path[0] == tor.MetaInfo.Info.Name {
+			// Single File Mode
+			tor.MetaInfo.Info.Length = files[0].Length
+			tor.MetaInfo.Info.Files = nil
+		} else {
+			tor.MetaInfo.Info.Files = files
+		}
+	}
+	return nil
+}
+
+// Walks the file tree in key order, entries with an empty key are files
+func parseFileTree(tree map[string]interface{}, path []string, files *[]File) error {
+	names := []string{}
+	for name := range tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		node, ok := tree[name].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("Malformed file tree")
+		}
+		if name == "" {
+			if len(path) == 0 {
+				return fmt.Errorf("Malformed file tree")
+			}
+			length, ok := node["length"].(int64)
+			if !ok || length < 0 {
+				return fmt.Errorf("Malformed file tree")
+			}
+			piecesRoot, _ := node["pieces root"].(string)
+			attr, _ := node["attr"].(string)
+			if length > 0 && len(piecesRoot) != sha256.Size {
+				return fmt.Errorf("Missing pieces root for %v", path)
+			}
+			*files = append(*files, File{
+				Length:     int(length),
+				Path:       append([]string{}, path...),
+				PiecesRoot: piecesRoot,
+				Attr:       attr,
+			})
+			continue
+		}
+		err := parseFileTree(node, append(path, name), files)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The piece layer must hash up to the file's pieces root. Absent layers are
+// allowed, e.g. torrents from magnet links, the file's pieces can't be verified.
+func validatePieceLayer(layer string, file File, pieceLength int) error {
+	if layer == "" {
+		return nil
+	}
+	numPieces := (file.Length + pieceLength - 1) / pieceLength
+	if len(layer) != numPieces*sha256.Size {
+		return fmt.Errorf("Invalid piece layer for %v", file.Path)
+	}
+	hashes := make([][32]byte, numPieces)
+	for i := range hashes {
+		copy(hashes[i][:], layer[i*sha256.Size:])
+	}
+	// Pieces beyond the end of the file hash to the root of a piece of zero blocks
+	padding := merkleRoot(nil, pieceLength/MERKLE_BLOCK_SIZE, [32]byte{})
+	root := merkleRoot(hashes, nextPowerOfTwo(numPieces), padding)
+	if string(root[:]) != file.PiecesRoot {
+		return fmt.Errorf("Invalid piece layer for %v", file.Path)
+	}
+	return nil
+}
+
+func blockHashes(data []byte) [][32]byte {
+	hashes := [][32]byte{}
+	for offset := 0; offset < len(data); offset += MERKLE_BLOCK_SIZE {
+		hashes = append(hashes, sha256.Sum256(data[offset:min(offset+MERKLE_BLOCK_SIZE, len(data))]))
+	}
+	return hashes
+}
+
+// Root of a merkle tree with width leaves, leaves beyond the given hashes
+// are set to padding
+func merkleRoot(hashes [][32]byte, width int, padding [32]byte) [32]byte {
+	layer := make([][32]byte, width)
+	for i := range layer {
+		if i < len(hashes) {
+			layer[i] = hashes[i]
+		} else {
+			layer[i] = padding
+		}
+	}
+	if len(layer) == 0 {
+		return padding
+	}
+	for len(layer) > 1 {
+		next := make([][32]byte, (len(layer)+1)/2)
+		for i := range next {
+			next[i] = sha256.Sum256(append(layer[2*i][:], layer[2*i+1][:]...))
+		}
+		layer = next
+	}
+	return layer[0]
+}
+
+func nextPowerOfTwo(n int) int {
+	p := 1
+	for p < n {
+		p *= 2
+	}
+	return p
+}
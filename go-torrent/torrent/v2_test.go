@@ -0,0 +1,116 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+
+	bencode "github.com/jackpal/bencode-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMerkleRoot(t *testing.T) {
+	data := bytes.Repeat([]byte{1}, 3*MERKLE_BLOCK_SIZE)
+	leaf := sha256.Sum256(data[:MERKLE_BLOCK_SIZE])
+	zero := [32]byte{}
+
+	// A single block is its own root
+	assert.Equal(t, leaf, merkleRoot(blockHashes(data[:MERKLE_BLOCK_SIZE]), 1, zero))
+
+	// Leaves beyond the end of the data are zero hashes
+	pair := sha256.Sum256(append(leaf[:], leaf[:]...))
+	padded := sha256.Sum256(append(leaf[:], zero[:]...))
+	root := sha256.Sum256(append(pair[:], padded[:]...))
+	assert.Equal(t, root, merkleRoot(blockHashes(data), 4, zero))
+}
+
+func TestNewTorrentV2(t *testing.T) {
+	pieceLength := 2 * MERKLE_BLOCK_SIZE
+	file1 := bytes.Repeat([]byte{1}, pieceLength+100)
+	file2 := bytes.Repeat([]byte{2}, 100)
+
+	// file1 spans two pieces and has a piece layer
+	piece1 := merkleRoot(blockHashes(file1[:pieceLength]), 2, [32]byte{})
+	piece2 := merkleRoot(blockHashes(file1[pieceLength:]), 2, [32]byte{})
+	root1 := sha256.Sum256(append(piece1[:], piece2[:]...))
+	root2 := sha256.Sum256(file2)
+
+	info := map[string]interface{}{
+		"name":         "root",
+		"piece length": pieceLength,
+		"meta version": 2,
+		"file tree": map[string]interface{}{
+			"sub": map[string]interface{}{
+				"name2": map[string]interface{}{
+					"": map[string]interface{}{"length": len(file2), "pieces root": string(root2[:])},
+				},
+			},
+			"name1": map[string]interface{}{
+				"": map[string]interface{}{"length": len(file1), "pieces root": string(root1[:])},
+			},
+		},
+	}
+	metaInfo := &bytes.Buffer{}
+	bencode.Marshal(metaInfo, map[string]interface{}{
+		"info": info,
+		"piece layers": map[string]interface{}{
+			string(root1[:]): string(piece1[:]) + string(piece2[:]),
+		},
+	})
+	tor, err := NewTorrent(bytes.NewReader(metaInfo.Bytes()))
+	assert.Nil(t, err)
+
+	infoBencode := &bytes.Buffer{}
+	bencode.Marshal(infoBencode, info)
+	infoHash := sha256.Sum256(infoBencode.Bytes())
+	assert.Equal(t, infoHash[:], tor.InfoHashV2)
+	assert.Equal(t, infoHash[:20], tor.InfoHash)
+	assert.True(t, tor.IsV2())
+	assert.False(t, tor.IsHybrid())
+	assert.Equal(t, [][]byte{infoHash[:20]}, tor.InfoHashes())
+
+	// Files are in key order and start on a piece boundary
+	assert.Equal(t, []File{
+		File{Length: len(file1), Path: []string{"name1"}, PiecesRoot: string(root1[:])},
+		File{Length: len(file2), Path: []string{"sub", "name2"}, PiecesRoot: string(root2[:])},
+	}, tor.MetaInfo.Info.Files)
+	assert.Equal(t, 3, tor.NumPieces)
+	assert.Equal(t, 2*pieceLength+len(file2), tor.Length)
+	assert.Equal(t, pieceLength, tor.PieceSize(0))
+	assert.Equal(t, 100, tor.PieceSize(1))
+	assert.Equal(t, 100, tor.PieceSize(2))
+
+	assert.True(t, tor.VerifyPiece(0, file1[:pieceLength]))
+	assert.True(t, tor.VerifyPiece(1, file1[pieceLength:]))
+	assert.True(t, tor.VerifyPiece(2, file2))
+	assert.False(t, tor.VerifyPiece(1, file2))
+	assert.False(t, tor.VerifyPiece(2, file1[pieceLength:]))
+
+	// A piece layer that doesn't hash up to the pieces root is rejected
+	metaInfo.Reset()
+	bencode.Marshal(metaInfo, map[string]interface{}{
+		"info": info,
+		"piece layers": map[string]interface{}{
+			string(root1[:]): string(piece2[:]) + string(piece1[:]),
+		},
+	})
+	_, err = NewTorrent(bytes.NewReader(metaInfo.Bytes()))
+	assert.NotNil(t, err)
+}
+
+func TestHybridInfoHashes(t *testing.T) {
+	tor := &Torrent{
+		InfoHash:   bytes.Repeat([]byte{1}, 20),
+		InfoHashV2: bytes.Repeat([]byte{2}, 32),
+		MetaInfo: MetaInfo{
+			Info: Info{
+				Pieces:      string(bytes.Repeat([]byte{3}, 20)),
+				MetaVersion: META_VERSION_2,
+			},
+		},
+	}
+	assert.True(t, tor.IsHybrid())
+	assert.True(t, tor.HasInfoHash(bytes.Repeat([]byte{1}, 20)))
+	assert.True(t, tor.HasInfoHash(bytes.Repeat([]byte{2}, 20)))
+	assert.False(t, tor.HasInfoHash(bytes.Repeat([]byte{3}, 20)))
+}
@@ -9,13 +9,13 @@ import (
 	"github.com/Charana123/torrent/go-torrent/torrent"
 )
 
-func (tr *tracker) queryHTTPTracker(trackerURL string, event int) error {
+func (tr *tracker) queryHTTPTracker(trackerURL string, event int) ([]string, error) {
 	u, err := url.Parse(trackerURL)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if !u.IsAbs() {
-		return fmt.Errorf("trackerURL not an absolute URL")
+		return nil, fmt.Errorf("trackerURL not an absolute URL")
 	}
 
 	q := u.Query()
@@ -43,7 +43,7 @@ func (tr *tracker) queryHTTPTracker(trackerURL string, event int) error {
 
 	resp, err := http.Get(u.String())
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
@@ -62,5 +62,5 @@ func (tr *tracker) queryHTTPTracker(trackerURL string, event int) error {
 	// 		tr.peerMgr.AddPeer(ip.String(), nil)
 	// 	}
 	// }
-	return nil
+	return nil, nil
 }
@@ -3,6 +3,7 @@ package tracker
 import (
 	"fmt"
 	"math/rand"
+	"sync"
 	"time"
 
 	"github.com/Charana123/torrent/go-torrent/peer"
@@ -18,9 +19,11 @@ const (
 
 type Tracker interface {
 	Start()
+	SetPrivate(private bool)
 }
 
 type tracker struct {
+	sync.Mutex
 	announceList [][]string
 	infoHash     []byte
 	peerMgr      peer.PeerManager
@@ -29,6 +32,11 @@ type tracker struct {
 	serverPort   int
 	key          int32
 	numwant      int32
+	query        func(trackerURL string, event int) ([]string, error)
+	// Private torrents (BEP 0027) announce tier by tier, tier is the tier
+	// of the tracker last announced to
+	private bool
+	tier    int
 
 	interval      int32
 	totalLeechers int32 `bencode:"incomplete"`
@@ -48,8 +56,13 @@ func NewTracker(
 	quit chan int,
 	serverPort int) Tracker {
 
+	// Trackers are reordered within their tiers (BEP 0012)
+	tiers := [][]string{}
+	for _, tier := range announceList {
+		tiers = append(tiers, append([]string{}, tier...))
+	}
 	tr := &tracker{
-		announceList: announceList,
+		announceList: tiers,
 		infoHash:     infoHash,
 		quit:         quit,
 		serverPort:   serverPort,
@@ -57,32 +70,85 @@ func NewTracker(
 		key:          genKey(),
 		numwant:      -1,
 		stats:        stats,
+		tier:         -1,
 	}
+	tr.query = tr.queryTracker
 	return tr
 }
 
-func (tr *tracker) queryTracker(trackerURL string, event int) error {
-	var qt func(string, int) error
+// Torrents of magnet links are known to be private once their metadata is
+// downloaded
+func (tr *tracker) SetPrivate(private bool) {
+	tr.Lock()
+	defer tr.Unlock()
+
+	tr.private = private
+}
+
+func (tr *tracker) queryTracker(trackerURL string, event int) ([]string, error) {
+	var qt func(string, int) ([]string, error)
 	if trackerURL[:6] == "udp://" {
 		qt = tr.queryUDPTracker
 	} else if trackerURL[:7] == "http://" {
 		qt = tr.queryHTTPTracker
 	} else {
-		return fmt.Errorf("Invalid schema for trackerURL")
+		return nil, fmt.Errorf("Invalid schema for trackerURL")
 	}
-	err := qt(trackerURL, event)
-	return err
+	return qt(trackerURL, event)
 }
 
 func (tr *tracker) queryTrackers(event int) {
+	tr.Lock()
+	private := tr.private
+	tr.Unlock()
+	if private {
+		tr.queryTiers(event)
+		return
+	}
 	for _, trackerURLs := range tr.announceList {
 		for _, trackerURL := range trackerURLs {
 			fmt.Println("querying tracker: ", trackerURL)
-			tr.queryTracker(trackerURL, event)
+			peers, err := tr.query(trackerURL, event)
+			if err != nil {
+				fmt.Println(err)
+			}
+			tr.addPeers(peers)
+		}
+	}
+}
+
+// Announces to the first tracker that responds, trying the tiers in order
+// and the trackers of a tier in order (BEP 0012). A tracker that responds is
+// moved to the front of its tier. When the tracker is in a different tier
+// to the last one, the peers of the previous tracker are dropped (BEP 0027).
+func (tr *tracker) queryTiers(event int) {
+	for tierIndex, trackerURLs := range tr.announceList {
+		for i, trackerURL := range trackerURLs {
+			fmt.Println("querying tracker: ", trackerURL)
+			peers, err := tr.query(trackerURL, event)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			copy(trackerURLs[1:i+1], trackerURLs[:i])
+			trackerURLs[0] = trackerURL
+			if tr.tier != -1 && tr.tier != tierIndex {
+				fmt.Println("switched tracker tier, dropping peers")
+				tr.peerMgr.StopTrackerPeers(tr.infoHash)
+			}
+			tr.tier = tierIndex
+			tr.addPeers(peers)
+			return
 		}
 	}
 }
 
+func (tr *tracker) addPeers(peers []string) {
+	for _, id := range peers {
+		tr.peerMgr.AddPeer(id, nil, peer.PEER_SOURCE_TRACKER, tr.infoHash)
+	}
+}
+
 func (tr *tracker) Start() {
 	for {
 		select {
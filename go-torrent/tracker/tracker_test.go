@@ -0,0 +1,81 @@
+package tracker
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/Charana123/torrent/go-torrent/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+var testInfoHash = []byte("aaaaaaaaaaaaaaaaaaaa")
+
+type mockPeerManager struct {
+	peer.PeerManager
+	mock.Mock
+}
+
+func (m *mockPeerManager) AddPeer(id string, conn net.Conn, source int, infoHash []byte) {
+	m.Called(id, conn, source, infoHash)
+}
+
+func (m *mockPeerManager) StopTrackerPeers(infoHash []byte) {
+	m.Called(infoHash)
+}
+
+// Trackers that are up respond with a peer named after the tracker
+func newTestTracker(announceList [][]string, up map[string]bool, queried *[]string) (*tracker, *mockPeerManager) {
+	peerMgr := &mockPeerManager{}
+	tr := NewTracker(announceList, testInfoHash, nil, peerMgr, nil, 0).(*tracker)
+	tr.query = func(trackerURL string, event int) ([]string, error) {
+		*queried = append(*queried, trackerURL)
+		if !up[trackerURL] {
+			return nil, fmt.Errorf("tracker down")
+		}
+		return []string{trackerURL + "-peer"}, nil
+	}
+	return tr, peerMgr
+}
+
+func TestPrivateTrackerTiers(t *testing.T) {
+	announceList := [][]string{{"a1", "a2"}, {"b1"}}
+	up := map[string]bool{"a2": true, "b1": true}
+	queried := []string{}
+	tr, peerMgr := newTestTracker(announceList, up, &queried)
+	tr.SetPrivate(true)
+	peerMgr.On("AddPeer", mock.Anything, nil, peer.PEER_SOURCE_TRACKER, testInfoHash)
+	peerMgr.On("StopTrackerPeers", testInfoHash)
+
+	// The first tracker of a tier to respond is moved to its front
+	tr.queryTrackers(NONE)
+	assert.Equal(t, []string{"a1", "a2"}, queried)
+	assert.Equal(t, [][]string{{"a2", "a1"}, {"b1"}}, tr.announceList)
+	assert.Equal(t, [][]string{{"a1", "a2"}, {"b1"}}, announceList)
+	peerMgr.AssertCalled(t, "AddPeer", "a2-peer", nil, peer.PEER_SOURCE_TRACKER, testInfoHash)
+	peerMgr.AssertNotCalled(t, "StopTrackerPeers")
+
+	// Switching tiers drops the peers of the previous tracker
+	up["a2"] = false
+	queried = queried[:0]
+	tr.queryTrackers(NONE)
+	assert.Equal(t, []string{"a2", "a1", "b1"}, queried)
+	peerMgr.AssertNumberOfCalls(t, "StopTrackerPeers", 1)
+	peerMgr.AssertCalled(t, "AddPeer", "b1-peer", nil, peer.PEER_SOURCE_TRACKER, testInfoHash)
+
+	// Staying on a tier keeps the peers
+	tr.queryTrackers(NONE)
+	peerMgr.AssertNumberOfCalls(t, "StopTrackerPeers", 1)
+}
+
+func TestPublicTrackers(t *testing.T) {
+	queried := []string{}
+	tr, peerMgr := newTestTracker([][]string{{"a1", "a2"}, {"b1"}}, map[string]bool{"a1": true, "b1": true}, &queried)
+	peerMgr.On("AddPeer", mock.Anything, nil, peer.PEER_SOURCE_TRACKER, testInfoHash)
+
+	tr.queryTrackers(NONE)
+	assert.Equal(t, []string{"a1", "a2", "b1"}, queried)
+	peerMgr.AssertNumberOfCalls(t, "AddPeer", 2)
+	peerMgr.AssertNotCalled(t, "StopTrackerPeers")
+}
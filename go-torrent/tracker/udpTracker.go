@@ -16,22 +16,22 @@ import (
 )
 
 // BEP 0015 - UDP Tracker Protocol for BitTorrent
-func (tr *tracker) queryUDPTracker(trackerURL string, event int) error {
+func (tr *tracker) queryUDPTracker(trackerURL string, event int) ([]string, error) {
 	udpAddress := trackerURL[6:]
 	udpAddress = strings.TrimSuffix(udpAddress, "/announce")
 	trackerAddr, err := net.ResolveUDPAddr("udp", udpAddress)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	trackerConn, err := net.DialUDP("udp", nil, trackerAddr)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	trackerConn.SetDeadline(time.Now().Add(time.Second * 5))
 
 	connectionID, err := tr.connectUDP(trackerConn)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	return tr.announceUDP(trackerConn, event, connectionID)
 }
@@ -80,7 +80,8 @@ func (tr *tracker) connectUDP(trackerConn *net.UDPConn) (int64, error) {
 	return connectionID, nil
 }
 
-func (tr *tracker) announceUDP(trackerConn *net.UDPConn, event int, connectionID int64) error {
+// Returns the addresses of the peers in the response
+func (tr *tracker) announceUDP(trackerConn *net.UDPConn, event int, connectionID int64) ([]string, error) {
 
 	// Connection Request
 	announceRequest := &bytes.Buffer{}
@@ -109,21 +110,21 @@ func (tr *tracker) announceUDP(trackerConn *net.UDPConn, event int, connectionID
 	announceResponse := &bytes.Buffer{}
 	n, err := io.Copy(announceResponse, trackerConn)
 	if err, ok := err.(net.Error); !ok || !err.Timeout() {
-		return err
+		return nil, err
 	}
 	if n < 20 {
-		return fmt.Errorf("Malformed announce response body")
+		return nil, fmt.Errorf("Malformed announce response body")
 	}
 
 	var actionResp int32
 	binary.Read(announceResponse, binary.BigEndian, &actionResp)
 	if actionResp != 1 {
-		return fmt.Errorf("action of connection response not 'announce'")
+		return nil, fmt.Errorf("action of connection response not 'announce'")
 	}
 	var transactionIDResp int32
 	binary.Read(announceResponse, binary.BigEndian, &transactionIDResp)
 	if transactionID != transactionIDResp {
-		return fmt.Errorf("transactionID doesn't match")
+		return nil, fmt.Errorf("transactionID doesn't match")
 	}
 	var interval int32
 	binary.Read(announceResponse, binary.BigEndian, &interval)
@@ -139,16 +140,16 @@ func (tr *tracker) announceUDP(trackerConn *net.UDPConn, event int, connectionID
 
 	peerAddrs, err := ioutil.ReadAll(announceResponse)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	peers := []string{}
 	if event != STOPPED {
-		for i := 0; i < len(peerAddrs); i += 6 {
+		for i := 0; i+6 <= len(peerAddrs); i += 6 {
 			ip := net.IPv4(peerAddrs[i+0], peerAddrs[i+1], peerAddrs[i+2], peerAddrs[i+3])
 			port := binary.BigEndian.Uint16([]byte(peerAddrs[i+4 : i+6]))
-			id := fmt.Sprintf("%s:%d", ip, port)
-			tr.peerMgr.AddPeer(id, nil)
+			peers = append(peers, fmt.Sprintf("%s:%d", ip, port))
 		}
 	}
-	return nil
+	return peers, nil
 }
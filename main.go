@@ -3,11 +3,15 @@ package main
 import (
 	"log"
 	"net/http"
+	"os"
 
 	"github.com/Charana123/torrent/go-torrent/client"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "edit" {
+		os.Exit(edit(os.Args[2:]))
+	}
 	sm := client.NewHTTPServeMux("/Users/charana/Downloads/temp")
 	sm.Handle("/", http.FileServer(http.Dir(".")))
 	http.ListenAndServe(":8080", logHandler(sm))